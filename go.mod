@@ -1,3 +1,11 @@
 module lbwtg
 
 go 1.21.4
+
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/tetratelabs/wazero v1.8.2
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+)
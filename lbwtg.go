@@ -1,132 +1,359 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-)
 
-// Server represents a backend server
-type Server struct {
-	URL             *url.URL
-	healthCheckPath string
-}
+	"lbwtg/loadbalancer"
+)
 
-// LoadBalancer represents a round-robin load balancer with health checks for multiple target groups
-type LoadBalancer struct {
-	targetGroups []*TargetGroup
-	mu           sync.Mutex
-}
+func main() {
+	configFile := flag.String("config", "", "JSON configuration file; replaces the built-in example target groups")
+	addr := flag.String("addr", ":8080", "address to serve the load balancer on")
+	certFile := flag.String("tls-cert", "", "PEM certificate file; enables TLS termination")
+	keyFile := flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	ocspStapling := flag.Bool("ocsp-stapling", false, "fetch OCSP responses for the TLS certificates from their responders and staple them to handshakes")
+	certInterval := flag.Duration("tls-reload-interval", 30*time.Second, "how often certificate files are checked for changes; 0 only reloads them through the admin API")
+	redirectAddr := flag.String("redirect-addr", "", "address of a plain HTTP listener redirecting to HTTPS, e.g. :80")
+	acmeWebroot := flag.String("acme-webroot", "", "webroot directory ACME HTTP-01 challenges are served from on -redirect-addr")
+	adminTokenFile := flag.String("admin-token-file", "", "file with a bearer token the admin listener requires; without one the admin API is read-only")
+	replayFile := flag.String("replay", "", "replay the requests of a capture file against -replay-target and exit")
+	replayTarget := flag.String("replay-target", "", "URL of the server -replay sends requests to")
+	auditLog := flag.String("audit-log", "", "file admin API changes and configuration reloads are appended to")
+	configHistory := flag.String("config-history", "", "directory the last applied configurations are kept in for rollbacks")
+	logLevel := flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	zone := flag.String("zone", "", "zone the load balancer runs in; servers in the same zone are preferred")
+	instanceID := flag.Int("instance-id", 0, "number of this replica, from 0, picking its subset of target groups with a subset_size")
+	gatewayClass := flag.String("gateway-class", "", "serve the HTTPRoutes of the Kubernetes Gateways of this GatewayClass, in addition to -config")
+	gatewayNamespace := flag.String("gateway-namespace", "", "namespace Gateways and HTTPRoutes are read from; all namespaces if empty")
+	gossipAddr := flag.String("gossip-addr", "", "UDP address to share health check results with other instances on, e.g. :7946")
+	gossipPeers := flag.String("gossip-peers", "", "comma-separated UDP addresses of the other instances for -gossip-addr")
+	gossipKeyFile := flag.String("gossip-key-file", "", "file with a key shared by the instances to sign gossip with")
+	stickyRedis := flag.String("sticky-redis", "", "address of a Redis server sharing the sticky session table between instances; kept in memory if empty")
+	raftID := flag.String("raft-id", "", "ID of this node in a cluster replicating configuration changes with Raft; requires -config")
+	raftAddr := flag.String("raft-addr", ":7947", "address the Raft RPCs of -raft-id are served on")
+	raftPeers := flag.String("raft-peers", "", "comma-separated id=url pairs of the other cluster nodes, e.g. lb-2=http://lb-2:7947")
+	raftDir := flag.String("raft-dir", "", "directory the node's Raft state is kept in")
+	raftKeyFile := flag.String("raft-key-file", "", "file with a key shared by the cluster nodes to authenticate each other; required unless -raft-addr is a loopback address")
+	stateFile := flag.String("state-file", "", "file the servers' health check results and weights are kept in across restarts")
+	stickyFile := flag.String("sticky-file", "", "file the sticky session table is kept in across restarts, unless -sticky-redis is set")
+	service := flag.String("service", "", "install, uninstall, start, stop or show the status of the Windows service running with the other flags given")
+	serviceName := flag.String("service-name", "lbwtg", "name of the Windows service")
+	flag.Parse()
+	if *instanceID < 0 {
+		fmt.Println("-instance-id must be 0 or more")
+		os.Exit(2)
+	}
 
-// TargetGroup represents a group of backend servers for a specific URI path
-type TargetGroup struct {
-	URIPath string
-	Servers []*Server
-}
+	if *service != "" {
+		if err := controlService(*serviceName, *service); err != nil {
+			fmt.Println("Controlling the service failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// SIGTERM, Ctrl-C and stopping the Windows service shut the listeners down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := startService(*serviceName, stop)
+	defer stopped()
 
-// NewLoadBalancer creates a new LoadBalancer with a list of target groups
-func NewLoadBalancer(targetGroups []*TargetGroup) *LoadBalancer {
-	return &LoadBalancer{targetGroups: targetGroups}
-}
+	level, err := loadbalancer.ParseLogLevel(*logLevel)
+	if err != nil {
+		panic(err)
+	}
+	loadbalancer.LogLevel.Set(level)
 
-// ServeHTTP handles incoming HTTP requests and forwards them to healthy backend servers
-func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	if *replayFile != "" {
+		replay(*replayFile, *replayTarget)
+		return
+	}
 
-	for _, targetGroup := range lb.targetGroups {
-		if r.URL.Path == targetGroup.URIPath {
-			server := lb.getNextServer(targetGroup)
-			if server != nil && lb.isServerHealthy(server) {
-				// Create a reverse proxy
-				proxy := httputil.NewSingleHostReverseProxy(server.URL)
+	options := []loadbalancer.Option{loadbalancer.WithInstanceID(*instanceID), loadbalancer.WithZone(*zone)}
+	if *adminTokenFile != "" {
+		token, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, loadbalancer.WithAdminAuth(loadbalancer.BearerTokenAuth(strings.TrimSpace(string(token)))))
+	}
 
-				// Update the request to preserve the original URL path
-				r.URL.Path = fmt.Sprintf("/%s%s", server.URL.Host, r.URL.Path)
+	var audit *loadbalancer.AuditLog
+	if *auditLog != "" {
+		audit, err = loadbalancer.OpenAuditLog(*auditLog)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, loadbalancer.WithAuditLog(audit))
+	}
+	reopenOnSignal(audit)
 
-				// Forward the request to the healthy backend server
-				proxy.ServeHTTP(w, r)
-				return
+	if *gossipAddr != "" {
+		config := loadbalancer.GossipConfig{Addr: *gossipAddr}
+		if *gossipPeers != "" {
+			config.Peers = strings.Split(*gossipPeers, ",")
+		}
+		if *gossipKeyFile != "" {
+			key, err := os.ReadFile(*gossipKeyFile)
+			if err != nil {
+				panic(err)
 			}
+			config.Key = strings.TrimSpace(string(key))
 		}
+		gossip, err := loadbalancer.NewGossip(config)
+		if err != nil {
+			panic(err)
+		}
+		go gossip.Run(context.Background())
+		options = append(options, loadbalancer.WithGossip(gossip))
 	}
 
-	http.Error(w, "No healthy backend servers available", http.StatusServiceUnavailable)
-}
+	if *stateFile != "" {
+		state, err := loadbalancer.NewStateFile(*stateFile, 0)
+		if err != nil {
+			panic(err)
+		}
+		go state.Run(context.Background(), 10*time.Second)
+		options = append(options, loadbalancer.WithStateFile(state))
+	}
 
-// getNextServer returns the next server in the round-robin order for a given target group
-func (lb *LoadBalancer) getNextServer(targetGroup *TargetGroup) *Server {
-	serverCount := len(targetGroup.Servers)
-	if serverCount == 0 {
-		return nil
+	// The sticky table outlives reloads, so sessions stay on their servers
+	stickyTable := loadbalancer.NewMemoryStickyTable()
+	switch {
+	case *stickyRedis != "":
+		stickyTable = loadbalancer.NewRedisStickyTable(*stickyRedis, os.Getenv("REDIS_PASSWORD"), 0, "")
+	case *stickyFile != "":
+		if stickyTable, err = loadbalancer.NewFileStickyTable(*stickyFile); err != nil {
+			panic(err)
+		}
 	}
+	options = append(options, loadbalancer.WithStickyTable(stickyTable))
 
-	// Round-robin index for the target group
-	targetGroupIndex := len(targetGroup.Servers) % serverCount
+	certificates := loadbalancer.NewCertificateStore()
+	options = append(options, loadbalancer.WithCertificateStore(certificates))
 
-	// Update the round-robin index for the next request
-	targetGroupIndex = (targetGroupIndex + 1) % serverCount
+	listener := loadbalancer.DefaultListenerConfig(*addr)
+	admin := loadbalancer.DefaultListenerConfig("127.0.0.1:9090")
+	var handler, adminHandler http.Handler
+	var metrics *loadbalancer.Metrics
+	var extraListeners []loadbalancer.ListenerConfig
+	var passthrough []loadbalancer.PassthroughConfig
+	var tenantCertificates []tls.Certificate
+	if *configFile != "" || *gatewayClass != "" {
+		var raft *loadbalancer.RaftConfig
+		if *raftID != "" {
+			raft = &loadbalancer.RaftConfig{ID: *raftID, Addr: *raftAddr, Dir: *raftDir, Peers: make(map[string]string)}
+			for _, peer := range strings.Split(*raftPeers, ",") {
+				if id, url, ok := strings.Cut(peer, "="); ok {
+					raft.Peers[id] = url
+				}
+			}
+			if *raftKeyFile != "" {
+				key, err := os.ReadFile(*raftKeyFile)
+				if err != nil {
+					panic(err)
+				}
+				raft.Key = strings.TrimSpace(string(key))
+			}
+		}
+		var gateway *loadbalancer.GatewayConfig
+		if *gatewayClass != "" {
+			gateway = &loadbalancer.GatewayConfig{GatewayClass: *gatewayClass, Namespace: *gatewayNamespace}
+		}
+		reloader, err := loadbalancer.NewConfigReloader(loadbalancer.ReloaderConfig{
+			Path:       *configFile,
+			Gateway:    gateway,
+			Raft:       raft,
+			Audit:      audit,
+			HistoryDir: *configHistory,
+		}, options...)
+		if err != nil {
+			panic(err)
+		}
+		if gateway != nil {
+			go reloader.WatchGateway(context.Background())
+		}
+		if raft != nil {
+			go func() {
+				if err := reloader.ServeRaft(context.Background()); err != nil {
+					panic(err)
+				}
+			}()
+		}
+		config := reloader.Config()
+		if listener, err = config.Listen.ListenerConfig(*addr); err != nil {
+			panic(err)
+		}
+		if admin, err = config.Admin.ListenerConfig("127.0.0.1:9090"); err != nil {
+			panic(err)
+		}
+		for _, spec := range config.Listeners {
+			extra, err := spec.ListenerConfig("")
+			if err != nil {
+				panic(err)
+			}
+			extraListeners = append(extraListeners, extra)
+		}
+		for _, spec := range config.Passthrough {
+			passthrough = append(passthrough, spec.PassthroughConfig())
+		}
+		if tenantCertificates, err = config.TenantCertificates(); err != nil {
+			panic(err)
+		}
+		handler, adminHandler, metrics = reloader, reloader.AdminHandler(), reloader.Metrics()
+		reloadOnSignal(reloader)
+	} else {
+		// Create a new load balancer with target groups for different URI paths
+		options = append([]loadbalancer.Option{
+			loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+				URIPath: "/app1",
+				Servers: []*loadbalancer.Server{
+					{URL: parseURL("http://localhost:8081")},
+					{URL: parseURL("http://localhost:8082")},
+				},
+			}),
+			loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+				URIPath: "/app2",
+				Servers: []*loadbalancer.Server{
+					{URL: parseURL("http://localhost:8083")},
+					{URL: parseURL("http://localhost:8084")},
+				},
+			}),
+			loadbalancer.WithHealthCheck("/health"),
+		}, options...)
+		loadBalancer := loadbalancer.NewLoadBalancer(options...)
+		handler, adminHandler, metrics = loadBalancer, loadBalancer.AdminHandler(), loadBalancer.Metrics()
+	}
+	if *certFile != "" {
+		listener.CertFile = *certFile
+		listener.KeyFile = *keyFile
+	}
+	listener.Metrics = metrics
+	listener.Certificates = withTenantCertificates(listener, tenantCertificates)
+	listener.CertificateStore = certificates
+	if *certInterval > 0 {
+		go certificates.Watch(context.Background(), *certInterval)
+	}
+	if *ocspStapling {
+		go certificates.StapleOCSP(context.Background(), time.Minute)
+	}
 
-	return targetGroup.Servers[targetGroupIndex]
-}
+	// Serve metrics and the admin API on a separate admin port
+	adminServer := loadbalancer.NewServer(admin, adminHandler)
+	go func() {
+		fmt.Println("Admin listening on", admin.Addr)
+		if err := adminServer.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
 
-// isServerHealthy checks the health of a backend server with retries
-func (lb *LoadBalancer) isServerHealthy(server *Server) bool {
-	if server.healthCheckPath == "" {
-		// If no health check path is specified, consider the server healthy
-		return true
+	// serving waits for the listeners besides the main one to shut down
+	var serving sync.WaitGroup
+
+	// Redirect plain HTTP to HTTPS, except for ACME challenges
+	if *redirectAddr != "" {
+		var acme http.Handler
+		if *acmeWebroot != "" {
+			acme = loadbalancer.ACMEChallengeDir(*acmeWebroot)
+		}
+		_, httpsPort, _ := net.SplitHostPort(listener.Addr)
+		redirect := loadbalancer.RedirectToHTTPS(httpsPort, acme)
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			fmt.Println("HTTPS redirect listening on", *redirectAddr)
+			if err := loadbalancer.ListenAndServeContext(ctx, loadbalancer.DefaultListenerConfig(*redirectAddr), redirect); err != nil {
+				panic(err)
+			}
+		}()
 	}
 
-	// Set a timeout for the health check
-	client := http.Client{
-		Timeout: time.Second * 5, // Adjust the timeout as needed
+	// Serve the load balancer on named listeners that target groups can be bound to
+	for _, extra := range extraListeners {
+		extra := extra
+		extra.Metrics = metrics
+		extra.Certificates = withTenantCertificates(extra, tenantCertificates)
+		extra.CertificateStore = certificates
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			fmt.Printf("Listener %s listening on %s\n", extra.Name, extra.Addr)
+			if err := loadbalancer.ListenAndServeContext(ctx, extra, handler); err != nil {
+				panic(err)
+			}
+		}()
 	}
 
-	// Perform the health check with retries
-	maxRetries := 3
-	for retry := 0; retry < maxRetries; retry++ {
-		resp, err := client.Get(server.URL.String() + server.healthCheckPath)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			// Retry if the health check fails
-			time.Sleep(time.Second) // Wait before the next retry
-			continue
-		}
-		return true
+	// Route TLS connections to backends without terminating them
+	for _, listener := range passthrough {
+		listener := listener
+		listener.Metrics = metrics
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			fmt.Println("TLS passthrough listening on", listener.Addr)
+			if err := loadbalancer.ServePassthroughContext(ctx, listener); err != nil {
+				panic(err)
+			}
+		}()
 	}
 
-	// If all retries fail, consider the server unhealthy
-	return false
+	// Set up the HTTP server with timeouts
+	fmt.Println("Load balancer listening on", listener.Addr)
+	err = loadbalancer.ListenAndServeContext(ctx, listener, handler)
+	if err != nil {
+		panic(err)
+	}
+	serving.Wait()
+	fmt.Println("Load balancer stopped")
 }
 
-func main() {
-	// Define target groups with different URI paths and backend servers
-	targetGroups := []*TargetGroup{
-		{
-			URIPath: "/app1",
-			Servers: []*Server{
-				{URL: parseURL("http://localhost:8081"), healthCheckPath: "/health"},
-				{URL: parseURL("http://localhost:8082"), healthCheckPath: "/health"},
-			},
-		},
-		{
-			URIPath: "/app2",
-			Servers: []*Server{
-				{URL: parseURL("http://localhost:8083"), healthCheckPath: "/health"},
-				{URL: parseURL("http://localhost:8084"), healthCheckPath: "/health"},
-			},
-		},
-	}
-
-	// Create a new load balancer with target groups
-	loadBalancer := NewLoadBalancer(targetGroups)
-
-	// Set up the HTTP server
-	http.HandleFunc("/", loadBalancer.ServeHTTP)
-	fmt.Println("Load balancer listening on :8080")
-	err := http.ListenAndServe(":8080", nil)
+// withTenantCertificates adds the tenants' certificates to a listener terminating TLS
+func withTenantCertificates(listener loadbalancer.ListenerConfig, certificates []tls.Certificate) []tls.Certificate {
+	if listener.CertFile == "" && len(listener.KeyPairs) == 0 && len(listener.Certificates) == 0 {
+		return listener.Certificates
+	}
+	return append(listener.Certificates, certificates...)
+}
+
+// reloadOnSignal reloads the configuration file whenever the process receives SIGHUP
+func reloadOnSignal(reloader *loadbalancer.ConfigReloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reloader.Reload("signal:SIGHUP"); err != nil {
+				fmt.Println("Reloading configuration failed:", err)
+			}
+		}
+	}()
+}
+
+// replay sends captured requests to a server and prints the response statuses
+func replay(path, target string) {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	result, err := loadbalancer.Replay(context.Background(), file, httputil.NewSingleHostReverseProxy(parseURL(target)))
+	fmt.Printf("Replayed %d requests, %d errors\n", result.Requests, result.Errors)
+	for status, count := range result.Statuses {
+		fmt.Printf("  %d: %d\n", status, count)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,399 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	// CommonLogFormat is the Apache Common Log Format
+	CommonLogFormat = `%client_ip - %user [%time] "%method %uri %proto" %status %bytes`
+
+	// CombinedLogFormat is the Apache Combined Log Format, which adds the referer and user agent
+	CombinedLogFormat = CommonLogFormat + ` "%{Referer}i" "%{User-Agent}i"`
+)
+
+// AccessLogConfig configures the access log
+type AccessLogConfig struct {
+	// Format is "common", "combined", "json" or a template, "combined" by default.
+	// Templates contain fields like %status that are replaced with their values:
+	//
+	//	%time        local time in the Common Log Format, e.g. 10/Oct/2000:13:55:36 -0700
+	//	%client_ip   client address, see ClientIP
+	//	%user        authenticated user
+	//	%method      request method
+	//	%uri         request URI, including the query string
+	//	%path        request path
+	//	%proto       request protocol, e.g. HTTP/1.1
+	//	%host        request host
+	//	%status      response status code
+	//	%bytes       response body size
+	//	%duration    time taken to serve the request in seconds
+	//	%duration_ms time taken to serve the request in milliseconds
+	//	%route       path of the route that served the request
+	//	%upstream    name of the server the request was forwarded to
+	//	%request_id  request ID, see RequestID
+	//	%trace_id    trace ID, see WithTracing
+	//	%referer     Referer request header
+	//	%user_agent  User-Agent request header
+	//	%{Name}i     request header Name
+	//	%{Name}o     response header Name
+	//	%%           a percent sign
+	//
+	// Fields without a value are written as "-".
+	Format string
+
+	// Output receives one line per request, os.Stdout by default
+	Output io.Writer
+
+	// Conditional limits the log to errors, slow requests and a sample of the others
+	Conditional bool
+
+	// ErrorStatus is the lowest status logged as an error, 500 by default
+	ErrorStatus int
+
+	// SlowThreshold is the duration beyond which requests are logged as slow. Zero means
+	// duration doesn't matter.
+	SlowThreshold time.Duration
+
+	// SampleRate is the fraction, from 0 to 1, of the other requests that are logged
+	SampleRate float64
+}
+
+// AccessLog writes a line for every request handled by a load balancer
+type AccessLog struct {
+	config AccessLogConfig
+	output io.Writer
+	json   bool
+	fields []accessLogField
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// accessLogField appends the value of a template field, or literal text, to a line
+type accessLogField func(b *bytes.Buffer, entry *accessLogEntry)
+
+// NewAccessLog creates an access log, returning an error if the format is invalid
+func NewAccessLog(config AccessLogConfig) (*AccessLog, error) {
+	if config.ErrorStatus == 0 {
+		config.ErrorStatus = http.StatusInternalServerError
+	}
+	accessLog := &AccessLog{config: config, output: config.Output}
+	if accessLog.output == nil {
+		accessLog.output = os.Stdout
+	}
+	switch config.Format {
+	case "json":
+		accessLog.json = true
+		return accessLog, nil
+	case "", "combined":
+		config.Format = CombinedLogFormat
+	case "common":
+		config.Format = CommonLogFormat
+	}
+	fields, err := parseAccessLogFormat(config.Format)
+	if err != nil {
+		return nil, fmt.Errorf("access log: %w", err)
+	}
+	accessLog.fields = fields
+	return accessLog, nil
+}
+
+// Close closes the Output it was configured with if it is an io.Closer
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if closer, ok := a.config.Output.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// WithAccessLog writes a line to the access log for every request
+func WithAccessLog(accessLog *AccessLog) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessLog = accessLog
+	}
+}
+
+// requestLog collects details about a request that are only known deep inside the
+// handler chain
+type requestLog struct {
+	route    string
+	upstream string
+	user     string
+}
+
+type requestLogKey struct{}
+
+// logDetails returns the request's log details, or nil if the request isn't logged
+func logDetails(r *http.Request) *requestLog {
+	details, _ := r.Context().Value(requestLogKey{}).(*requestLog)
+	return details
+}
+
+// setRequestUser records the authenticated user for the access log
+func setRequestUser(r *http.Request, user string) {
+	if details := logDetails(r); details != nil {
+		details.user = user
+	}
+}
+
+// accessLogEntry is a handled request
+type accessLogEntry struct {
+	request  *http.Request
+	header   http.Header
+	details  *requestLog
+	start    time.Time
+	duration time.Duration
+	status   int
+	bytes    int64
+}
+
+// serve handles the request with next and logs it once the response has been written
+func (a *AccessLog) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	details := &requestLog{}
+	r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, details))
+	writer := &accessLogWriter{ResponseWriter: w}
+	start := time.Now()
+	next.ServeHTTP(writer, r)
+
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	duration := time.Since(start)
+	if !a.logged(writer.status, duration) {
+		return
+	}
+	a.write(&accessLogEntry{
+		request:  r,
+		header:   w.Header(),
+		details:  details,
+		start:    start,
+		duration: duration,
+		status:   writer.status,
+		bytes:    writer.bytes,
+	})
+}
+
+// logged reports whether a request is written to a conditional log
+func (a *AccessLog) logged(status int, duration time.Duration) bool {
+	switch {
+	case !a.config.Conditional:
+		return true
+	case status >= a.config.ErrorStatus:
+		return true
+	case a.config.SlowThreshold > 0 && duration >= a.config.SlowThreshold:
+		return true
+	}
+	return rand.Float64() < a.config.SampleRate
+}
+
+// write formats the entry and writes it to the output as a single line
+func (a *AccessLog) write(entry *accessLogEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.buf.Reset()
+	if a.json {
+		a.writeJSON(entry)
+	} else {
+		for _, field := range a.fields {
+			field(&a.buf, entry)
+		}
+		a.buf.WriteByte('\n')
+	}
+	if _, err := a.output.Write(a.buf.Bytes()); err != nil {
+		logger().Error("access log: write failed", "error", err)
+	}
+}
+
+func (a *AccessLog) writeJSON(entry *accessLogEntry) {
+	r := entry.request
+	json.NewEncoder(&a.buf).Encode(struct {
+		Time      time.Time `json:"time"`
+		ClientIP  string    `json:"client_ip"`
+		User      string    `json:"user,omitempty"`
+		Method    string    `json:"method"`
+		URI       string    `json:"uri"`
+		Proto     string    `json:"proto"`
+		Host      string    `json:"host"`
+		Status    int       `json:"status"`
+		Bytes     int64     `json:"bytes"`
+		Duration  float64   `json:"duration"`
+		Route     string    `json:"route,omitempty"`
+		Upstream  string    `json:"upstream,omitempty"`
+		RequestID string    `json:"request_id"`
+		TraceID   string    `json:"trace_id,omitempty"`
+		Referer   string    `json:"referer,omitempty"`
+		UserAgent string    `json:"user_agent,omitempty"`
+	}{
+		Time:      entry.start,
+		ClientIP:  ClientIP(r).String(),
+		User:      entry.details.user,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Host:      r.Host,
+		Status:    entry.status,
+		Bytes:     entry.bytes,
+		Duration:  entry.duration.Seconds(),
+		Route:     entry.details.route,
+		Upstream:  entry.details.upstream,
+		RequestID: RequestID(r),
+		TraceID:   traceID(r),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	})
+}
+
+// traceID returns the request's trace ID, or an empty string without tracing
+func traceID(r *http.Request) string {
+	if trace, ok := Trace(r); ok {
+		return trace.TraceIDString()
+	}
+	return ""
+}
+
+// accessLogFields are the values available in templates
+var accessLogFields = map[string]func(entry *accessLogEntry) string{
+	"time":        func(e *accessLogEntry) string { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"client_ip":   func(e *accessLogEntry) string { return ClientIP(e.request).String() },
+	"user":        func(e *accessLogEntry) string { return e.details.user },
+	"method":      func(e *accessLogEntry) string { return e.request.Method },
+	"uri":         func(e *accessLogEntry) string { return e.request.RequestURI },
+	"path":        func(e *accessLogEntry) string { return e.request.URL.Path },
+	"proto":       func(e *accessLogEntry) string { return e.request.Proto },
+	"host":        func(e *accessLogEntry) string { return e.request.Host },
+	"status":      func(e *accessLogEntry) string { return strconv.Itoa(e.status) },
+	"bytes":       func(e *accessLogEntry) string { return strconv.FormatInt(e.bytes, 10) },
+	"duration":    func(e *accessLogEntry) string { return strconv.FormatFloat(e.duration.Seconds(), 'f', 6, 64) },
+	"duration_ms": func(e *accessLogEntry) string { return strconv.FormatInt(e.duration.Milliseconds(), 10) },
+	"route":       func(e *accessLogEntry) string { return e.details.route },
+	"upstream":    func(e *accessLogEntry) string { return e.details.upstream },
+	"request_id":  func(e *accessLogEntry) string { return RequestID(e.request) },
+	"trace_id":    func(e *accessLogEntry) string { return traceID(e.request) },
+	"referer":     func(e *accessLogEntry) string { return e.request.Referer() },
+	"user_agent":  func(e *accessLogEntry) string { return e.request.UserAgent() },
+}
+
+// parseAccessLogFormat compiles a template into the fields that write its lines
+func parseAccessLogFormat(format string) ([]accessLogField, error) {
+	var fields []accessLogField
+	literal := func(s string) {
+		if s != "" {
+			fields = append(fields, func(b *bytes.Buffer, _ *accessLogEntry) { b.WriteString(s) })
+		}
+	}
+	value := func(fn func(*accessLogEntry) string) {
+		fields = append(fields, func(b *bytes.Buffer, entry *accessLogEntry) { writeLogValue(b, fn(entry)) })
+	}
+
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			literal(format)
+			return fields, nil
+		}
+		literal(format[:i])
+		format = format[i+1:]
+
+		switch {
+		case strings.HasPrefix(format, "%"):
+			literal("%")
+			format = format[1:]
+		case strings.HasPrefix(format, "{"):
+			end := strings.IndexByte(format, '}')
+			if end < 0 || end+1 >= len(format) {
+				return nil, fmt.Errorf("unterminated header field %%%s", format)
+			}
+			name := http.CanonicalHeaderKey(format[1:end])
+			switch format[end+1] {
+			case 'i':
+				value(func(e *accessLogEntry) string { return e.request.Header.Get(name) })
+			case 'o':
+				value(func(e *accessLogEntry) string { return e.header.Get(name) })
+			default:
+				return nil, fmt.Errorf("header field %%{%s} must be followed by i or o", name)
+			}
+			format = format[end+2:]
+		default:
+			end := 0
+			for end < len(format) && (format[end] == '_' || format[end] >= 'a' && format[end] <= 'z') {
+				end++
+			}
+			fn, ok := accessLogFields[format[:end]]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %%%s", format[:end])
+			}
+			value(fn)
+			format = format[end:]
+		}
+	}
+}
+
+// writeLogValue writes a template value, escaping quotes, backslashes and control
+// characters so values can't forge log lines
+func writeLogValue(b *bytes.Buffer, s string) {
+	if s == "" {
+		b.WriteByte('-')
+		return
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 && (status >= http.StatusOK || status == http.StatusSwitchingProtocols) {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessLogWriter) Flush() {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	http.NewResponseController(aw.ResponseWriter).Flush()
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
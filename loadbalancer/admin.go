@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// AdminHandler returns the handler for the admin API, meant to be served on a separate,
+// non-public listener. Without WithAdminAuth it is read-only; with it, it requires
+// authentication and also serves the net/http/pprof profiles under /debug/pprof/. Requests with a tenant's admin token get the
+// tenant's own admin API instead.
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	handler := lb.adminHandler()
+	if len(lb.tenants) == 0 {
+		return handler
+	}
+	tenants := make(map[string]http.Handler, len(lb.tenants))
+	for _, tenant := range lb.tenants {
+		tenants[tenant.Name] = lb.tenantAdminHandler(tenant)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant, ok := lb.requestTenant(r); ok {
+			tenants[tenant.Name].ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", lb.metrics)
+	mux.HandleFunc("/cache/purge", lb.handleCachePurge)
+	mux.HandleFunc("/certificates/reload", lb.handleCertificateReload)
+	mux.HandleFunc("/debug/vars", lb.handleDebugVars)
+	mux.HandleFunc("/log/level", lb.handleLogLevel)
+	mux.HandleFunc("/servers/weights", lb.handleServerWeights)
+	if lb.adminAuth == nil {
+		return readOnly(mux)
+	}
+
+	// Profiles expose memory contents, so they are never served without authentication
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return lb.adminAuth(mux)
+}
+
+// readOnly is the admin API's middleware without authentication: anyone who can reach the
+// admin listener may read it, but only authenticated requests may change anything
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Changes require admin authentication", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BearerTokenAuth returns middleware that requires an "Authorization: Bearer" header with
+// one of the tokens
+func BearerTokenAuth(tokens ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			valid := 0
+			for _, expected := range tokens {
+				valid |= subtle.ConstantTimeCompare([]byte(token), []byte(expected))
+			}
+			if !ok || token == "" || valid != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleCachePurge removes cached responses from every target group's cache.
+// Exactly one of the url, prefix or tag query parameters selects the entries:
+//
+//	POST /cache/purge?url=/app1/index.html
+//	POST /cache/purge?prefix=/app1/
+//	POST /cache/purge?tag=release-42
+func (lb *LoadBalancer) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	lb.purgeCaches(w, r, lb.caches)
+}
+
+// purgeCaches removes the cached responses selected by the request from the caches
+func (lb *LoadBalancer) purgeCaches(w http.ResponseWriter, r *http.Request, caches []*Cache) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var purge func(*Cache) int
+	switch {
+	case query.Has("url"):
+		purge = func(c *Cache) int { return c.PurgeURL(query.Get("url")) }
+	case query.Has("prefix"):
+		purge = func(c *Cache) int { return c.PurgePrefix(query.Get("prefix")) }
+	case query.Has("tag"):
+		purge = func(c *Cache) int { return c.PurgeTag(query.Get("tag")) }
+	default:
+		http.Error(w, "One of url, prefix or tag is required", http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	for _, cache := range caches {
+		purged += purge(cache)
+	}
+	lb.audit.recordRequest(r, "cache.purge", fmt.Sprintf("%s: purged %d entries", r.URL.RawQuery, purged))
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,44 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbwtg/loadbalancer"
+)
+
+func TestAdminAPIIsReadOnlyWithoutAuth(t *testing.T) {
+	tests := []struct {
+		method, target string
+		auth           bool
+		token          string
+		want           int
+	}{
+		{http.MethodGet, "/log/level", false, "", http.StatusOK},
+		{http.MethodGet, "/servers/weights", false, "", http.StatusOK},
+		{http.MethodPut, "/log/level", false, "", http.StatusForbidden},
+		{http.MethodPut, "/servers/weights", false, "", http.StatusForbidden},
+		{http.MethodPost, "/cache/purge?prefix=/", false, "", http.StatusForbidden},
+		{http.MethodPost, "/certificates/reload", false, "", http.StatusForbidden},
+		{http.MethodPost, "/cache/purge?prefix=/", true, "", http.StatusUnauthorized},
+		{http.MethodPost, "/cache/purge?prefix=/", true, "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		var opts []loadbalancer.Option
+		if test.auth {
+			opts = append(opts, loadbalancer.WithAdminAuth(loadbalancer.BearerTokenAuth("secret")))
+		}
+		lb := loadbalancer.NewLoadBalancer(opts...)
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		lb.AdminHandler().ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s with auth %t: status %d, want %d", test.method, test.target, test.auth, w.Code, test.want)
+		}
+		lb.Close()
+	}
+}
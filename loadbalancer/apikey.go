@@ -0,0 +1,288 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// APIKey describes the client an API key belongs to and its quota
+type APIKey struct {
+	Name string `json:"name"`
+
+	// RequestsPerSecond is the sustained rate the key may make requests at and Burst
+	// the number of requests it may make at once. Zero means unlimited.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// APIKeyStore looks up API keys
+type APIKeyStore interface {
+	// Lookup returns the key's details, or nil if the key is unknown
+	Lookup(ctx context.Context, key string) (*APIKey, error)
+}
+
+// FileAPIKeyStore is an APIKeyStore loaded from a JSON file mapping keys to their details
+type FileAPIKeyStore map[string]*APIKey
+
+// LoadAPIKeyFile reads a JSON file of the form {"<key>": {"name": "...", "requests_per_second": 10, "burst": 20}}
+func LoadAPIKeyFile(path string) (FileAPIKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store := make(FileAPIKeyStore)
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Lookup returns the key's details, or nil if the key is unknown
+func (s FileAPIKeyStore) Lookup(ctx context.Context, key string) (*APIKey, error) {
+	return s[key], nil
+}
+
+// RedisAPIKeyStore is an APIKeyStore backed by Redis hashes named prefix+key with the fields
+// name, requests_per_second and burst. Each request increments the hash's usage field.
+type RedisAPIKeyStore struct {
+	client *redisClient
+	prefix string
+
+	mu      sync.Mutex
+	cache   map[string]redisAPIKeyEntry
+	swept   time.Time
+	usage   map[string]int64
+	done    chan struct{}
+	flushed chan struct{}
+}
+
+type redisAPIKeyEntry struct {
+	key     *APIKey
+	fetched time.Time
+}
+
+// redisAPIKeyCacheTTL is how long looked up keys are remembered before Redis is asked again
+const redisAPIKeyCacheTTL = 30 * time.Second
+
+// maxRedisAPIKeyCache bounds the cached keys, which include the unknown keys any client can
+// send
+const maxRedisAPIKeyCache = 10000
+
+// redisAPIKeyUsageInterval is how often the usage counted since the last time is added to
+// the keys' usage fields
+const redisAPIKeyUsageInterval = time.Second
+
+// NewRedisAPIKeyStore creates a store reading keys from the Redis server at addr. Close
+// stops it recording usage.
+func NewRedisAPIKeyStore(addr, password string, db int, prefix string) *RedisAPIKeyStore {
+	if prefix == "" {
+		prefix = "apikey:"
+	}
+	s := &RedisAPIKeyStore{
+		client:  newRedisClient(addr, password, db),
+		prefix:  prefix,
+		cache:   make(map[string]redisAPIKeyEntry),
+		usage:   make(map[string]int64),
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+	go s.recordUsage()
+	return s
+}
+
+// Lookup returns the key's details, or nil if the key is unknown
+func (s *RedisAPIKeyStore) Lookup(ctx context.Context, key string) (*APIKey, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && time.Since(entry.fetched) < redisAPIKeyCacheTTL {
+		return entry.key, nil
+	}
+
+	reply, err := s.client.do(ctx, "HGETALL", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]any)
+	var apiKey *APIKey
+	if len(fields) > 0 {
+		apiKey = &APIKey{}
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := fields[i].(string)
+			value, _ := fields[i+1].(string)
+			switch name {
+			case "name":
+				apiKey.Name = value
+			case "requests_per_second":
+				apiKey.RequestsPerSecond, _ = strconv.ParseFloat(value, 64)
+			case "burst":
+				apiKey.Burst, _ = strconv.Atoi(value)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	if len(s.cache) >= maxRedisAPIKeyCache && now.Sub(s.swept) > redisAPIKeyCacheTTL {
+		for key, entry := range s.cache {
+			if now.Sub(entry.fetched) >= redisAPIKeyCacheTTL {
+				delete(s.cache, key)
+			}
+		}
+		s.swept = now
+	}
+	for key := range s.cache {
+		if len(s.cache) < maxRedisAPIKeyCache {
+			break
+		}
+		// Map order is random, so clients flooding unknown keys mostly evict their own
+		delete(s.cache, key)
+	}
+	s.cache[key] = redisAPIKeyEntry{key: apiKey, fetched: now}
+	s.mu.Unlock()
+	return apiKey, nil
+}
+
+// RecordUsage counts a request made with the key. The counts are added to the keys' usage
+// fields in Redis every redisAPIKeyUsageInterval, so requests never wait for it.
+func (s *RedisAPIKeyStore) RecordUsage(key string) {
+	s.mu.Lock()
+	s.usage[key]++
+	s.mu.Unlock()
+}
+
+// recordUsage adds the usage counts to Redis until the store is closed
+func (s *RedisAPIKeyStore) recordUsage() {
+	defer close(s.flushed)
+	ticker := time.NewTicker(redisAPIKeyUsageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.flushUsage()
+			return
+		case <-ticker.C:
+			s.flushUsage()
+		}
+	}
+}
+
+func (s *RedisAPIKeyStore) flushUsage() {
+	s.mu.Lock()
+	usage := s.usage
+	s.usage = make(map[string]int64)
+	s.mu.Unlock()
+
+	for key, count := range usage {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := s.client.do(ctx, "HINCRBY", s.prefix+key, "usage", strconv.FormatInt(count, 10))
+		cancel()
+		if err != nil {
+			logger().Error("apikey: recording usage failed", "error", err)
+		}
+	}
+}
+
+// Close records the usage counted so far and stops recording it
+func (s *RedisAPIKeyStore) Close() error {
+	close(s.done)
+	<-s.flushed
+	return nil
+}
+
+// APIKeyConfig configures API-key authentication for a target group
+type APIKeyConfig struct {
+	// Store holds the accepted keys; without one every key is rejected
+	Store APIKeyStore
+
+	// Header carries the API key. Defaults to X-API-Key.
+	Header string
+
+	// QueryParam optionally names a query parameter that may carry the key instead
+	QueryParam string
+
+	// PassKey forwards the API key to the backend. The header and query parameter are
+	// removed by default, so the servers never see the clients' keys.
+	PassKey bool
+}
+
+// APIKeyAuth returns middleware that rejects requests without a known API key with 401 and
+// requests over the key's quota with 429. Usage is counted per key name in metrics.
+func APIKeyAuth(config APIKeyConfig, metrics *Metrics) Middleware {
+	if config.Header == "" {
+		config.Header = "X-API-Key"
+	}
+	if config.Store == nil {
+		config.Store = FileAPIKeyStore{}
+	}
+	var mu sync.Mutex
+	limiters := make(map[string]*tokenBucket)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del(authUserHeader)
+
+			key := r.Header.Get(config.Header)
+			var query url.Values
+			if config.QueryParam != "" {
+				query = r.URL.Query()
+				if key == "" {
+					key = query.Get(config.QueryParam)
+				}
+			}
+			if key == "" {
+				http.Error(w, "API key required", http.StatusUnauthorized)
+				return
+			}
+
+			apiKey, err := config.Store.Lookup(r.Context(), key)
+			if err != nil {
+				logger().Error("apikey: lookup failed", "error", err)
+				http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if apiKey == nil {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+
+			if apiKey.RequestsPerSecond > 0 {
+				mu.Lock()
+				limiter, ok := limiters[key]
+				if !ok || limiter.rate != apiKey.RequestsPerSecond {
+					limiter = newTokenBucket(apiKey.RequestsPerSecond, apiKey.Burst)
+					limiters[key] = limiter
+				}
+				mu.Unlock()
+
+				if ok, wait := limiter.allow(); !ok {
+					metrics.Counter("loadbalancer_api_key_requests_total", "Number of requests per API key by result.", "key", apiKey.Name, "result", "over_quota").Inc()
+					w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+					http.Error(w, "API key quota exceeded", http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			metrics.Counter("loadbalancer_api_key_requests_total", "Number of requests per API key by result.", "key", apiKey.Name, "result", "allowed").Inc()
+			if recorder, ok := config.Store.(interface{ RecordUsage(key string) }); ok {
+				recorder.RecordUsage(key)
+			}
+			if !config.PassKey {
+				r.Header.Del(config.Header)
+				if query.Has(config.QueryParam) {
+					query.Del(config.QueryParam)
+					r.URL.RawQuery = query.Encode()
+				}
+			}
+			r.Header.Set(authUserHeader, apiKey.Name)
+			setRequestUser(r, apiKey.Name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeRedis answers HGETALL with an empty hash and sums HINCRBY increments
+type fakeRedis struct {
+	addr string
+
+	mu         sync.Mutex
+	increments map[string]int64
+	commands   map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	f := &fakeRedis{addr: listener.Addr().String(), increments: make(map[string]int64), commands: make(map[string]int)}
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(&redisConn{conn: netConn, reader: bufio.NewReader(netConn)})
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn *redisConn) {
+	defer conn.conn.Close()
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]any)
+		if len(args) == 0 {
+			return
+		}
+		name, _ := args[0].(string)
+		f.mu.Lock()
+		f.commands[name]++
+		switch name {
+		case "HGETALL":
+			fmt.Fprint(conn.conn, "*0\r\n")
+		case "HINCRBY":
+			key, _ := args[1].(string)
+			by, _ := args[3].(string)
+			n, _ := strconv.ParseInt(by, 10, 64)
+			f.increments[key] += n
+			fmt.Fprintf(conn.conn, ":%d\r\n", f.increments[key])
+		default:
+			fmt.Fprint(conn.conn, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisAPIKeyCacheIsBounded(t *testing.T) {
+	redis := newFakeRedis(t)
+	store := NewRedisAPIKeyStore(redis.addr, "", 0, "")
+	defer store.Close()
+
+	for i := 0; i < maxRedisAPIKeyCache+100; i++ {
+		key, err := store.Lookup(context.Background(), "unknown-"+strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			t.Fatalf("an unknown key was found: %+v", key)
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.cache) > maxRedisAPIKeyCache {
+		t.Errorf("%d keys are cached, want at most %d", len(store.cache), maxRedisAPIKeyCache)
+	}
+}
+
+func TestRedisAPIKeyUsageIsBatched(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage map[string]int
+	}{
+		{"OneKey", map[string]int{"a": 100}},
+		{"ManyKeys", map[string]int{"a": 1, "b": 50, "c": 200}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redis := newFakeRedis(t)
+			store := NewRedisAPIKeyStore(redis.addr, "", 0, "")
+			var wg sync.WaitGroup
+			requests := 0
+			for key, n := range test.usage {
+				for i := 0; i < n; i++ {
+					wg.Add(1)
+					go func(key string) {
+						defer wg.Done()
+						store.RecordUsage(key)
+					}(key)
+				}
+				requests += n
+			}
+			wg.Wait()
+			store.Close()
+
+			redis.mu.Lock()
+			defer redis.mu.Unlock()
+			for key, n := range test.usage {
+				if got := redis.increments["apikey:"+key]; got != int64(n) {
+					t.Errorf("usage of %s is %d, want %d", key, got, n)
+				}
+			}
+			if commands := redis.commands["HINCRBY"]; commands >= requests {
+				t.Errorf("%d requests were recorded with %d commands", requests, commands)
+			}
+		})
+	}
+}
+
+func TestAPIKeyIsRemoved(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		pass       bool
+		wantHeader string
+		wantQuery  string
+	}{
+		{"Header", "/?a=1", "k1", false, "", "a=1"},
+		{"QueryParam", "/?a=1&key=k1", "", false, "", "a=1"},
+		{"PassedHeader", "/?a=1", "k1", true, "k1", "a=1"},
+		{"PassedQueryParam", "/?a=1&key=k1", "", true, "", "a=1&key=k1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header, query string
+			handler := APIKeyAuth(APIKeyConfig{
+				Store:      FileAPIKeyStore{"k1": {Name: "client"}},
+				QueryParam: "key",
+				PassKey:    test.pass,
+			}, NewMetrics())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header, query = r.Header.Get("X-API-Key"), r.URL.RawQuery
+			}))
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.header != "" {
+				r.Header.Set("X-API-Key", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if header != test.wantHeader || query != test.wantQuery {
+				t.Errorf("the backend got the header %q and the query %q, want %q and %q", header, query, test.wantHeader, test.wantQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent is an entry of the audit log: who changed what, when, and how
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Action     string    `json:"action"`
+
+	// Changes describe the change as "path: old -> new" lines
+	Changes []string `json:"changes,omitempty"`
+
+	// Error is set when the change failed and nothing was changed
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog records changes made through the admin API and configuration reloads to an
+// append-only file, one JSON object per line
+type AuditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenAuditLog opens the audit log for appending, creating it if needed
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// WithAuditLog records admin API changes to the audit log
+func WithAuditLog(audit *AuditLog) Option {
+	return func(lb *LoadBalancer) {
+		lb.audit = audit
+	}
+}
+
+// Record appends an event, synced to disk before it returns. A nil AuditLog records nothing.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	// Changes read better with arrows than their HTML-safe escapes
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(event)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.file.Write(line.Bytes())
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		logger().Error("audit log: write failed", "action", event.Action, "error", err)
+	}
+}
+
+// recordRequest records a change made with an admin API request
+func (a *AuditLog) recordRequest(r *http.Request, action string, changes ...string) {
+	a.Record(AuditEvent{Actor: adminActor(r), RemoteAddr: r.RemoteAddr, Action: action, Changes: changes})
+}
+
+// Reopen opens the audit log's path again, for when the file was renamed by logrotate
+func (a *AuditLog) Reopen() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file.Close()
+	a.file = file
+	return nil
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// adminActor identifies who sent an admin request: the Basic auth user, or a fingerprint
+// of the bearer token so the token itself never appears in the log
+func adminActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return "user:" + user
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:4])
+	}
+	return "anonymous"
+}
+
+// diffConfigs lists the settings that differ between two configurations as "path: old -> new"
+func diffConfigs(old, new *Config) []string {
+	var changes []string
+	diffJSON(&changes, "", toJSONValue(old), toJSONValue(new))
+	sort.Strings(changes)
+	return changes
+}
+
+// toJSONValue converts v to the maps, slices and scalars it is encoded as in JSON
+func toJSONValue(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var value any
+	json.Unmarshal(data, &value)
+	return value
+}
+
+func diffJSON(changes *[]string, path string, old, new any) {
+	oldMap, oldIsMap := old.(map[string]any)
+	newMap, newIsMap := new.(map[string]any)
+	// Added and removed objects are compared with nothing so secrets in them stay masked
+	if (oldIsMap || old == nil) && (newIsMap || new == nil) && (oldIsMap || newIsMap) {
+		keys := make(map[string]bool)
+		for key := range oldMap {
+			keys[key] = true
+		}
+		for key := range newMap {
+			keys[key] = true
+		}
+		for key := range keys {
+			diffJSON(changes, joinPath(path, key), oldMap[key], newMap[key])
+		}
+		return
+	}
+	oldSlice, oldIsSlice := old.([]any)
+	newSlice, newIsSlice := new.([]any)
+	if (oldIsSlice || old == nil) && (newIsSlice || new == nil) && (oldIsSlice || newIsSlice) {
+		for i := 0; i < len(oldSlice) || i < len(newSlice); i++ {
+			var o, n any
+			if i < len(oldSlice) {
+				o = oldSlice[i]
+			}
+			if i < len(newSlice) {
+				n = newSlice[i]
+			}
+			diffJSON(changes, fmt.Sprintf("%s[%d]", path, i), o, n)
+		}
+		return
+	}
+
+	oldJSON, _ := json.Marshal(old)
+	newJSON, _ := json.Marshal(new)
+	if string(oldJSON) == string(newJSON) {
+		return
+	}
+	if isSecretPath(path) {
+		oldJSON, newJSON = []byte(`"***"`), []byte(`"***"`)
+	}
+	*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", path, oldJSON, newJSON))
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// isSecretPath reports whether a setting holds a secret whose value is kept out of the log
+func isSecretPath(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if strings.Contains(key, "secret") || strings.Contains(key, "password") || key == "users" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package loadbalancer
+
+// Balancer selects the next server from a list of candidates
+type Balancer interface {
+	Next(servers []*Server) *Server
+}
+
+// RoundRobin is a Balancer that cycles through servers in order
+type RoundRobin struct {
+	// indexes are the positions in lists of servers by their first server, so different
+	// lists, like the servers of the local zone and those it spills over to, are each
+	// cycled through
+	indexes map[string]int
+}
+
+// maxRoundRobinLists bounds the positions a RoundRobin remembers as servers change
+const maxRoundRobinLists = 1024
+
+// NewRoundRobin creates a new round-robin Balancer
+func NewRoundRobin() Balancer {
+	return &RoundRobin{}
+}
+
+// Next returns the next server in the round-robin order
+func (rr *RoundRobin) Next(servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	if rr.indexes == nil || len(rr.indexes) >= maxRoundRobinLists {
+		rr.indexes = make(map[string]int)
+	}
+	key := servers[0].name()
+	index := rr.indexes[key] % len(servers)
+	rr.indexes[key] = index + 1
+	return servers[index]
+}
+
+// LeastConnections is a Balancer that picks the server with the fewest requests in flight,
+// cycling through servers with equally few
+type LeastConnections struct {
+	inFlight map[string]int
+	rr       RoundRobin
+}
+
+// NewLeastConnections creates a least-connections Balancer
+func NewLeastConnections() Balancer {
+	return &LeastConnections{inFlight: make(map[string]int)}
+}
+
+// Next returns the server with the fewest requests in flight
+func (lc *LeastConnections) Next(servers []*Server) *Server {
+	var least []*Server
+	for _, server := range servers {
+		switch n := lc.inFlight[server.name()]; {
+		case len(least) == 0 || n < lc.inFlight[least[0].name()]:
+			least = append(least[:0], server)
+		case n == lc.inFlight[least[0].name()]:
+			least = append(least, server)
+		}
+	}
+	server := lc.rr.Next(least)
+	if server != nil {
+		lc.inFlight[server.name()]++
+	}
+	return server
+}
+
+// Done implements RequestTracker
+func (lc *LeastConnections) Done(server *Server) {
+	if lc.inFlight[server.name()]--; lc.inFlight[server.name()] <= 0 {
+		delete(lc.inFlight, server.name())
+	}
+}
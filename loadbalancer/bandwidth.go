@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// BandwidthConfig limits how fast response bodies are sent to clients, so large downloads
+// can't take all of the load balancer's bandwidth from interactive traffic
+type BandwidthConfig struct {
+	// BytesPerSecond limits each response; zero means no limit
+	BytesPerSecond int64
+
+	// RouteBytesPerSecond limits all responses of the route together; zero means no limit
+	RouteBytesPerSecond int64
+}
+
+// bandwidthChunk is the most written to the client at once while throttling, so
+// throttled responses flow steadily rather than in bursts
+const bandwidthChunk = 16 << 10
+
+// Bandwidth returns middleware that throttles response bodies to the configured rates.
+// Each response may send a second worth of bytes at once before being slowed down.
+func Bandwidth(config BandwidthConfig) Middleware {
+	var route *tokenBucket
+	if config.RouteBytesPerSecond > 0 {
+		route = newTokenBucket(float64(config.RouteBytesPerSecond), int(config.RouteBytesPerSecond))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tw := &throttledWriter{ResponseWriter: w, ctx: r.Context(), route: route}
+			if config.BytesPerSecond > 0 {
+				tw.response = newTokenBucket(float64(config.BytesPerSecond), int(config.BytesPerSecond))
+			}
+			if tw.response == nil && tw.route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(tw, r)
+		})
+	}
+}
+
+// throttledWriter waits for the response's and the route's buckets before writing
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	response *tokenBucket
+	route    *tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		var wait time.Duration
+		if tw.response != nil {
+			wait = tw.response.reserve(len(chunk))
+		}
+		if tw.route != nil {
+			wait = max(wait, tw.route.reserve(len(chunk)))
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			case <-timer.C:
+			}
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
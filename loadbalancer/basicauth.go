@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd maps user names to bcrypt password hashes
+type Htpasswd map[string][]byte
+
+// LoadHtpasswd reads an htpasswd file with bcrypt hashes, as created by `htpasswd -B`
+func LoadHtpasswd(path string) (Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseHtpasswd(file)
+}
+
+// ParseHtpasswd parses htpasswd entries of the form user:hash. Only bcrypt hashes are supported.
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	htpasswd := make(Htpasswd)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: user %q: only bcrypt hashes are supported", line, user)
+		}
+		htpasswd[user] = []byte(hash)
+	}
+	return htpasswd, scanner.Err()
+}
+
+// BasicAuthConfig configures HTTP Basic authentication for a target group
+type BasicAuthConfig struct {
+	// Realm is sent to clients in the WWW-Authenticate challenge. Defaults to "Restricted".
+	Realm string
+
+	// Users holds the accepted credentials, typically loaded with LoadHtpasswd
+	Users Htpasswd
+
+	// PassAuthorization forwards the client's Authorization header to the backend. It is
+	// removed by default, so the servers never see the users' passwords.
+	PassAuthorization bool
+}
+
+// dummyHash is compared against for unknown users so they take as long to reject as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// BasicAuth returns middleware that requires valid Basic auth credentials, responding
+// 401 Unauthorized otherwise
+func BasicAuth(config BasicAuthConfig) Middleware {
+	if config.Realm == "" {
+		config.Realm = "Restricted"
+	}
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", config.Realm)
+
+	// bcrypt is deliberately slow, so remember credentials that have already been verified
+	var verified sync.Map
+
+	return func(next http.Handler) http.Handler {
+		authenticated := func(w http.ResponseWriter, r *http.Request, user string) {
+			setRequestUser(r, user)
+			if !config.PassAuthorization {
+				r.Header.Del("Authorization")
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if ok {
+				hash, known := config.Users[user]
+				digest := sha256.Sum256([]byte(user + ":" + password))
+				if _, cached := verified.Load(digest); known && cached {
+					authenticated(w, r, user)
+					return
+				}
+				if !known {
+					bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+				} else if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+					verified.Store(digest, struct{}{})
+					authenticated(w, r, user)
+					return
+				}
+			}
+
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
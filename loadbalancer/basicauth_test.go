@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthRemovesCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pass bool
+		want string
+	}{
+		{"Removed", false, ""},
+		{"Passed", true, "Basic YWxpY2U6c2VjcmV0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			handler := BasicAuth(BasicAuthConfig{Users: Htpasswd{"alice": hash}, PassAuthorization: test.pass})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Authorization")
+			}))
+			// The second request is authenticated from the cache of verified credentials
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("alice", "secret")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d", w.Code)
+				}
+				if got != test.want {
+					t.Errorf("request %d: the backend got Authorization %q, want %q", i, got, test.want)
+				}
+			}
+		})
+	}
+}
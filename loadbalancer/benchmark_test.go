@@ -0,0 +1,169 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkServers returns n servers with distinct URLs that are never dialed
+func benchmarkServers(n int) []*Server {
+	servers := make([]*Server, n)
+	for i := range servers {
+		servers[i] = &Server{URL: &url.URL{Scheme: "http", Host: "10.0.0." + strconv.Itoa(i+1) + ":8080"}}
+	}
+	return servers
+}
+
+func BenchmarkBalancers(b *testing.B) {
+	balancers := []struct {
+		name string
+		new  func() Balancer
+	}{
+		{"RoundRobin", NewRoundRobin},
+		{"LeastConnections", NewLeastConnections},
+		{"EWMA", NewEWMA},
+		{"ConsistentHash", newDefaultConsistentHash},
+		{"Maglev", newDefaultMaglev},
+		{"Rendezvous", NewRendezvous},
+	}
+	for _, servers := range []int{3, 30} {
+		for _, balancer := range balancers {
+			balancer := balancer
+			b.Run(fmt.Sprintf("%s/%d", balancer.name, servers), func(b *testing.B) {
+				list := benchmarkServers(servers)
+				next := balancer.new()
+				hashBalancer, hashed := next.(HashBalancer)
+				tracker, tracked := next.(RequestTracker)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var server *Server
+					if hashed {
+						server = hashBalancer.NextKey(mix64(uint64(i)), list)
+					} else {
+						server = next.Next(list)
+					}
+					if tracked {
+						tracker.Done(server)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkGetNextServer(b *testing.B) {
+	targetGroup := &TargetGroup{URIPath: "/", Servers: benchmarkServers(10)}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lb.getNextServer(targetGroup, r, lb.servers(targetGroup), nil)
+	}
+}
+
+func BenchmarkMatchTargetGroup(b *testing.B) {
+	var options []Option
+	for i := 0; i < 50; i++ {
+		options = append(options, WithTargetGroup(&TargetGroup{URIPath: "/app" + strconv.Itoa(i), Servers: benchmarkServers(2)}))
+	}
+	for i := 0; i < 50; i++ {
+		options = append(options, WithVirtualHost(&VirtualHost{
+			Hosts:        []string{"app" + strconv.Itoa(i) + ".example.com", "*.app" + strconv.Itoa(i) + ".example.com"},
+			TargetGroups: []*TargetGroup{{URIPath: "/api", Servers: benchmarkServers(2)}},
+		}))
+	}
+	lb := NewLoadBalancer(options...)
+
+	requests := []struct {
+		name string
+		url  string
+	}{
+		{"FirstPath", "http://lb/app0"},
+		{"LastPath", "http://lb/app49"},
+		{"NoMatch", "http://lb/none"},
+		{"ExactHost", "http://app49.example.com/api"},
+		{"WildcardHost", "http://a.b.app49.example.com/api"},
+	}
+	for _, request := range requests {
+		r := httptest.NewRequest(http.MethodGet, request.url, nil)
+		b.Run(request.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				lb.matchTargetGroup(r)
+			}
+		})
+	}
+}
+
+// benchmarkBackend serves a fixed body of size bytes
+func benchmarkBackend(b *testing.B, size int) *httptest.Server {
+	body := make([]byte, size)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(body)
+	}))
+	b.Cleanup(backend.Close)
+	return backend
+}
+
+func BenchmarkProxy(b *testing.B) {
+	for _, size := range []int{0, 64 << 10} {
+		size := size
+		b.Run("Body"+strconv.Itoa(size), func(b *testing.B) {
+			var servers []*Server
+			for i := 0; i < 3; i++ {
+				backend := benchmarkBackend(b, size)
+				u, _ := url.Parse(backend.URL)
+				servers = append(servers, &Server{URL: u})
+			}
+			lb := NewLoadBalancer(WithTargetGroup(&TargetGroup{URIPath: "/", Servers: servers}))
+			b.Cleanup(func() { lb.Close() })
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				lb.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProxyParallel(b *testing.B) {
+	backend := benchmarkBackend(b, 1024)
+	u, _ := url.Parse(backend.URL)
+	lb := NewLoadBalancer(
+		WithTargetGroup(&TargetGroup{URIPath: "/", Servers: []*Server{{URL: u}}}),
+		WithTransportConfig(TransportConfig{MaxIdleConnsPerHost: 256, IdleConnTimeout: time.Minute}),
+	)
+	b.Cleanup(func() { lb.Close() })
+	front := httptest.NewServer(lb)
+	b.Cleanup(front.Close)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 256}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(front.URL + "/")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// ResponseBufferingConfig reads backend responses completely before sending them to the
+// client, so slow clients don't hold backend connections. Responses larger than MaxBytes
+// are streamed once the buffer is full, as are upgrades and Server-Sent Events.
+type ResponseBufferingConfig struct {
+	// MaxBytes is the most buffered per response, 1 MiB if zero
+	MaxBytes int64
+}
+
+func (config *ResponseBufferingConfig) maxBytes() int64 {
+	if config.MaxBytes <= 0 {
+		return 1 << 20
+	}
+	return config.MaxBytes
+}
+
+// bufferResponse reads up to the configured size of the response body into memory,
+// setting its Content-Length if it all fit
+func bufferResponse(resp *http.Response, config *ResponseBufferingConfig) error {
+	switch {
+	case resp.StatusCode < http.StatusOK, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return nil
+	case resp.Body == nil, resp.Body == http.NoBody:
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return nil
+	}
+	limit := config.maxBytes()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	if resp.Header.Get("Content-Length") == "" {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
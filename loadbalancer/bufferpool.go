@@ -0,0 +1,55 @@
+package loadbalancer
+
+import "sync"
+
+// bufferSize matches the copy buffer size used by httputil.ReverseProxy
+const bufferSize = 32 * 1024
+
+// BufferPool is an httputil.BufferPool backed by a sync.Pool that records its usage in metrics
+type BufferPool struct {
+	pool        sync.Pool
+	emptied     sync.Pool
+	gets        *Counter
+	puts        *Counter
+	allocations *Counter
+}
+
+// NewBufferPool creates a BufferPool that reports its stats to the given metrics registry
+func NewBufferPool(metrics *Metrics) *BufferPool {
+	p := &BufferPool{
+		gets:        metrics.Counter("loadbalancer_buffer_pool_gets_total", "Number of buffers taken from the proxy buffer pool."),
+		puts:        metrics.Counter("loadbalancer_buffer_pool_puts_total", "Number of buffers returned to the proxy buffer pool."),
+		allocations: metrics.Counter("loadbalancer_buffer_pool_allocations_total", "Number of buffers allocated because the proxy buffer pool was empty."),
+	}
+	p.pool.New = func() any {
+		p.allocations.Inc()
+		buf := make([]byte, bufferSize)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from the pool. The pointer the buffer was kept in is put aside for
+// Put to reuse, so that returning buffers doesn't allocate.
+func (p *BufferPool) Get() []byte {
+	p.gets.Inc()
+	ptr := p.pool.Get().(*[]byte)
+	buf := *ptr
+	*ptr = nil
+	p.emptied.Put(ptr)
+	return buf
+}
+
+// Put returns a buffer to the pool
+func (p *BufferPool) Put(buf []byte) {
+	if cap(buf) < bufferSize {
+		return
+	}
+	p.puts.Inc()
+	ptr, _ := p.emptied.Get().(*[]byte)
+	if ptr == nil {
+		ptr = new([]byte)
+	}
+	*ptr = buf[:bufferSize]
+	p.pool.Put(ptr)
+}
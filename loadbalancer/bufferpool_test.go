@@ -0,0 +1,18 @@
+package loadbalancer
+
+import "testing"
+
+func TestBufferPoolReusesBuffers(t *testing.T) {
+	pool := NewBufferPool(NewMetrics())
+	pool.Put(pool.Get())
+	if allocs := testing.AllocsPerRun(100, func() { pool.Put(pool.Get()) }); allocs != 0 {
+		t.Errorf("taking and returning a buffer allocates %v times", allocs)
+	}
+	if buf := pool.Get(); len(buf) != bufferSize {
+		t.Errorf("got a buffer of %d bytes, want %d", len(buf), bufferSize)
+	}
+	pool.Put(make([]byte, 10))
+	if buf := pool.Get(); len(buf) != bufferSize {
+		t.Errorf("got a buffer of %d bytes after returning a short one, want %d", len(buf), bufferSize)
+	}
+}
@@ -0,0 +1,536 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig configures an in-memory response cache for a target group
+type CacheConfig struct {
+	// MaxBytes limits the total size of cached response bodies. Defaults to 64 MiB.
+	MaxBytes int64
+
+	// MaxEntryBytes limits the size of a single cached response body. Defaults to 1 MiB.
+	MaxEntryBytes int64
+
+	// DefaultTTL is used for responses without Cache-Control or Expires freshness
+	// information. Zero means such responses aren't cached.
+	DefaultTTL time.Duration
+
+	// MaxTTL caps how long any response is cached; zero means no cap
+	MaxTTL time.Duration
+
+	// StaleWhileRevalidate and StaleIfError are how long an expired entry may still be
+	// served while it is refreshed in the background, or when the backends fail. They apply
+	// to responses without the corresponding Cache-Control extensions.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// TagHeader names the response header holding comma-separated tags that entries
+	// can be purged by. Defaults to Cache-Tag.
+	TagHeader string
+}
+
+// Cache is an LRU cache of backend responses keyed by method, URL, experiment variants and
+// the headers named in Vary
+type Cache struct {
+	config  CacheConfig
+	metrics *Metrics
+	route   string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	vary    map[string][]string
+	size    int64
+
+	revalidating map[string]bool
+}
+
+type cacheEntry struct {
+	key     string
+	url     string
+	tags    []string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// NewCache creates an empty response cache that reports hits and misses for route to metrics
+func NewCache(config CacheConfig, metrics *Metrics, route string) *Cache {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 64 << 20
+	}
+	if config.MaxEntryBytes <= 0 {
+		config.MaxEntryBytes = 1 << 20
+	}
+	if config.TagHeader == "" {
+		config.TagHeader = "Cache-Tag"
+	}
+	return &Cache{
+		config:  config,
+		metrics: metrics,
+		route:   route,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		vary:    make(map[string][]string),
+
+		revalidating: make(map[string]bool),
+	}
+}
+
+// Middleware returns middleware that serves fresh responses from the cache and stores cacheable ones.
+// Expired entries are still served while they are within their stale-while-revalidate window,
+// refreshing them in the background, or within their stale-if-error window when the backends fail.
+func (c *Cache) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || hasDirective(r.Header, "no-store") || hasDirective(r.Header, "no-cache") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			req := newCacheRequest(r)
+			entry := c.get(req.baseKey, r)
+			now := time.Now()
+			switch {
+			case entry != nil && now.Before(entry.expires):
+				c.count("hit")
+				entry.serve(w, "HIT")
+				return
+			case entry != nil && now.Before(entry.expires.Add(entry.staleWhileRevalidate)):
+				c.count("stale")
+				entry.serve(w, "STALE")
+				c.revalidate(req, r, next)
+				return
+			case entry != nil && now.Before(entry.expires.Add(entry.staleIfError)):
+				// Buffer the response so the stale entry can replace it if the backends fail
+				buffered := newBufferedResponse()
+				next.ServeHTTP(buffered, r)
+				if buffered.status >= http.StatusInternalServerError {
+					c.count("stale")
+					entry.serve(w, "STALE")
+					return
+				}
+				c.count("miss")
+				buffered.writeTo(w)
+				if int64(buffered.body.Len()) <= c.config.MaxEntryBytes {
+					c.store(req, buffered.status, buffered.header, buffered.body.Bytes())
+				}
+				return
+			}
+
+			c.count("miss")
+			cw := &cacheWriter{ResponseWriter: w, limit: c.config.MaxEntryBytes}
+			next.ServeHTTP(cw, r)
+			if !cw.overflow && cw.header != nil {
+				c.store(req, cw.status, cw.header, cw.body)
+			}
+		})
+	}
+}
+
+// count records the result of a cache lookup
+func (c *Cache) count(result string) {
+	c.metrics.Counter("loadbalancer_cache_requests_total", "Number of cacheable requests by result.", "route", c.route, "result", result).Inc()
+}
+
+// revalidate refreshes an entry in the background, at most once at a time per URL
+func (c *Cache) revalidate(req cacheRequest, r *http.Request, next http.Handler) {
+	c.mu.Lock()
+	if c.revalidating[req.baseKey] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[req.baseKey] = true
+	c.mu.Unlock()
+
+	// The client's request is finished once the stale response has been served
+	background := r.Clone(context.Background())
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, req.baseKey)
+			c.mu.Unlock()
+		}()
+
+		buffered := newBufferedResponse()
+		next.ServeHTTP(buffered, background)
+		if int64(buffered.body.Len()) <= c.config.MaxEntryBytes {
+			c.store(req, buffered.status, buffered.header, buffered.body.Bytes())
+		}
+	}()
+}
+
+// get returns the entry matching the request, if any, as long as it may still be served
+func (c *Cache) get(baseKey string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[varyKey(baseKey, c.vary[baseKey], r.Header)]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(max(entry.staleWhileRevalidate, entry.staleIfError))) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+// cacheRequest holds the parts of a request needed to store its response,
+// captured before the request is forwarded
+type cacheRequest struct {
+	baseKey    string
+	url        string
+	header     http.Header
+	authorized bool
+}
+
+func newCacheRequest(r *http.Request) cacheRequest {
+	baseKey := r.Method + " " + r.Host + r.URL.RequestURI()
+	if assignments := experimentAssignments(r); assignments != "" {
+		// Variants served by the same group may get different responses, tagged with the variant
+		baseKey += " " + assignments
+	}
+	return cacheRequest{
+		baseKey:    baseKey,
+		url:        r.URL.RequestURI(),
+		header:     r.Header.Clone(),
+		authorized: r.Header.Get("Authorization") != "",
+	}
+}
+
+// store adds a response to the cache if it is cacheable
+func (c *Cache) store(req cacheRequest, status int, header http.Header, body []byte) {
+	if !cacheableStatus(status) {
+		return
+	}
+	ttl, ok := c.freshness(header, req.authorized)
+	if !ok {
+		return
+	}
+
+	varyHeaders := parseVary(header)
+	for _, name := range varyHeaders {
+		if name == "*" {
+			return
+		}
+	}
+
+	directives := parseCacheControl(header)
+	staleWhileRevalidate := c.config.StaleWhileRevalidate
+	if value, ok := directives["stale-while-revalidate"]; ok {
+		staleWhileRevalidate = parseSeconds(value)
+	}
+	staleIfError := c.config.StaleIfError
+	if value, ok := directives["stale-if-error"]; ok {
+		staleIfError = parseSeconds(value)
+	}
+	if _, ok := directives["must-revalidate"]; ok {
+		staleWhileRevalidate, staleIfError = 0, 0
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:                  varyKey(req.baseKey, varyHeaders, req.header),
+		url:                  req.url,
+		tags:                 parseTags(header.Values(c.config.TagHeader)),
+		status:               status,
+		header:               header,
+		body:                 body,
+		stored:               now,
+		expires:              now.Add(ttl),
+		staleWhileRevalidate: staleWhileRevalidate,
+		staleIfError:         staleIfError,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.vary[req.baseKey] = varyHeaders
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.size > c.config.MaxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// PurgeURL removes the entries for a request URI (path and query) and returns how many were removed
+func (c *Cache) PurgeURL(url string) int {
+	return c.purge(func(entry *cacheEntry) bool { return entry.url == url })
+}
+
+// PurgePrefix removes the entries whose request URI starts with prefix and returns how many were removed
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(entry *cacheEntry) bool { return strings.HasPrefix(entry.url, prefix) })
+}
+
+// PurgeTag removes the entries tagged with tag and returns how many were removed
+func (c *Cache) PurgeTag(tag string) int {
+	return c.purge(func(entry *cacheEntry) bool {
+		for _, t := range entry.tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// purge removes the entries matching the predicate
+func (c *Cache) purge(match func(*cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*cacheEntry)) {
+			c.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// remove deletes an entry; the caller must hold c.mu
+func (c *Cache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// freshness returns how long a response may be cached based on its Cache-Control and Expires headers
+func (c *Cache) freshness(header http.Header, authorized bool) (time.Duration, bool) {
+	if header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	directives := parseCacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["private"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["public"]; authorized && !ok {
+		if _, ok := directives["s-maxage"]; !ok {
+			return 0, false
+		}
+	}
+
+	var ttl time.Duration
+	if age, ok := directives["s-maxage"]; ok {
+		ttl = parseSeconds(age)
+	} else if age, ok := directives["max-age"]; ok {
+		ttl = parseSeconds(age)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = expires.Sub(date)
+	} else {
+		ttl = c.config.DefaultTTL
+	}
+
+	if c.config.MaxTTL > 0 && ttl > c.config.MaxTTL {
+		ttl = c.config.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// serve writes the cached response to the client, marking it with the cache status
+func (e *cacheEntry) serve(w http.ResponseWriter, cacheStatus string) {
+	header := w.Header()
+	for name, values := range e.header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	header.Set("X-Cache", cacheStatus)
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// cacheWriter passes a response through to the client while recording it for the cache
+type cacheWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	header   http.Header
+	body     []byte
+	overflow bool
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.header == nil && status >= http.StatusOK {
+		cw.status = status
+		cw.header = cw.ResponseWriter.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.header == nil {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if int64(len(cw.body)+len(p)) > cw.limit {
+			cw.overflow = true
+			cw.body = nil
+		} else {
+			cw.body = append(cw.body, p...)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the whole response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 && status >= http.StatusOK {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.WriteHeader(http.StatusOK)
+	}
+	return br.body.Write(p)
+}
+
+// writeTo sends the buffered response to w
+func (br *bufferedResponse) writeTo(w http.ResponseWriter) {
+	header := w.Header()
+	for name, values := range br.header {
+		header[name] = values
+	}
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	w.WriteHeader(br.status)
+	w.Write(br.body.Bytes())
+}
+
+// cacheableStatus reports whether responses with the status code may be cached
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// parseCacheControl splits a Cache-Control header into lower-case directive names and their values
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// hasDirective reports whether a Cache-Control header contains the directive
+func hasDirective(header http.Header, directive string) bool {
+	_, ok := parseCacheControl(header)[directive]
+	return ok
+}
+
+// parseSeconds parses a delta-seconds value, treating invalid values as zero
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseVary returns the canonical header names listed in a Vary header
+func parseVary(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// parseTags splits comma-separated cache tags
+func parseTags(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// varyKey extends a base cache key with the request's values for the Vary headers
+func varyKey(baseKey string, varyHeaders []string, requestHeader http.Header) string {
+	if len(varyHeaders) == 0 {
+		return baseKey
+	}
+	var b strings.Builder
+	b.WriteString(baseKey)
+	for _, name := range varyHeaders {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(requestHeader.Values(name), ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// CanaryConfig sends a share of a target group's requests to a canary target group
+type CanaryConfig struct {
+	TargetGroup *TargetGroup
+
+	// Weight is the fraction of requests, from 0 to 1, sent to the canary
+	Weight float64
+
+	// Requests whose Header or Cookie equals Value (default "true") always go to the canary,
+	// whatever the weight, and requests where it is "false" never do, so the new version can
+	// be tested in production
+	Header string
+	Cookie string
+	Value  string
+}
+
+// forced reports whether the request's header or cookie picks the canary or the stable group
+func (config CanaryConfig) forced(r *http.Request) (canary, ok bool) {
+	value := config.Value
+	if value == "" {
+		value = "true"
+	}
+	var selected string
+	if config.Header != "" {
+		selected = r.Header.Get(config.Header)
+	}
+	if selected == "" && config.Cookie != "" {
+		if cookie, err := r.Cookie(config.Cookie); err == nil {
+			selected = cookie.Value
+		}
+	}
+	switch selected {
+	case value:
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// canary returns middleware that applies a target group's CanaryConfig
+func (lb *LoadBalancer) canary(config CanaryConfig, route string) Middleware {
+	const help = "Number of requests sent to the stable and canary target groups."
+	canaryRequests := lb.metrics.Counter("loadbalancer_canary_requests_total", help, "route", route, "target", "canary")
+	stableRequests := lb.metrics.Counter("loadbalancer_canary_requests_total", help, "route", route, "target", "stable")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			canary, forced := config.forced(r)
+			if !forced {
+				canary = rand.Float64() < config.Weight
+			}
+			if canary && config.TargetGroup != nil {
+				canaryRequests.Inc()
+				lb.serveTargetGroup(w, r, config.TargetGroup)
+				return
+			}
+			stableRequests.Inc()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureConfig configures recording of sampled requests
+type CaptureConfig struct {
+	// Path is the file captured requests are appended to, one JSON object per line
+	Path string
+
+	// SampleRate is the fraction of requests, from 0 to 1, that are recorded
+	SampleRate float64
+
+	// Bodies records request bodies up to MaxBodyBytes (default 64KB) as well as headers
+	Bodies       bool
+	MaxBodyBytes int64
+}
+
+// CapturedRequest is a recorded request
+type CapturedRequest struct {
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	ClientIP  string      `json:"client_ip"`
+	RequestID string      `json:"request_id"`
+}
+
+// Capture records sampled requests to a file for later replay
+type Capture struct {
+	config CaptureConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewCapture opens the capture file for appending
+func NewCapture(config CaptureConfig) (*Capture, error) {
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 64 << 10
+	}
+	file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{config: config, file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// Middleware returns middleware recording sampled requests
+func (c *Capture) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rand.Float64() >= c.config.SampleRate || r.Context().Value(replayKey{}) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			captured := CapturedRequest{
+				Time:      time.Now(),
+				Method:    r.Method,
+				URL:       r.URL.RequestURI(),
+				Host:      r.Host,
+				Header:    r.Header.Clone(),
+				ClientIP:  ClientIP(r).String(),
+				RequestID: RequestID(r),
+			}
+			if c.config.Bodies && r.Body != nil && r.Body != http.NoBody {
+				body, err := io.ReadAll(io.LimitReader(r.Body, c.config.MaxBodyBytes+1))
+				if int64(len(body)) > c.config.MaxBodyBytes {
+					captured.Body = body[:c.config.MaxBodyBytes]
+					captured.Truncated = true
+				} else {
+					captured.Body = body
+				}
+				// Hand the backend the whole body, including what was read here
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				if err != nil {
+					captured.Truncated = true
+				}
+			}
+
+			c.mu.Lock()
+			err := c.encoder.Encode(captured)
+			c.mu.Unlock()
+			if err != nil {
+				logger().Error("capture: write failed", "error", err)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// readCloser reads from a replacement reader and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// replayKey marks replayed requests, which are never captured again
+type replayKey struct{}
+
+// ReplayResult summarizes a replay
+type ReplayResult struct {
+	Requests int
+	Errors   int
+	Statuses map[int]int
+}
+
+// Replay sends the requests of a capture file to handler, one at a time, and counts the
+// response statuses. Use TargetGroupHandler to replay against a target group, or a
+// reverse proxy to replay against a server.
+func Replay(ctx context.Context, capture io.Reader, handler http.Handler) (ReplayResult, error) {
+	result := ReplayResult{Statuses: make(map[int]int)}
+	ctx = context.WithValue(ctx, replayKey{}, true)
+	scanner := bufio.NewScanner(capture)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		var captured CapturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &captured); err != nil {
+			return result, fmt.Errorf("replay: line %d: %w", result.Requests+1, err)
+		}
+		result.Requests++
+
+		r, err := http.NewRequestWithContext(ctx, captured.Method, captured.URL, bytes.NewReader(captured.Body))
+		if err != nil {
+			result.Errors++
+			continue
+		}
+		r.Host = captured.Host
+		r.Header = captured.Header
+		if r.Header == nil {
+			r.Header = make(http.Header)
+		}
+		r.ContentLength = int64(len(captured.Body))
+		r.RemoteAddr = "127.0.0.1:0"
+
+		response := newBufferedResponse()
+		handler.ServeHTTP(response, r)
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+		result.Statuses[response.status]++
+		if response.status >= http.StatusInternalServerError {
+			result.Errors++
+		}
+	}
+	return result, scanner.Err()
+}
+
+// TargetGroupHandler returns a handler serving every request with a target group, whatever
+// its path
+func (lb *LoadBalancer) TargetGroupHandler(targetGroup *TargetGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.serveTargetGroup(w, withRequestID(lb.withClientIP(r)), targetGroup)
+	})
+}
@@ -0,0 +1,278 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertificateStore keeps the certificates of TLS listeners and reloads them from their
+// files, when Watch sees the files change or on Reload, so renewed certificates are served
+// without a restart. A certificate failing to load keeps the previous one in use.
+type CertificateStore struct {
+	mu    sync.Mutex
+	files map[[2]string]*CertificateFile
+}
+
+// CertificateFile is a certificate loaded from a PEM certificate and key file
+type CertificateFile struct {
+	CertFile string
+	KeyFile  string
+
+	certificate atomic.Pointer[tls.Certificate]
+
+	// mu serializes reloads from Watch and Reload, and OCSP stapling
+	mu      sync.Mutex
+	modTime time.Time
+
+	// stapled is the certificate with the current OCSP response, see StapleOCSP
+	stapled     *tls.Certificate
+	ocspRefresh time.Time
+	ocspExpires time.Time
+}
+
+// KeyPair names the PEM certificate and key files of a certificate
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// NewCertificateStore creates an empty CertificateStore
+func NewCertificateStore() *CertificateStore {
+	return &CertificateStore{files: make(map[[2]string]*CertificateFile)}
+}
+
+// WithCertificateStore lets the admin API reload the store's certificates:
+//
+//	POST /certificates/reload
+func WithCertificateStore(store *CertificateStore) Option {
+	return func(lb *LoadBalancer) {
+		lb.certificates = store
+	}
+}
+
+// Load loads a certificate and key into the store, or returns the one already loaded
+// from them
+func (s *CertificateStore) Load(certFile, keyFile string) (*CertificateFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]string{certFile, keyFile}
+	if file, ok := s.files[key]; ok {
+		return file, nil
+	}
+	file := &CertificateFile{CertFile: certFile, KeyFile: keyFile}
+	if err := file.load(); err != nil {
+		return nil, err
+	}
+	s.files[key] = file
+	return file, nil
+}
+
+// Reload loads all the store's certificates again
+func (s *CertificateStore) Reload() error {
+	var errs []error
+	for _, file := range s.list() {
+		if err := file.load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Watch reloads the certificates whose files changed every interval until ctx is done
+func (s *CertificateStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, file := range s.list() {
+			if file.changed() {
+				file.load()
+			}
+		}
+	}
+}
+
+func (s *CertificateStore) list() []*CertificateFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make([]*CertificateFile, 0, len(s.files))
+	for _, file := range s.files {
+		files = append(files, file)
+	}
+	return files
+}
+
+// Certificate returns the last certificate loaded from the files
+func (f *CertificateFile) Certificate() *tls.Certificate {
+	return f.certificate.Load()
+}
+
+// load reads the files, keeping the previous certificate if they are invalid
+func (f *CertificateFile) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	modTime := f.lastModified()
+	certificate, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		logger().Error("loading certificate failed", "cert_file", f.CertFile, "error", err)
+		return fmt.Errorf("%s: %w", f.CertFile, err)
+	}
+	if certificate.Leaf == nil {
+		certificate.Leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+	}
+	previous := f.certificate.Swap(&certificate)
+	f.modTime = modTime
+	if previous != nil && certificate.Leaf != nil {
+		logger().Info("certificate reloaded", "cert_file", f.CertFile, "not_after", certificate.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// changed reports whether the files were modified since they were last loaded
+func (f *CertificateFile) changed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return !f.lastModified().Equal(f.modTime)
+}
+
+// lastModified returns the latest modification time of the files
+func (f *CertificateFile) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{f.CertFile, f.KeyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// handleCertificateReload reloads the certificates of the TLS listeners from their files:
+//
+//	POST /certificates/reload
+func (lb *LoadBalancer) handleCertificateReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if lb.certificates == nil {
+		http.Error(w, "No certificates to reload", http.StatusNotFound)
+		return
+	}
+	if err := lb.certificates.Reload(); err != nil {
+		lb.audit.recordRequest(r, "certificates.reload", "failed: "+err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lb.audit.recordRequest(r, "certificates.reload")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// getCertificate loads the listener's certificates and returns a tls.Config.GetCertificate
+// function choosing among them, or nil if the listener doesn't terminate TLS
+func (config ListenerConfig) getCertificate() (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	pairs := config.KeyPairs
+	if config.CertFile != "" || config.KeyFile != "" {
+		pairs = append([]KeyPair{{CertFile: config.CertFile, KeyFile: config.KeyFile}}, pairs...)
+	}
+	if len(pairs) == 0 && len(config.Certificates) == 0 {
+		return nil, nil
+	}
+	store := config.CertificateStore
+	if store == nil {
+		store = NewCertificateStore()
+	}
+	var certificates []func() *tls.Certificate
+	for _, pair := range pairs {
+		file, err := store.Load(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, file.Certificate)
+	}
+	for _, certificate := range config.Certificates {
+		certificate := certificate
+		if certificate.Leaf == nil {
+			certificate.Leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+		}
+		certificates = append(certificates, func() *tls.Certificate { return &certificate })
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return selectCertificate(hello, certificates), nil
+	}, nil
+}
+
+// selectCertificate returns the first certificate for the exact SNI name, else the first
+// one valid for it, like a wildcard, else the default first certificate
+func selectCertificate(hello *tls.ClientHelloInfo, certificates []func() *tls.Certificate) *tls.Certificate {
+	if hello.ServerName != "" {
+		var wildcard *tls.Certificate
+		for _, get := range certificates {
+			certificate := get()
+			if hello.SupportsCertificate(certificate) != nil {
+				continue
+			}
+			if certificate.Leaf != nil && hasName(certificate.Leaf, hello.ServerName) {
+				return certificate
+			}
+			if wildcard == nil {
+				wildcard = certificate
+			}
+		}
+		if wildcard != nil {
+			return wildcard
+		}
+	}
+	return certificates[0]()
+}
+
+// hasName reports whether the certificate lists name itself rather than a matching wildcard
+func hasName(leaf *x509.Certificate, name string) bool {
+	for _, dnsName := range leaf.DNSNames {
+		if strings.EqualFold(dnsName, strings.TrimSuffix(name, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCertificates reads the certificates of a PEM file, like a CA bundle
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	return certificates, nil
+}
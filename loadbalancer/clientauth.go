@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ClientAuthConfig makes a TLS listener verify client certificates, for services only
+// other trusted services may reach
+type ClientAuthConfig struct {
+	// CAFile holds the PEM certificates of the CAs client certificates must be issued by
+	CAFile string
+
+	// Optional lets clients without certificates connect, for listeners where only some
+	// routes require them, see RequireClientCertificate. Certificates clients present are
+	// verified all the same.
+	Optional bool
+
+	// CRLFiles are PEM or DER revocation lists of the CAs; certificates they revoke are
+	// refused. They are read when the listener starts.
+	CRLFiles []string
+
+	// AllowedNames limits the accepted certificates to those with one of the names as
+	// their common name or a DNS name; any certificate from the CAs is accepted if empty
+	AllowedNames []string
+}
+
+// apply sets up the TLS configuration to verify client certificates
+func (config *ClientAuthConfig) apply(tlsConfig *tls.Config) error {
+	cas, err := readCertificates(config.CAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	revoked, err := loadRevocationLists(config.CRLFiles, cas)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.Optional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	allowed := config.AllowedNames
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		leaf := state.PeerCertificates[0]
+		if revoked[string(leaf.RawIssuer)][leaf.SerialNumber.String()] {
+			return errors.New("client certificate is revoked")
+		}
+		if len(allowed) > 0 && !certificateHasName(leaf, allowed) {
+			return fmt.Errorf("client certificate %q isn't allowed", leaf.Subject.CommonName)
+		}
+		return nil
+	}
+	return nil
+}
+
+// loadRevocationLists reads CRLs signed by the CAs, returning the revoked serial numbers
+// by the raw subject of their issuer
+func loadRevocationLists(paths []string, cas []*x509.Certificate) (map[string]map[string]bool, error) {
+	revoked := make(map[string]map[string]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		i := slices.IndexFunc(cas, func(ca *x509.Certificate) bool { return bytes.Equal(ca.RawSubject, list.RawIssuer) })
+		if i < 0 {
+			return nil, fmt.Errorf("%s: not issued by a client CA", path)
+		}
+		if err := list.CheckSignatureFrom(cas[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		serials := revoked[string(list.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(list.RawIssuer)] = serials
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+	return revoked, nil
+}
+
+// certificateHasName reports whether one of the names is the certificate's common name or
+// one of its DNS names
+func certificateHasName(certificate *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if name == certificate.Subject.CommonName || slices.Contains(certificate.DNSNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireClientCertificate returns middleware refusing requests without a verified client
+// certificate with 403 Forbidden, for routes of listeners whose ClientAuthConfig is
+// Optional. If names are given, the certificate must have one of them, see
+// ClientAuthConfig.AllowedNames.
+func RequireClientCertificate(names ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				http.Error(w, "Client certificate required", http.StatusForbidden)
+				return
+			}
+			if len(names) > 0 && !certificateHasName(r.TLS.VerifiedChains[0][0], names) {
+				http.Error(w, "Client certificate not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientCertHeader is the header telling backends about the client's verified certificate
+const clientCertHeader = "X-Forwarded-Client-Cert"
+
+// forwardClientCert replaces the X-Forwarded-Client-Cert header clients send, which
+// backends can't trust, with the details of the client certificate verified by the
+// listener, if any, in Envoy's format:
+//
+//	Hash=<SHA-256 of the DER certificate>;Subject="CN=svc,O=example";URI=spiffe://...;DNS=svc.example.com
+func forwardClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(clientCertHeader)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			r.Header.Set(clientCertHeader, clientCertDetails(r.TLS.VerifiedChains[0][0]))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertDetails formats an X-Forwarded-Client-Cert element for the certificate
+func clientCertDetails(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.Raw)
+	fields := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Subject=" + quoteClientCertValue(certificate.Subject.String()),
+	}
+	for _, uri := range certificate.URIs {
+		fields = append(fields, "URI="+quoteClientCertValue(uri.String()))
+	}
+	for _, name := range certificate.DNSNames {
+		fields = append(fields, "DNS="+quoteClientCertValue(name))
+	}
+	return strings.Join(fields, ";")
+}
+
+// quoteClientCertValue quotes values containing the separators of the header
+func quoteClientCertValue(value string) string {
+	if !strings.ContainsAny(value, `,;="\`) {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ClientIP returns the address of the client that sent the request. Behind trusted proxies
+// (see WithTrustedProxies) it is taken from X-Forwarded-For, otherwise it is the peer address.
+func ClientIP(r *http.Request) netip.Addr {
+	if ip, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address of the connection's peer
+func remoteIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, _ := netip.ParseAddr(host)
+	return ip.Unmap()
+}
+
+// withClientIP resolves the client address, skipping trusted proxies, and stores it in the request context
+func (lb *LoadBalancer) withClientIP(r *http.Request) *http.Request {
+	ip := remoteIP(r)
+	if lb.trustedProxy(ip) {
+		// Walk X-Forwarded-For from the nearest hop until an untrusted address is found
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			ip = hop.Unmap()
+			if !lb.trustedProxy(ip) {
+				break
+			}
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+func (lb *LoadBalancer) trustedProxy(ip netip.Addr) bool {
+	return containsAddr(lb.trustedProxies, ip)
+}
+
+// containsAddr reports whether any of the prefixes contains ip
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses CIDR prefixes; plain addresses are treated as single-address prefixes
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,240 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressionConfig configures response compression for backends that don't compress themselves
+type CompressionConfig struct {
+	// MinSize is the smallest response body, in bytes, that gets compressed. Defaults to 1024.
+	MinSize int
+
+	// ContentTypes lists the media types to compress. A trailing "/*" matches a whole
+	// type, e.g. "text/*". Defaults to common textual types.
+	ContentTypes []string
+
+	// Level is the compression level passed to the encoder; zero uses the encoder's default
+	Level int
+}
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Compress returns middleware that compresses responses with brotli or gzip based on the
+// client's Accept-Encoding header
+func Compress(config CompressionConfig) Middleware {
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = defaultCompressibleTypes
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, config: &config, status: http.StatusOK}
+			defer cw.Close()
+
+			// Let the backend send identity-encoded responses we can compress
+			r.Header.Del("Accept-Encoding")
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks brotli or gzip from an Accept-Encoding header, preferring brotli
+func negotiateEncoding(acceptEncoding string) string {
+	var gzipOK, brotliOK bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "br":
+			brotliOK = true
+		case "gzip":
+			gzipOK = true
+		}
+	}
+	switch {
+	case brotliOK:
+		return "br"
+	case gzipOK:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter buffers the start of a response until it knows whether to compress it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	config   *CompressionConfig
+	status   int
+
+	buf         []byte
+	encoder     io.WriteCloser
+	passthrough bool
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status < http.StatusOK {
+		// Informational responses are forwarded as is
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if !cw.compressible() {
+		cw.startPassthrough()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(p)
+	case cw.encoder != nil:
+		return cw.encoder.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.config.MinSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends buffered data to the client so streamed responses aren't held back.
+// A response that is still being buffered starts being compressed right away.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.passthrough && cw.encoder == nil {
+		if err := cw.startCompression(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close finishes the response, writing out anything still buffered
+func (cw *compressWriter) Close() error {
+	if !cw.wroteHeader {
+		return nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	if !cw.passthrough {
+		// The body stayed below MinSize
+		cw.startPassthrough()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// compressible reports whether the response headers allow compression
+func (cw *compressWriter) compressible() bool {
+	if cw.status == http.StatusNoContent || cw.status == http.StatusNotModified || cw.status == http.StatusPartialContent {
+		return false
+	}
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < cw.config.MinSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cw.config.ContentTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *compressWriter) startPassthrough() {
+	cw.passthrough = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) startCompression() error {
+	header := cw.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", cw.encoding)
+	header.Add("Vary", "Accept-Encoding")
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	switch cw.encoding {
+	case "br":
+		level := brotli.DefaultCompression
+		if cw.config.Level != 0 {
+			level = cw.config.Level
+		}
+		cw.encoder = brotli.NewWriterLevel(cw.ResponseWriter, level)
+	default:
+		level := gzip.DefaultCompression
+		if cw.config.Level != 0 {
+			level = cw.config.Level
+		}
+		encoder, err := gzip.NewWriterLevel(cw.ResponseWriter, level)
+		if err != nil {
+			return err
+		}
+		cw.encoder = encoder
+	}
+
+	_, err := cw.encoder.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
@@ -0,0 +1,2024 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written in configuration files as a string like "1m30s"
+// or as a number of seconds
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if seconds, err := strconv.ParseFloat(string(data), 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the JSON configuration file format of the load balancer
+type Config struct {
+	Listen ListenerSpec `json:"listen"`
+	Admin  ListenerSpec `json:"admin"`
+
+	// Listeners are additional named listeners serving the load balancer, e.g. on an
+	// internal interface, that target groups can be bound to
+	Listeners []ListenerSpec `json:"listeners"`
+
+	// Passthrough listeners route TLS connections to backends by server name without
+	// terminating them
+	Passthrough []PassthroughSpec `json:"passthrough"`
+
+	// AdminAuth protects the admin listener and enables profiling endpoints on it
+	AdminAuth *AdminAuthSpec `json:"admin_auth"`
+
+	// HealthCheck is the default health check path for all servers
+	HealthCheck string `json:"health_check"`
+
+	// BalancerSpec selects the balancer of groups without their own, round_robin by default
+	BalancerSpec
+
+	// WeightTuning adjusts server weights from their error rates and latencies when set
+	WeightTuning *WeightTuningSpec `json:"weight_tuning"`
+
+	TrustedProxies []string       `json:"trusted_proxies"`
+	GeoIP          *GeoIPSpec     `json:"geoip"`
+	Transport      *TransportSpec `json:"transport"`
+
+	// DNSCache resolves server host names with a cache honoring record TTLs when set
+	DNSCache *DNSCacheSpec `json:"dns_cache"`
+
+	// Servers make up the default target group, which serves unmatched requests
+	Servers []ServerSpec `json:"servers"`
+
+	// UnmatchedResponse answers requests matching no target group, 404 by default
+	UnmatchedResponse *ErrorResponseSpec `json:"unmatched_response"`
+
+	// UnavailableResponse answers requests whose group has no healthy server, 503 by default
+	UnavailableResponse *ErrorResponseSpec `json:"unavailable_response"`
+
+	// Middleware runs, in order, for every request
+	Middleware []MiddlewareSpec `json:"middleware"`
+
+	TargetGroups []TargetGroupSpec `json:"target_groups"`
+
+	// VirtualHosts route requests for their hosts with their own target groups instead
+	VirtualHosts []VirtualHostSpec `json:"virtual_hosts"`
+
+	// StatsD exports metrics to a StatsD or DogStatsD agent as well as on the admin listener
+	StatsD *StatsDSpec `json:"statsd"`
+
+	// AccessLog writes a line for every request when set
+	AccessLog *AccessLogSpec `json:"access_log"`
+
+	// Tracing propagates trace context headers to backends when set
+	Tracing *TracingSpec `json:"tracing"`
+
+	// ErrorLog configures the load balancer's own log messages, written to standard error
+	// by default
+	ErrorLog *ErrorLogSpec `json:"error_log"`
+
+	// Tenants are teams sharing the load balancer, each with its own hosts and limits
+	Tenants []TenantSpec `json:"tenants"`
+}
+
+// ErrorResponseSpec configures a response of the load balancer itself in a configuration file
+type ErrorResponseSpec struct {
+	Status      int      `json:"status"`
+	Body        string   `json:"body"`
+	ContentType string   `json:"content_type"`
+	RetryAfter  Duration `json:"retry_after"`
+}
+
+// errorResponse converts the specification, using defaults for the status and body, or
+// the status text for the body of other statuses
+func (spec *ErrorResponseSpec) errorResponse(defaults ErrorResponse) (ErrorResponse, error) {
+	response := ErrorResponse{
+		Status:      spec.Status,
+		Body:        spec.Body,
+		ContentType: spec.ContentType,
+		RetryAfter:  time.Duration(spec.RetryAfter),
+	}
+	if response.Status == 0 {
+		response.Status = defaults.Status
+	}
+	if response.Status < 400 || response.Status > 599 {
+		return ErrorResponse{}, fmt.Errorf("status must be from 400 to 599")
+	}
+	switch {
+	case response.Body != "":
+	case response.Status == defaults.Status:
+		response.Body = defaults.Body
+	default:
+		response.Body = http.StatusText(response.Status) + "\n"
+	}
+	return response, nil
+}
+
+// TenantSpec configures a tenant in a configuration file. A tenant's routes are its virtual
+// hosts, whose target group names only need to be unique within the tenant. Its middleware,
+// like rate limits, applies to all of its routes together. Its certificates are served on
+// the TLS listeners for the names they are valid for.
+type TenantSpec struct {
+	Name            string            `json:"name"`
+	AdminTokenFiles []string          `json:"admin_token_files"`
+	VirtualHosts    []VirtualHostSpec `json:"virtual_hosts"`
+	Middleware      []MiddlewareSpec  `json:"middleware"`
+	Certificates    []CertificateSpec `json:"certificates"`
+}
+
+// CertificateSpec is a PEM certificate and key in a configuration file. The key may be given
+// as a Secret instead of a file; it is resolved once, when the certificate is loaded.
+type CertificateSpec struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	Key      Secret `json:"key"`
+}
+
+// TenantCertificates loads the certificates of every tenant
+func (config *Config) TenantCertificates() ([]tls.Certificate, error) {
+	var certificates []tls.Certificate
+	for _, tenant := range config.Tenants {
+		for _, spec := range tenant.Certificates {
+			certificate, err := spec.certificate()
+			if err != nil {
+				return nil, fmt.Errorf("config: tenant %q: %w", tenant.Name, err)
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	return certificates, nil
+}
+
+// certificate loads the certificate and its key
+func (spec CertificateSpec) certificate() (tls.Certificate, error) {
+	if spec.Key == "" {
+		return tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+	}
+	certPEM, err := os.ReadFile(spec.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := spec.Key.Resolve()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, []byte(key))
+}
+
+// BalancerSpec selects a balancer in a configuration file, for all target groups or one
+type BalancerSpec struct {
+	// Balancer is the name of a registered balancer
+	Balancer string `json:"balancer"`
+
+	// HashKey is the request key of hash balancers like rendezvous, see ParseHashKey
+	HashKey string `json:"hash_key"`
+
+	// MaglevTableSize is the lookup table size of the maglev balancer, a prime
+	MaglevTableSize int `json:"maglev_table_size"`
+
+	// HashLoadFactor bounds the load of each server of the consistent_hash balancer to this
+	// factor of the average, e.g. 1.25. Zero means no bound.
+	HashLoadFactor float64 `json:"hash_load_factor"`
+}
+
+// newBalancer returns the constructor of the balancer, or nil if none is selected
+func (spec BalancerSpec) newBalancer() (func() Balancer, error) {
+	if spec.Balancer == "" {
+		return nil, nil
+	}
+	newBalancer, err := lookupBalancer(spec.Balancer)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Balancer == "maglev" && spec.MaglevTableSize != 0 {
+		if _, err := NewMaglev(spec.MaglevTableSize); err != nil {
+			return nil, err
+		}
+		newBalancer = func() Balancer {
+			m, _ := NewMaglev(spec.MaglevTableSize)
+			return m
+		}
+	}
+	if spec.Balancer == "consistent_hash" && spec.HashLoadFactor != 0 {
+		if spec.HashLoadFactor < 1 {
+			return nil, fmt.Errorf("hash_load_factor must be at least 1")
+		}
+		newBalancer = func() Balancer { return NewConsistentHash(0, spec.HashLoadFactor) }
+	}
+	return newBalancer, nil
+}
+
+// hashKey returns the request key of hash balancers, or nil if none is set
+func (spec BalancerSpec) hashKey() (func(*http.Request) string, error) {
+	if spec.HashKey == "" {
+		return nil, nil
+	}
+	return ParseHashKey(spec.HashKey)
+}
+
+// WeightTuningSpec configures automatic weight tuning in a configuration file
+type WeightTuningSpec struct {
+	Interval  Duration `json:"interval"`
+	MinWeight int      `json:"min_weight"`
+	MaxWeight int      `json:"max_weight"`
+}
+
+// TracingSpec configures trace context propagation in a configuration file
+type TracingSpec struct {
+	Sampled bool `json:"sampled"`
+
+	// B3 lists the B3 formats, single and multi, sent to every backend
+	B3 []B3Format `json:"b3"`
+}
+
+// ErrorLogSpec configures the error log in a configuration file
+type ErrorLogSpec struct {
+	// Level is debug, info, warn or error, info by default
+	Level string `json:"level"`
+
+	// Format is text or json, text by default
+	Format string `json:"format"`
+
+	// Path appends messages to a file instead of standard error. The file is reopened on
+	// SIGUSR1, so it can be rotated by logrotate.
+	Path string `json:"path"`
+
+	// Syslog sends messages to a syslog server instead of standard error
+	Syslog *SyslogSpec `json:"syslog"`
+}
+
+// SyslogSpec configures a syslog output in a configuration file
+type SyslogSpec struct {
+	Network  string `json:"network"`
+	Addr     string `json:"addr"`
+	Facility string `json:"facility"`
+	Severity string `json:"severity"`
+	AppName  string `json:"app_name"`
+}
+
+// AccessLogSpec configures the access log in a configuration file
+type AccessLogSpec struct {
+	// Format is common, combined, json or a template; see AccessLogConfig
+	Format string `json:"format"`
+
+	// Path is the file lines are appended to, standard output by default
+	Path string `json:"path"`
+
+	// Syslog sends lines to a syslog server instead of a file
+	Syslog *SyslogSpec `json:"syslog"`
+
+	// Conditional logs only errors, slow requests and a sample of the others; see
+	// AccessLogConfig
+	Conditional   bool     `json:"conditional"`
+	ErrorStatus   int      `json:"error_status"`
+	SlowThreshold Duration `json:"slow_threshold"`
+	SampleRate    float64  `json:"sample_rate"`
+
+	// The file is rotated when it grows beyond MaxSizeMB megabytes or gets older than
+	// MaxAge, keeping MaxBackups rotated files, gzipped if Compress is set
+	MaxSizeMB  int64    `json:"max_size_mb"`
+	MaxAge     Duration `json:"max_age"`
+	MaxBackups int      `json:"max_backups"`
+	Compress   bool     `json:"compress"`
+}
+
+// StatsDSpec configures the StatsD exporter in a configuration file
+type StatsDSpec struct {
+	Addr      string   `json:"addr"`
+	Prefix    string   `json:"prefix"`
+	Tags      []string `json:"tags"`
+	DogStatsD bool     `json:"dogstatsd"`
+	Interval  Duration `json:"interval"`
+}
+
+// ListenerSpec configures a listener in a configuration file
+type ListenerSpec struct {
+	Name              string   `json:"name"`
+	Addr              string   `json:"addr"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+	MaxHeaderCount    int      `json:"max_header_count"`
+	CertFile          string   `json:"cert_file"`
+	KeyFile           string   `json:"key_file"`
+
+	// Certificates are served besides CertFile by SNI, see ListenerConfig.KeyPairs
+	Certificates []CertificateSpec `json:"certificates"`
+
+	TLS            *TLSPolicySpec      `json:"tls"`
+	SessionTickets *SessionTicketsSpec `json:"session_tickets"`
+	ClientAuth     *ClientAuthSpec     `json:"client_auth"`
+
+	ClientLimits *ClientLimitsSpec `json:"client_limits"`
+}
+
+// TLSPolicySpec configures a listener's TLS policy in a configuration file, by the names of
+// the version, cipher suites and curves, e.g. "min_version": "1.2"
+type TLSPolicySpec struct {
+	MinVersion   string   `json:"min_version"`
+	CipherSuites []string `json:"cipher_suites"`
+	Curves       []string `json:"curves"`
+	ALPN         []string `json:"alpn"`
+}
+
+// ClientAuthSpec configures client certificate verification in a configuration file
+type ClientAuthSpec struct {
+	CAFile       string   `json:"ca_file"`
+	Optional     bool     `json:"optional"`
+	CRLFiles     []string `json:"crl_files"`
+	AllowedNames []string `json:"allowed_names"`
+}
+
+// SessionTicketsSpec configures TLS session ticket key rotation in a configuration file
+type SessionTicketsSpec struct {
+	RotationInterval Duration `json:"rotation_interval"`
+	Keys             int      `json:"keys"`
+	KeyFile          string   `json:"key_file"`
+}
+
+// ClientLimitsSpec configures per-client connection limits in a configuration file
+type ClientLimitsSpec struct {
+	MaxConnections       int            `json:"max_connections"`
+	ConnectionsPerSecond float64        `json:"connections_per_second"`
+	Burst                int            `json:"burst"`
+	Exempt               []netip.Prefix `json:"exempt"`
+}
+
+// PassthroughSpec configures a TLS passthrough listener in a configuration file
+type PassthroughSpec struct {
+	Addr             string                 `json:"addr"`
+	Routes           []PassthroughRouteSpec `json:"routes"`
+	DefaultBackends  []string               `json:"default_backends"`
+	HandshakeTimeout Duration               `json:"handshake_timeout"`
+	DialTimeout      Duration               `json:"dial_timeout"`
+
+	ClientLimits *ClientLimitsSpec `json:"client_limits"`
+}
+
+// PassthroughRouteSpec configures a TLS passthrough route in a configuration file
+type PassthroughRouteSpec struct {
+	Hosts    []string `json:"hosts"`
+	Backends []string `json:"backends"`
+}
+
+// AdminAuthSpec configures admin authentication in a configuration file: bearer tokens,
+// read from files or given as secrets so they stay out of the configuration, or an
+// htpasswd file
+type AdminAuthSpec struct {
+	TokenFiles []string `json:"token_files"`
+	Tokens     []Secret `json:"tokens"`
+	Htpasswd   string   `json:"htpasswd"`
+}
+
+// GeoIPSpec configures the GeoIP database in a configuration file
+type GeoIPSpec struct {
+	Database       string   `json:"database"`
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// TransportSpec configures an upstream transport in a configuration file
+type TransportSpec struct {
+	DialTimeout           Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	MaxIdleConns          int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int      `json:"max_conns_per_host"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`
+	KeepAlive             Duration `json:"keep_alive"`
+	DisableKeepAlives     bool     `json:"disable_keep_alives"`
+	Proxy                 string   `json:"proxy"`
+	NoProxy               string   `json:"no_proxy"`
+	Dialer                string   `json:"dialer"`
+
+	// CAFile is a PEM bundle of the CAs verifying the servers' certificates
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// DNSCacheSpec configures the DNS cache in a configuration file
+type DNSCacheSpec struct {
+	MinTTL      Duration `json:"min_ttl"`
+	MaxTTL      Duration `json:"max_ttl"`
+	DefaultTTL  Duration `json:"default_ttl"`
+	NegativeTTL Duration `json:"negative_ttl"`
+}
+
+// ServerSpec configures a backend server in a configuration file
+type ServerSpec struct {
+	URL             string `json:"url"`
+	Name            string `json:"name"`
+	HealthCheckPath string `json:"health_check_path"`
+	Zone            string `json:"zone"`
+	Weight          int    `json:"weight"`
+}
+
+// VirtualHostSpec configures a virtual host in a configuration file. Its servers make up
+// the default group for requests matching none of its target groups.
+type VirtualHostSpec struct {
+	Hosts        []string          `json:"hosts"`
+	Servers      []ServerSpec      `json:"servers"`
+	TargetGroups []TargetGroupSpec `json:"target_groups"`
+}
+
+// TargetGroupSpec configures a target group in a configuration file. Groups without a path,
+// a match or listeners aren't routed to directly but can be referenced by name, e.g. from
+// geo routes.
+type TargetGroupSpec struct {
+	Name                string            `json:"name"`
+	Path                string            `json:"path"`
+	StripPrefix         bool              `json:"strip_prefix"`
+	Match               string            `json:"match"`
+	Listeners           []string          `json:"listeners"`
+	Servers             []ServerSpec      `json:"servers"`
+	Discovery           *DiscoverySpec    `json:"discovery"`
+	FlushInterval       Duration          `json:"flush_interval"`
+	MaxRequestBodyBytes int64             `json:"max_request_body_bytes"`
+	SubsetSize          int               `json:"subset_size"`
+	HedgeDelay          Duration          `json:"hedge_delay"`
+	Retries             int               `json:"retries"`
+	RetryNonIdempotent  bool              `json:"retry_non_idempotent"`
+	BufferResponses     bool              `json:"buffer_responses"`
+	MaxBufferedBytes    int64             `json:"max_buffered_bytes"`
+	Transport           *TransportSpec    `json:"transport"`
+	Headers             *HeaderRulesSpec  `json:"headers"`
+	Static              *StaticSpec       `json:"static"`
+	Redirect            *RedirectSpec     `json:"redirect"`
+	StatusMap           []StatusMapSpec   `json:"status_map"`
+	UpstreamAuth        *UpstreamAuthSpec `json:"upstream_auth"`
+	Sticky              *StickySpec       `json:"sticky"`
+
+	// BalancerSpec selects the group's own balancer
+	BalancerSpec
+
+	// Middleware runs, in order, for requests routed to the group
+	Middleware []MiddlewareSpec `json:"middleware"`
+}
+
+// StaticSpec configures static file serving in a configuration file
+type StaticSpec struct {
+	Root     string   `json:"root"`
+	Index    []string `json:"index"`
+	Fallback string   `json:"fallback"`
+	MaxAge   Duration `json:"max_age"`
+}
+
+// StickySpec configures sticky sessions in a configuration file. Key is a request key like
+// the balancers' hash_key, e.g. cookie:session.
+type StickySpec struct {
+	Key string   `json:"key"`
+	TTL Duration `json:"ttl"`
+}
+
+// RedirectSpec configures a redirecting target group in a configuration file
+type RedirectSpec struct {
+	Target string `json:"target"`
+	Status int    `json:"status"`
+}
+
+// UpstreamAuthSpec configures the credential added to requests forwarded to a target
+// group in a configuration file. Type is bearer, basic or header; the token, password or
+// header value is read from File or the environment variable Env, or given as a Secret, so
+// it stays out of the configuration.
+type UpstreamAuthSpec struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Header   string `json:"header"`
+	File     string `json:"file"`
+	Env      string `json:"env"`
+	Value    Secret `json:"value"`
+}
+
+// StatusMapSpec configures a status mapping in a configuration file
+type StatusMapSpec struct {
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+// HeaderRulesSpec configures header rules in a configuration file
+type HeaderRulesSpec struct {
+	Request  []HeaderRuleSpec `json:"request"`
+	Response []HeaderRuleSpec `json:"response"`
+}
+
+// HeaderRuleSpec configures a header rule in a configuration file
+type HeaderRuleSpec struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+
+	// Expr is an expression computing the value; When is an expression limiting the rule
+	// to matching requests
+	Expr string `json:"expr"`
+	When string `json:"when"`
+}
+
+// MiddlewareSpec is a middleware entry in a configuration file: an object with a "type"
+// and the type's parameters
+type MiddlewareSpec struct {
+	Type   string
+	Params json.RawMessage
+}
+
+// UnmarshalJSON reads the type and keeps the whole object as the parameters
+func (m *MiddlewareSpec) UnmarshalJSON(data []byte) error {
+	return unmarshalTyped(data, "middleware", &m.Type, &m.Params)
+}
+
+// MarshalJSON writes the middleware entry back as a single object
+func (m MiddlewareSpec) MarshalJSON() ([]byte, error) {
+	return m.Params, nil
+}
+
+// DiscoverySpec is a service discovery entry in a configuration file: an object with the
+// "type" of a registered discovery and its parameters
+type DiscoverySpec struct {
+	Type   string
+	Params json.RawMessage
+}
+
+// UnmarshalJSON reads the type and keeps the whole object as the parameters
+func (d *DiscoverySpec) UnmarshalJSON(data []byte) error {
+	return unmarshalTyped(data, "discovery", &d.Type, &d.Params)
+}
+
+// MarshalJSON writes the discovery entry back as a single object
+func (d DiscoverySpec) MarshalJSON() ([]byte, error) {
+	return d.Params, nil
+}
+
+func unmarshalTyped(data []byte, kind string, typ *string, params *json.RawMessage) error {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	if typed.Type == "" {
+		return fmt.Errorf("%s entry without a type: %s", kind, data)
+	}
+	*typ = typed.Type
+	*params = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// LoadConfig reads a JSON configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a JSON configuration, rejecting unknown fields
+func ParseConfig(data []byte) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return config, nil
+}
+
+// PassthroughConfig converts the passthrough listener specification
+func (spec PassthroughSpec) PassthroughConfig() PassthroughConfig {
+	config := PassthroughConfig{
+		Addr:             spec.Addr,
+		DefaultBackends:  spec.DefaultBackends,
+		HandshakeTimeout: time.Duration(spec.HandshakeTimeout),
+		DialTimeout:      time.Duration(spec.DialTimeout),
+		ClientLimits:     spec.ClientLimits.clientLimits(),
+	}
+	for _, route := range spec.Routes {
+		config.Routes = append(config.Routes, PassthroughRoute{Hosts: route.Hosts, Backends: route.Backends})
+	}
+	return config
+}
+
+// clientLimits converts the limits, nil if unset
+func (spec *ClientLimitsSpec) clientLimits() *ClientLimits {
+	if spec == nil {
+		return nil
+	}
+	return &ClientLimits{
+		MaxConnections:       spec.MaxConnections,
+		ConnectionsPerSecond: spec.ConnectionsPerSecond,
+		Burst:                spec.Burst,
+		Exempt:               spec.Exempt,
+	}
+}
+
+// tlsPolicy parses the policy's names
+func (spec *TLSPolicySpec) tlsPolicy() (TLSPolicy, error) {
+	policy := TLSPolicy{NextProtos: spec.ALPN}
+	if spec.MinVersion != "" {
+		version, err := ParseTLSVersion(spec.MinVersion)
+		if err != nil {
+			return TLSPolicy{}, err
+		}
+		policy.MinVersion = version
+	}
+	for _, name := range spec.CipherSuites {
+		suite, err := ParseCipherSuite(name)
+		if err != nil {
+			return TLSPolicy{}, err
+		}
+		policy.CipherSuites = append(policy.CipherSuites, suite)
+	}
+	for _, name := range spec.Curves {
+		curve, err := ParseCurve(name)
+		if err != nil {
+			return TLSPolicy{}, err
+		}
+		policy.CurvePreferences = append(policy.CurvePreferences, curve)
+	}
+	return policy, nil
+}
+
+// upstreamAuth reads the credential
+func (spec *UpstreamAuthSpec) upstreamAuth() (*UpstreamAuth, error) {
+	sources := 0
+	for _, source := range []string{spec.File, spec.Env, string(spec.Value)} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("file, env and value are exclusive")
+	}
+	var secret string
+	switch {
+	case spec.File != "":
+		data, err := os.ReadFile(spec.File)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(data))
+	case spec.Env != "":
+		value, ok := os.LookupEnv(spec.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", spec.Env)
+		}
+		secret = value
+	case spec.Value != "":
+		value, err := spec.Value.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		secret = value
+	default:
+		return nil, fmt.Errorf("one of file, env or value is required")
+	}
+	switch spec.Type {
+	case "bearer":
+		return BearerUpstreamAuth(secret), nil
+	case "basic":
+		if spec.Username == "" {
+			return nil, fmt.Errorf("basic auth needs a username")
+		}
+		return BasicUpstreamAuth(spec.Username, secret), nil
+	case "header":
+		if spec.Header == "" {
+			return nil, fmt.Errorf("header auth needs a header")
+		}
+		return &UpstreamAuth{Header: spec.Header, Value: secret}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q, want bearer, basic or header", spec.Type)
+	}
+}
+
+// ListenerConfig converts the listener specification; addr is used if it doesn't set one.
+// Certificates with a Secret key are loaded, failing if a key can't be resolved.
+func (spec ListenerSpec) ListenerConfig(addr string) (ListenerConfig, error) {
+	config := DefaultListenerConfig(addr)
+	config.Name = spec.Name
+	if spec.Addr != "" {
+		config.Addr = spec.Addr
+	}
+	if spec.ReadHeaderTimeout != 0 {
+		config.ReadHeaderTimeout = time.Duration(spec.ReadHeaderTimeout)
+	}
+	if spec.ReadTimeout != 0 {
+		config.ReadTimeout = time.Duration(spec.ReadTimeout)
+	}
+	if spec.WriteTimeout != 0 {
+		config.WriteTimeout = time.Duration(spec.WriteTimeout)
+	}
+	if spec.IdleTimeout != 0 {
+		config.IdleTimeout = time.Duration(spec.IdleTimeout)
+	}
+	config.MaxHeaderBytes = spec.MaxHeaderBytes
+	config.MaxHeaderCount = spec.MaxHeaderCount
+	config.CertFile = spec.CertFile
+	config.KeyFile = spec.KeyFile
+	for _, certificate := range spec.Certificates {
+		if certificate.Key == "" {
+			config.KeyPairs = append(config.KeyPairs, KeyPair{CertFile: certificate.CertFile, KeyFile: certificate.KeyFile})
+			continue
+		}
+		loaded, err := certificate.certificate()
+		if err != nil {
+			return ListenerConfig{}, fmt.Errorf("config: listener %q: %s: %w", spec.Name, certificate.CertFile, err)
+		}
+		config.Certificates = append(config.Certificates, loaded)
+	}
+	if spec.TLS != nil {
+		// NewFromConfig rejects configurations with invalid policies
+		policy, _ := spec.TLS.tlsPolicy()
+		config.TLS = &policy
+	}
+	if spec.ClientAuth != nil {
+		config.ClientAuth = &ClientAuthConfig{
+			CAFile:       spec.ClientAuth.CAFile,
+			Optional:     spec.ClientAuth.Optional,
+			CRLFiles:     spec.ClientAuth.CRLFiles,
+			AllowedNames: spec.ClientAuth.AllowedNames,
+		}
+	}
+	if spec.SessionTickets != nil {
+		config.SessionTickets = &SessionTicketConfig{
+			RotationInterval: time.Duration(spec.SessionTickets.RotationInterval),
+			Keys:             spec.SessionTickets.Keys,
+			KeyFile:          spec.SessionTickets.KeyFile,
+		}
+	}
+	config.ClientLimits = spec.ClientLimits.clientLimits()
+	return config, nil
+}
+
+func (spec *AdminAuthSpec) middleware() (Middleware, error) {
+	switch {
+	case len(spec.TokenFiles) > 0 || len(spec.Tokens) > 0:
+		tokens, err := readTokenFiles(spec.TokenFiles)
+		if err != nil {
+			return nil, err
+		}
+		secrets, err := resolveSecrets(spec.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		return BearerTokenAuth(append(tokens, secrets...)...), nil
+	case spec.Htpasswd != "":
+		users, err := LoadHtpasswd(spec.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		return BasicAuth(BasicAuthConfig{Realm: "admin", Users: users}), nil
+	}
+	return nil, fmt.Errorf("one of token_files, tokens or htpasswd is required")
+}
+
+// readTokenFiles reads a token from each file
+func readTokenFiles(paths []string) ([]string, error) {
+	var tokens []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("%s is empty", path)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (spec *AccessLogSpec) accessLog() (*AccessLog, error) {
+	config := AccessLogConfig{
+		Format:        spec.Format,
+		Conditional:   spec.Conditional,
+		ErrorStatus:   spec.ErrorStatus,
+		SlowThreshold: time.Duration(spec.SlowThreshold),
+		SampleRate:    spec.SampleRate,
+	}
+	switch {
+	case spec.Syslog != nil && spec.Path != "":
+		return nil, fmt.Errorf("only one of path and syslog can be set")
+	case spec.Syslog != nil:
+		writer, err := DialSyslog(spec.Syslog.syslogConfig())
+		if err != nil {
+			return nil, err
+		}
+		config.Output = writer
+	case spec.Path != "":
+		file, err := OpenRotatingFile(RotatingFileConfig{
+			Path:       spec.Path,
+			MaxSize:    spec.MaxSizeMB << 20,
+			MaxAge:     time.Duration(spec.MaxAge),
+			MaxBackups: spec.MaxBackups,
+			Compress:   spec.Compress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		config.Output = file
+	}
+	accessLog, err := NewAccessLog(config)
+	if err != nil {
+		if closer, ok := config.Output.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return accessLog, nil
+}
+
+// errorLog is a configured error log, installed once the rest of the configuration is valid
+type errorLog struct {
+	level   *slog.Level
+	handler slog.Handler
+
+	// output is the log file or syslog connection, if any
+	output io.Closer
+}
+
+// errorLog opens the error log's output and creates its handler
+func (spec *ErrorLogSpec) errorLog() (*errorLog, error) {
+	var l errorLog
+	if spec.Level != "" {
+		level, err := ParseLogLevel(spec.Level)
+		if err != nil {
+			return nil, err
+		}
+		l.level = &level
+	}
+	if spec.Syslog != nil {
+		if spec.Path != "" {
+			return nil, fmt.Errorf("only one of path and syslog can be set")
+		}
+		writer, err := DialSyslog(spec.Syslog.syslogConfig())
+		if err != nil {
+			return nil, err
+		}
+		l.handler, l.output = NewSyslogHandler(writer), writer
+		return &l, nil
+	}
+	if spec.Format != "" && spec.Format != "text" && spec.Format != "json" {
+		return nil, fmt.Errorf("unknown format %q", spec.Format)
+	}
+	var output io.Writer = os.Stderr
+	if spec.Path != "" {
+		file, err := OpenRotatingFile(RotatingFileConfig{Path: spec.Path})
+		if err != nil {
+			return nil, err
+		}
+		output, l.output = file, file
+	}
+	if spec.Format == "json" {
+		l.handler = slog.NewJSONHandler(output, &slog.HandlerOptions{Level: slog.LevelDebug})
+	} else {
+		l.handler = slog.NewTextHandler(output, &slog.HandlerOptions{Level: slog.LevelDebug})
+	}
+	return &l, nil
+}
+
+// install sets the log level and handler, closing the output of the previous error log
+func (l *errorLog) install() {
+	if l.level != nil {
+		LogLevel.Set(*l.level)
+	}
+	SetLogHandler(l.handler)
+	setErrorLogOutput(l.output)
+}
+
+func (spec *SyslogSpec) syslogConfig() SyslogConfig {
+	return SyslogConfig{
+		Network:  spec.Network,
+		Addr:     spec.Addr,
+		Facility: spec.Facility,
+		Severity: spec.Severity,
+		AppName:  spec.AppName,
+	}
+}
+
+func (spec *TransportSpec) transportConfig() (TransportConfig, error) {
+	if spec.Proxy != "" && spec.Proxy != directProxy {
+		if _, err := ParseProxyURL(spec.Proxy); err != nil {
+			return TransportConfig{}, fmt.Errorf("proxy: %w", err)
+		}
+	}
+	if spec.Dialer != "" {
+		if _, err := lookupDialer(spec.Dialer); err != nil {
+			return TransportConfig{}, err
+		}
+	}
+	var rootCAs *x509.CertPool
+	if spec.CAFile != "" {
+		cas, err := readCertificates(spec.CAFile)
+		if err != nil {
+			return TransportConfig{}, fmt.Errorf("ca_file: %w", err)
+		}
+		rootCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			rootCAs.AddCert(ca)
+		}
+	}
+	return TransportConfig{
+		DialTimeout:           time.Duration(spec.DialTimeout),
+		TLSHandshakeTimeout:   time.Duration(spec.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(spec.ResponseHeaderTimeout),
+		MaxIdleConns:          spec.MaxIdleConns,
+		MaxIdleConnsPerHost:   spec.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       spec.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(spec.IdleConnTimeout),
+		KeepAlive:             time.Duration(spec.KeepAlive),
+		DisableKeepAlives:     spec.DisableKeepAlives,
+		Proxy:                 spec.Proxy,
+		NoProxy:               spec.NoProxy,
+		Dialer:                spec.Dialer,
+		RootCAs:               rootCAs,
+		ServerName:            spec.ServerName,
+		InsecureSkipVerify:    spec.InsecureSkipVerify,
+	}, nil
+}
+
+func (spec ServerSpec) server() (*Server, error) {
+	serverURL, err := url.Parse(spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL.Scheme == "" || serverURL.Host == "" {
+		return nil, fmt.Errorf("server URL %q must be absolute", spec.URL)
+	}
+	if spec.Weight < 0 || spec.Weight > maxWeight {
+		return nil, fmt.Errorf("server %q: weight must be from 0 to %d", spec.URL, maxWeight)
+	}
+	return &Server{URL: serverURL, Name: spec.Name, HealthCheckPath: spec.HealthCheckPath, Zone: spec.Zone, Weight: spec.Weight}, nil
+}
+
+func (spec *HeaderRulesSpec) headerRules() (HeaderRules, error) {
+	var rules HeaderRules
+	for _, list := range []struct {
+		specs []HeaderRuleSpec
+		rules *[]HeaderRule
+	}{{spec.Request, &rules.Request}, {spec.Response, &rules.Response}} {
+		for _, rule := range list.specs {
+			switch HeaderAction(rule.Action) {
+			case HeaderAdd, HeaderSet, HeaderRemove:
+			default:
+				return rules, fmt.Errorf("unknown header action %q", rule.Action)
+			}
+			headerRule := HeaderRule{Action: HeaderAction(rule.Action), Name: rule.Name, Value: rule.Value}
+			var err error
+			if rule.Expr != "" {
+				if headerRule.ValueExpr, err = CompileExpr(rule.Expr); err != nil {
+					return rules, err
+				}
+			}
+			if rule.When != "" {
+				if headerRule.When, err = CompileExpr(rule.When); err != nil {
+					return rules, err
+				}
+			}
+			*list.rules = append(*list.rules, headerRule)
+		}
+	}
+	return rules, nil
+}
+
+// NewFromConfig creates a load balancer from a configuration. Extra options are applied after
+// the configuration's own.
+func NewFromConfig(config *Config, opts ...Option) (lb *LoadBalancer, err error) {
+	var options []Option
+
+	// What was opened for the configuration is closed again if it turns out invalid. The
+	// error log outlives the load balancer, until another one is installed.
+	var closers []io.Closer
+	var newErrorLog *errorLog
+	defer func() {
+		if err == nil {
+			return
+		}
+		if newErrorLog != nil && newErrorLog.output != nil {
+			newErrorLog.output.Close()
+		}
+		if lb != nil {
+			lb.Close()
+			return
+		}
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	if config.HealthCheck != "" {
+		options = append(options, WithHealthCheck(config.HealthCheck))
+	}
+	if config.AdminAuth != nil {
+		auth, err := config.AdminAuth.middleware()
+		if err != nil {
+			return nil, fmt.Errorf("config: admin_auth: %w", err)
+		}
+		options = append(options, WithAdminAuth(auth))
+	}
+	newBalancer, err := config.BalancerSpec.newBalancer()
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if newBalancer != nil {
+		options = append(options, WithBalancer(newBalancer))
+	}
+	if spec := config.WeightTuning; spec != nil {
+		if spec.MinWeight < 0 || spec.MaxWeight < 0 || spec.MaxWeight != 0 && spec.MinWeight > spec.MaxWeight || spec.MaxWeight > maxWeight {
+			return nil, fmt.Errorf("config: weight_tuning: weights must be from 0 to %d with min_weight below max_weight", maxWeight)
+		}
+		options = append(options, WithWeightTuning(WeightTuningConfig{
+			Interval:  time.Duration(spec.Interval),
+			MinWeight: spec.MinWeight,
+			MaxWeight: spec.MaxWeight,
+		}))
+	}
+	if config.UnmatchedResponse != nil {
+		response, err := config.UnmatchedResponse.errorResponse(defaultUnmatchedResponse)
+		if err != nil {
+			return nil, fmt.Errorf("config: unmatched_response: %w", err)
+		}
+		options = append(options, WithUnmatchedResponse(response))
+	}
+	if config.UnavailableResponse != nil {
+		response, err := config.UnavailableResponse.errorResponse(defaultUnavailableResponse)
+		if err != nil {
+			return nil, fmt.Errorf("config: unavailable_response: %w", err)
+		}
+		options = append(options, WithUnavailableResponse(response))
+	}
+	hashKey, err := config.BalancerSpec.hashKey()
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if hashKey != nil {
+		options = append(options, WithHashKey(hashKey))
+	}
+	if len(config.TrustedProxies) > 0 {
+		prefixes, err := ParsePrefixes(config.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("config: trusted_proxies: %w", err)
+		}
+		options = append(options, WithTrustedProxies(prefixes...))
+	}
+	if config.GeoIP != nil {
+		geoIP, err := OpenGeoIP(config.GeoIP.Database, time.Duration(config.GeoIP.ReloadInterval))
+		if err != nil {
+			return nil, fmt.Errorf("config: geoip: %w", err)
+		}
+		options = append(options, WithGeoIP(geoIP))
+		closers = append(closers, geoIP)
+	}
+	if config.ErrorLog != nil {
+		if newErrorLog, err = config.ErrorLog.errorLog(); err != nil {
+			return nil, fmt.Errorf("config: error_log: %w", err)
+		}
+	}
+	if config.Tracing != nil {
+		for _, format := range config.Tracing.B3 {
+			if format != B3Single && format != B3Multi {
+				return nil, fmt.Errorf("config: tracing: unknown b3 format %q", format)
+			}
+		}
+		options = append(options, WithTracing(TracingConfig{Sampled: config.Tracing.Sampled, B3: config.Tracing.B3}))
+	}
+	if config.AccessLog != nil {
+		accessLog, err := config.AccessLog.accessLog()
+		if err != nil {
+			return nil, fmt.Errorf("config: access_log: %w", err)
+		}
+		options = append(options, WithAccessLog(accessLog))
+		closers = append(closers, accessLog)
+	}
+	var dnsCache *DNSCache
+	if spec := config.DNSCache; spec != nil {
+		dnsCache = NewDNSCache(DNSCacheConfig{
+			MinTTL:      time.Duration(spec.MinTTL),
+			MaxTTL:      time.Duration(spec.MaxTTL),
+			DefaultTTL:  time.Duration(spec.DefaultTTL),
+			NegativeTTL: time.Duration(spec.NegativeTTL),
+		})
+		options = append(options, WithDNSCache(dnsCache))
+	}
+	if config.Transport != nil || dnsCache != nil {
+		var transportConfig TransportConfig
+		if config.Transport != nil {
+			var err error
+			if transportConfig, err = config.Transport.transportConfig(); err != nil {
+				return nil, fmt.Errorf("config: transport: %w", err)
+			}
+		}
+		transportConfig.DNSCache = dnsCache
+		options = append(options, WithTransportConfig(transportConfig))
+	}
+	for _, spec := range config.Servers {
+		server, err := spec.server()
+		if err != nil {
+			return nil, fmt.Errorf("config: servers: %w", err)
+		}
+		options = append(options, withDefaultServer(server))
+	}
+
+	listeners := map[string]bool{config.Listen.Name: true}
+	for _, listener := range config.Listeners {
+		if listener.Name == "" || listeners[listener.Name] {
+			return nil, fmt.Errorf("config: listeners need unique names")
+		}
+		listeners[listener.Name] = true
+	}
+	for i, passthrough := range config.Passthrough {
+		if passthrough.Addr == "" {
+			return nil, fmt.Errorf("config: passthrough %d: addr is required", i)
+		}
+		for _, route := range passthrough.Routes {
+			if len(route.Hosts) == 0 || len(route.Backends) == 0 {
+				return nil, fmt.Errorf("config: passthrough %d: routes need hosts and backends", i)
+			}
+		}
+	}
+	for _, listener := range append([]ListenerSpec{config.Listen}, config.Listeners...) {
+		if listener.TLS == nil {
+			continue
+		}
+		if _, err := listener.TLS.tlsPolicy(); err != nil {
+			return nil, fmt.Errorf("config: listener %q: tls: %w", listener.Name, err)
+		}
+	}
+
+	// Build every group first so middleware can refer to groups by name
+	builder := &groupBuilder{listeners: listeners}
+	groups := make(map[string]*TargetGroup)
+	routed, err := builder.build(config.TargetGroups, "target group %d", groups, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, targetGroup := range routed {
+		options = append(options, WithTargetGroup(targetGroup))
+	}
+	for i, spec := range config.VirtualHosts {
+		vhost, err := builder.virtualHost(spec, fmt.Sprintf("virtual host %d", i), groups, "")
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithVirtualHost(vhost))
+	}
+	tenantGroups := make([][]*TargetGroup, len(config.Tenants))
+	tenantScopes := make([]map[string]*TargetGroup, len(config.Tenants))
+	tenantNames := make(map[string]bool)
+	for i, spec := range config.Tenants {
+		if spec.Name == "" || tenantNames[spec.Name] || strings.Contains(spec.Name, ":") {
+			return nil, fmt.Errorf("config: tenants need unique names without colons")
+		}
+		tenantNames[spec.Name] = true
+		tokens, err := readTokenFiles(spec.AdminTokenFiles)
+		if err != nil {
+			return nil, fmt.Errorf("config: tenant %q: %w", spec.Name, err)
+		}
+		options = append(options, WithTenant(Tenant{Name: spec.Name, AdminTokens: tokens}))
+
+		// Group names are looked up within the tenant only
+		tenantScopes[i] = make(map[string]*TargetGroup)
+		for j, vhostSpec := range spec.VirtualHosts {
+			vhost, err := builder.virtualHost(vhostSpec, fmt.Sprintf("tenant %q: virtual host %d", spec.Name, j), tenantScopes[i], spec.Name)
+			if err != nil {
+				return nil, err
+			}
+			tenantGroups[i] = append(tenantGroups[i], vhost.groups()...)
+			options = append(options, WithVirtualHost(vhost))
+		}
+	}
+	if err := builder.checkHosts(); err != nil {
+		return nil, err
+	}
+	for _, built := range builder.built {
+		if built.targetGroup.TransportConfig != nil {
+			built.targetGroup.TransportConfig.DNSCache = dnsCache
+		}
+	}
+
+	lb = NewLoadBalancer(append(options, opts...)...)
+	lb.closers = append(lb.closers, closers...)
+	lb.vars.Get("config_generation").(*expvar.Int).Add(1)
+	if config.StatsD != nil {
+		exporter, err := NewStatsDExporter(lb.metrics, StatsDConfig{
+			Addr:      config.StatsD.Addr,
+			Prefix:    config.StatsD.Prefix,
+			Tags:      config.StatsD.Tags,
+			DogStatsD: config.StatsD.DogStatsD,
+			Interval:  time.Duration(config.StatsD.Interval),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("config: statsd: %w", err)
+		}
+		go exporter.Run(lb.ctx)
+	}
+	for _, pool := range builder.pools {
+		lb.initTargetGroup(pool)
+	}
+	// Republished with the pools, which aren't routed to and weren't set up by NewLoadBalancer
+	lb.publishRoutes()
+
+	for _, built := range builder.built {
+		if built.spec.Discovery == nil {
+			continue
+		}
+		factory, err := lookupDiscovery(built.spec.Discovery.Type)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %w", built.label, err)
+		}
+		discovery, err := factory(built.spec.Discovery.Params)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: discovery %q: %w", built.label, built.spec.Discovery.Type, err)
+		}
+		lb.Discover(lb.ctx, built.targetGroup, discovery)
+	}
+
+	globalMiddleware := &middlewareBuilder{lb: lb, groups: groups}
+	for _, spec := range config.Middleware {
+		middleware, err := globalMiddleware.build(spec, nil)
+		if err != nil {
+			return nil, fmt.Errorf("config: middleware %q: %w", spec.Type, err)
+		}
+		lb.Use(middleware)
+	}
+	// Tenant middleware is built once so its state, like rate limits, is shared by the
+	// tenant's groups, and runs before the groups' own middleware
+	for i, spec := range config.Tenants {
+		tenantMiddleware := &middlewareBuilder{lb: lb, groups: tenantScopes[i], tenant: spec.Name}
+		for _, middlewareSpec := range spec.Middleware {
+			middleware, err := tenantMiddleware.build(middlewareSpec, nil)
+			if err != nil {
+				return nil, fmt.Errorf("config: tenant %q: middleware %q: %w", spec.Name, middlewareSpec.Type, err)
+			}
+			for _, targetGroup := range tenantGroups[i] {
+				targetGroup.Use(middleware)
+			}
+		}
+	}
+	for _, built := range builder.built {
+		groupMiddleware := &middlewareBuilder{lb: lb, groups: built.names}
+		for _, middlewareSpec := range built.spec.Middleware {
+			middleware, err := groupMiddleware.build(middlewareSpec, built.targetGroup)
+			if err != nil {
+				return nil, fmt.Errorf("config: %s: middleware %q: %w", built.label, middlewareSpec.Type, err)
+			}
+			built.targetGroup.Use(middleware)
+		}
+	}
+	if newErrorLog != nil {
+		newErrorLog.install()
+	}
+	return lb, nil
+}
+
+// withDefaultServer adds a configured server to the default target group
+func withDefaultServer(server *Server) Option {
+	return func(lb *LoadBalancer) {
+		lb.defaultGroup.Servers = append(lb.defaultGroup.Servers, server)
+	}
+}
+
+func (spec TargetGroupSpec) targetGroup() (*TargetGroup, error) {
+	targetGroup := &TargetGroup{
+		URIPath:             spec.Path,
+		StripPrefix:         spec.StripPrefix,
+		Listeners:           spec.Listeners,
+		FlushInterval:       time.Duration(spec.FlushInterval),
+		MaxRequestBodyBytes: spec.MaxRequestBodyBytes,
+		SubsetSize:          spec.SubsetSize,
+	}
+	if spec.Match != "" {
+		match, err := CompileExpr(spec.Match)
+		if err != nil {
+			return nil, err
+		}
+		targetGroup.Match = match
+	}
+	if spec.HedgeDelay < 0 {
+		return nil, fmt.Errorf("hedge_delay must not be negative")
+	}
+	if spec.HedgeDelay > 0 {
+		targetGroup.Hedge = &HedgeConfig{Delay: time.Duration(spec.HedgeDelay)}
+	}
+	if spec.Retries < 0 {
+		return nil, fmt.Errorf("retries must not be negative")
+	}
+	if spec.Retries > 0 {
+		targetGroup.Retry = &RetryConfig{Attempts: spec.Retries, NonIdempotent: spec.RetryNonIdempotent}
+	}
+	if spec.Static != nil {
+		if spec.Static.Root == "" {
+			return nil, fmt.Errorf("static: root is required")
+		}
+		targetGroup.Static = &StaticConfig{
+			Root:     spec.Static.Root,
+			Index:    spec.Static.Index,
+			Fallback: spec.Static.Fallback,
+			MaxAge:   time.Duration(spec.Static.MaxAge),
+		}
+	}
+	if spec.Redirect != nil {
+		if spec.Redirect.Target == "" {
+			return nil, fmt.Errorf("redirect: target is required")
+		}
+		if spec.Redirect.Status != 0 && !validRedirectStatus(spec.Redirect.Status) {
+			return nil, fmt.Errorf("redirect: unsupported status %d", spec.Redirect.Status)
+		}
+		targetGroup.Redirect = &RedirectConfig{Target: spec.Redirect.Target, Status: spec.Redirect.Status}
+	}
+	for _, mapping := range spec.StatusMap {
+		if mapping.From < 200 || mapping.From > 599 || mapping.To < 200 || mapping.To > 599 {
+			return nil, fmt.Errorf("status_map: status codes must be from 200 to 599")
+		}
+		targetGroup.StatusMap = append(targetGroup.StatusMap, StatusMapping(mapping))
+	}
+	if spec.UpstreamAuth != nil {
+		auth, err := spec.UpstreamAuth.upstreamAuth()
+		if err != nil {
+			return nil, fmt.Errorf("upstream_auth: %w", err)
+		}
+		targetGroup.UpstreamAuth = auth
+	}
+	if spec.Sticky != nil {
+		key, err := ParseHashKey(spec.Sticky.Key)
+		if err != nil {
+			return nil, fmt.Errorf("sticky: %w", err)
+		}
+		targetGroup.Sticky = &StickyConfig{Key: key, TTL: time.Duration(spec.Sticky.TTL), Name: spec.Name}
+	}
+	if spec.BufferResponses {
+		targetGroup.ResponseBuffering = &ResponseBufferingConfig{MaxBytes: spec.MaxBufferedBytes}
+	}
+	for _, serverSpec := range spec.Servers {
+		server, err := serverSpec.server()
+		if err != nil {
+			return nil, err
+		}
+		targetGroup.Servers = append(targetGroup.Servers, server)
+	}
+	if spec.Transport != nil {
+		transportConfig, err := spec.Transport.transportConfig()
+		if err != nil {
+			return nil, fmt.Errorf("transport: %w", err)
+		}
+		targetGroup.TransportConfig = &transportConfig
+	}
+	if spec.Headers != nil {
+		rules, err := spec.Headers.headerRules()
+		if err != nil {
+			return nil, err
+		}
+		targetGroup.Headers = rules
+	}
+	var err error
+	if targetGroup.NewBalancer, err = spec.BalancerSpec.newBalancer(); err != nil {
+		return nil, err
+	}
+	if targetGroup.HashKey, err = spec.BalancerSpec.hashKey(); err != nil {
+		return nil, err
+	}
+	return targetGroup, nil
+}
+
+// groupBuilder builds the target groups of a configuration
+type groupBuilder struct {
+	listeners map[string]bool
+	built     []builtGroup
+	vhosts    []*VirtualHost
+
+	// pools are the groups that aren't routed to directly
+	pools []*TargetGroup
+}
+
+// builtGroup is a target group and the configuration it was built from
+type builtGroup struct {
+	spec        TargetGroupSpec
+	targetGroup *TargetGroup
+
+	// label identifies the group in errors, e.g. "target group 2"
+	label string
+
+	// names are the groups the group's middleware can refer to
+	names map[string]*TargetGroup
+}
+
+// build builds the groups of a tenant, or of no tenant if tenant is empty, adds them to
+// names and returns those that are routed to. label is a format for the groups' labels
+// given their index.
+func (b *groupBuilder) build(specs []TargetGroupSpec, label string, names map[string]*TargetGroup, tenant string) ([]*TargetGroup, error) {
+	var routed []*TargetGroup
+	for i, spec := range specs {
+		label := fmt.Sprintf(label, i)
+		isRouted := spec.Path != "" || spec.Match != "" || len(spec.Listeners) > 0
+		if spec.Name == "" && !isRouted {
+			return nil, fmt.Errorf("config: %s needs a path, a match, listeners or a name", label)
+		}
+		for _, listener := range spec.Listeners {
+			if listener == "" || !b.listeners[listener] {
+				return nil, fmt.Errorf("config: %s: unknown listener %q", label, listener)
+			}
+		}
+		targetGroup, err := spec.targetGroup()
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %w", label, err)
+		}
+		targetGroup.Tenant = tenant
+		if spec.Name != "" {
+			if _, ok := names[spec.Name]; ok {
+				return nil, fmt.Errorf("config: duplicate target group name %q", spec.Name)
+			}
+			names[spec.Name] = targetGroup
+		}
+		b.built = append(b.built, builtGroup{spec: spec, targetGroup: targetGroup, label: label, names: names})
+		if isRouted {
+			routed = append(routed, targetGroup)
+		} else {
+			b.pools = append(b.pools, targetGroup)
+		}
+	}
+	return routed, nil
+}
+
+// virtualHost builds a virtual host and its groups
+func (b *groupBuilder) virtualHost(spec VirtualHostSpec, label string, names map[string]*TargetGroup, tenant string) (*VirtualHost, error) {
+	if len(spec.Hosts) == 0 {
+		return nil, fmt.Errorf("config: %s needs hosts", label)
+	}
+	vhost := &VirtualHost{Hosts: spec.Hosts}
+	var err error
+	if vhost.TargetGroups, err = b.build(spec.TargetGroups, label+": target group %d", names, tenant); err != nil {
+		return nil, err
+	}
+	if len(spec.Servers) > 0 {
+		vhost.DefaultGroup = &TargetGroup{Tenant: tenant}
+		for _, serverSpec := range spec.Servers {
+			server, err := serverSpec.server()
+			if err != nil {
+				return nil, fmt.Errorf("config: %s: servers: %w", label, err)
+			}
+			vhost.DefaultGroup.Servers = append(vhost.DefaultGroup.Servers, server)
+		}
+	}
+	b.vhosts = append(b.vhosts, vhost)
+	return vhost, nil
+}
+
+// checkHosts makes sure no host belongs to two virtual hosts, so one tenant can't take
+// over another's traffic
+func (b *groupBuilder) checkHosts() error {
+	hosts := make(map[string]bool)
+	for _, vhost := range b.vhosts {
+		for _, host := range vhost.Hosts {
+			host = strings.ToLower(host)
+			if hosts[host] {
+				return fmt.Errorf("config: host %q is in more than one virtual host", host)
+			}
+			hosts[host] = true
+		}
+	}
+	return nil
+}
+
+// middlewareBuilder creates middleware from configuration entries
+type middlewareBuilder struct {
+	lb     *LoadBalancer
+	groups map[string]*TargetGroup
+
+	// tenant is set for a tenant's middleware, which is global to the tenant
+	tenant string
+}
+
+// build creates the middleware for an entry. targetGroup is nil for global middleware.
+func (b *middlewareBuilder) build(spec MiddlewareSpec, targetGroup *TargetGroup) (Middleware, error) {
+	route := "global"
+	if targetGroup != nil {
+		route = routeName(targetGroup)
+	} else if b.tenant != "" {
+		route = tenantPrefix(b.tenant) + route
+	}
+	decode := func(v any) error { return decodeParams(spec.Params, v) }
+
+	switch spec.Type {
+	case "rate_limit":
+		var params struct {
+			Type              string  `json:"type"`
+			RequestsPerSecond float64 `json:"requests_per_second"`
+			Burst             int     `json:"burst"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return RateLimit(RateLimitConfig{RequestsPerSecond: params.RequestsPerSecond, Burst: params.Burst}), nil
+
+	case "bandwidth":
+		var params struct {
+			Type                string `json:"type"`
+			BytesPerSecond      int64  `json:"bytes_per_second"`
+			RouteBytesPerSecond int64  `json:"route_bytes_per_second"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return Bandwidth(BandwidthConfig{BytesPerSecond: params.BytesPerSecond, RouteBytesPerSecond: params.RouteBytesPerSecond}), nil
+
+	case "decompress":
+		var params struct {
+			Type     string `json:"type"`
+			Reject   bool   `json:"reject"`
+			MaxBytes int64  `json:"max_bytes"`
+			MaxRatio int64  `json:"max_ratio"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return Decompress(DecompressionConfig{Reject: params.Reject, MaxBytes: params.MaxBytes, MaxRatio: params.MaxRatio}), nil
+
+	case "client_certificate":
+		var params struct {
+			Type         string   `json:"type"`
+			AllowedNames []string `json:"allowed_names"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return RequireClientCertificate(params.AllowedNames...), nil
+
+	case "body_limit":
+		var params struct {
+			Type     string `json:"type"`
+			MaxBytes int64  `json:"max_bytes"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return maxRequestBody(params.MaxBytes), nil
+
+	case "basic_auth":
+		var params struct {
+			Type              string `json:"type"`
+			Realm             string `json:"realm"`
+			Htpasswd          string `json:"htpasswd"`
+			PassAuthorization bool   `json:"pass_authorization"`
+
+			// Users are htpasswd entries, user:hash, possibly given as secret references
+			Users []Secret `json:"users"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		users := make(Htpasswd)
+		if params.Htpasswd != "" {
+			var err error
+			if users, err = LoadHtpasswd(params.Htpasswd); err != nil {
+				return nil, err
+			}
+		}
+		entries, err := resolveSecrets(params.Users)
+		if err != nil {
+			return nil, err
+		}
+		inline, err := ParseHtpasswd(strings.NewReader(strings.Join(entries, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		for user, hash := range inline {
+			users[user] = hash
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("one of htpasswd or users is required")
+		}
+		return BasicAuth(BasicAuthConfig{Realm: params.Realm, Users: users, PassAuthorization: params.PassAuthorization}), nil
+
+	case "api_key":
+		var params struct {
+			Type  string `json:"type"`
+			File  string `json:"file"`
+			Redis *struct {
+				Addr     string `json:"addr"`
+				Password Secret `json:"password"`
+				DB       int    `json:"db"`
+				Prefix   string `json:"prefix"`
+			} `json:"redis"`
+			Header     string `json:"header"`
+			QueryParam string `json:"query_param"`
+			PassKey    bool   `json:"pass_key"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		config := APIKeyConfig{Header: params.Header, QueryParam: params.QueryParam, PassKey: params.PassKey}
+		switch {
+		case params.File != "":
+			store, err := LoadAPIKeyFile(params.File)
+			if err != nil {
+				return nil, err
+			}
+			config.Store = store
+		case params.Redis != nil:
+			password, err := params.Redis.Password.Resolve()
+			if err != nil {
+				return nil, err
+			}
+			store := NewRedisAPIKeyStore(params.Redis.Addr, password, params.Redis.DB, params.Redis.Prefix)
+			b.lb.closers = append(b.lb.closers, store)
+			config.Store = store
+		default:
+			return nil, fmt.Errorf("one of file or redis is required")
+		}
+		return APIKeyAuth(config, b.lb.metrics), nil
+
+	case "oidc":
+		var params struct {
+			Type            string   `json:"type"`
+			IssuerURL       string   `json:"issuer_url"`
+			ClientID        string   `json:"client_id"`
+			ClientSecret    Secret   `json:"client_secret"`
+			RedirectURL     string   `json:"redirect_url"`
+			Scopes          []string `json:"scopes"`
+			CookieName      string   `json:"cookie_name"`
+			SessionTTL      Duration `json:"session_ttl"`
+			PassAccessToken bool     `json:"pass_access_token"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		clientSecret, err := params.ClientSecret.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		path := ""
+		if targetGroup != nil {
+			path = targetGroup.URIPath
+		}
+		return OIDC(OIDCConfig{
+			IssuerURL:       params.IssuerURL,
+			ClientID:        params.ClientID,
+			ClientSecret:    clientSecret,
+			RedirectURL:     params.RedirectURL,
+			Scopes:          params.Scopes,
+			CookieName:      params.CookieName,
+			SessionTTL:      time.Duration(params.SessionTTL),
+			PassAccessToken: params.PassAccessToken,
+		}, path), nil
+
+	case "cors":
+		var params struct {
+			Type             string   `json:"type"`
+			AllowedOrigins   []string `json:"allowed_origins"`
+			AllowedMethods   []string `json:"allowed_methods"`
+			AllowedHeaders   []string `json:"allowed_headers"`
+			ExposedHeaders   []string `json:"exposed_headers"`
+			AllowCredentials bool     `json:"allow_credentials"`
+			MaxAge           Duration `json:"max_age"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return CORS(CORSConfig{
+			AllowedOrigins:   params.AllowedOrigins,
+			AllowedMethods:   params.AllowedMethods,
+			AllowedHeaders:   params.AllowedHeaders,
+			ExposedHeaders:   params.ExposedHeaders,
+			AllowCredentials: params.AllowCredentials,
+			MaxAge:           time.Duration(params.MaxAge),
+		}), nil
+
+	case "ip_filter":
+		var params struct {
+			Type  string   `json:"type"`
+			Allow []string `json:"allow"`
+			Deny  []string `json:"deny"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		allow, err := ParsePrefixes(params.Allow)
+		if err != nil {
+			return nil, err
+		}
+		deny, err := ParsePrefixes(params.Deny)
+		if err != nil {
+			return nil, err
+		}
+		return IPFilter(IPFilterConfig{Allow: allow, Deny: deny}), nil
+
+	case "geo":
+		var params struct {
+			Type           string   `json:"type"`
+			AllowCountries []string `json:"allow_countries"`
+			DenyCountries  []string `json:"deny_countries"`
+			Routes         []struct {
+				Countries   []string `json:"countries"`
+				Continents  []string `json:"continents"`
+				TargetGroup string   `json:"target_group"`
+			} `json:"routes"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		config := GeoConfig{AllowCountries: params.AllowCountries, DenyCountries: params.DenyCountries}
+		for _, route := range params.Routes {
+			group, ok := b.groups[route.TargetGroup]
+			if !ok {
+				return nil, fmt.Errorf("unknown target group %q", route.TargetGroup)
+			}
+			config.Routes = append(config.Routes, GeoRoute{Countries: route.Countries, Continents: route.Continents, TargetGroup: group})
+		}
+		return b.lb.geoFilter(config), nil
+
+	case "canary":
+		var params struct {
+			Type        string  `json:"type"`
+			TargetGroup string  `json:"target_group"`
+			Weight      float64 `json:"weight"`
+			Header      string  `json:"header"`
+			Cookie      string  `json:"cookie"`
+			Value       string  `json:"value"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		group, ok := b.groups[params.TargetGroup]
+		if !ok {
+			return nil, fmt.Errorf("unknown target group %q", params.TargetGroup)
+		}
+		if params.Weight < 0 || params.Weight > 1 {
+			return nil, fmt.Errorf("weight must be between 0 and 1")
+		}
+		return b.lb.canary(CanaryConfig{
+			TargetGroup: group,
+			Weight:      params.Weight,
+			Header:      params.Header,
+			Cookie:      params.Cookie,
+			Value:       params.Value,
+		}, route), nil
+
+	case "experiment":
+		var params struct {
+			Type     string `json:"type"`
+			Name     string `json:"name"`
+			Variants []struct {
+				Name        string `json:"name"`
+				Weight      int    `json:"weight"`
+				TargetGroup string `json:"target_group"`
+			} `json:"variants"`
+			ClientHeader string   `json:"client_header"`
+			Cookie       string   `json:"cookie"`
+			CookieMaxAge Duration `json:"cookie_max_age"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		if params.Name == "" {
+			return nil, fmt.Errorf("experiment needs a name")
+		}
+		config := ExperimentConfig{
+			Name:         params.Name,
+			ClientHeader: params.ClientHeader,
+			Cookie:       params.Cookie,
+			CookieMaxAge: time.Duration(params.CookieMaxAge),
+		}
+		for _, variant := range params.Variants {
+			var group *TargetGroup
+			if variant.TargetGroup != "" {
+				var ok bool
+				if group, ok = b.groups[variant.TargetGroup]; !ok {
+					return nil, fmt.Errorf("unknown target group %q", variant.TargetGroup)
+				}
+			}
+			config.Variants = append(config.Variants, ExperimentVariant{Name: variant.Name, Weight: variant.Weight, TargetGroup: group})
+		}
+		return b.lb.experiment(config), nil
+
+	case "waf":
+		var params struct {
+			Type         string `json:"type"`
+			Mode         string `json:"mode"`
+			DefaultRules bool   `json:"default_rules"`
+			Rules        []struct {
+				ID      string   `json:"id"`
+				Targets []string `json:"targets"`
+				Pattern string   `json:"pattern"`
+			} `json:"rules"`
+			AllowedMethods []string `json:"allowed_methods"`
+			MaxBodyBytes   int64    `json:"max_body_bytes"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		config := WAFConfig{Mode: WAFMode(params.Mode), AllowedMethods: params.AllowedMethods, MaxBodyBytes: params.MaxBodyBytes}
+		if config.Mode != "" && config.Mode != WAFLogOnly && config.Mode != WAFEnforce {
+			return nil, fmt.Errorf("unknown mode %q", params.Mode)
+		}
+		if params.DefaultRules {
+			config.Rules = DefaultWAFRules()
+		}
+		for _, rule := range params.Rules {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+			}
+			config.Rules = append(config.Rules, WAFRule{ID: rule.ID, Targets: rule.Targets, Pattern: pattern})
+		}
+		return b.lb.waf(config, route), nil
+
+	case "fault":
+		var params struct {
+			Type         string   `json:"type"`
+			Delay        Duration `json:"delay"`
+			DelayPercent float64  `json:"delay_percent"`
+			AbortStatus  int      `json:"abort_status"`
+			AbortPercent float64  `json:"abort_percent"`
+			Header       string   `json:"header"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		if params.AbortStatus != 0 && (params.AbortStatus < 100 || params.AbortStatus > 599) {
+			return nil, fmt.Errorf("invalid abort status %d", params.AbortStatus)
+		}
+		return Fault(FaultConfig{
+			Delay:        time.Duration(params.Delay),
+			DelayPercent: params.DelayPercent,
+			AbortStatus:  params.AbortStatus,
+			AbortPercent: params.AbortPercent,
+			Header:       params.Header,
+		}), nil
+
+	case "security_headers":
+		var params struct {
+			Type                  string   `json:"type"`
+			HSTSMaxAge            Duration `json:"hsts_max_age"`
+			HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+			HSTSPreload           bool     `json:"hsts_preload"`
+			ContentTypeNosniff    bool     `json:"content_type_nosniff"`
+			FrameOptions          string   `json:"frame_options"`
+			ReferrerPolicy        string   `json:"referrer_policy"`
+			ContentSecurityPolicy string   `json:"content_security_policy"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return SecurityHeaders(SecurityHeadersConfig{
+			HSTSMaxAge:            time.Duration(params.HSTSMaxAge),
+			HSTSIncludeSubdomains: params.HSTSIncludeSubdomains,
+			HSTSPreload:           params.HSTSPreload,
+			ContentTypeNosniff:    params.ContentTypeNosniff,
+			FrameOptions:          params.FrameOptions,
+			ReferrerPolicy:        params.ReferrerPolicy,
+			ContentSecurityPolicy: params.ContentSecurityPolicy,
+		}), nil
+
+	case "compress":
+		var params struct {
+			Type         string   `json:"type"`
+			MinSize      int      `json:"min_size"`
+			ContentTypes []string `json:"content_types"`
+			Level        int      `json:"level"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return Compress(CompressionConfig{MinSize: params.MinSize, ContentTypes: params.ContentTypes, Level: params.Level}), nil
+
+	case "cache":
+		var params struct {
+			Type                 string   `json:"type"`
+			MaxBytes             int64    `json:"max_bytes"`
+			MaxEntryBytes        int64    `json:"max_entry_bytes"`
+			DefaultTTL           Duration `json:"default_ttl"`
+			MaxTTL               Duration `json:"max_ttl"`
+			StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+			StaleIfError         Duration `json:"stale_if_error"`
+			TagHeader            string   `json:"tag_header"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		cache := NewCache(CacheConfig{
+			MaxBytes:             params.MaxBytes,
+			MaxEntryBytes:        params.MaxEntryBytes,
+			DefaultTTL:           time.Duration(params.DefaultTTL),
+			MaxTTL:               time.Duration(params.MaxTTL),
+			StaleWhileRevalidate: time.Duration(params.StaleWhileRevalidate),
+			StaleIfError:         time.Duration(params.StaleIfError),
+			TagHeader:            params.TagHeader,
+		}, b.lb.metrics, route)
+		b.lb.caches = append(b.lb.caches, cache)
+		return cache.Middleware(), nil
+
+	case "capture":
+		var params struct {
+			Type         string  `json:"type"`
+			Path         string  `json:"path"`
+			SampleRate   float64 `json:"sample_rate"`
+			Bodies       bool    `json:"bodies"`
+			MaxBodyBytes int64   `json:"max_body_bytes"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		capture, err := NewCapture(CaptureConfig{
+			Path:         params.Path,
+			SampleRate:   params.SampleRate,
+			Bodies:       params.Bodies,
+			MaxBodyBytes: params.MaxBodyBytes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		b.lb.closers = append(b.lb.closers, capture)
+		return capture.Middleware(), nil
+
+	case "wasm":
+		var params struct {
+			Type   string `json:"type"`
+			Path   string `json:"path"`
+			Config string `json:"config"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		plugin, err := LoadWASMPlugin(params.Path, params.Config)
+		if err != nil {
+			return nil, err
+		}
+		b.lb.closers = append(b.lb.closers, plugin)
+		return plugin.Middleware(), nil
+
+	case "headers":
+		// Header rules need the chosen backend, so they are applied when the request is
+		// forwarded rather than at this point in the chain
+		if targetGroup == nil {
+			return nil, fmt.Errorf("headers can only be used in target groups")
+		}
+		var params struct {
+			Type string `json:"type"`
+			HeaderRulesSpec
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		rules, err := params.HeaderRulesSpec.headerRules()
+		if err != nil {
+			return nil, err
+		}
+		targetGroup.Headers.Request = append(targetGroup.Headers.Request, rules.Request...)
+		targetGroup.Headers.Response = append(targetGroup.Headers.Response, rules.Response...)
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	if factory, ok := lookupMiddleware(spec.Type); ok {
+		return factory(spec.Params)
+	}
+	return nil, fmt.Errorf("unknown middleware type")
+}
+
+// builtinMiddleware are the middleware types build handles itself
+var builtinMiddleware = map[string]bool{
+	"rate_limit": true, "bandwidth": true, "decompress": true, "body_limit": true, "basic_auth": true,
+	"client_certificate": true, "api_key": true, "oidc": true, "cors": true, "ip_filter": true,
+	"geo": true, "canary": true, "experiment": true, "waf": true, "fault": true,
+	"security_headers": true, "compress": true, "cache": true, "capture": true, "wasm": true,
+	"headers": true,
+}
+
+// decodeParams decodes the parameters of a typed configuration entry, rejecting unknown fields
+func decodeParams(params json.RawMessage, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
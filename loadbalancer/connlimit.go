@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ClientLimits limits the connections each client address may open to a listener. Clients
+// over a limit have their new connections closed right after they are accepted, before
+// any TLS handshake or request is read. Limits apply to the connection's peer address, so
+// behind another proxy they apply to that proxy.
+type ClientLimits struct {
+	// MaxConnections limits the concurrent connections per client; zero means no limit
+	MaxConnections int
+
+	// ConnectionsPerSecond and Burst limit how fast each client may open connections;
+	// zero means no limit
+	ConnectionsPerSecond float64
+	Burst                int
+
+	// Exempt clients, like health checkers or other proxies, aren't limited
+	Exempt []netip.Prefix
+}
+
+// clientLimitListener closes the connections of clients over their limits
+type clientLimitListener struct {
+	net.Listener
+	limits ClientLimits
+
+	// rejected counts closed connections by the limit they exceeded
+	rejected func(reason string)
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*clientConnections
+	lastPrune time.Time
+}
+
+type clientConnections struct {
+	open   int
+	bucket *tokenBucket
+}
+
+// limitClients wraps the listener to enforce the limits
+func limitClients(listener net.Listener, limits ClientLimits, metrics *Metrics, name string) net.Listener {
+	l := &clientLimitListener{
+		Listener:  listener,
+		limits:    limits,
+		rejected:  func(string) {},
+		clients:   make(map[netip.Addr]*clientConnections),
+		lastPrune: time.Now(),
+	}
+	if metrics != nil {
+		l.rejected = func(reason string) {
+			metrics.Counter("loadbalancer_rejected_connections_total", "Number of client connections closed for exceeding per-client limits.",
+				"listener", name, "reason", reason).Inc()
+		}
+	}
+	return l
+}
+
+func (l *clientLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		ip := addrPort.Addr().Unmap()
+		if err != nil || containsAddr(l.limits.Exempt, ip) {
+			return conn, nil
+		}
+		if reason := l.admit(ip); reason != "" {
+			l.rejected(reason)
+			logger().Debug("client connection rejected", "client", ip, "reason", reason)
+			conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// admit counts a new connection of the client, or returns the limit it exceeds
+func (l *clientLimitListener) admit(ip netip.Addr) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		// Forget clients without connections whose buckets have refilled completely
+		for key, client := range l.clients {
+			if client.open == 0 && (client.bucket == nil || client.bucket.full(now)) {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientConnections{}
+		if l.limits.ConnectionsPerSecond > 0 {
+			client.bucket = newTokenBucket(l.limits.ConnectionsPerSecond, l.limits.Burst)
+		}
+		l.clients[ip] = client
+	}
+	if l.limits.MaxConnections > 0 && client.open >= l.limits.MaxConnections {
+		return "max_connections"
+	}
+	if client.bucket != nil {
+		if ok, _ := client.bucket.allow(); !ok {
+			return "connection_rate"
+		}
+	}
+	client.open++
+	return ""
+}
+
+func (l *clientLimitListener) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if client, ok := l.clients[ip]; ok {
+		client.open--
+	}
+}
+
+// limitedConn releases its client's connection slot once closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes connections that support it, like TCP connections
+func (c *limitedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return c.Close()
+}
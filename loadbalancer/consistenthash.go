@@ -0,0 +1,149 @@
+package loadbalancer
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// RequestTracker is implemented by balancers that keep count of the requests in flight on
+// each server. Every server a balancer returns is passed to Done once its request is over,
+// including servers the request never reached because they were unhealthy.
+type RequestTracker interface {
+	Done(server *Server)
+}
+
+// DefaultHashReplicas is the number of points each server has on a consistent hash ring
+const DefaultHashReplicas = 100
+
+// ConsistentHash is a HashBalancer placing servers on a hash ring: a key goes to the first
+// server after it on the ring, so a server coming or going only moves the keys next to its
+// points. With a load factor, a server never gets more than that factor times the average
+// number of requests in flight, and keys of hot servers spill over to the next servers on
+// the ring (consistent hashing with bounded loads). Like RoundRobin, it isn't safe for
+// concurrent use on its own.
+type ConsistentHash struct {
+	replicas   int
+	loadFactor float64
+
+	// names identify the servers the ring was built for
+	names  []string
+	points []ringPoint
+
+	// load counts the requests in flight by server name, so it survives rebuilding the ring
+	load  map[string]int
+	total int
+}
+
+// ringPoint is a point of a server on the ring
+type ringPoint struct {
+	hash   uint64
+	server int
+}
+
+// NewConsistentHash creates a consistent hashing Balancer with replicas points per server,
+// DefaultHashReplicas if zero. A load factor above 1, like 1.25, bounds the load of each
+// server; zero means no bound.
+func NewConsistentHash(replicas int, loadFactor float64) *ConsistentHash {
+	if replicas <= 0 {
+		replicas = DefaultHashReplicas
+	}
+	return &ConsistentHash{replicas: replicas, loadFactor: loadFactor, load: make(map[string]int)}
+}
+
+// newDefaultConsistentHash creates a ConsistentHash without a load bound
+func newDefaultConsistentHash() Balancer {
+	return NewConsistentHash(0, 0)
+}
+
+// Next returns a random server, for callers without a request key
+func (c *ConsistentHash) Next(servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	return c.acquire(servers[rand.Intn(len(servers))])
+}
+
+// NextKey returns the first server after the key on the ring that is below the load bound
+func (c *ConsistentHash) NextKey(key uint64, servers []*Server) *Server {
+	return c.nextKeyExcluding(key, servers, nil)
+}
+
+// nextKeyExcluding returns the first server after the key on the ring that hasn't failed
+// for the request and is below the load bound. Failed servers are passed over like hot
+// ones, so the ring isn't rebuilt without them.
+func (c *ConsistentHash) nextKeyExcluding(key uint64, servers []*Server, failed map[*Server]bool) *Server {
+	available := remaining(servers, failed)
+	if available == 0 {
+		return nil
+	}
+	if !c.builtFor(servers) {
+		c.build(servers)
+	}
+	key = mix64(key)
+	start := sort.Search(len(c.points), func(i int) bool { return c.points[i].hash >= key })
+	bound := math.MaxInt
+	if c.loadFactor > 0 {
+		bound = int(math.Ceil(c.loadFactor * float64(c.total+1) / float64(available)))
+	}
+	var first *Server
+	for i := 0; i < len(c.points); i++ {
+		server := servers[c.points[(start+i)%len(c.points)].server]
+		if failed[server] {
+			continue
+		}
+		if c.load[server.name()] < bound {
+			return c.acquire(server)
+		}
+		if first == nil {
+			first = server
+		}
+	}
+	// Unreachable with a load factor of at least 1, as some server is always below average
+	return c.acquire(first)
+}
+
+// Done implements RequestTracker
+func (c *ConsistentHash) Done(server *Server) {
+	name := server.name()
+	if c.load[name] <= 0 {
+		return
+	}
+	c.total--
+	if c.load[name]--; c.load[name] == 0 {
+		delete(c.load, name)
+	}
+}
+
+func (c *ConsistentHash) acquire(server *Server) *Server {
+	c.load[server.name()]++
+	c.total++
+	return server
+}
+
+// builtFor reports whether the ring was built for the servers
+func (c *ConsistentHash) builtFor(servers []*Server) bool {
+	if len(c.names) != len(servers) {
+		return false
+	}
+	for i, server := range servers {
+		if c.names[i] != server.name() {
+			return false
+		}
+	}
+	return true
+}
+
+// build places replicas points of every server on the ring
+func (c *ConsistentHash) build(servers []*Server) {
+	c.names = c.names[:0]
+	c.points = c.points[:0]
+	for i, server := range servers {
+		c.names = append(c.names, server.name())
+		for replica := 0; replica < c.replicas; replica++ {
+			c.points = append(c.points, ringPoint{hash: mix64(hashString(server.name() + "#" + strconv.Itoa(replica))), server: i})
+		}
+	}
+	sort.Slice(c.points, func(i, j int) bool { return c.points[i].hash < c.points[j].hash })
+}
@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsistentHashFailover(t *testing.T) {
+	servers := benchmarkServers(5)
+	tests := []struct {
+		name       string
+		loadFactor float64
+		failed     map[*Server]bool
+	}{
+		{"None", 0, nil},
+		{"One", 0, map[*Server]bool{servers[0]: true}},
+		{"Several", 0, map[*Server]bool{servers[1]: true, servers[3]: true}},
+		{"OneWithBoundedLoads", 1.25, map[*Server]bool{servers[2]: true}},
+		{"AllButOneWithBoundedLoads", 1.25, map[*Server]bool{servers[0]: true, servers[1]: true, servers[2]: true, servers[3]: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewConsistentHash(0, test.loadFactor)
+			before := make(map[uint64]*Server)
+			for key := uint64(0); key < 1000; key++ {
+				before[key] = c.NextKey(key, servers)
+				c.Done(before[key])
+			}
+
+			for key := uint64(0); key < 1000; key++ {
+				server := c.nextKeyExcluding(key, servers, test.failed)
+				c.Done(server)
+				switch {
+				case server == nil || test.failed[server]:
+					t.Fatalf("key %d went to %v, which failed", key, server)
+				case !test.failed[before[key]] && server != before[key]:
+					t.Fatalf("key %d moved from a server that didn't fail", key)
+				}
+			}
+			if !c.builtFor(servers) {
+				t.Error("failing over rebuilt the ring without the failed servers")
+			}
+		})
+	}
+}
+
+func TestConsistentHashBoundsLoadsOfRemainingServers(t *testing.T) {
+	servers := benchmarkServers(4)
+	failed := map[*Server]bool{servers[0]: true}
+	c := NewConsistentHash(0, 1.25)
+	counts := make(map[*Server]int)
+	for i := 0; i < 300; i++ {
+		// The same key over and over would all go to one server without the bound
+		counts[c.nextKeyExcluding(42, servers, failed)]++
+	}
+	if counts[servers[0]] != 0 {
+		t.Errorf("the failed server got %d requests", counts[servers[0]])
+	}
+	for _, server := range servers[1:] {
+		// 1.25 times an even share of 100 requests, rounded up
+		if counts[server] > 126 {
+			t.Errorf("%s got %d of 300 requests in flight", server.name(), counts[server])
+		}
+	}
+	all := map[*Server]bool{servers[0]: true, servers[1]: true, servers[2]: true, servers[3]: true}
+	if server := c.nextKeyExcluding(42, servers, all); server != nil {
+		t.Errorf("got %v with every server failed", server)
+	}
+}
+
+func TestConsistentHashRingIsKeptAcrossRequestFailures(t *testing.T) {
+	servers := benchmarkServers(3)
+	targetGroup := &TargetGroup{URIPath: "/", Servers: servers}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup), WithBalancer(newDefaultConsistentHash))
+	defer lb.Close()
+	c := lb.balancers[targetGroup].(*ConsistentHash)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	first := lb.getNextServer(targetGroup, r, servers, nil)
+	if second := lb.getNextServer(targetGroup, r, servers, map[*Server]bool{first: true}); second == nil || second == first {
+		t.Errorf("failed over from %v to %v", first, second)
+	}
+	if !c.builtFor(servers) {
+		t.Error("failing over rebuilt the ring without the failed server")
+	}
+}
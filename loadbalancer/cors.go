@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures Cross-Origin Resource Sharing for a target group
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to make cross-origin requests. "*" allows
+	// any origin and a "*." label matches subdomains, e.g. "https://*.example.com".
+	AllowedOrigins []string
+
+	// AllowedMethods defaults to GET, HEAD and POST
+	AllowedMethods []string
+
+	// AllowedHeaders lists the request headers clients may send; "*" allows any header
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers clients may read
+	ExposedHeaders []string
+
+	AllowCredentials bool
+
+	// MaxAge is how long clients may cache a preflight response
+	MaxAge time.Duration
+}
+
+// CORS returns middleware that adds CORS headers to responses and answers preflight requests
+// without forwarding them
+func CORS(config CORSConfig) Middleware {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowedMethods := strings.Join(config.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(config.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(config.ExposedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			header := w.Header()
+			header.Add("Vary", "Origin")
+			if origin == "" || !config.allowsOrigin(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if config.AllowCredentials || !config.allowsAnyOrigin() {
+				header.Set("Access-Control-Allow-Origin", origin)
+			} else {
+				header.Set("Access-Control-Allow-Origin", "*")
+			}
+			if config.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			// Preflight requests are answered by the load balancer
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				header.Add("Vary", "Access-Control-Request-Method")
+				header.Add("Vary", "Access-Control-Request-Headers")
+				header.Set("Access-Control-Allow-Methods", allowedMethods)
+				if len(config.AllowedHeaders) == 1 && config.AllowedHeaders[0] == "*" {
+					if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+						header.Set("Access-Control-Allow-Headers", requested)
+					}
+				} else if allowedHeaders != "" {
+					header.Set("Access-Control-Allow-Headers", allowedHeaders)
+				}
+				if config.MaxAge > 0 {
+					header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if exposedHeaders != "" {
+				header.Set("Access-Control-Expose-Headers", exposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (config *CORSConfig) allowsAnyOrigin() bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*."); ok {
+			// e.g. "https://*.example.com" matches "https://app.example.com"
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+suffix) &&
+				len(origin) > len(prefix)+len(suffix)+1 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// newDebugVars creates the internal counters published on the admin listener's /debug/vars
+func newDebugVars() *expvar.Map {
+	vars := new(expvar.Map).Init()
+	vars.Set("backend_selections", new(expvar.Map).Init())
+	vars.Set("health_checks", new(expvar.Map).Init())
+	vars.Set("config_generation", new(expvar.Int))
+	return vars
+}
+
+// recordHealthCheck counts the result of a health check for a server
+func (lb *LoadBalancer) recordHealthCheck(server *Server, healthy bool) {
+	result := "fail"
+	if healthy {
+		result = "pass"
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	checks := lb.vars.Get("health_checks").(*expvar.Map)
+	if checks.Get(server.name()) == nil {
+		results := new(expvar.Map).Init()
+		results.Add("pass", 0)
+		results.Add("fail", 0)
+		checks.Set(server.name(), results)
+	}
+	checks.Get(server.name()).(*expvar.Map).Add(result, 1)
+}
+
+// handleDebugVars serves the variables published with expvar, like expvar.Handler, together
+// with the load balancer's own under "loadbalancer". They aren't published globally so that
+// a process can run several load balancers.
+func (lb *LoadBalancer) handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", "loadbalancer", lb.vars)
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DecompressionConfig configures the handling of compressed request bodies for backends
+// that can't read them
+type DecompressionConfig struct {
+	// Reject rejects compressed requests with 415 Unsupported Media Type instead of
+	// decompressing them
+	Reject bool
+
+	// MaxBytes limits the decompressed size of request bodies, 10 MiB if zero
+	MaxBytes int64
+
+	// MaxRatio limits how many times larger than their Content-Length bodies may get when
+	// decompressed; zero means no limit
+	MaxRatio int64
+}
+
+// Decompress returns middleware that decompresses gzip and brotli request bodies before
+// they are forwarded. Bodies expanding beyond the limits are rejected with 413 Request
+// Entity Too Large and other encodings with 415 Unsupported Media Type.
+func Decompress(config DecompressionConfig) Middleware {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 10 << 20
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if encoding == "" || encoding == "identity" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if config.Reject {
+				http.Error(w, "Compressed request bodies are not supported", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			var body io.Reader
+			switch encoding {
+			case "gzip", "x-gzip":
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+					return
+				}
+				body = reader
+			case "br":
+				body = brotli.NewReader(r.Body)
+			default:
+				http.Error(w, "Unsupported request content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			limit := config.MaxBytes
+			if config.MaxRatio > 0 && r.ContentLength > 0 {
+				limit = min(limit, r.ContentLength*config.MaxRatio)
+			}
+			r.Body = http.MaxBytesReader(w, struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}, limit)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Discovery finds the servers of a target group
+type Discovery interface {
+	// Watch calls update with the current servers whenever they change, until ctx is done
+	Watch(ctx context.Context, update func(servers []*Server))
+}
+
+// Discover keeps the servers of a target group up to date from a Discovery until ctx is done
+func (lb *LoadBalancer) Discover(ctx context.Context, targetGroup *TargetGroup, discovery Discovery) {
+	go discovery.Watch(ctx, func(servers []*Server) {
+		lb.SetServers(targetGroup, servers)
+	})
+}
+
+// SetServers replaces the servers of a target group. The group's Servers are left as
+// configured; requests use the new servers from the route table.
+func (lb *LoadBalancer) SetServers(targetGroup *TargetGroup, servers []*Server) {
+	for _, server := range servers {
+		if server.HealthCheckPath == "" {
+			server.HealthCheckPath = lb.healthCheckPath
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.publishServers(targetGroup, servers)
+}
+
+// servers returns the current servers of a target group from the route table
+func (lb *LoadBalancer) servers(targetGroup *TargetGroup) []*Server {
+	return lb.routes.Load().servers[targetGroup]
+}
+
+// DNSDiscovery resolves a host name periodically and uses every address as a server
+type DNSDiscovery struct {
+	Host     string
+	Port     string
+	Scheme   string
+	Interval time.Duration
+	Resolver *net.Resolver
+}
+
+// Watch implements Discovery
+func (d *DNSDiscovery) Watch(ctx context.Context, update func(servers []*Server)) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	var last []string
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		addrs, err := resolver.LookupHost(ctx, d.Host)
+		if err != nil {
+			logger().Warn("dns discovery: lookup failed", "host", d.Host, "error", err)
+		} else {
+			sort.Strings(addrs)
+			if !equalStrings(addrs, last) {
+				servers := make([]*Server, 0, len(addrs))
+				for _, addr := range addrs {
+					host := addr
+					if d.Port != "" {
+						host = net.JoinHostPort(addr, d.Port)
+					}
+					servers = append(servers, &Server{URL: &url.URL{Scheme: scheme, Host: host}})
+				}
+				update(servers)
+				last = addrs
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newDNSDiscoveryFromConfig(params json.RawMessage) (Discovery, error) {
+	var config struct {
+		Type     string   `json:"type"`
+		Host     string   `json:"host"`
+		Port     string   `json:"port"`
+		Scheme   string   `json:"scheme"`
+		Interval Duration `json:"interval"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	if config.Host == "" {
+		return nil, fmt.Errorf("dns discovery needs a host")
+	}
+	return &DNSDiscovery{Host: config.Host, Port: config.Port, Scheme: config.Scheme, Interval: time.Duration(config.Interval)}, nil
+}
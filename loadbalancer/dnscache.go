@@ -0,0 +1,350 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCacheConfig configures a DNSCache. Zero values use the defaults.
+type DNSCacheConfig struct {
+	// MinTTL and MaxTTL bound how long resolved addresses are kept, whatever the TTLs of
+	// their records; 5s and 5m by default
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// DefaultTTL is used for names resolved without TTLs, e.g. from /etc/hosts or through
+	// search domains; 30s by default
+	DefaultTTL time.Duration
+
+	// NegativeTTL is how long failed lookups are remembered; 5s by default
+	NegativeTTL time.Duration
+}
+
+// DNSCache resolves backend host names, caching their addresses for the TTLs of their
+// records and failures for NegativeTTL. Names are looked up directly with the name servers
+// of /etc/resolv.conf to learn the TTLs, falling back to the system resolver for names
+// they don't resolve.
+type DNSCache struct {
+	config      DNSCacheConfig
+	nameservers []string
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+
+	// ready is closed once the lookup filling the entry is done
+	ready chan struct{}
+}
+
+// NewDNSCache creates a DNSCache
+func NewDNSCache(config DNSCacheConfig) *DNSCache {
+	if config.MinTTL <= 0 {
+		config.MinTTL = 5 * time.Second
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = 5 * time.Minute
+	}
+	if config.DefaultTTL <= 0 {
+		config.DefaultTTL = 30 * time.Second
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = 5 * time.Second
+	}
+	return &DNSCache{config: config, nameservers: readNameservers("/etc/resolv.conf"), entries: make(map[string]*dnsEntry)}
+}
+
+// WithDNSCache makes health checks fail for servers whose host name doesn't resolve,
+// without trying to connect. Transports resolve through the cache when it is set in their
+// TransportConfig.
+func WithDNSCache(cache *DNSCache) Option {
+	return func(lb *LoadBalancer) {
+		lb.dnsCache = cache
+	}
+}
+
+// Lookup returns the addresses of host, from the cache if they haven't expired. Concurrent
+// lookups of the same host share one query.
+func (c *DNSCache) Lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok {
+		select {
+		case <-entry.ready:
+			if time.Now().Before(entry.expires) {
+				c.mu.Unlock()
+				return entry.addrs, entry.err
+			}
+			ok = false
+		default:
+		}
+	}
+	if !ok {
+		entry = &dnsEntry{ready: make(chan struct{})}
+		c.entries[host] = entry
+		c.mu.Unlock()
+		go c.resolve(host, entry)
+	} else {
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve fills the entry, without the context of the request that found it missing so
+// the other requests waiting for it don't fail with that request
+func (c *DNSCache) resolve(host string, entry *dnsEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addrs, ttl, err := c.query(ctx, host)
+	if err != nil {
+		logger().Warn("dns lookup failed", "host", host, "error", err)
+		entry.err = err
+		ttl = c.config.NegativeTTL
+	} else {
+		entry.addrs = addrs
+		ttl = min(max(ttl, c.config.MinTTL), c.config.MaxTTL)
+	}
+	entry.expires = time.Now().Add(ttl)
+	close(entry.ready)
+}
+
+// query resolves host with the name servers, or the system resolver if they don't give an
+// answer
+func (c *DNSCache) query(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	for _, nameserver := range c.nameservers {
+		addrs, ttl, err := queryNameserver(ctx, nameserver, host)
+		if err == nil && len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, c.config.DefaultTTL, nil
+}
+
+// DialContext returns a dial function that resolves host names through the cache and
+// connects with dial to their addresses, in turn until one accepts
+func (c *DNSCache) DialContext(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.Lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// readNameservers returns the name server addresses of a resolv.conf file
+func readNameservers(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var nameservers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				nameservers = append(nameservers, net.JoinHostPort(ip.String(), "53"))
+			}
+		}
+	}
+	return nameservers
+}
+
+// DNS record types
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// queryNameserver asks the name server for the A and AAAA records of host, returning the
+// addresses and the lowest TTL among the answers
+func queryNameserver(ctx context.Context, nameserver, host string) ([]netip.Addr, time.Duration, error) {
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		found, foundTTL, err := queryRecords(ctx, nameserver, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs = append(addrs, found...)
+		if len(found) > 0 && (ttl < 0 || foundTTL < ttl) {
+			ttl = foundTTL
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// queryRecords sends one query over UDP and parses the addresses in its answer
+func queryRecords(ctx context.Context, nameserver, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	query, id, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", nameserver)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n >= 2 && dnsUint16(buf) == id {
+			return parseDNSAnswer(buf[:n], qtype)
+		}
+	}
+}
+
+// dnsQuery builds a recursive query for the records of the given type of host
+func dnsQuery(host string, qtype uint16) ([]byte, uint16, error) {
+	id := uint16(rand.Uint32())
+	msg := []byte{byte(id >> 8), byte(id)}
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // recursion desired, one question
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid host name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, 1) // class IN
+	return msg, id, nil
+}
+
+var errDNSMessage = errors.New("malformed DNS response")
+
+// parseDNSAnswer returns the addresses of the given type in a DNS response and their
+// lowest TTL
+func parseDNSAnswer(msg []byte, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errDNSMessage
+	}
+	flags := dnsUint16(msg[2:])
+	switch {
+	case flags&0x0200 != 0:
+		return nil, 0, errors.New("truncated DNS response")
+	case flags&0x000f == 3:
+		return nil, 0, errors.New("no such host")
+	case flags&0x000f != 0:
+		return nil, 0, fmt.Errorf("DNS response code %d", flags&0x000f)
+	}
+	questions := int(dnsUint16(msg[4:]))
+	answers := int(dnsUint16(msg[6:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+4 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		offset += 4
+	}
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	for i := 0; i < answers; i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+10 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		rtype := dnsUint16(msg[offset:])
+		recordTTL := time.Duration(dnsUint32(msg[offset+4:])) * time.Second
+		length := int(dnsUint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		data := msg[offset : offset+length]
+		offset += length
+
+		// CNAME records on the way to the addresses count with their TTLs too
+		if ttl < 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		if rtype != qtype {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(data); ok && (qtype == dnsTypeA) == addr.Is4() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// skipDNSName returns the offset after the possibly compressed name at offset, or -1 if
+// the name is malformed
+func skipDNSName(msg []byte, offset int) int {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			return offset + 2
+		}
+		offset += 1 + length
+	}
+	return -1
+}
+
+// dnsUint16 and dnsUint32 read the big-endian integers of DNS messages
+func dnsUint16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func dnsUint32(b []byte) uint32 {
+	return uint32(dnsUint16(b))<<16 | uint32(dnsUint16(b[2:]))
+}
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorResponse is a response the load balancer sends itself when it can't serve a request
+type ErrorResponse struct {
+	// Status is the response's status code
+	Status int
+
+	// Body is sent as text/plain, unless ContentType says otherwise
+	Body        string
+	ContentType string
+
+	// RetryAfter, when positive, is sent in a Retry-After header so clients know when to
+	// try again
+	RetryAfter time.Duration
+}
+
+var (
+	defaultUnmatchedResponse   = ErrorResponse{Status: http.StatusNotFound, Body: "404 page not found\n"}
+	defaultUnavailableResponse = ErrorResponse{Status: http.StatusServiceUnavailable, Body: "No healthy backend servers available\n"}
+)
+
+// WithUnmatchedResponse sets the response to requests matching no target group, 404 Not
+// Found by default
+func WithUnmatchedResponse(response ErrorResponse) Option {
+	return func(lb *LoadBalancer) {
+		lb.unmatched = response
+	}
+}
+
+// WithUnavailableResponse sets the response to requests whose target group has no healthy
+// server, 503 Service Unavailable by default
+func WithUnavailableResponse(response ErrorResponse) Option {
+	return func(lb *LoadBalancer) {
+		lb.unavailable = response
+	}
+}
+
+func (e ErrorResponse) write(w http.ResponseWriter) {
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((e.RetryAfter+time.Second-1)/time.Second)))
+	}
+	w.WriteHeader(e.Status)
+	w.Write([]byte(e.Body))
+}
@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// LatencyObserver is implemented by balancers that learn from how servers respond. Observe
+// is called with the time until a server's response headers arrived, or with the error if
+// there was no response.
+type LatencyObserver interface {
+	Observe(server *Server, latency time.Duration, err error)
+}
+
+// EWMA is a Balancer picking servers at random in proportion to the inverse of their
+// exponentially weighted moving average latency, so faster servers get more requests while
+// slower ones still get enough to notice when they recover
+type EWMA struct {
+	// Decay is the time over which old observations lose most of their weight, 10s if zero
+	Decay time.Duration
+
+	// ErrorPenalty is the latency recorded for failed requests, 1s if zero, so servers
+	// failing fast don't look fast
+	ErrorPenalty time.Duration
+
+	latencies map[string]*ewmaLatency
+}
+
+type ewmaLatency struct {
+	seconds float64
+	updated time.Time
+}
+
+// minEWMALatency keeps servers with tiny latencies from taking all requests
+const minEWMALatency = time.Millisecond
+
+// NewEWMA creates an EWMA Balancer with the default decay and error penalty
+func NewEWMA() Balancer {
+	return &EWMA{}
+}
+
+// Next picks a server with a probability proportional to the inverse of its latency.
+// Servers without observations are assumed to be as fast as the average.
+func (e *EWMA) Next(servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	seconds := make([]float64, len(servers))
+	var known, sum float64
+	for i, server := range servers {
+		if latency, ok := e.latencies[server.name()]; ok {
+			seconds[i] = latency.seconds
+			known++
+			sum += latency.seconds
+		}
+	}
+	average := minEWMALatency.Seconds()
+	if known > 0 {
+		average = sum / known
+	}
+
+	weights := make([]float64, len(servers))
+	var total float64
+	for i := range servers {
+		if seconds[i] == 0 {
+			seconds[i] = average
+		}
+		weights[i] = 1 / math.Max(seconds[i], minEWMALatency.Seconds())
+		total += weights[i]
+	}
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick -= weight; pick < 0 {
+			return servers[i]
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+// Observe implements LatencyObserver
+func (e *EWMA) Observe(server *Server, latency time.Duration, err error) {
+	if err != nil {
+		latency = max(latency, e.errorPenalty())
+	}
+	if e.latencies == nil {
+		e.latencies = make(map[string]*ewmaLatency)
+	}
+	now := time.Now()
+	current, ok := e.latencies[server.name()]
+	if !ok {
+		e.latencies[server.name()] = &ewmaLatency{seconds: latency.Seconds(), updated: now}
+		return
+	}
+	weight := math.Exp(-now.Sub(current.updated).Seconds() / e.decay().Seconds())
+	current.seconds = current.seconds*weight + latency.Seconds()*(1-weight)
+	current.updated = now
+}
+
+func (e *EWMA) decay() time.Duration {
+	if e.Decay <= 0 {
+		return 10 * time.Second
+	}
+	return e.Decay
+}
+
+func (e *EWMA) errorPenalty() time.Duration {
+	if e.ErrorPenalty <= 0 {
+		return time.Second
+	}
+	return e.ErrorPenalty
+}
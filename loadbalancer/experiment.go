@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExperimentConfig assigns clients to the variants of an A/B experiment. Assignment hashes
+// a client ID, so a client stays in its variant for as long as its ID stays the same.
+type ExperimentConfig struct {
+	Name     string
+	Variants []ExperimentVariant
+
+	// ClientHeader names a request header identifying clients, such as a user ID set by an
+	// authentication layer. Clients without it get a random ID in the Cookie cookie, which
+	// defaults to "lb_client_id".
+	ClientHeader string
+	Cookie       string
+	CookieMaxAge time.Duration
+}
+
+// ExperimentVariant is one arm of an experiment. Requests assigned to it go to TargetGroup,
+// or stay on the experiment's own group if it is nil.
+type ExperimentVariant struct {
+	Name        string
+	Weight      int
+	TargetGroup *TargetGroup
+}
+
+// experimentHeader tags requests to backends and responses to clients with the variants
+// they were assigned, as name=variant
+const experimentHeader = "X-Experiment"
+
+type experimentsKey struct{}
+
+// Experiments returns the variant the request was assigned to for each experiment it is in
+func Experiments(r *http.Request) map[string]string {
+	experiments, _ := r.Context().Value(experimentsKey{}).(map[string]string)
+	return experiments
+}
+
+// experimentAssignments returns the variants the request was assigned to as sorted
+// name=variant pairs, or "" if it isn't in an experiment
+func experimentAssignments(r *http.Request) string {
+	experiments := Experiments(r)
+	if len(experiments) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(experiments))
+	for name, variant := range experiments {
+		pairs = append(pairs, name+"="+variant)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// variant picks the variant for a client ID
+func (config ExperimentConfig) variant(clientID string) *ExperimentVariant {
+	total := 0
+	for _, variant := range config.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(config.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(clientID))
+	bucket := int(h.Sum64() % uint64(total))
+	for i := range config.Variants {
+		if bucket < config.Variants[i].Weight {
+			return &config.Variants[i]
+		}
+		bucket -= config.Variants[i].Weight
+	}
+	return nil
+}
+
+// experiment returns middleware that applies an ExperimentConfig
+func (lb *LoadBalancer) experiment(config ExperimentConfig) Middleware {
+	cookieName := config.Cookie
+	if cookieName == "" {
+		cookieName = "lb_client_id"
+	}
+	cookieMaxAge := config.CookieMaxAge
+	if cookieMaxAge == 0 {
+		cookieMaxAge = 365 * 24 * time.Hour
+	}
+	counters := make(map[string]*Counter)
+	for _, variant := range config.Variants {
+		counters[variant.Name] = lb.metrics.Counter("loadbalancer_experiment_requests_total", "Number of requests per experiment variant.",
+			"experiment", config.Name, "variant", variant.Name)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var clientID string
+			if config.ClientHeader != "" {
+				clientID = r.Header.Get(config.ClientHeader)
+			}
+			if clientID == "" {
+				if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
+					clientID = cookie.Value
+				} else {
+					clientID = randomToken()
+					http.SetCookie(w, &http.Cookie{
+						Name:     cookieName,
+						Value:    clientID,
+						Path:     "/",
+						MaxAge:   int(cookieMaxAge.Seconds()),
+						HttpOnly: true,
+						SameSite: http.SameSiteLaxMode,
+					})
+					// Later experiments in the chain see the same ID
+					r.AddCookie(&http.Cookie{Name: cookieName, Value: clientID})
+				}
+			}
+
+			variant := config.variant(clientID)
+			if variant == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			counters[variant.Name].Inc()
+
+			experiments := map[string]string{config.Name: variant.Name}
+			if previous := Experiments(r); previous != nil {
+				for name, assigned := range previous {
+					experiments[name] = assigned
+				}
+			} else {
+				// Don't pass on tags clients made up
+				r.Header.Del(experimentHeader)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), experimentsKey{}, experiments))
+			tag := config.Name + "=" + variant.Name
+			r.Header.Add(experimentHeader, tag)
+			w.Header().Add(experimentHeader, tag)
+
+			if variant.TargetGroup != nil {
+				lb.serveTargetGroup(w, r, variant.TargetGroup)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCachedResponsesAreKeptPerExperimentVariant(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.Header.Get(experimentHeader)))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	experiment := &ExperimentConfig{
+		Name:         "checkout",
+		Variants:     []ExperimentVariant{{Name: "a", Weight: 1}, {Name: "b", Weight: 1}},
+		ClientHeader: "X-User",
+	}
+	lb := NewLoadBalancer(WithTargetGroup(&TargetGroup{
+		URIPath:    "/",
+		Servers:    []*Server{{URL: backendURL}},
+		Experiment: experiment,
+		Cache:      &CacheConfig{DefaultTTL: time.Minute},
+	}))
+	defer lb.Close()
+
+	// A user in each variant
+	users := make(map[string]string)
+	for i := 0; len(users) < 2; i++ {
+		user := strconv.Itoa(i)
+		if variant := experiment.variant(user).Name; users[variant] == "" {
+			users[variant] = user
+		}
+	}
+	tests := []struct {
+		variant string
+		cache   string
+	}{
+		{"a", ""},
+		{"b", ""},
+		{"a", "HIT"},
+		{"b", "HIT"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", users[test.variant])
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+
+		want := "checkout=" + test.variant
+		if w.Body.String() != want || w.Header().Get(experimentHeader) != want {
+			t.Errorf("variant %s got the body %q tagged %q, want %q", test.variant, w.Body, w.Header().Values(experimentHeader), want)
+		}
+		if got := w.Header().Get("X-Cache"); got != test.cache {
+			t.Errorf("variant %s: X-Cache is %q, want %q", test.variant, got, test.cache)
+		}
+	}
+}
@@ -0,0 +1,666 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled expression evaluated against requests, used for routing predicates and
+// header rules in configuration files. The language has string, number and boolean literals,
+// the operators || && ! == != < <= > >= =~ !~ + - * / and parentheses, the request as req and
+// a few functions:
+//
+//	req.Header["X-Beta"] == "1" && rand() < 0.1
+//	req.Method == "POST" && has_prefix(req.Path, "/api/")
+//	in_cidr(req.ClientIP, "10.0.0.0/8") || req.Cookie["canary"] =~ "^(yes|true)$"
+//
+// req has the fields Method, Host, Path, Scheme, ClientIP, RequestID and the maps Header,
+// Query and Cookie, which return "" for missing keys. The functions are rand, lower, upper,
+// len, has_prefix, has_suffix, contains and in_cidr.
+type Expr struct {
+	source string
+	eval   exprFunc
+}
+
+type exprFunc func(r *http.Request) (any, error)
+
+// exprObject is a value with named fields, like req
+type exprObject func(r *http.Request, name string) (any, bool)
+
+// exprMap is a value indexed by string keys, like req.Header
+type exprMap func(key string) any
+
+// CompileExpr parses an expression
+func CompileExpr(source string) (*Expr, error) {
+	p := &exprParser{lexer: exprLexer{source: source}}
+	p.next()
+	eval, err := p.parseOr()
+	if err == nil && p.token.kind != tokenEOF {
+		err = p.errorf("unexpected %q", p.token.text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+	return &Expr{source: source, eval: eval}, nil
+}
+
+// String returns the expression's source
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression for a request
+func (e *Expr) Eval(r *http.Request) (any, error) {
+	return e.eval(r)
+}
+
+// Match reports whether the expression is true for a request. Errors, such as comparing
+// a string with a number, count as false.
+func (e *Expr) Match(r *http.Request) bool {
+	v, err := e.eval(r)
+	b, ok := v.(bool)
+	return err == nil && ok && b
+}
+
+// EvalString evaluates the expression for a request and formats the result as a string
+func (e *Expr) EvalString(r *http.Request) (string, error) {
+	v, err := e.eval(r)
+	if err != nil {
+		return "", err
+	}
+	return formatExprValue(v), nil
+}
+
+func formatExprValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// requestObject exposes a request to expressions as req
+func requestObject(r *http.Request, name string) (any, bool) {
+	switch name {
+	case "Method":
+		return r.Method, true
+	case "Host":
+		return r.Host, true
+	case "Path":
+		return r.URL.Path, true
+	case "Scheme":
+		return requestScheme(r), true
+	case "ClientIP":
+		return ClientIP(r).String(), true
+	case "RequestID":
+		return RequestID(r), true
+	case "Header":
+		return exprMap(func(key string) any { return r.Header.Get(key) }), true
+	case "Query":
+		query := r.URL.Query()
+		return exprMap(func(key string) any { return query.Get(key) }), true
+	case "Cookie":
+		return exprMap(func(key string) any {
+			if cookie, err := r.Cookie(key); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}), true
+	}
+	return nil, false
+}
+
+var exprFunctions = map[string]func(args []any) (any, error){
+	"rand": func(args []any) (any, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("rand takes no arguments")
+		}
+		return rand.Float64(), nil
+	},
+	"lower": stringFunction("lower", strings.ToLower),
+	"upper": stringFunction("upper", strings.ToUpper),
+	"len": func(args []any) (any, error) {
+		s, err := stringArgs("len", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return float64(len(s[0])), nil
+	},
+	"has_prefix": stringPredicate("has_prefix", strings.HasPrefix),
+	"has_suffix": stringPredicate("has_suffix", strings.HasSuffix),
+	"contains":   stringPredicate("contains", strings.Contains),
+	"in_cidr": func(args []any) (any, error) {
+		s, err := stringArgs("in_cidr", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(s[0])
+		if err != nil {
+			return false, nil
+		}
+		prefix, err := netip.ParsePrefix(s[1])
+		if err != nil {
+			return nil, err
+		}
+		return prefix.Contains(addr.Unmap()), nil
+	},
+}
+
+func stringArgs(name string, args []any, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d arguments", name, n)
+	}
+	s := make([]string, n)
+	for i, arg := range args {
+		var ok bool
+		if s[i], ok = arg.(string); !ok {
+			return nil, fmt.Errorf("%s takes string arguments", name)
+		}
+	}
+	return s, nil
+}
+
+func stringFunction(name string, f func(string) string) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		s, err := stringArgs(name, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0]), nil
+	}
+}
+
+func stringPredicate(name string, f func(s, substr string) bool) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		s, err := stringArgs(name, args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0], s[1]), nil
+	}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type exprLexer struct {
+	source string
+	pos    int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "!", "<", ">", "+", "-", "*", "/", "(", ")", "[", "]", ".", ","}
+
+func (l *exprLexer) next() (exprToken, error) {
+	for l.pos < len(l.source) && strings.ContainsRune(" \t\r\n", rune(l.source[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.source) {
+		return exprToken{kind: tokenEOF, pos: start}, nil
+	}
+	c := l.source[l.pos]
+	switch {
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.source) && (l.source[l.pos] >= '0' && l.source[l.pos] <= '9' || l.source[l.pos] == '.') {
+			l.pos++
+		}
+		return exprToken{kind: tokenNumber, text: l.source[start:l.pos], pos: start}, nil
+	case c == '"' || c == '\'':
+		for l.pos++; l.pos < len(l.source) && l.source[l.pos] != c; l.pos++ {
+			if l.source[l.pos] == '\\' {
+				l.pos++
+			}
+		}
+		if l.pos >= len(l.source) {
+			return exprToken{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		text := l.source[start:l.pos]
+		if c == '\'' {
+			text = `"` + strings.ReplaceAll(text[1:len(text)-1], `"`, `\"`) + `"`
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return exprToken{}, fmt.Errorf("invalid string at %d", start)
+		}
+		return exprToken{kind: tokenString, text: value, pos: start}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.source) {
+			c := l.source[l.pos]
+			if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+				break
+			}
+			l.pos++
+		}
+		return exprToken{kind: tokenIdent, text: l.source[start:l.pos], pos: start}, nil
+	}
+	for _, op := range exprOperators {
+		if strings.HasPrefix(l.source[l.pos:], op) {
+			l.pos += len(op)
+			return exprToken{kind: tokenOperator, text: op, pos: start}, nil
+		}
+	}
+	return exprToken{}, fmt.Errorf("unexpected %q at %d", c, start)
+}
+
+// exprParser is a recursive descent parser compiling expressions to closures
+type exprParser struct {
+	lexer exprLexer
+	token exprToken
+	err   error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.token, p.err = p.lexer.next()
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf(format+" at %d", append(args, p.token.pos)...)
+}
+
+func (p *exprParser) accept(op string) bool {
+	if p.err == nil && p.token.kind == tokenOperator && p.token.text == op {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprFunc, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right exprFunc
+		if right, err = p.parseAnd(); err == nil {
+			left = logical(left, right, true)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprFunc, error) {
+	left, err := p.parseComparison()
+	for err == nil && p.accept("&&") {
+		var right exprFunc
+		if right, err = p.parseComparison(); err == nil {
+			left = logical(left, right, false)
+		}
+	}
+	return left, err
+}
+
+// logical short-circuits: || stops at the first true operand, && at the first false one
+func logical(left, right exprFunc, stopAt bool) exprFunc {
+	return func(r *http.Request) (any, error) {
+		for _, operand := range []exprFunc{left, right} {
+			v, err := operand(r)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("logical operator on %T", v)
+			}
+			if b == stopAt {
+				return b, nil
+			}
+		}
+		return !stopAt, nil
+	}
+}
+
+func (p *exprParser) parseComparison() (exprFunc, error) {
+	left, err := p.parseAdditive()
+	if err != nil || p.token.kind != tokenOperator {
+		return left, err
+	}
+	op := p.token.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return binary(left, right, func(a, b any) (any, error) { return compare(op, a, b) }), nil
+	case "=~", "!~":
+		p.next()
+		negate := op == "!~"
+		var right exprFunc
+		if p.token.kind == tokenString && !p.continuesOperand() {
+			// Compile constant patterns once
+			pattern, err := regexp.Compile(p.token.text)
+			if err != nil {
+				return nil, err
+			}
+			p.next()
+			right = constant(pattern)
+		} else if right, err = p.parseAdditive(); err != nil {
+			return nil, err
+		}
+		return binary(left, right, func(a, b any) (any, error) {
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s on %T", op, a)
+			}
+			pattern, ok := b.(*regexp.Regexp)
+			if !ok {
+				source, ok := b.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s pattern is %T", op, b)
+				}
+				var err error
+				if pattern, err = regexp.Compile(source); err != nil {
+					return nil, err
+				}
+			}
+			return pattern.MatchString(s) != negate, nil
+		}), nil
+	}
+	return left, nil
+}
+
+// continuesOperand reports whether the token after the current one extends an operand
+func (p *exprParser) continuesOperand() bool {
+	lexer := p.lexer
+	following, err := lexer.next()
+	return err == nil && following.kind == tokenOperator && strings.Contains("+-*/[.", following.text)
+}
+
+func compare(op string, a, b any) (any, error) {
+	// Objects and maps are funcs, which == can't compare
+	for _, v := range []any{a, b} {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return nil, fmt.Errorf("%s on %T", op, v)
+		}
+	}
+	switch op {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	}
+	var c int
+	switch a := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return nil, fmt.Errorf("comparing number with %T", b)
+		}
+		switch {
+		case a < y:
+			c = -1
+		case a > y:
+			c = 1
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("comparing string with %T", b)
+		}
+		c = strings.Compare(a, y)
+	default:
+		return nil, fmt.Errorf("%s on %T", op, a)
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func binary(left, right exprFunc, op func(a, b any) (any, error)) exprFunc {
+	return func(r *http.Request) (any, error) {
+		a, err := left(r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(r)
+		if err != nil {
+			return nil, err
+		}
+		return op(a, b)
+	}
+}
+
+func (p *exprParser) parseAdditive() (exprFunc, error) {
+	left, err := p.parseMultiplicative()
+	for err == nil && p.token.kind == tokenOperator && (p.token.text == "+" || p.token.text == "-") {
+		op := p.token.text
+		p.next()
+		var right exprFunc
+		if right, err = p.parseMultiplicative(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return arithmetic(op, a, b) })
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseMultiplicative() (exprFunc, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.token.kind == tokenOperator && (p.token.text == "*" || p.token.text == "/") {
+		op := p.token.text
+		p.next()
+		var right exprFunc
+		if right, err = p.parseUnary(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return arithmetic(op, a, b) })
+		}
+	}
+	return left, err
+}
+
+// arithmetic applies a numeric operator; + also concatenates strings
+func arithmetic(op string, a, b any) (any, error) {
+	if s, ok := a.(string); ok && op == "+" {
+		t, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("adding string and %T", b)
+		}
+		return s + t, nil
+	}
+	x, ok1 := a.(float64)
+	y, ok2 := b.(float64)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s on %T and %T", op, a, b)
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	}
+	return x / y, nil
+}
+
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	switch {
+	case p.accept("!"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) (any, error) {
+			v, err := operand(r)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("! on %T", v)
+			}
+			return !b, nil
+		}, nil
+	case p.accept("-"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *http.Request) (any, error) {
+			v, err := operand(r)
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic("-", 0.0, v)
+		}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprFunc, error) {
+	value, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.accept("."):
+			if p.token.kind != tokenIdent {
+				return nil, p.errorf("expected field name")
+			}
+			name := p.token.text
+			p.next()
+			object := value
+			value = func(r *http.Request) (any, error) {
+				v, err := object(r)
+				if err != nil {
+					return nil, err
+				}
+				fields, ok := v.(exprObject)
+				if !ok {
+					return nil, fmt.Errorf("field %s of %T", name, v)
+				}
+				field, ok := fields(r, name)
+				if !ok {
+					return nil, fmt.Errorf("unknown field %s", name)
+				}
+				return field, nil
+			}
+		case p.accept("["):
+			var key exprFunc
+			if key, err = p.parseOr(); err != nil {
+				return nil, err
+			}
+			if !p.accept("]") {
+				return nil, p.errorf("expected ]")
+			}
+			value = binary(value, key, func(a, b any) (any, error) {
+				m, ok := a.(exprMap)
+				if !ok {
+					return nil, fmt.Errorf("indexing %T", a)
+				}
+				return m(formatExprValue(b)), nil
+			})
+		default:
+			return value, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	token := p.token
+	switch token.kind {
+	case tokenNumber:
+		p.next()
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", token.text, token.pos)
+		}
+		return constant(n), nil
+	case tokenString:
+		p.next()
+		return constant(token.text), nil
+	case tokenIdent:
+		p.next()
+		switch token.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "req":
+			return constant(exprObject(requestObject)), nil
+		}
+		function, ok := exprFunctions[token.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown name %s at %d", token.text, token.pos)
+		}
+		if !p.accept("(") {
+			return nil, p.errorf("expected ( after %s", token.text)
+		}
+		var args []exprFunc
+		for !p.accept(")") {
+			if len(args) > 0 && !p.accept(",") {
+				return nil, p.errorf("expected , or )")
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return func(r *http.Request) (any, error) {
+			values := make([]any, len(args))
+			for i, arg := range args {
+				v, err := arg(r)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = v
+			}
+			return function(values)
+		}, nil
+	case tokenOperator:
+		if p.accept("(") {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, p.errorf("expected )")
+			}
+			return inner, nil
+		}
+	case tokenEOF:
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", token.text)
+}
+
+func constant(v any) exprFunc {
+	return func(*http.Request) (any, error) { return v, nil }
+}
@@ -0,0 +1,107 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbwtg/loadbalancer"
+)
+
+func TestExpr(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/api/users?debug=1", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Beta", "1")
+	r.AddCookie(&http.Cookie{Name: "canary", Value: "yes"})
+
+	tests := []struct {
+		source string
+		want   any
+	}{
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`-4 / 2`, -2.0},
+		{`"a" + "b"`, "ab"},
+		{`1 < 2 && 2 <= 2 && 3 > 2 && 3 >= 4`, false},
+		{`"abc" < "abd"`, true},
+		{`true == true`, true},
+		{`1 == "1"`, false},
+		{`!(1 != 1)`, true},
+		{`false || true`, true},
+		{`req.Method == "POST" && has_prefix(req.Path, "/api/")`, true},
+		{`req.Header["X-Beta"] == "1"`, true},
+		{`req.Header["X-Missing"]`, ""},
+		{`req.Query["debug"]`, "1"},
+		{`req.Cookie["canary"] =~ "^(yes|true)$"`, true},
+		{`req.Host !~ "^api\\."`, true},
+		{`in_cidr(req.ClientIP, "10.0.0.0/8")`, true},
+		{`in_cidr(req.ClientIP, "192.168.0.0/16")`, false},
+		{`upper(lower("MiXed"))`, "MIXED"},
+		{`len(req.Path)`, 10.0},
+		{`has_suffix(req.Path, "users") && contains(req.Path, "pi/u")`, true},
+		{`rand() < 1`, true},
+		// The right operand isn't evaluated once the result is known
+		{`true || 1`, true},
+		{`false && 1`, false},
+	}
+	for _, test := range tests {
+		expr, err := loadbalancer.CompileExpr(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if got, err := expr.Eval(r); err != nil || got != test.want {
+			t.Errorf("%s = %v (%v), want %v", test.source, got, err, test.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		source     string
+		compileErr bool
+	}{
+		{`1 +`, true},
+		{`(1`, true},
+		{`req.`, true},
+		{`req.Header["a"`, true},
+		{`unknown(1)`, true},
+		{`rand`, true},
+		{`"unterminated`, true},
+		{`1 2`, true},
+		{`"a" =~ "("`, true},
+		{`req.Header == req.Query`, false},
+		{`req == req`, false},
+		{`req != 1`, false},
+		{`req.Header < "a"`, false},
+		{`1 < "a"`, false},
+		{`"a" - "b"`, false},
+		{`!1`, false},
+		{`1 && true`, false},
+		{`req.Bogus`, false},
+		{`req.Method.Length`, false},
+		{`req.Method["a"]`, false},
+		{`lower(1)`, false},
+		{`in_cidr("10.0.0.1", "bad")`, false},
+	}
+	for _, test := range tests {
+		expr, err := loadbalancer.CompileExpr(test.source)
+		if test.compileErr {
+			if err == nil {
+				t.Errorf("%s compiled", test.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if got, err := expr.Eval(r); err == nil {
+			t.Errorf("%s = %v, want an error", test.source, got)
+		}
+		if expr.Match(r) {
+			t.Errorf("%s matched", test.source)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// FaultConfig injects delays and errors into a target group's requests so clients can test
+// their retry and timeout handling
+type FaultConfig struct {
+	// Delay is added before the fraction DelayPercent (0 to 100) of requests are forwarded
+	Delay        time.Duration
+	DelayPercent float64
+
+	// AbortStatus is returned instead of forwarding the fraction AbortPercent of requests
+	AbortStatus  int
+	AbortPercent float64
+
+	// Header, when set, limits faults to requests carrying the header, so only clients
+	// asking for faults get them
+	Header string
+}
+
+// Fault returns middleware that injects the configured faults
+func Fault(config FaultConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.Header != "" && r.Header.Get(config.Header) == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if config.Delay > 0 && rand.Float64()*100 < config.DelayPercent {
+				timer := time.NewTimer(config.Delay)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			if config.AbortStatus != 0 && rand.Float64()*100 < config.AbortPercent {
+				http.Error(w, "Injected fault", config.AbortStatus)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package loadbalancer
+
+import (
+	"os"
+	"syscall"
+)
+
+// registerFDMetrics exports the process's open and maximum file descriptors
+func registerFDMetrics(metrics *Metrics) {
+	metrics.GaugeFunc("process_open_fds", "Number of open file descriptors.", func() float64 {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return float64(len(entries))
+	})
+	metrics.GaugeFunc("process_max_fds", "Maximum number of open file descriptors.", func() float64 {
+		var limit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+			return -1
+		}
+		return float64(limit.Cur)
+	})
+}
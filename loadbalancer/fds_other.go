@@ -0,0 +1,6 @@
+//go:build !linux
+
+package loadbalancer
+
+// registerFDMetrics does nothing on platforms without /proc/self/fd
+func registerFDMetrics(metrics *Metrics) {}
@@ -0,0 +1,550 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GatewayConfig reads routes from Kubernetes Gateway API resources: the HTTPRoutes attached
+// to the Gateways of a GatewayClass become target groups, routed to the Services of their
+// backendRefs by weight. Zero values use the in-cluster defaults.
+type GatewayConfig struct {
+	// GatewayClass selects the Gateways, by their gatewayClassName, whose routes are served
+	GatewayClass string
+
+	// Namespace limits the Gateways and HTTPRoutes read to one namespace; all namespaces
+	// are read if empty
+	Namespace string
+
+	// Interval is how often the resources are read again by WatchGateway; 10s by default
+	Interval time.Duration
+
+	// APIServer is the URL of the Kubernetes API server; https://$KUBERNETES_SERVICE_HOST:
+	// $KUBERNETES_SERVICE_PORT by default
+	APIServer string
+
+	// TokenFile and CAFile authenticate to the API server and verify it; the service
+	// account's by default. The token is read for every request so rotated tokens are used.
+	TokenFile string
+	CAFile    string
+
+	// ClusterDomain is the DNS domain of the cluster's Services; cluster.local by default
+	ClusterDomain string
+}
+
+const (
+	gatewayGroup = "gateway.networking.k8s.io"
+	saDir        = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+// gatewayRoutes are translated HTTPRoutes: a virtual host for each of their host names,
+// and the target groups of routes without host names
+type gatewayRoutes struct {
+	VirtualHosts []VirtualHostSpec `json:"virtual_hosts"`
+	TargetGroups []TargetGroupSpec `json:"target_groups"`
+}
+
+// merge adds the routes to a configuration. Host names the configuration already has a
+// virtual host for are left to it.
+func (routes *gatewayRoutes) merge(config *Config) {
+	hosts := make(map[string]bool)
+	for _, vhost := range config.VirtualHosts {
+		for _, host := range vhost.Hosts {
+			hosts[strings.ToLower(host)] = true
+		}
+	}
+	for _, vhost := range routes.VirtualHosts {
+		if hosts[vhost.Hosts[0]] {
+			logger().Warn("gateway: host is configured in the configuration file, ignoring its routes", "host", vhost.Hosts[0])
+			continue
+		}
+		config.VirtualHosts = append(config.VirtualHosts, vhost)
+	}
+	config.TargetGroups = append(config.TargetGroups, routes.TargetGroups...)
+}
+
+// objectMeta is the metadata of a Kubernetes object
+type objectMeta struct {
+	Name              string    `json:"name"`
+	Namespace         string    `json:"namespace"`
+	CreationTimestamp time.Time `json:"creationTimestamp"`
+}
+
+type gatewayList struct {
+	Items []struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     struct {
+			GatewayClassName string `json:"gatewayClassName"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type httpRouteList struct {
+	Items []httpRoute `json:"items"`
+}
+
+type httpRoute struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ParentRefs []gatewayRef    `json:"parentRefs"`
+		Hostnames  []string        `json:"hostnames"`
+		Rules      []httpRouteRule `json:"rules"`
+	} `json:"spec"`
+}
+
+// gatewayRef is a parentRef or backendRef of an HTTPRoute
+type gatewayRef struct {
+	Group     *string `json:"group"`
+	Kind      *string `json:"kind"`
+	Namespace string  `json:"namespace"`
+	Name      string  `json:"name"`
+	Port      int     `json:"port"`
+	Weight    *int    `json:"weight"`
+}
+
+type httpRouteRule struct {
+	Matches     []httpRouteMatch  `json:"matches"`
+	Filters     []httpRouteFilter `json:"filters"`
+	BackendRefs []gatewayRef      `json:"backendRefs"`
+}
+
+type httpRouteMatch struct {
+	Path *struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"path"`
+	Headers     []httpRouteValueMatch `json:"headers"`
+	QueryParams []httpRouteValueMatch `json:"queryParams"`
+	Method      string                `json:"method"`
+}
+
+type httpRouteValueMatch struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type httpRouteFilter struct {
+	Type                   string               `json:"type"`
+	RequestHeaderModifier  *httpHeaderModifier  `json:"requestHeaderModifier"`
+	ResponseHeaderModifier *httpHeaderModifier  `json:"responseHeaderModifier"`
+	RequestRedirect        *httpRequestRedirect `json:"requestRedirect"`
+}
+
+type httpHeaderModifier struct {
+	Set []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"set"`
+	Add []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type httpRequestRedirect struct {
+	Scheme   *string `json:"scheme"`
+	Hostname *string `json:"hostname"`
+	Port     *int    `json:"port"`
+	Path     *struct {
+		Type            string  `json:"type"`
+		ReplaceFullPath *string `json:"replaceFullPath"`
+	} `json:"path"`
+	StatusCode *int `json:"statusCode"`
+}
+
+// routes reads the Gateways and HTTPRoutes and translates the routes attached to the
+// class's Gateways
+func (g *GatewayConfig) routes(ctx context.Context) (*gatewayRoutes, error) {
+	client, err := g.client()
+	if err != nil {
+		return nil, err
+	}
+	defer client.CloseIdleConnections()
+	var gateways gatewayList
+	if err := g.list(ctx, client, "gateways", &gateways); err != nil {
+		return nil, err
+	}
+	var routes httpRouteList
+	if err := g.list(ctx, client, "httproutes", &routes); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]bool)
+	for _, gateway := range gateways.Items {
+		if gateway.Spec.GatewayClassName == g.GatewayClass {
+			selected[gateway.Metadata.Namespace+"/"+gateway.Metadata.Name] = true
+		}
+	}
+	var attached []httpRoute
+	for _, route := range routes.Items {
+		for _, parent := range route.Spec.ParentRefs {
+			namespace := parent.Namespace
+			if namespace == "" {
+				namespace = route.Metadata.Namespace
+			}
+			if isGatewayRef(parent, gatewayGroup, "Gateway") && selected[namespace+"/"+parent.Name] {
+				attached = append(attached, route)
+				break
+			}
+		}
+	}
+	return g.translate(attached), nil
+}
+
+// isGatewayRef reports whether a reference is to the group and kind, which it defaults to
+func isGatewayRef(ref gatewayRef, group, kind string) bool {
+	return (ref.Group == nil || *ref.Group == group) && (ref.Kind == nil || *ref.Kind == kind)
+}
+
+// client returns a client for the API server
+func (g *GatewayConfig) client() (*http.Client, error) {
+	caFile := g.CAFile
+	if caFile == "" {
+		caFile = saDir + "ca.crt"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if _, err := os.Stat(caFile); err == nil || g.CAFile != "" {
+		cas, err := readCertificates(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("gateway: %w", err)
+		}
+		pool := x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// list reads the resources of a Gateway API kind
+func (g *GatewayConfig) list(ctx context.Context, client *http.Client, resource string, into any) error {
+	server := g.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return fmt.Errorf("gateway: no API server given and not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+	path := "/apis/" + gatewayGroup + "/v1/"
+	if g.Namespace != "" {
+		path += "namespaces/" + url.PathEscape(g.Namespace) + "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+path+resource, nil)
+	if err != nil {
+		return err
+	}
+	tokenFile := g.TokenFile
+	if tokenFile == "" {
+		tokenFile = saDir + "token"
+	}
+	if token, err := os.ReadFile(tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if g.TokenFile != "" {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway: listing %s: %s", resource, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(into); err != nil {
+		return fmt.Errorf("gateway: listing %s: %w", resource, err)
+	}
+	return nil
+}
+
+// gatewayMatch is a target group translated from a match of a route rule, with what
+// orders it among the groups of a host
+type gatewayMatch struct {
+	group   TargetGroupSpec
+	exact   bool
+	prefix  int
+	method  bool
+	headers int
+	query   int
+}
+
+// translate turns the routes into target groups. Within a host, groups are ordered by the
+// precedence the Gateway API gives their matches: exact paths, then longer prefixes, then
+// matches with a method, more headers and more query parameters, then older routes.
+func (g *GatewayConfig) translate(routes []httpRoute) *gatewayRoutes {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].Metadata, routes[j].Metadata
+		if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(b.CreationTimestamp)
+		}
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	})
+
+	byHost := make(map[string][]gatewayMatch)
+	for _, route := range routes {
+		for i, rule := range route.Spec.Rules {
+			name := fmt.Sprintf("httproute/%s/%s/%d", route.Metadata.Namespace, route.Metadata.Name, i)
+			matches, err := g.translateRule(route.Metadata.Namespace, name, rule)
+			if err != nil {
+				logger().Warn("gateway: ignoring route rule", "route", name, "error", err)
+				continue
+			}
+			hostnames := route.Spec.Hostnames
+			if len(hostnames) == 0 {
+				hostnames = []string{""}
+			}
+			for _, host := range hostnames {
+				host = strings.ToLower(host)
+				byHost[host] = append(byHost[host], matches...)
+			}
+		}
+	}
+
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	translated := &gatewayRoutes{}
+	for _, host := range hosts {
+		matches := byHost[host]
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, b := matches[i], matches[j]
+			switch {
+			case a.exact != b.exact:
+				return a.exact
+			case a.prefix != b.prefix:
+				return a.prefix > b.prefix
+			case a.method != b.method:
+				return a.method
+			case a.headers != b.headers:
+				return a.headers > b.headers
+			}
+			return a.query > b.query
+		})
+		groups := make([]TargetGroupSpec, len(matches))
+		for i, match := range matches {
+			groups[i] = match.group
+		}
+		if host == "" {
+			translated.TargetGroups = groups
+		} else {
+			translated.VirtualHosts = append(translated.VirtualHosts, VirtualHostSpec{Hosts: []string{host}, TargetGroups: groups})
+		}
+	}
+	return translated
+}
+
+// translateRule returns a target group for each match of a route rule
+func (g *GatewayConfig) translateRule(namespace, name string, rule httpRouteRule) ([]gatewayMatch, error) {
+	var template TargetGroupSpec
+	for _, filter := range rule.Filters {
+		switch {
+		case filter.Type == "RequestHeaderModifier" && filter.RequestHeaderModifier != nil:
+			template.Headers = headerModifierRules(template.Headers, filter.RequestHeaderModifier, false)
+		case filter.Type == "ResponseHeaderModifier" && filter.ResponseHeaderModifier != nil:
+			template.Headers = headerModifierRules(template.Headers, filter.ResponseHeaderModifier, true)
+		case filter.Type == "RequestRedirect" && filter.RequestRedirect != nil:
+			redirect, err := redirectFilter(filter.RequestRedirect)
+			if err != nil {
+				return nil, err
+			}
+			template.Redirect = redirect
+		default:
+			return nil, fmt.Errorf("unsupported filter %s", filter.Type)
+		}
+	}
+
+	if template.Redirect == nil {
+		domain := g.ClusterDomain
+		if domain == "" {
+			domain = "cluster.local"
+		}
+		for _, backend := range rule.BackendRefs {
+			if !isGatewayRef(backend, "", "Service") {
+				return nil, fmt.Errorf("unsupported backend kind")
+			}
+			weight := 1
+			if backend.Weight != nil {
+				weight = *backend.Weight
+			}
+			if weight == 0 {
+				continue
+			}
+			if backend.Port == 0 {
+				return nil, fmt.Errorf("backend %s has no port", backend.Name)
+			}
+			backendNamespace := backend.Namespace
+			if backendNamespace == "" {
+				backendNamespace = namespace
+			}
+			template.Servers = append(template.Servers, ServerSpec{
+				URL:    fmt.Sprintf("http://%s.%s.svc.%s:%d", backend.Name, backendNamespace, domain, backend.Port),
+				Weight: weight,
+			})
+		}
+		if len(template.Servers) == 0 {
+			return nil, fmt.Errorf("no backends")
+		}
+	}
+
+	matches := rule.Matches
+	if len(matches) == 0 {
+		matches = []httpRouteMatch{{}}
+	}
+	translated := make([]gatewayMatch, 0, len(matches))
+	for i, match := range matches {
+		expr, err := gatewayMatchExpr(match)
+		if err != nil {
+			return nil, err
+		}
+		group := template
+		group.Name = fmt.Sprintf("%s/%d", name, i)
+		group.Match = expr
+		m := gatewayMatch{group: group, method: match.Method != "", headers: len(match.Headers), query: len(match.QueryParams)}
+		if match.Path != nil {
+			m.exact = match.Path.Type == "Exact"
+			m.prefix = len(match.Path.Value)
+		} else {
+			m.prefix = 1
+		}
+		translated = append(translated, m)
+	}
+	return translated, nil
+}
+
+// gatewayMatchExpr returns an expression matching the requests an HTTPRoute match does
+func gatewayMatchExpr(match httpRouteMatch) (string, error) {
+	var conditions []string
+	pathType, path := "PathPrefix", "/"
+	if match.Path != nil {
+		if match.Path.Type != "" {
+			pathType = match.Path.Type
+		}
+		if match.Path.Value != "" {
+			path = match.Path.Value
+		}
+	}
+	switch pathType {
+	case "Exact":
+		conditions = append(conditions, "req.Path == "+strconv.Quote(path))
+	case "PathPrefix":
+		if path = strings.TrimSuffix(path, "/"); path != "" {
+			conditions = append(conditions, fmt.Sprintf("(req.Path == %s || has_prefix(req.Path, %s))", strconv.Quote(path), strconv.Quote(path+"/")))
+		}
+	case "RegularExpression":
+		conditions = append(conditions, "req.Path =~ "+strconv.Quote(path))
+	default:
+		return "", fmt.Errorf("unsupported path match %s", pathType)
+	}
+	if match.Method != "" {
+		conditions = append(conditions, "req.Method == "+strconv.Quote(match.Method))
+	}
+	for _, header := range match.Headers {
+		condition, err := valueMatchExpr("req.Header", header)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+	for _, param := range match.QueryParams {
+		condition, err := valueMatchExpr("req.Query", param)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 0 {
+		return "true", nil
+	}
+	return strings.Join(conditions, " && "), nil
+}
+
+// valueMatchExpr returns an expression matching a header or query parameter of the map
+func valueMatchExpr(field string, match httpRouteValueMatch) (string, error) {
+	value := field + "[" + strconv.Quote(match.Name) + "]"
+	switch match.Type {
+	case "", "Exact":
+		return value + " == " + strconv.Quote(match.Value), nil
+	case "RegularExpression":
+		return value + " =~ " + strconv.Quote(match.Value), nil
+	}
+	return "", fmt.Errorf("unsupported match %s for %s", match.Type, match.Name)
+}
+
+// headerModifierRules adds header rules for a header modifier filter
+func headerModifierRules(rules *HeaderRulesSpec, modifier *httpHeaderModifier, response bool) *HeaderRulesSpec {
+	if rules == nil {
+		rules = &HeaderRulesSpec{}
+	}
+	var added []HeaderRuleSpec
+	rule := func(action, name, value string) HeaderRuleSpec {
+		// Values are literal, not expanded like configured ones
+		if strings.Contains(value, "$") {
+			return HeaderRuleSpec{Action: action, Name: name, Expr: strconv.Quote(value)}
+		}
+		return HeaderRuleSpec{Action: action, Name: name, Value: value}
+	}
+	for _, header := range modifier.Set {
+		added = append(added, rule("set", header.Name, header.Value))
+	}
+	for _, header := range modifier.Add {
+		added = append(added, rule("add", header.Name, header.Value))
+	}
+	for _, name := range modifier.Remove {
+		added = append(added, HeaderRuleSpec{Action: "remove", Name: name})
+	}
+	if response {
+		rules.Response = append(rules.Response, added...)
+	} else {
+		rules.Request = append(rules.Request, added...)
+	}
+	return rules
+}
+
+// redirectFilter translates a request redirect filter
+func redirectFilter(filter *httpRequestRedirect) (*RedirectSpec, error) {
+	// ${host} keeps the request's port, which another scheme or host name doesn't
+	scheme, host := "${scheme}", "${host}"
+	if filter.Scheme != nil {
+		scheme, host = *filter.Scheme, "${hostname}"
+	}
+	if filter.Hostname != nil {
+		host = *filter.Hostname
+	}
+	if filter.Port != nil {
+		host = strings.TrimSuffix(strings.TrimSuffix(host, "${host}"), "${hostname}")
+		if host == "" {
+			host = "${hostname}"
+		}
+		host += ":" + strconv.Itoa(*filter.Port)
+	}
+	path := "${request_uri}"
+	if filter.Path != nil {
+		if filter.Path.Type != "ReplaceFullPath" || filter.Path.ReplaceFullPath == nil {
+			return nil, fmt.Errorf("unsupported redirect path %s", filter.Path.Type)
+		}
+		path = *filter.Path.ReplaceFullPath + "${query}"
+	}
+	status := http.StatusFound
+	if filter.StatusCode != nil {
+		status = *filter.StatusCode
+	}
+	return &RedirectSpec{Target: scheme + "://" + host + path, Status: status}, nil
+}
@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoLocation is the location of a client address
+type GeoLocation struct {
+	// Country is the ISO 3166-1 country code, e.g. "DE"
+	Country string
+
+	// Region is the ISO 3166-2 code of the country subdivision, e.g. "US-CA"
+	Region string
+
+	// Continent is the continent code, e.g. "EU"
+	Continent string
+}
+
+// GeoIP looks up client locations in a MaxMind-format (GeoIP2/GeoLite2 City or Country) database
+type GeoIP struct {
+	path    string
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	done    chan struct{}
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// OpenGeoIP opens the database at path. If reloadInterval is positive, the file is checked
+// that often and reopened when it has changed, so database updates don't need a restart.
+func OpenGeoIP(path string, reloadInterval time.Duration) (*GeoIP, error) {
+	g := &GeoIP{path: path, done: make(chan struct{})}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go g.watch(reloadInterval)
+	}
+	return g, nil
+}
+
+// load opens the database file and swaps it in for the current one
+func (g *GeoIP) load() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.Open(g.path)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	old := g.reader
+	g.reader = reader
+	g.modTime = info.ModTime()
+	g.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (g *GeoIP) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(g.path)
+			if err != nil {
+				logger().Error("geoip: watching database failed", "error", err)
+				continue
+			}
+			g.mu.RLock()
+			changed := !info.ModTime().Equal(g.modTime)
+			g.mu.RUnlock()
+			if changed {
+				if err := g.load(); err != nil {
+					logger().Error("geoip: reloading database failed", "path", g.path, "error", err)
+				} else {
+					logger().Info("geoip: reloaded database", "path", g.path)
+				}
+			}
+		}
+	}
+}
+
+// Lookup returns the location of ip. Addresses not in the database have an empty location.
+func (g *GeoIP) Lookup(ip netip.Addr) (GeoLocation, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var record geoRecord
+	if err := g.reader.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+		return GeoLocation{}, err
+	}
+	location := GeoLocation{Country: record.Country.ISOCode, Continent: record.Continent.Code}
+	if len(record.Subdivisions) > 0 && location.Country != "" {
+		location.Region = location.Country + "-" + record.Subdivisions[0].ISOCode
+	}
+	return location, nil
+}
+
+// Close stops reloading and closes the database
+func (g *GeoIP) Close() error {
+	close(g.done)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reader.Close()
+}
+
+// GeoConfig blocks or reroutes a target group's requests by client location. Location codes
+// are ISO country codes ("DE") or country subdivision codes ("US-CA").
+type GeoConfig struct {
+	// AllowCountries, if non-empty, admits only clients located in the listed places
+	AllowCountries []string
+
+	// DenyCountries rejects clients located in the listed places
+	DenyCountries []string
+
+	// Routes send matching clients to another target group instead, e.g. EU traffic to an EU pool.
+	// The first matching route wins.
+	Routes []GeoRoute
+}
+
+// GeoRoute sends clients in the listed countries or continents to a target group
+type GeoRoute struct {
+	Countries   []string
+	Continents  []string
+	TargetGroup *TargetGroup
+}
+
+// matches reports whether the location is one of the listed country or region codes
+func (location GeoLocation) matches(codes []string) bool {
+	for _, code := range codes {
+		if location.Country != "" && strings.EqualFold(code, location.Country) {
+			return true
+		}
+		if location.Region != "" && strings.EqualFold(code, location.Region) {
+			return true
+		}
+	}
+	return false
+}
+
+func (route GeoRoute) matches(location GeoLocation) bool {
+	if location.matches(route.Countries) {
+		return true
+	}
+	for _, continent := range route.Continents {
+		if location.Continent != "" && strings.EqualFold(continent, location.Continent) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoFilter returns middleware that applies a target group's GeoConfig. Without a GeoIP
+// database every client has an unknown location.
+func (lb *LoadBalancer) geoFilter(config GeoConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var location GeoLocation
+			if lb.geoIP != nil {
+				var err error
+				if location, err = lb.geoIP.Lookup(ClientIP(r)); err != nil {
+					logger().Warn("geoip: lookup failed", "error", err)
+				}
+			}
+
+			if location.matches(config.DenyCountries) ||
+				(len(config.AllowCountries) > 0 && !location.matches(config.AllowCountries)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			for _, route := range config.Routes {
+				if route.TargetGroup != nil && route.matches(location) {
+					lb.serveTargetGroup(w, r, route.TargetGroup)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// GossipConfig configures the gossip between load balancer instances, see Gossip
+type GossipConfig struct {
+	// Addr is the UDP address gossip is received on, e.g. ":7946"
+	Addr string
+
+	// Peers are the UDP addresses of the other instances
+	Peers []string
+
+	// Interval is how often the state is sent to the peers; 1s by default
+	Interval time.Duration
+
+	// TTL is how long a failed health check keeps a server down, so it is checked again
+	// afterwards; 10s by default
+	TTL time.Duration
+
+	// Key signs the messages; those from instances without the same key are dropped. It
+	// should be set whenever other hosts can reach Addr.
+	Key string
+}
+
+// Gossip shares health check results between load balancer instances, so servers one
+// instance found down are skipped by all of them, and a newly started instance knows the
+// dead servers within an interval instead of rediscovering them with failing requests.
+// Every instance sends the results of the last TTL to all its peers every interval; the
+// latest result for a server wins.
+type Gossip struct {
+	config GossipConfig
+	node   string
+	conn   net.PacketConn
+	peers  []*net.UDPAddr
+
+	health *healthTable
+}
+
+// gossipMessage is the state an instance sends its peers
+type gossipMessage struct {
+	Node   string                  `json:"node"`
+	Health map[string]serverHealth `json:"health"`
+}
+
+// NewGossip listens for gossip on the configured address; Run exchanges it
+func NewGossip(config GossipConfig) (*Gossip, error) {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.TTL <= 0 {
+		config.TTL = 10 * time.Second
+	}
+	g := &Gossip{config: config, health: newHealthTable(config.TTL)}
+	for _, peer := range config.Peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, err
+		}
+		g.peers = append(g.peers, addr)
+	}
+	var node [8]byte
+	if _, err := rand.Read(node[:]); err != nil {
+		return nil, err
+	}
+	g.node = hex.EncodeToString(node[:])
+	conn, err := net.ListenPacket("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	g.conn = conn
+	return g, nil
+}
+
+// WithGossip shares the load balancer's health check results through the gossip and skips
+// servers other instances found down
+func WithGossip(gossip *Gossip) Option {
+	return func(lb *LoadBalancer) {
+		lb.health = gossip.health
+	}
+}
+
+// Run sends and receives gossip until ctx is done, then closes the gossip's listener
+func (g *Gossip) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		g.conn.Close()
+	}()
+	go g.receive()
+
+	ticker := time.NewTicker(g.config.Interval)
+	defer ticker.Stop()
+	for {
+		g.send()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends the recent results to every peer
+func (g *Gossip) send() {
+	message := gossipMessage{Node: g.node, Health: g.health.recent()}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	data = g.sign(data)
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteTo(data, peer); err != nil {
+			logger().Debug("gossip: sending failed", "peer", peer, "error", err)
+		}
+	}
+}
+
+// receive merges the state of the peers until the listener is closed
+func (g *Gossip) receive() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		data, ok := g.verify(buf[:n])
+		if !ok {
+			logger().Debug("gossip: dropping unsigned message", "peer", from)
+			continue
+		}
+		var message gossipMessage
+		if err := json.Unmarshal(data, &message); err != nil || message.Node == g.node {
+			continue
+		}
+		g.health.merge(message.Health)
+	}
+}
+
+// sign prefixes a message with its HMAC if there is a key
+func (g *Gossip) sign(data []byte) []byte {
+	if g.config.Key == "" {
+		return data
+	}
+	mac := hmac.New(sha256.New, []byte(g.config.Key))
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// verify checks and strips the HMAC of a message if there is a key
+func (g *Gossip) verify(data []byte) ([]byte, bool) {
+	if g.config.Key == "" {
+		return data, true
+	}
+	if len(data) < sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, []byte(g.config.Key))
+	mac.Write(data[sha256.Size:])
+	return data[sha256.Size:], hmac.Equal(mac.Sum(nil), data[:sha256.Size])
+}
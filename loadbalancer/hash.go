@@ -0,0 +1,138 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// HashBalancer is a Balancer that maps requests to servers by a hash of a request key, so
+// requests with the same key keep going to the same server while it is available
+type HashBalancer interface {
+	Balancer
+
+	// NextKey returns the server for the key's hash among the candidates, which exclude
+	// servers that already failed for the request
+	NextKey(key uint64, servers []*Server) *Server
+}
+
+// failoverHashBalancer is a HashBalancer with a lookup structure built for its servers,
+// like a Maglev table or a hash ring. It is given the servers no request failed on, which
+// only change with the group's servers and weights, and skips those that failed for the
+// request itself, so failing over doesn't rebuild the structure.
+type failoverHashBalancer interface {
+	nextKeyExcluding(key uint64, servers []*Server, failed map[*Server]bool) *Server
+}
+
+// remaining counts the servers that haven't failed
+func remaining(servers []*Server, failed map[*Server]bool) int {
+	if len(failed) == 0 {
+		return len(servers)
+	}
+	n := 0
+	for _, server := range servers {
+		if !failed[server] {
+			n++
+		}
+	}
+	return n
+}
+
+// WithHashKey sets the request key of hash balancers, the client address by default.
+// Requests for which key returns an empty string are keyed by their client address too.
+func WithHashKey(key func(r *http.Request) string) Option {
+	return func(lb *LoadBalancer) {
+		lb.hashKey = key
+	}
+}
+
+// ParseHashKey parses a request key for hash balancers: client_ip, host, path,
+// header:<name> or cookie:<name>
+func ParseHashKey(s string) (func(r *http.Request) string, error) {
+	kind, name, _ := strings.Cut(s, ":")
+	switch {
+	case s == "client_ip":
+		return func(r *http.Request) string { return ClientIP(r).String() }, nil
+	case s == "host":
+		return func(r *http.Request) string { return r.Host }, nil
+	case s == "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case kind == "header" && name != "":
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case kind == "cookie" && name != "":
+		return func(r *http.Request) string {
+			cookie, err := r.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown hash key %q", s)
+}
+
+// requestHash returns the hash of the request's key for the group's balancer
+func (lb *LoadBalancer) requestHash(r *http.Request, targetGroup *TargetGroup) uint64 {
+	hashKey := lb.hashKey
+	if targetGroup.HashKey != nil {
+		hashKey = targetGroup.HashKey
+	}
+	var key string
+	if hashKey != nil {
+		key = hashKey(r)
+	}
+	if key == "" {
+		key = ClientIP(r).String()
+	}
+	return hashString(key)
+}
+
+// hashString hashes s with 64-bit FNV-1a
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix64 scrambles the bits of x so that similar inputs give unrelated outputs (the
+// SplitMix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Rendezvous is a HashBalancer using highest random weight hashing: every server gets a
+// score from the key and its name, and the highest score wins. When a server goes away only
+// its keys move, spread over the remaining servers, without any ring to maintain.
+type Rendezvous struct{}
+
+// NewRendezvous creates a rendezvous hashing Balancer
+func NewRendezvous() Balancer {
+	return Rendezvous{}
+}
+
+// Next returns a random server, for callers without a request key
+func (Rendezvous) Next(servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	return servers[rand.Intn(len(servers))]
+}
+
+// NextKey returns the server with the highest score for the key
+func (Rendezvous) NextKey(key uint64, servers []*Server) *Server {
+	var best *Server
+	var bestScore uint64
+	for _, server := range servers {
+		if score := mix64(key ^ hashString(server.name())); best == nil || score > bestScore {
+			best, bestScore = server, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+)
+
+// HeaderAction is what a HeaderRule does with its header
+type HeaderAction string
+
+const (
+	// HeaderAdd appends a value to the header
+	HeaderAdd HeaderAction = "add"
+
+	// HeaderSet replaces the header's values
+	HeaderSet HeaderAction = "set"
+
+	// HeaderRemove deletes the header
+	HeaderRemove HeaderAction = "remove"
+)
+
+// HeaderRule adds, sets or removes a header. Value may reference variables as ${name}:
+// client_ip, request_id, backend, route, host, method and path.
+type HeaderRule struct {
+	Action HeaderAction
+	Name   string
+	Value  string
+
+	// ValueExpr computes the value instead of Value when set
+	ValueExpr *Expr
+
+	// When limits the rule to requests the expression is true for
+	When *Expr
+}
+
+// HeaderRules are applied to requests forwarded to and responses received from a target group's servers
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+// applyHeaderRules runs the rules for request r against header, expanding variables in their values
+func applyHeaderRules(rules []HeaderRule, header http.Header, r *http.Request, vars map[string]string) {
+	for _, rule := range rules {
+		if rule.When != nil && !rule.When.Match(r) {
+			continue
+		}
+		value := os.Expand(rule.Value, func(name string) string { return vars[name] })
+		if rule.ValueExpr != nil {
+			var err error
+			if value, err = rule.ValueExpr.EvalString(r); err != nil {
+				continue
+			}
+		}
+		switch rule.Action {
+		case HeaderAdd:
+			header.Add(rule.Name, value)
+		case HeaderSet:
+			header.Set(rule.Name, value)
+		case HeaderRemove:
+			header.Del(rule.Name)
+		}
+	}
+}
+
+// headerVars returns the variables available to header rules for a request sent to server
+func headerVars(r *http.Request, targetGroup *TargetGroup, server *Server) map[string]string {
+	return map[string]string{
+		"client_ip":  ClientIP(r).String(),
+		"request_id": RequestID(r),
+		"backend":    server.name(),
+		"route":      routeName(targetGroup),
+		"host":       r.Host,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	}
+}
+
+type requestIDKey struct{}
+
+// requestIDHeader carries request IDs between clients, the load balancer and backends
+const requestIDHeader = "X-Request-ID"
+
+// RequestID returns the ID of the request: the client's X-Request-ID if it sent one,
+// or one generated by the load balancer
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+// withRequestID stores the request's ID in its context, generating one if needed
+func withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// healthTable keeps the latest health check result of each server, so servers found down
+// are skipped without checking them again until the result is older than the TTL
+type healthTable struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	servers map[string]serverHealth
+}
+
+// serverHealth is the latest health check result for a server
+type serverHealth struct {
+	Healthy bool      `json:"healthy"`
+	Time    time.Time `json:"time"`
+}
+
+func newHealthTable(ttl time.Duration) *healthTable {
+	return &healthTable{ttl: ttl, servers: make(map[string]serverHealth)}
+}
+
+// observe records the result of a health check of the server. A nil table records nothing.
+func (t *healthTable) observe(server *Server, healthy bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.servers[server.URL.String()] = serverHealth{Healthy: healthy, Time: time.Now()}
+}
+
+// down reports whether the latest health check of the server within the TTL failed
+func (t *healthTable) down(server *Server) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health, ok := t.servers[server.URL.String()]
+	return ok && !health.Healthy && time.Since(health.Time) <= t.ttl
+}
+
+// recent returns the results within the TTL by server URL, forgetting older ones
+func (t *healthTable) recent() map[string]serverHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recent := make(map[string]serverHealth, len(t.servers))
+	for server, health := range t.servers {
+		if time.Since(health.Time) > t.ttl {
+			delete(t.servers, server)
+			continue
+		}
+		recent[server] = health
+	}
+	return recent
+}
+
+// merge adds results unless the table has later ones for their servers
+func (t *healthTable) merge(servers map[string]serverHealth) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for server, health := range servers {
+		if current, ok := t.servers[server]; !ok || health.Time.After(current.Time) {
+			t.servers[server] = health
+		}
+	}
+}
+
+// isServerHealthy checks the health of a backend server with retries
+func (lb *LoadBalancer) isServerHealthy(server *Server) bool {
+	if server.HealthCheckPath == "" {
+		// If no health check path is specified, consider the server healthy
+		return true
+	}
+
+	// Servers another instance, or an earlier check, recently found down are skipped
+	if lb.health.down(server) {
+		return false
+	}
+
+	// Servers whose names don't resolve are down without trying to reach them
+	if lb.dnsCache != nil {
+		if _, err := netip.ParseAddr(server.URL.Hostname()); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_, err := lb.dnsCache.Lookup(ctx, server.URL.Hostname())
+			cancel()
+			if err != nil {
+				lb.recordHealthCheck(server, false)
+				lb.health.observe(server, false)
+				logger().Debug("health check failed", "server", server.name(), "error", err)
+				return false
+			}
+		}
+	}
+
+	// Set a timeout for the health check
+	client := http.Client{
+		Timeout: time.Second * 5, // Adjust the timeout as needed
+	}
+
+	// Perform the health check with retries
+	maxRetries := 3
+	for retry := 0; retry < maxRetries; retry++ {
+		resp, err := client.Get(server.URL.String() + server.HealthCheckPath)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			lb.recordHealthCheck(server, false)
+			if err != nil {
+				logger().Debug("health check failed", "server", server.name(), "error", err)
+			} else {
+				logger().Debug("health check failed", "server", server.name(), "status", resp.StatusCode)
+			}
+			// Retry if the health check fails
+			time.Sleep(time.Second) // Wait before the next retry
+			continue
+		}
+		lb.recordHealthCheck(server, true)
+		lb.health.observe(server, true)
+		return true
+	}
+
+	// If all retries fail, consider the server unhealthy
+	lb.health.observe(server, false)
+	return false
+}
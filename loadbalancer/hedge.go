@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HedgeConfig sends a second copy of slow requests to another server and uses whichever
+// response arrives first, canceling the other request. Only requests without a body using
+// the idempotent GET, HEAD or OPTIONS methods are hedged.
+type HedgeConfig struct {
+	// Delay is how long the first server has to respond before the request is hedged,
+	// typically around the route's 95th percentile latency
+	Delay time.Duration
+}
+
+// upstreamKey is the context key of the server a request was sent to instead of the one
+// first chosen for it, by hedging or retries
+type upstreamKey struct{}
+
+// hedged reports whether a request to the group may be hedged
+func (targetGroup *TargetGroup) hedged(r *http.Request) bool {
+	if targetGroup.Hedge == nil || r.ContentLength != 0 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// hedgingTransport sends requests to the first server through next and hedges them to a
+// second server if they are slow
+type hedgingTransport struct {
+	lb          *LoadBalancer
+	targetGroup *TargetGroup
+	servers     []*Server
+	first       *Server
+	request     *http.Request
+	next        http.RoundTripper
+}
+
+// hedgeResult is the outcome of one of the copies of a request. Its cancel ends the copy,
+// canceling its context and releasing its server.
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	cancel func()
+	server *Server
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	send := func(req *http.Request, server *Server, done func()) {
+		ctx, cancel := context.WithCancel(req.Context())
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+		results <- hedgeResult{resp: resp, err: err, cancel: func() { cancel(); done() }, server: server}
+	}
+	// The first server is released by forward once the response has been copied
+	go send(req, nil, func() {})
+
+	timer := time.NewTimer(t.targetGroup.Hedge.Delay)
+	defer timer.Stop()
+	var second *Server
+	select {
+	case result := <-results:
+		return result.win()
+	case <-timer.C:
+		if second = t.second(); second == nil {
+			return (<-results).win()
+		}
+	}
+	hedge := req.Clone(context.WithValue(req.Context(), upstreamKey{}, second))
+	hedge.URL.Scheme, hedge.URL.Host = second.URL.Scheme, second.URL.Host
+	go send(hedge, second, func() { t.lb.serverDone(t.targetGroup, second) })
+
+	// Use the first response, or the last error if neither copy got a response
+	result := <-results
+	if result.err != nil {
+		result.cancel()
+		result = <-results
+	} else {
+		go func() {
+			loser := <-results
+			loser.cancel()
+			if loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+		}()
+	}
+	winner := "first"
+	if result.server != nil {
+		winner = "hedge"
+	}
+	t.lb.metrics.Counter("loadbalancer_hedged_requests_total", "Number of hedged requests by the copy that answered first.",
+		"route", routeName(t.targetGroup), "winner", winner).Inc()
+	return result.win()
+}
+
+// second picks the server to hedge the request to, if there is one besides the first
+func (t *hedgingTransport) second() *Server {
+	server := t.lb.getNextServer(t.targetGroup, t.request, t.servers, map[*Server]bool{t.first: true})
+	if server == t.first {
+		if server != nil {
+			t.lb.serverDone(t.targetGroup, server)
+		}
+		return nil
+	}
+	return server
+}
+
+// win returns the result's response, which keeps its request's context and server until the
+// body is closed
+func (result hedgeResult) win() (*http.Response, error) {
+	if result.err != nil {
+		result.cancel()
+		return nil, result.err
+	}
+	result.resp.Body = &doneOnClose{ReadCloser: result.resp.Body, done: result.cancel}
+	return result.resp, nil
+}
+
+// doneOnClose calls done once its response body is closed, to end the request only after
+// its response has been read
+type doneOnClose struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (c *doneOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.done)
+	return err
+}
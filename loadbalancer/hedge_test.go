@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHedgeAndRetryServersAreBusyUntilTheBodyIsClosed(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	tests := []struct {
+		name      string
+		first     string
+		transport func(lb *LoadBalancer, targetGroup *TargetGroup, first *Server, r *http.Request) http.RoundTripper
+	}{
+		{"Hedge", slow.URL, func(lb *LoadBalancer, targetGroup *TargetGroup, first *Server, r *http.Request) http.RoundTripper {
+			targetGroup.Hedge = &HedgeConfig{Delay: 10 * time.Millisecond}
+			return &hedgingTransport{lb: lb, targetGroup: targetGroup, servers: lb.servers(targetGroup), first: first, request: r, next: http.DefaultTransport}
+		}},
+		{"Retry", refused.URL, func(lb *LoadBalancer, targetGroup *TargetGroup, first *Server, r *http.Request) http.RoundTripper {
+			targetGroup.Retry = &RetryConfig{Attempts: 1}
+			return lb.retryingTransport(targetGroup, lb.servers(targetGroup), first, r, http.DefaultTransport)
+		}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			firstURL, _ := url.Parse(test.first)
+			fastURL, _ := url.Parse(fast.URL)
+			first, second := &Server{URL: firstURL}, &Server{URL: fastURL}
+			targetGroup := &TargetGroup{URIPath: "/", Servers: []*Server{first, second}}
+			lb := NewLoadBalancer(WithTargetGroup(targetGroup), WithBalancer(NewLeastConnections))
+			defer lb.Close()
+			inFlight := func(server *Server) int {
+				lb.mu.Lock()
+				defer lb.mu.Unlock()
+				return lb.balancers[targetGroup].(*LeastConnections).inFlight[server.name()]
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			req := r.Clone(r.Context())
+			req.URL.Scheme, req.URL.Host = firstURL.Scheme, firstURL.Host
+			resp, err := test.transport(lb, targetGroup, first, r).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := inFlight(second); n != 1 {
+				t.Errorf("%d requests in flight to the second server before the body was read, want 1", n)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body.Close()
+			if string(body) != "fast" {
+				t.Errorf("the body is %q", body)
+			}
+			if n := inFlight(second); n != 0 {
+				t.Errorf("%d requests in flight to the second server after the body was closed, want 0", n)
+			}
+		})
+	}
+}
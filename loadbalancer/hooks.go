@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// ResponseInfo describes a response received from a backend server
+type ResponseInfo struct {
+	StatusCode int
+	Header     http.Header
+	Duration   time.Duration
+}
+
+// Hooks are callbacks invoked during the lifecycle of a proxied request.
+// Any of the callbacks may be nil.
+type Hooks struct {
+	// OnBackendSelected is called once a healthy server has been chosen for the request
+	OnBackendSelected func(r *http.Request, server *Server)
+
+	// OnProxyError is called when forwarding the request to the server fails
+	OnProxyError func(r *http.Request, server *Server, err error)
+
+	// OnResponse is called when the server's response headers have been received
+	OnResponse func(r *http.Request, server *Server, info ResponseInfo)
+}
+
+// WithHooks registers lifecycle hooks. It can be given multiple times; hooks run in registration order.
+func WithHooks(hooks Hooks) Option {
+	return func(lb *LoadBalancer) {
+		lb.hooks = append(lb.hooks, hooks)
+	}
+}
+
+func (lb *LoadBalancer) backendSelected(r *http.Request, server *Server) {
+	for _, hooks := range lb.hooks {
+		if hooks.OnBackendSelected != nil {
+			hooks.OnBackendSelected(r, server)
+		}
+	}
+}
+
+func (lb *LoadBalancer) proxyError(r *http.Request, server *Server, err error) {
+	for _, hooks := range lb.hooks {
+		if hooks.OnProxyError != nil {
+			hooks.OnProxyError(r, server, err)
+		}
+	}
+}
+
+func (lb *LoadBalancer) response(r *http.Request, server *Server, info ResponseInfo) {
+	for _, hooks := range lb.hooks {
+		if hooks.OnResponse != nil {
+			hooks.OnResponse(r, server, info)
+		}
+	}
+}
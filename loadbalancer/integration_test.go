@@ -0,0 +1,138 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lbwtg/loadbalancer"
+	"lbwtg/loadbalancer/testutil"
+)
+
+func TestRoundRobinSpreadsRequestsEvenly(t *testing.T) {
+	a := testutil.NewBackend(t, "a")
+	b := testutil.NewBackend(t, "b")
+	c := testutil.NewBackend(t, "c")
+	lb := loadbalancer.NewLoadBalancer(loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+		URIPath: "/",
+		Servers: testutil.Servers(a, b, c),
+	}))
+	defer lb.Close()
+
+	counts := testutil.Distribution(lb, "/", 30)
+	for _, backend := range []string{"a", "b", "c"} {
+		if counts[backend] != 10 {
+			t.Errorf("backend %s served %d of 30 requests, want 10: %v", backend, counts[backend], counts)
+		}
+	}
+}
+
+func TestRequestsAreRoutedByPath(t *testing.T) {
+	api := testutil.NewBackend(t, "api")
+	web := testutil.NewBackend(t, "web")
+	lb := loadbalancer.NewLoadBalancer(
+		loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{URIPath: "/api/", StripPrefix: true, Servers: testutil.Servers(api)}),
+		loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{URIPath: "/", Servers: testutil.Servers(web)}),
+	)
+	defer lb.Close()
+
+	for target, want := range map[string]string{"/api/users": "api", "/": "web", "/index.html": ""} {
+		if got := testutil.Get(lb, target).Header().Get(testutil.BackendHeader); got != want {
+			t.Errorf("%s was served by %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestBackendStatusIsPassedThrough(t *testing.T) {
+	backend := testutil.NewBackend(t, "a", testutil.WithStatus(http.StatusTeapot))
+	lb := loadbalancer.NewLoadBalancer(loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+		URIPath: "/",
+		Servers: testutil.Servers(backend),
+	}))
+	defer lb.Close()
+
+	if w := testutil.Get(lb, "/"); w.Code != http.StatusTeapot {
+		t.Errorf("status %d, want %d", w.Code, http.StatusTeapot)
+	}
+	backend.SetStatus(http.StatusOK)
+	if w := testutil.Get(lb, "/"); w.Code != http.StatusOK {
+		t.Errorf("status %d after the backend recovered, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestUnhealthyBackendIsSkipped(t *testing.T) {
+	healthy := testutil.NewBackend(t, "healthy")
+	unhealthy := testutil.NewBackend(t, "unhealthy", testutil.WithUnhealthy())
+	// The state file remembers the failed checks, so the unhealthy backend is checked once
+	state, err := loadbalancer.NewStateFile(filepath.Join(t.TempDir(), "state.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := loadbalancer.NewLoadBalancer(
+		loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{URIPath: "/", Servers: testutil.Servers(healthy, unhealthy)}),
+		loadbalancer.WithStateFile(state),
+	)
+	defer lb.Close()
+
+	counts := testutil.Distribution(lb, "/", 10)
+	if counts["healthy"] != 10 {
+		t.Errorf("the healthy backend served %d of 10 requests: %v", counts["healthy"], counts)
+	}
+	if unhealthy.Requests() != 0 {
+		t.Errorf("the unhealthy backend got %d requests", unhealthy.Requests())
+	}
+	if checks := unhealthy.HealthChecks(); checks != 3 {
+		t.Errorf("the unhealthy backend was checked %d times, want 3", checks)
+	}
+}
+
+func TestNoHealthyBackend(t *testing.T) {
+	backend := testutil.NewBackend(t, "a", testutil.WithUnhealthy())
+	lb := loadbalancer.NewLoadBalancer(loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+		URIPath: "/",
+		Servers: testutil.Servers(backend),
+	}))
+	defer lb.Close()
+
+	if w := testutil.Get(lb, "/"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if backend.Requests() != 0 {
+		t.Errorf("the unhealthy backend got %d requests", backend.Requests())
+	}
+}
+
+func TestFlappingBackendDoesNotFailRequests(t *testing.T) {
+	stable := testutil.NewBackend(t, "stable")
+	flapping := testutil.NewBackend(t, "flapping", testutil.WithFlapping(150*time.Millisecond))
+	lb := loadbalancer.NewLoadBalancer(loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{
+		URIPath: "/",
+		Servers: testutil.Servers(stable, flapping),
+	}))
+	defer lb.Close()
+
+	// Failed checks are retried, so the flapping backend passes one of them most of the time
+	counts := testutil.Distribution(lb, "/", 6)
+	if counts["stable"]+counts["flapping"] != 6 {
+		t.Errorf("not every request was served: %v", counts)
+	}
+	if counts["flapping"] == 0 {
+		t.Errorf("the flapping backend was never served: %v", counts)
+	}
+}
+
+func TestEWMAPrefersFastBackends(t *testing.T) {
+	fast := testutil.NewBackend(t, "fast")
+	slow := testutil.NewBackend(t, "slow", testutil.WithLatency(50*time.Millisecond))
+	lb := loadbalancer.NewLoadBalancer(
+		loadbalancer.WithTargetGroup(&loadbalancer.TargetGroup{URIPath: "/", Servers: testutil.Servers(fast, slow)}),
+		loadbalancer.WithBalancer(loadbalancer.NewEWMA),
+	)
+	defer lb.Close()
+
+	counts := testutil.Distribution(lb, "/", 50)
+	if counts["fast"] < 3*counts["slow"] {
+		t.Errorf("the fast backend served %d requests and the slow one %d", counts["fast"], counts["slow"])
+	}
+}
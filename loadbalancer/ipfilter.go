@@ -0,0 +1,27 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// IPFilterConfig restricts which client addresses may use a target group.
+// Deny is checked first; if Allow is non-empty, only addresses it contains are admitted.
+type IPFilterConfig struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// IPFilter returns middleware that rejects clients not admitted by the config with 403 Forbidden
+func IPFilter(config IPFilterConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := ClientIP(r)
+			if containsAddr(config.Deny, ip) || (len(config.Allow) > 0 && !containsAddr(config.Allow, ip)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+)
+
+// maxRequestBody rejects requests whose body is larger than limit bytes with 413 Request Entity Too Large
+func maxRequestBody(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxHeaderCount rejects requests with more than limit header fields with 431 Request Header Fields Too Large
+func maxHeaderCount(limit int) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count := 0
+			for _, values := range r.Header {
+				count += len(values)
+			}
+			if count > limit {
+				http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isMaxBytesError reports whether err was caused by a body exceeding http.MaxBytesReader's limit
+func isMaxBytesError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
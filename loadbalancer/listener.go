@@ -0,0 +1,242 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ListenerConfig configures the frontend HTTP server that accepts client connections.
+// Zero timeouts mean no timeout, as with http.Server.
+type ListenerConfig struct {
+	// Name identifies the listener to target groups bound to it, see TargetGroup.Listeners
+	Name string
+
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// MaxHeaderBytes limits the size of the request line and headers; zero uses
+	// http.DefaultMaxHeaderBytes. Larger requests are rejected with 431.
+	MaxHeaderBytes int
+
+	// MaxHeaderCount limits the number of request header fields; zero means no limit.
+	// Requests with more headers are rejected with 431.
+	MaxHeaderCount int
+
+	// CertFile and KeyFile enable TLS termination with the given PEM certificate and key
+	CertFile string
+	KeyFile  string
+
+	// KeyPairs and Certificates are served besides CertFile for the names they are valid
+	// for, chosen by the client's SNI, preferring certificates for the exact name over
+	// wildcards. CertFile is the default certificate for clients without SNI or asking for
+	// other names; without it the first key pair is.
+	KeyPairs     []KeyPair
+	Certificates []tls.Certificate
+
+	// CertificateStore, when set, loads CertFile and KeyPairs so they are reloaded when
+	// they change, see CertificateStore
+	CertificateStore *CertificateStore
+
+	// TLS restricts the TLS versions, cipher suites and curves, and sets the ALPN protocols,
+	// of connections to a listener terminating TLS
+	TLS *TLSPolicy
+
+	// ClientAuth makes a listener terminating TLS verify client certificates when set. The
+	// verified certificates are described to backends in X-Forwarded-Client-Cert headers,
+	// which are removed from requests on every listener so clients can't forge them.
+	ClientAuth *ClientAuthConfig
+
+	// SessionTickets rotates the keys of TLS session tickets when set; otherwise Go rotates
+	// them daily
+	SessionTickets *SessionTicketConfig
+
+	// ClientLimits limits the connections of each client address when set
+	ClientLimits *ClientLimits
+
+	// Metrics, when set, gets gauges of the listener's open client connections
+	Metrics *Metrics
+}
+
+// DefaultListenerConfig returns a ListenerConfig for addr with timeouts that protect against
+// slowloris-style clients. WriteTimeout is left unset so streaming responses aren't cut off.
+func DefaultListenerConfig(addr string) ListenerConfig {
+	return ListenerConfig{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
+// NewServer creates an http.Server for the listener configuration that serves handler
+func NewServer(config ListenerConfig, handler http.Handler) *http.Server {
+	handler = forwardClientCert(handler)
+	if config.MaxHeaderCount > 0 {
+		handler = maxHeaderCount(config.MaxHeaderCount)(handler)
+	}
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	if config.Metrics != nil {
+		server.ConnState = connectionGauges(config.Metrics, config.Addr)
+	}
+	if config.Name != "" {
+		server.BaseContext = func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, config.Name)
+		}
+	}
+	return server
+}
+
+type listenerKey struct{}
+
+// ListenerName returns the name of the listener that received the request, or an empty
+// string if the listener has no name
+func ListenerName(r *http.Request) string {
+	name, _ := r.Context().Value(listenerKey{}).(string)
+	return name
+}
+
+// connectionGauges returns a ConnState hook tracking a listener's open connections and how
+// many of them are idle
+func connectionGauges(metrics *Metrics, listener string) func(net.Conn, http.ConnState) {
+	open := metrics.Gauge("loadbalancer_open_connections", "Number of open client connections.", "listener", listener)
+	idle := metrics.Gauge("loadbalancer_idle_connections", "Number of idle keep-alive client connections.", "listener", listener)
+	var mu sync.Mutex
+	states := make(map[net.Conn]http.ConnState)
+	return func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		previous, known := states[conn]
+		if previous == http.StateIdle {
+			idle.Add(-1)
+		}
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateIdle:
+			idle.Add(1)
+		case http.StateHijacked, http.StateClosed:
+			if known {
+				open.Add(-1)
+			}
+			delete(states, conn)
+			return
+		}
+		states[conn] = state
+	}
+}
+
+// isLoopbackAddr reports whether a listen address only accepts connections from the same
+// host; an address without a host listens on every interface
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// shutdownTimeout is how long a listener that is shut down waits for requests in flight
+const shutdownTimeout = 30 * time.Second
+
+// ListenAndServe serves handler on the listener's address, terminating TLS if a certificate is configured
+func ListenAndServe(config ListenerConfig, handler http.Handler) error {
+	return ListenAndServeContext(context.Background(), config, handler)
+}
+
+// ListenAndServeContext is ListenAndServe until ctx is done. Then it stops accepting
+// connections and returns nil once the requests in flight are over, or shutdownTimeout has
+// passed.
+func ListenAndServeContext(ctx context.Context, config ListenerConfig, handler http.Handler) error {
+	server := NewServer(config, handler)
+	addr := config.Addr
+	if addr == "" {
+		addr = ":http"
+		if config.CertFile != "" || len(config.KeyPairs) > 0 || len(config.Certificates) > 0 {
+			addr = ":https"
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if config.ClientLimits != nil {
+		listener = limitClients(listener, *config.ClientLimits, config.Metrics, config.Addr)
+	}
+	getCertificate, err := config.getCertificate()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if getCertificate != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+		if config.TLS != nil {
+			config.TLS.apply(server)
+		}
+		if config.ClientAuth != nil {
+			if err := config.ClientAuth.apply(server.TLSConfig); err != nil {
+				listener.Close()
+				return err
+			}
+		}
+		if config.SessionTickets != nil {
+			// The configurations with rotated keys replace the one ServeTLS completes, so
+			// they need its ALPN protocols from the start
+			if len(server.TLSConfig.NextProtos) == 0 {
+				server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+			}
+			keys, err := newSessionTicketKeys(*config.SessionTickets, server.TLSConfig)
+			if err != nil {
+				listener.Close()
+				return err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go keys.run(ctx)
+			server.TLSConfig.GetConfigForClient = keys.getConfigForClient
+		}
+		return serveUntilDone(ctx, server, func() error { return server.ServeTLS(listener, "", "") })
+	}
+	return serveUntilDone(ctx, server, func() error { return server.Serve(listener) })
+}
+
+// serveUntilDone runs serve, shutting the server down gracefully once ctx is done
+func serveUntilDone(ctx context.Context, server *http.Server, serve func() error) error {
+	shutdown := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdown)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger().Warn("listener: requests were still in flight at shutdown", "addr", server.Addr, "error", err)
+		}
+	})
+	err := serve()
+	if errors.Is(err, http.ErrServerClosed) {
+		// Serve returns as soon as shutting down starts
+		<-shutdown
+		return nil
+	}
+	stop()
+	return err
+}
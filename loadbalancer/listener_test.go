@@ -0,0 +1,60 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeUntilDoneFinishesRequestsInFlight(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilDone(ctx, server, func() error { return server.Serve(listener) })
+	}()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serving failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serving didn't stop")
+	}
+	select {
+	case resp := <-responses:
+		if resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("the request in flight got %v", resp)
+		} else {
+			resp.Body.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request in flight wasn't answered")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Error("a request after shutting down was served")
+	}
+}
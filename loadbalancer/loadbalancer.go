@@ -0,0 +1,640 @@
+// Package loadbalancer provides a round-robin HTTP load balancer with health
+// checks and URI path based target groups. A LoadBalancer is an http.Handler
+// and can be embedded in any Go HTTP server.
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server represents a backend server
+type Server struct {
+	URL             *url.URL
+	HealthCheckPath string
+
+	// Name identifies the server in metrics, logs and header rules. Defaults to the URL's host.
+	Name string
+
+	// Zone is where the server runs, like an availability zone, see WithZone
+	Zone string
+
+	// Weight is the server's share of requests relative to the others in its group, 1 if
+	// zero. Hash balancers ignore it. It can be changed at runtime with SetWeight.
+	Weight int
+}
+
+// name returns the server's name, falling back to its host
+func (s *Server) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.URL.Host
+}
+
+// TargetGroup represents a group of backend servers for a specific URI path
+type TargetGroup struct {
+	URIPath string
+	Servers []*Server
+
+	// StripPrefix makes the group serve every path under URIPath and removes URIPath from
+	// the path forwarded to its servers. Cookie paths in responses are prefixed to match.
+	StripPrefix bool
+
+	// Listeners limits the group to requests received on the named listeners, see
+	// ListenerConfig.Name. Requests on other listeners never match it. A group with
+	// Listeners and no URIPath serves requests for any path on its listeners.
+	Listeners []string
+
+	// Tenant is the name of the tenant the group belongs to, if any, see Tenant
+	Tenant string
+
+	// Match is an expression that must also be true for the group to serve a request.
+	// A group with a Match and no URIPath serves requests for any path.
+	Match *Expr
+
+	// Transport is used to forward requests to the group's servers. If nil, a transport is
+	// built from TransportConfig, or the load balancer's transport is used.
+	Transport       http.RoundTripper
+	TransportConfig *TransportConfig
+
+	// FlushInterval is how often response bodies are flushed to the client while copying.
+	// Zero means no periodic flushing and a negative value flushes after each write, which
+	// suits Server-Sent Events and long-polling backends.
+	FlushInterval time.Duration
+
+	// NewBalancer creates the group's balancer, instead of the load balancer's WithBalancer
+	NewBalancer func() Balancer
+
+	// HashKey is the request key of the group's hash balancer, instead of WithHashKey
+	HashKey func(r *http.Request) string
+
+	// SubsetSize limits each load balancer instance to this many of the group's servers,
+	// to bound connection fan-out to large groups. Instances pick different subsets by
+	// their WithInstanceID, so consecutive IDs keep the load of all servers even. Zero
+	// uses every server.
+	SubsetSize int
+
+	// Hedge sends a second copy of slow idempotent requests to another server when set
+	Hedge *HedgeConfig
+
+	// Retry retries requests on other servers when they fail without a response, if set
+	Retry *RetryConfig
+
+	// Sticky keeps the requests with the same key on one server when set
+	Sticky *StickyConfig
+
+	// UpstreamAuth adds a credential to the requests forwarded to the servers when set
+	UpstreamAuth *UpstreamAuth
+
+	// StatusMap changes the status codes, and possibly bodies, of the servers' responses
+	StatusMap []StatusMapping
+
+	// Redirect answers requests with a redirect instead of forwarding them when set
+	Redirect *RedirectConfig
+
+	// Static serves files from a local directory instead of forwarding to Servers when set
+	Static *StaticConfig
+
+	// ResponseBuffering reads responses completely before sending them on when set;
+	// otherwise they are streamed as they arrive, see FlushInterval
+	ResponseBuffering *ResponseBufferingConfig
+
+	// Geo blocks or reroutes requests by client location when set; requires WithGeoIP
+	Geo *GeoConfig
+
+	// Canary sends a share of requests, or those asking for it, to a canary group when set
+	Canary *CanaryConfig
+
+	// Experiment assigns clients to A/B variants, each served by its own group, when set
+	Experiment *ExperimentConfig
+
+	// IPFilter restricts the group to allowed client addresses when set
+	IPFilter *IPFilterConfig
+
+	// WAF filters requests matching attack signatures when set
+	WAF *WAFConfig
+
+	// BasicAuth requires HTTP Basic authentication for the group when set
+	BasicAuth *BasicAuthConfig
+
+	// OIDC requires users to log in with an OpenID Connect provider when set
+	OIDC *OIDCConfig
+
+	// APIKey requires an API key, checked against a store with per-key quotas, when set
+	APIKey *APIKeyConfig
+
+	// CORS enables Cross-Origin Resource Sharing handling for the group when set
+	CORS *CORSConfig
+
+	// Fault injects delays and errors into the group's requests when set
+	Fault *FaultConfig
+
+	// SecurityHeaders adds security-related headers to the group's responses when set
+	SecurityHeaders *SecurityHeadersConfig
+
+	// Headers are rules that modify request and response headers for the group's servers
+	Headers HeaderRules
+
+	// MaxRequestBodyBytes limits the size of request bodies; larger requests are rejected
+	// with 413 Request Entity Too Large. Zero means no limit.
+	MaxRequestBodyBytes int64
+
+	// Compression enables compressing responses from the group's servers when set
+	Compression *CompressionConfig
+
+	// Cache enables an in-memory response cache for the group when set
+	Cache *CacheConfig
+
+	middleware []Middleware
+}
+
+// LoadBalancer represents a round-robin load balancer with health checks for multiple target groups
+type LoadBalancer struct {
+	targetGroups    []*TargetGroup
+	defaultGroup    *TargetGroup
+	vhosts          []*VirtualHost
+	tenants         []Tenant
+	balancers       map[*TargetGroup]Balancer
+	transports      map[*TargetGroup]http.RoundTripper
+	handlers        map[*TargetGroup]http.Handler
+	handler         http.Handler
+	caches          []*Cache
+	newBalancer     func() Balancer
+	hashKey         func(*http.Request) string
+	instanceID      int
+	zone            string
+	subsets         map[*TargetGroup]*serverSubset
+	candidateCaches map[*TargetGroup]*candidateCache
+	weights         map[string]int
+	tuner           *weightTuner
+	tuned           map[string]int
+	healthCheckPath string
+	transport       http.RoundTripper
+	dnsCache        *DNSCache
+	certificates    *CertificateStore
+	health          *healthTable
+	state           *StateFile
+	routes          atomic.Pointer[routeTable]
+	sticky          StickyTable
+	middleware      []Middleware
+	hooks           []Hooks
+	errorHandler    func(http.ResponseWriter, *http.Request, error)
+	unmatched       ErrorResponse
+	unavailable     ErrorResponse
+	metrics         *Metrics
+	bufferPool      httputil.BufferPool
+	trustedProxies  []netip.Prefix
+	geoIP           *GeoIP
+	inFlight        *Gauge
+	vars            *expvar.Map
+	adminAuth       Middleware
+	accessLog       *AccessLog
+	tracing         *TracingConfig
+	audit           *AuditLog
+	mu              sync.Mutex
+
+	// ctx is canceled by Close, stopping background work like service discovery
+	ctx     context.Context
+	stop    context.CancelFunc
+	closers []io.Closer
+}
+
+// NewLoadBalancer creates a new LoadBalancer configured by the given options
+func NewLoadBalancer(opts ...Option) *LoadBalancer {
+	lb := &LoadBalancer{
+		defaultGroup: &TargetGroup{},
+		newBalancer:  NewRoundRobin,
+		errorHandler: defaultErrorHandler,
+		unmatched:    defaultUnmatchedResponse,
+		unavailable:  defaultUnavailableResponse,
+		metrics:      NewMetrics(),
+	}
+	lb.ctx, lb.stop = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(lb)
+	}
+	if lb.bufferPool == nil {
+		lb.bufferPool = NewBufferPool(lb.metrics)
+	}
+	if lb.sticky == nil {
+		lb.sticky = NewMemoryStickyTable()
+	}
+	RegisterRuntimeMetrics(lb.metrics)
+	lb.vars = newDebugVars()
+	lb.inFlight = lb.metrics.Gauge("loadbalancer_in_flight_requests", "Number of client requests being handled, including those waiting for a backend.")
+
+	// Each target group keeps its own balancer state
+	lb.balancers = make(map[*TargetGroup]Balancer, len(lb.targetGroups)+1)
+	lb.subsets = make(map[*TargetGroup]*serverSubset)
+	lb.candidateCaches = make(map[*TargetGroup]*candidateCache)
+	lb.weights = make(map[string]int)
+	lb.tuned = make(map[string]int)
+	lb.transports = make(map[*TargetGroup]http.RoundTripper, len(lb.targetGroups)+1)
+	lb.handlers = make(map[*TargetGroup]http.Handler, len(lb.targetGroups)+1)
+	for _, targetGroup := range append(lb.targetGroups, lb.defaultGroup) {
+		lb.initTargetGroup(targetGroup)
+	}
+	for _, vhost := range lb.vhosts {
+		for _, targetGroup := range vhost.groups() {
+			lb.initTargetGroup(targetGroup)
+		}
+	}
+	lb.publishRoutes()
+	lb.handler = chain(http.HandlerFunc(lb.route), lb.middleware)
+	if lb.state != nil {
+		lb.state.attach(lb)
+	}
+	if lb.tuner != nil {
+		go lb.runWeightTuning()
+	}
+	return lb
+}
+
+// initTargetGroup sets up the state for a target group and any groups it routes to
+func (lb *LoadBalancer) initTargetGroup(targetGroup *TargetGroup) {
+	if _, ok := lb.handlers[targetGroup]; ok {
+		return
+	}
+	for _, server := range targetGroup.Servers {
+		if server.HealthCheckPath == "" {
+			server.HealthCheckPath = lb.healthCheckPath
+		}
+	}
+	if targetGroup.NewBalancer != nil {
+		lb.balancers[targetGroup] = targetGroup.NewBalancer()
+	} else {
+		lb.balancers[targetGroup] = lb.newBalancer()
+	}
+	lb.transports[targetGroup] = lb.targetGroupTransport(targetGroup)
+	lb.handlers[targetGroup] = &groupChain{targetGroup: targetGroup, next: chain(lb.groupHandler(targetGroup), lb.routeMiddleware(targetGroup))}
+
+	for _, other := range targetGroup.routedGroups() {
+		lb.initTargetGroup(other)
+	}
+}
+
+// Close stops the load balancer's background work and releases the resources it opened
+// for its configuration, like log files and plugins. Requests still in flight may fail.
+func (lb *LoadBalancer) Close() error {
+	lb.stop()
+	var errs []error
+	for _, closer := range lb.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Metrics returns the load balancer's metrics registry, which can be served as an http.Handler
+func (lb *LoadBalancer) Metrics() *Metrics {
+	return lb.metrics
+}
+
+// ServeHTTP handles incoming HTTP requests and forwards them to healthy backend servers
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.inFlight.Add(1)
+	defer lb.inFlight.Add(-1)
+
+	r = withRequestID(lb.withClientIP(r))
+	if lb.tracing != nil {
+		r = lb.tracing.withTrace(r)
+	}
+	if lb.accessLog != nil {
+		lb.accessLog.serve(w, r, lb.handler)
+		return
+	}
+	lb.handler.ServeHTTP(w, r)
+}
+
+// route matches the request to a target group and serves it from that group
+func (lb *LoadBalancer) route(w http.ResponseWriter, r *http.Request) {
+	targetGroup := lb.matchTargetGroup(r)
+	if targetGroup == nil {
+		lb.unmatched.write(w)
+		return
+	}
+	if details := logDetails(r); details != nil {
+		details.route = routeName(targetGroup)
+	}
+	lb.countingHandler(targetGroup, w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.serveTargetGroup(w, r, targetGroup)
+	}))
+}
+
+// serveTargetGroup runs the request through the group's middleware and forwards it to one of its servers
+func (lb *LoadBalancer) serveTargetGroup(w http.ResponseWriter, r *http.Request, targetGroup *TargetGroup) {
+	lb.handlers[targetGroup].ServeHTTP(w, r)
+}
+
+// groupChain is a target group's handler wrapped in the group's middleware. It is built on
+// the group's first request, as TargetGroup.Use may be called after the load balancer is
+// created.
+type groupChain struct {
+	once        sync.Once
+	targetGroup *TargetGroup
+	next        http.Handler
+	handler     http.Handler
+}
+
+// ServeHTTP implements http.Handler
+func (c *groupChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.once.Do(func() {
+		c.handler = chain(c.next, c.targetGroup.middleware)
+	})
+	c.handler.ServeHTTP(w, r)
+}
+
+// groupHandler returns the handler requests reach after the group's middleware: one
+// redirecting them or serving the group's static files if it has those, or forwarding them
+// to its servers
+func (lb *LoadBalancer) groupHandler(targetGroup *TargetGroup) http.Handler {
+	switch {
+	case targetGroup.Redirect != nil:
+		return redirectHandler(targetGroup)
+	case targetGroup.Static != nil:
+		return staticHandler(targetGroup)
+	}
+	return lb.proxyHandler(targetGroup)
+}
+
+// proxyHandler returns a handler that forwards requests to a healthy server in the target group
+func (lb *LoadBalancer) proxyHandler(targetGroup *TargetGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.forward(w, r, targetGroup)
+	})
+}
+
+// forward sends the request to the next healthy server in the target group
+func (lb *LoadBalancer) forward(w http.ResponseWriter, r *http.Request, targetGroup *TargetGroup) {
+	routes := lb.routes.Load()
+	servers := routes.servers[targetGroup]
+	var stickyKey string
+	var stuck *Server
+	if targetGroup.Sticky != nil {
+		if stickyKey = targetGroup.Sticky.Key(r); stickyKey != "" {
+			stuck = lb.stickyServer(r, targetGroup, stickyKey, servers)
+		}
+	}
+	attempts := len(servers)
+	if stuck != nil {
+		attempts++
+	}
+	var failed map[*Server]bool
+	for i := 0; i < attempts; i++ {
+		// The server the request is stuck to is tried first, outside the balancer
+		server, balanced := stuck, stuck == nil
+		if stuck != nil && failed[stuck] {
+			server, balanced = nil, true
+		}
+		if balanced {
+			server = lb.getNextServer(targetGroup, r, servers, failed)
+		}
+		done := func() {
+			if balanced {
+				lb.serverDone(targetGroup, server)
+			}
+		}
+		if server != nil && !lb.isServerHealthy(server) {
+			done()
+			if failed == nil {
+				failed = make(map[*Server]bool)
+			}
+			failed[server] = true
+			continue
+		}
+		if server != nil {
+			if stickyKey != "" && server != stuck {
+				lb.stick(targetGroup, stickyKey, server)
+			}
+			lb.backendSelected(r, server)
+			if details := logDetails(r); details != nil {
+				details.upstream = server.name()
+			}
+			lb.vars.Get("backend_selections").(*expvar.Map).Add(server.name(), 1)
+			start := time.Now()
+
+			if len(targetGroup.Headers.Request) > 0 {
+				applyHeaderRules(targetGroup.Headers.Request, r.Header, r, headerVars(r, targetGroup, server))
+			}
+
+			// Forward the original URL path, without the route's prefix if it is stripped
+			outReq := r.WithContext(context.WithValue(r.Context(), forwardingKey{}, &forwarding{request: r, servers: servers, start: start}))
+			outURL := *r.URL
+			outURL.Path = targetGroup.upstreamPath(r.URL.Path)
+			outURL.RawPath = ""
+			outReq.URL = &outURL
+
+			// Forward the request to the healthy backend server
+			inFlight := lb.backendInFlight(targetGroup, server)
+			// Deferred, as the proxy panics with http.ErrAbortHandler when copying the body fails
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+			defer done()
+			defer func() { lb.observeDuration(targetGroup, server, time.Since(start)) }()
+			routes.proxies[targetGroup][server].ServeHTTP(w, outReq)
+			return
+		}
+	}
+
+	lb.unavailable.write(w)
+}
+
+// forwardingKey is the context key of the forwarding state of a request
+type forwardingKey struct{}
+
+// forwarding is the state of a request being forwarded to a server. Proxies are built once
+// per server and shared by requests, so they find it in the context of the request.
+type forwarding struct {
+	request *http.Request
+	servers []*Server
+	start   time.Time
+}
+
+// forwardingState returns the forwarding state of a request sent through a proxy
+func forwardingState(r *http.Request) *forwarding {
+	return r.Context().Value(forwardingKey{}).(*forwarding)
+}
+
+// newProxy returns the reverse proxy forwarding requests of the target group to a server
+func (lb *LoadBalancer) newProxy(targetGroup *TargetGroup, server *Server) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(server.URL)
+	proxy.Transport = lb.transports[targetGroup]
+	if proxy.Transport == nil {
+		proxy.Transport = http.DefaultTransport
+	}
+	if targetGroup.Hedge != nil || targetGroup.Retry != nil {
+		proxy.Transport = &forwardingTransport{lb: lb, targetGroup: targetGroup, server: server, next: proxy.Transport}
+	}
+	if auth := targetGroup.UpstreamAuth; auth != nil {
+		// Set on the outgoing copy so the credential doesn't show in the client's request
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			auth.apply(req.Header)
+		}
+	}
+	proxy.BufferPool = lb.bufferPool
+	proxy.FlushInterval = targetGroup.FlushInterval
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		state := forwardingState(resp.Request)
+		server := server
+		if upstream, ok := resp.Request.Context().Value(upstreamKey{}).(*Server); ok {
+			// A hedged or retried copy of the request answered
+			server = upstream
+			if details := logDetails(state.request); details != nil {
+				details.upstream = server.name()
+			}
+		}
+		rewriteCookies(resp.Header, targetGroup, server)
+		rewriteLocation(resp, targetGroup, state.servers)
+		if len(targetGroup.Headers.Response) > 0 {
+			applyHeaderRules(targetGroup.Headers.Response, resp.Header, resp.Request, headerVars(resp.Request, targetGroup, server))
+		}
+		ttfb := time.Since(state.start)
+		lb.observeTTFB(targetGroup, server, ttfb)
+		lb.observeLatency(targetGroup, server, ttfb, nil)
+		lb.tuner.record(server, ttfb, resp.StatusCode >= 500)
+		lb.countBackendResponse(targetGroup, server, resp.StatusCode)
+		lb.response(resp.Request, server, ResponseInfo{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Duration:   ttfb,
+		})
+		if len(targetGroup.StatusMap) > 0 {
+			mapStatus(resp, targetGroup.StatusMap)
+		}
+		if targetGroup.ResponseBuffering != nil {
+			return bufferResponse(resp, targetGroup.ResponseBuffering)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		elapsed := time.Since(forwardingState(r).start)
+		lb.countProxyError(targetGroup, server, err)
+		lb.observeLatency(targetGroup, server, elapsed, err)
+		lb.tuner.record(server, elapsed, true)
+		lb.proxyError(r, server, err)
+		if isMaxBytesError(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		lb.errorHandler(w, r, err)
+	}
+	return proxy
+}
+
+// groupProxies returns the proxies to the servers of a target group, keeping those of the
+// previous servers that remain
+func (lb *LoadBalancer) groupProxies(targetGroup *TargetGroup, servers []*Server, previous map[*Server]*httputil.ReverseProxy) map[*Server]*httputil.ReverseProxy {
+	proxies := make(map[*Server]*httputil.ReverseProxy, len(servers))
+	for _, server := range servers {
+		if proxy, ok := previous[server]; ok {
+			proxies[server] = proxy
+		} else {
+			proxies[server] = lb.newProxy(targetGroup, server)
+		}
+	}
+	return proxies
+}
+
+// forwardingTransport hedges or retries a request with the servers it was forwarded with,
+// for groups configured to
+type forwardingTransport struct {
+	lb          *LoadBalancer
+	targetGroup *TargetGroup
+	server      *Server
+	next        http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *forwardingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state := forwardingState(req)
+	transport := t.next
+	if t.targetGroup.hedged(state.request) {
+		transport = &hedgingTransport{lb: t.lb, targetGroup: t.targetGroup, servers: state.servers, first: t.server, request: state.request, next: transport}
+	}
+	if t.targetGroup.Retry != nil {
+		transport = t.lb.retryingTransport(t.targetGroup, state.servers, t.server, state.request, transport)
+	}
+	return transport.RoundTrip(req)
+}
+
+// defaultErrorHandler logs the proxy error and responds with 502 Bad Gateway, like httputil.ReverseProxy
+func defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	logger().Error("proxy error", "error", err, "request_id", RequestID(r))
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// matchTargetGroup returns the target group for the request, falling back to the default
+// group of the request's virtual host or of the load balancer. It returns nil if there is
+// no default group, or the load balancer's has no servers.
+func (lb *LoadBalancer) matchTargetGroup(r *http.Request) *TargetGroup {
+	routes := lb.routes.Load()
+	if vhost := routes.matchVirtualHost(r); vhost != nil {
+		for _, targetGroup := range vhost.TargetGroups {
+			if targetGroup.matches(r) {
+				return targetGroup
+			}
+		}
+		return vhost.DefaultGroup
+	}
+	for _, targetGroup := range routes.targetGroups {
+		if targetGroup.matches(r) {
+			return targetGroup
+		}
+	}
+	if len(routes.servers[routes.defaultGroup]) == 0 {
+		// Without servers the default group isn't a route, so the request matched none
+		return nil
+	}
+	return routes.defaultGroup
+}
+
+// getNextServer returns the next server in the balancing order for a given target group,
+// among its servers from the route table the request started with that haven't failed for
+// the request yet
+func (lb *LoadBalancer) getNextServer(targetGroup *TargetGroup, r *http.Request, servers []*Server, failed map[*Server]bool) *Server {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// Hash balancers keep mapping keys to the same servers, whatever their weights
+	balancer := lb.balancers[targetGroup]
+	if hashBalancer, ok := balancer.(HashBalancer); ok {
+		if failover, ok := balancer.(failoverHashBalancer); ok {
+			return failover.nextKeyExcluding(lb.requestHash(r, targetGroup), lb.candidates(targetGroup, servers, nil, false), failed)
+		}
+		return hashBalancer.NextKey(lb.requestHash(r, targetGroup), lb.candidates(targetGroup, servers, failed, false))
+	}
+	return balancer.Next(lb.candidates(targetGroup, servers, failed, true))
+}
+
+// observeLatency tells the group's balancer how long the server took to respond
+func (lb *LoadBalancer) observeLatency(targetGroup *TargetGroup, server *Server, latency time.Duration, err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if observer, ok := lb.balancers[targetGroup].(LatencyObserver); ok {
+		observer.Observe(server, latency, err)
+	}
+}
+
+// serverDone tells the group's balancer that a request it chose the server for is over
+func (lb *LoadBalancer) serverDone(targetGroup *TargetGroup, server *Server) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if tracker, ok := lb.balancers[targetGroup].(RequestTracker); ok {
+		tracker.Done(server)
+	}
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAbortedResponsesReleaseTheServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promise more of the body than is sent, then hang up
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("cut short"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	server := &Server{URL: backendURL}
+	targetGroup := &TargetGroup{URIPath: "/", Servers: []*Server{server}}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup), WithBalancer(NewLeastConnections))
+	defer lb.Close()
+
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("forwarding panicked with %v, want http.ErrAbortHandler", err)
+			}
+		}()
+		// The proxy only panics for requests served by an http.Server
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+		lb.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	lb.mu.Lock()
+	inFlight := lb.balancers[targetGroup].(*LeastConnections).inFlight[server.name()]
+	lb.mu.Unlock()
+	if inFlight != 0 {
+		t.Errorf("the balancer counts %d requests in flight after the response was aborted, want 0", inFlight)
+	}
+	if n := lb.backendInFlight(targetGroup, server).value(); n != 0 {
+		t.Errorf("the in-flight gauge is %v after the response was aborted, want 0", n)
+	}
+}
+
+func TestProxiesAndMiddlewareAreBuiltOnce(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	first, second := &Server{URL: backendURL, Name: "first"}, &Server{URL: backendURL, Name: "second"}
+	targetGroup := &TargetGroup{URIPath: "/", Servers: []*Server{first}}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup))
+	defer lb.Close()
+	var built, groupBuilt int
+	lb.Use(func(next http.Handler) http.Handler {
+		built++
+		return next
+	})
+	targetGroup.Use(func(next http.Handler) http.Handler {
+		groupBuilt++
+		return next
+	})
+
+	proxy := lb.routes.Load().proxies[targetGroup][first]
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+	if built != 1 || groupBuilt != 1 {
+		t.Errorf("the middleware was built %d times and the group's %d times for 3 requests, want once", built, groupBuilt)
+	}
+
+	// Changing the servers keeps the proxies of those that remain
+	lb.SetServers(targetGroup, []*Server{first, second})
+	proxies := lb.routes.Load().proxies[targetGroup]
+	if proxies[first] != proxy {
+		t.Error("the proxy to a remaining server was rebuilt")
+	}
+	if proxies[second] == nil {
+		t.Error("there is no proxy to the added server")
+	}
+	lb.SetServers(targetGroup, []*Server{second})
+	if _, ok := lb.routes.Load().proxies[targetGroup][first]; ok {
+		t.Error("the proxy to a removed server was kept")
+	}
+}
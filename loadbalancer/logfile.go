@@ -0,0 +1,266 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFileConfig configures a log file that is rotated by size and age
+type RotatingFileConfig struct {
+	Path string
+
+	// MaxSize is the size in bytes the file may grow to before it is rotated. Zero means no limit.
+	MaxSize int64
+
+	// MaxAge is how long a file is written to before it is rotated. Zero means no limit.
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files kept. Zero keeps them all.
+	MaxBackups int
+
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// backupTimeFormat sorts rotated files by the time they were rotated
+const backupTimeFormat = "20060102T150405.000"
+
+// rotateRetryInterval is how long a file that failed to rotate is written to before
+// rotating it is tried again
+const rotateRetryInterval = time.Minute
+
+// RotatingFile is an io.WriteCloser appending to a file that is renamed, with the time of
+// rotation as a suffix, and replaced by a new file once it gets too large or too old
+type RotatingFile struct {
+	// key is the file's entry in openFiles, and refs the number of times it was opened
+	key  string
+	refs int
+
+	mu          sync.Mutex
+	config      RotatingFileConfig
+	file        *os.File
+	size        int64
+	opened      time.Time
+	retryRotate time.Time
+	compress    sync.WaitGroup
+}
+
+// openFiles are the open log files by absolute path, reopened by ReopenLogFiles
+var openFiles struct {
+	mu    sync.Mutex
+	files map[string]*RotatingFile
+}
+
+// OpenRotatingFile opens the log file for appending, creating it if needed. A file that is
+// already open is shared rather than opened twice, so the configurations before and after a
+// reload don't rotate it behind each other's back; it takes on the latest config, and is
+// closed once every OpenRotatingFile has been matched by a Close.
+func OpenRotatingFile(config RotatingFileConfig) (*RotatingFile, error) {
+	key, err := filepath.Abs(config.Path)
+	if err != nil {
+		key = config.Path
+	}
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	if f := openFiles.files[key]; f != nil {
+		f.refs++
+		f.mu.Lock()
+		f.config = config
+		f.mu.Unlock()
+		return f, nil
+	}
+
+	f := &RotatingFile{key: key, refs: 1, config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if openFiles.files == nil {
+		openFiles.files = make(map[string]*RotatingFile)
+	}
+	openFiles.files[key] = f
+	return f, nil
+}
+
+// ReopenLogFiles reopens every open log file, see RotatingFile.Reopen
+func ReopenLogFiles() error {
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	var errs []error
+	for _, f := range openFiles.files {
+		if err := f.Reopen(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would exceed MaxSize or the file is
+// older than MaxAge. If rotating fails, p is appended to the current file all the same.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooLarge := f.config.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.config.MaxSize
+	tooOld := f.config.MaxAge > 0 && time.Since(f.opened) >= f.config.MaxAge
+	if (tooLarge || tooOld) && !time.Now().Before(f.retryRotate) {
+		if err := f.rotate(); err != nil {
+			// The error log may be this file, so report to stderr
+			fmt.Fprintf(os.Stderr, "log file: rotating %s failed: %v\n", f.config.Path, err)
+			f.retryRotate = time.Now().Add(rotateRetryInterval)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate renames the current file and starts a new one
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// rotate renames the current file and starts a new one. If that fails, the current file is
+// opened again so lines go on being written to it.
+func (f *RotatingFile) rotate() error {
+	// Windows can't rename open files, so the file is closed first
+	backup := f.config.Path + "." + time.Now().Format(backupTimeFormat)
+	err := f.file.Close()
+	if err == nil {
+		if err = os.Rename(f.config.Path, backup); os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			if err = f.open(); err != nil {
+				os.Rename(backup, f.config.Path)
+			}
+		}
+	}
+	if err != nil {
+		if reopenErr := f.open(); reopenErr != nil {
+			return errors.Join(err, reopenErr)
+		}
+		return err
+	}
+	f.retryRotate = time.Time{}
+
+	config := f.config
+	f.compress.Add(1)
+	go func() {
+		defer f.compress.Done()
+		if config.Compress {
+			if err := compressFile(backup); err != nil {
+				logger().Error("log file: compressing failed", "path", backup, "error", err)
+			}
+		}
+		removeOldBackups(config)
+	}()
+	return nil
+}
+
+// Reopen opens the file at the path again, for when it was renamed by an external tool
+// like logrotate. Lines are written to the renamed file until it is called, so none are
+// lost.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Close closes the file once rotated files have been compressed and every other user of
+// the file has closed it too
+func (f *RotatingFile) Close() error {
+	openFiles.mu.Lock()
+	if f.refs--; f.refs > 0 {
+		openFiles.mu.Unlock()
+		return nil
+	}
+	delete(openFiles.files, f.key)
+	openFiles.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compress.Wait()
+	return f.file.Close()
+}
+
+// removeOldBackups removes all but the newest MaxBackups rotated files
+func removeOldBackups(config RotatingFileConfig) {
+	if config.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(config.Path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, config.Path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > config.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// compressFile replaces a file with a gzipped copy
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockBackups makes renaming path to a backup fail for the next few seconds by putting
+// directories where the backups would go
+func blockBackups(t *testing.T, path string) {
+	t.Helper()
+	now := time.Now()
+	for d := time.Duration(0); d < 3*time.Second; d += time.Millisecond {
+		if err := os.Mkdir(path+"."+now.Add(d).Format(backupTimeFormat), 0o755); err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFailedRotationKeepsTheFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(f *RotatingFile) error
+	}{
+		{"Rotate", func(f *RotatingFile) error {
+			if err := f.Rotate(); err == nil {
+				t.Error("rotating succeeded")
+			}
+			return nil
+		}},
+		{"MaxSize", func(f *RotatingFile) error {
+			_, err := f.Write([]byte(strings.Repeat("x", 100) + "\n"))
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			f, err := OpenRotatingFile(RotatingFileConfig{Path: path, MaxSize: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.Write([]byte("first\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			blockBackups(t, path)
+			if err := test.rotate(f); err != nil {
+				t.Fatalf("writing failed: %v", err)
+			}
+			if _, err := f.Write([]byte("last\n")); err != nil {
+				t.Fatalf("writing after the failed rotation failed: %v", err)
+			}
+			if got := readFile(t, path); !strings.HasPrefix(got, "first\n") || !strings.HasSuffix(got, "last\n") {
+				t.Errorf("the file holds %q", got)
+			}
+		})
+	}
+}
+
+func TestRotatingFilesAreSharedByPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	old, err := OpenRotatingFile(RotatingFileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reload opens the file again before closing it
+	reloaded, err := OpenRotatingFile(RotatingFileConfig{Path: path, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded != old {
+		t.Fatal("the file was opened twice")
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Write([]byte("after the reload\n")); err != nil {
+		t.Fatalf("writing after the old configuration closed the file failed: %v", err)
+	}
+	if reloaded.config.MaxSize != 1<<20 {
+		t.Errorf("the file kept the old config %+v", reloaded.config)
+	}
+	if err := reloaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	if len(openFiles.files) != 0 {
+		t.Errorf("files are still open: %v", openFiles.files)
+	}
+	if got := readFile(t, path); got != "after the reload\n" {
+		t.Errorf("the file holds %q", got)
+	}
+}
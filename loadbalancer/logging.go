@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LogLevel is the minimum level of the load balancer's log messages. It can be changed at
+// any time, including through the admin API.
+var LogLevel = new(slog.LevelVar)
+
+var currentLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	SetLogHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// SetLogHandler sets the handler the load balancer's log messages are sent to. Messages
+// below LogLevel are dropped before they reach it.
+func SetLogHandler(handler slog.Handler) {
+	currentLogger.Store(slog.New(levelHandler{handler}))
+}
+
+// errorLogOutput is the file or syslog connection the load balancer's messages are written
+// to, if any
+var errorLogOutput struct {
+	mu     sync.Mutex
+	output io.Closer
+}
+
+// setErrorLogOutput records the output messages now go to, nil if none, and closes the
+// previous one
+func setErrorLogOutput(output io.Closer) {
+	errorLogOutput.mu.Lock()
+	defer errorLogOutput.mu.Unlock()
+	if errorLogOutput.output != nil && errorLogOutput.output != output {
+		errorLogOutput.output.Close()
+	}
+	errorLogOutput.output = output
+}
+
+// logger returns the logger for the load balancer's own messages
+func logger() *slog.Logger {
+	return currentLogger.Load()
+}
+
+// Logger returns the logger the load balancer's own messages go to, for programs running
+// it to log theirs alongside
+func Logger() *slog.Logger {
+	return logger()
+}
+
+// ParseLogLevel parses debug, info, warn or error
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// levelHandler filters messages by LogLevel
+type levelHandler struct {
+	slog.Handler
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= LogLevel.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name)}
+}
+
+// handleLogLevel reports the log level and, for PUT requests, changes it:
+//
+//	GET /log/level
+//	PUT /log/level?level=debug
+func (lb *LoadBalancer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		level, err := ParseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		if previous := LogLevel.Level(); previous != level {
+			LogLevel.Set(level)
+			logger().Info("log level changed", "from", previous, "to", level)
+			lb.audit.recordRequest(r, "log.level", fmt.Sprintf("level: %s -> %s", previous, level))
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": strings.ToLower(LogLevel.Level().String())})
+}
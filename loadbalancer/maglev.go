@@ -0,0 +1,120 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+)
+
+// DefaultMaglevTableSize is the lookup table size of Maglev balancers, enough for a few
+// hundred servers
+const DefaultMaglevTableSize = 65537
+
+// Maglev is a HashBalancer using Google's Maglev hashing: servers take turns filling a
+// lookup table along their own permutation of it, so lookups are O(1) and each server gets
+// an almost equal share that barely changes when others come and go. The table is rebuilt
+// when the servers change, but not to skip a server that failed for a request. Like
+// RoundRobin, it isn't safe for concurrent use on its own.
+type Maglev struct {
+	tableSize int
+
+	// names identify the servers the table was built for
+	names []string
+	table []int
+}
+
+// NewMaglev creates a Maglev Balancer. The table size must be a prime, ideally more than
+// 100 times the number of servers for an even spread.
+func NewMaglev(tableSize int) (*Maglev, error) {
+	if tableSize < 2 || !big.NewInt(int64(tableSize)).ProbablyPrime(0) {
+		return nil, fmt.Errorf("maglev table size %d isn't a prime", tableSize)
+	}
+	return &Maglev{tableSize: tableSize}, nil
+}
+
+// newDefaultMaglev creates a Maglev Balancer with the default table size
+func newDefaultMaglev() Balancer {
+	m, _ := NewMaglev(DefaultMaglevTableSize)
+	return m
+}
+
+// Next returns a random server, for callers without a request key
+func (m *Maglev) Next(servers []*Server) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	return servers[rand.Intn(len(servers))]
+}
+
+// NextKey looks the key up in the table for the servers
+func (m *Maglev) NextKey(key uint64, servers []*Server) *Server {
+	return m.nextKeyExcluding(key, servers, nil)
+}
+
+// nextKeyExcluding looks the key up in the table for the servers. The keys of servers
+// that failed for the request fall to the servers of the next slots, which spreads them
+// over the others without rebuilding the table.
+func (m *Maglev) nextKeyExcluding(key uint64, servers []*Server, failed map[*Server]bool) *Server {
+	if remaining(servers, failed) == 0 {
+		return nil
+	}
+	if !m.builtFor(servers) {
+		m.build(servers)
+	}
+	slot := key % uint64(m.tableSize)
+	for i := 0; i < m.tableSize; i++ {
+		if server := servers[m.table[slot]]; !failed[server] {
+			return server
+		}
+		slot = (slot + 1) % uint64(m.tableSize)
+	}
+	// Only servers without a slot in a table smaller than the servers remain
+	return nil
+}
+
+// builtFor reports whether the table was built for the servers
+func (m *Maglev) builtFor(servers []*Server) bool {
+	if len(m.names) != len(servers) {
+		return false
+	}
+	for i, server := range servers {
+		if m.names[i] != server.name() {
+			return false
+		}
+	}
+	return true
+}
+
+// build fills the table with indexes of the servers
+func (m *Maglev) build(servers []*Server) {
+	size := uint64(m.tableSize)
+	offsets := make([]uint64, len(servers))
+	skips := make([]uint64, len(servers))
+	next := make([]uint64, len(servers))
+	m.names = m.names[:0]
+	for i, server := range servers {
+		h := hashString(server.name())
+		offsets[i] = h % size
+		skips[i] = mix64(h)%(size-1) + 1
+		m.names = append(m.names, server.name())
+	}
+
+	m.table = make([]int, m.tableSize)
+	for i := range m.table {
+		m.table[i] = -1
+	}
+	for filled := 0; ; {
+		for i := range servers {
+			slot := (offsets[i] + next[i]*skips[i]) % size
+			for m.table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % size
+			}
+			m.table[slot] = i
+			next[i]++
+			if filled++; filled == m.tableSize {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaglevFailover(t *testing.T) {
+	servers := benchmarkServers(5)
+	m, err := NewMaglev(DefaultMaglevTableSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[uint64]*Server)
+	for key := uint64(0); key < 1000; key++ {
+		before[key] = m.NextKey(key, servers)
+	}
+	table := &m.table[0]
+
+	tests := []struct {
+		name   string
+		failed map[*Server]bool
+	}{
+		{"None", nil},
+		{"One", map[*Server]bool{servers[0]: true}},
+		{"Several", map[*Server]bool{servers[1]: true, servers[3]: true}},
+		{"AllButOne", map[*Server]bool{servers[0]: true, servers[1]: true, servers[2]: true, servers[3]: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			moved := make(map[*Server]int)
+			for key := uint64(0); key < 1000; key++ {
+				server := m.nextKeyExcluding(key, servers, test.failed)
+				switch {
+				case server == nil || test.failed[server]:
+					t.Fatalf("key %d went to %v, which failed", key, server)
+				case !test.failed[before[key]] && server != before[key]:
+					t.Fatalf("key %d moved from a server that didn't fail", key)
+				case server != before[key]:
+					moved[server]++
+				}
+			}
+			if remaining(servers, test.failed) > 1 && len(test.failed) > 0 && len(moved) < 2 {
+				t.Errorf("the keys of the failed servers all moved to %v", moved)
+			}
+			if &m.table[0] != table {
+				t.Error("failing over rebuilt the table")
+			}
+		})
+	}
+
+	all := map[*Server]bool{}
+	for _, server := range servers {
+		all[server] = true
+	}
+	if server := m.nextKeyExcluding(1, servers, all); server != nil {
+		t.Errorf("got %v with every server failed", server)
+	}
+}
+
+func TestMaglevTableIsKeptAcrossRequestFailures(t *testing.T) {
+	servers := benchmarkServers(3)
+	targetGroup := &TargetGroup{URIPath: "/", Servers: servers}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup), WithBalancer(newDefaultMaglev))
+	defer lb.Close()
+	m := lb.balancers[targetGroup].(*Maglev)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	first := lb.getNextServer(targetGroup, r, servers, nil)
+	table := &m.table[0]
+	if second := lb.getNextServer(targetGroup, r, servers, map[*Server]bool{first: true}); second == nil || second == first {
+		t.Errorf("failed over from %v to %v", first, second)
+	}
+	if again := lb.getNextServer(targetGroup, r, servers, nil); again != first {
+		t.Errorf("the request went to %v after failing over, want %v", again, first)
+	}
+	if &m.table[0] != table {
+		t.Error("failing over rebuilt the table")
+	}
+}
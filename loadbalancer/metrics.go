@@ -0,0 +1,281 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics is a registry of counters, gauges and histograms exported in the Prometheus text format
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]metricValue
+	labels map[string][]string
+}
+
+type metricValue interface {
+	value() float64
+}
+
+// metricWriter is implemented by values exported as more than one sample, like histograms
+type metricWriter interface {
+	writeSamples(w io.Writer, name, labels string)
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) value() float64 {
+	return float64(c.v.Load())
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge to n
+func (g *Gauge) Set(n int64) {
+	g.v.Store(n)
+}
+
+// Add adds n, which may be negative, to the gauge
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) value() float64 {
+	return float64(g.v.Load())
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64 // float64 bits
+}
+
+// DefaultLatencyBuckets are histogram buckets in seconds suited to request latencies
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) value() float64 {
+	return float64(h.count.Load())
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i].Load())
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count.Load())
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, math.Float64frombits(h.sum.Load()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count.Load())
+}
+
+// withLabel adds a label to labels formatted by formatLabels
+func withLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+type gaugeFunc func() float64
+
+func (f gaugeFunc) value() float64 {
+	return f()
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// Counter returns the counter with the given name and labels, creating it if needed.
+// Labels are given as alternating names and values.
+func (m *Metrics) Counter(name, help string, labels ...string) *Counter {
+	return m.series(name, help, "counter", labels, func() metricValue { return &Counter{} }).(*Counter)
+}
+
+// Gauge returns the gauge with the given name and labels, creating it if needed.
+// Labels are given as alternating names and values.
+func (m *Metrics) Gauge(name, help string, labels ...string) *Gauge {
+	return m.series(name, help, "gauge", labels, func() metricValue { return &Gauge{} }).(*Gauge)
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when the metrics are collected
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	m.series(name, help, "gauge", labels, func() metricValue { return gaugeFunc(fn) })
+}
+
+// CounterFunc registers a counter whose value is read from fn when the metrics are collected
+func (m *Metrics) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	m.series(name, help, "counter", labels, func() metricValue { return gaugeFunc(fn) })
+}
+
+// Histogram returns the histogram with the given name, buckets and labels, creating it if
+// needed. Labels are given as alternating names and values.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return m.series(name, help, "histogram", labels, func() metricValue {
+		return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	}).(*Histogram)
+}
+
+// series returns the series for the labels in the named family, creating both as needed
+func (m *Metrics) series(name, help, kind string, labels []string, newValue func() metricValue) metricValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	family, ok := m.families[name]
+	if !ok {
+		family = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]metricValue), labels: make(map[string][]string)}
+		m.families[name] = family
+	}
+	key := formatLabels(labels)
+	value, ok := family.series[key]
+	if !ok {
+		value = newValue()
+		family.series[key] = value
+		family.labels[key] = append([]string(nil), labels...)
+	}
+	return value
+}
+
+// formatLabels renders alternating label names and values as {name="value",...}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.write(w, nil)
+}
+
+// filtered returns a handler writing only the series whose labels keep accepts
+func (m *Metrics) filtered(keep func(labels []string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.write(w, keep)
+	})
+}
+
+// write writes the series whose labels keep accepts, or all series if keep is nil.
+// Families without any such series are left out.
+func (m *Metrics) write(w http.ResponseWriter, keep func(labels []string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			if keep == nil || keep(family.labels[key]) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 && keep != nil {
+			continue
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+		for _, key := range keys {
+			if writer, ok := family.series[key].(metricWriter); ok {
+				writer.writeSamples(w, family.name, key)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %g\n", family.name, key, family.series[key].value())
+		}
+	}
+}
+
+// metricSample is the current value of a series, for exporters other than Prometheus
+type metricSample struct {
+	name   string
+	kind   string
+	labels []string
+	value  float64
+
+	// sum is the sum of observations for histograms, whose value is their count
+	sum float64
+}
+
+// snapshot returns the current value of every series
+func (m *Metrics) snapshot() []metricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var samples []metricSample
+	for _, family := range m.families {
+		for key, value := range family.series {
+			sample := metricSample{name: family.name, kind: family.kind, labels: family.labels[key], value: value.value()}
+			if h, ok := value.(*Histogram); ok {
+				sample.sum = math.Float64frombits(h.sum.Load())
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
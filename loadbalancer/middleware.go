@@ -0,0 +1,149 @@
+package loadbalancer
+
+import "net/http"
+
+// Middleware wraps an http.Handler with additional behavior
+type Middleware func(http.Handler) http.Handler
+
+// Use appends middleware that runs for every request handled by the load balancer.
+// It must be called before the load balancer starts serving requests.
+func (lb *LoadBalancer) Use(middleware ...Middleware) {
+	lb.middleware = append(lb.middleware, middleware...)
+	lb.handler = chain(http.HandlerFunc(lb.route), lb.middleware)
+}
+
+// Use appends middleware that runs only for requests routed to the target group.
+// It must be called before the load balancer starts serving requests.
+func (tg *TargetGroup) Use(middleware ...Middleware) {
+	tg.middleware = append(tg.middleware, middleware...)
+}
+
+// chain wraps a handler with middleware so that the first middleware is the outermost
+func chain(handler http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// routeMiddleware returns the built-in middleware enabled by a target group's settings
+func (lb *LoadBalancer) routeMiddleware(targetGroup *TargetGroup) []Middleware {
+	var middleware []Middleware
+	if targetGroup.IPFilter != nil {
+		middleware = append(middleware, IPFilter(*targetGroup.IPFilter))
+	}
+	if targetGroup.CORS != nil {
+		middleware = append(middleware, CORS(*targetGroup.CORS))
+	}
+	if targetGroup.WAF != nil {
+		middleware = append(middleware, lb.waf(*targetGroup.WAF, routeName(targetGroup)))
+	}
+	if targetGroup.BasicAuth != nil {
+		middleware = append(middleware, BasicAuth(*targetGroup.BasicAuth))
+	}
+	if targetGroup.OIDC != nil {
+		middleware = append(middleware, OIDC(*targetGroup.OIDC, targetGroup.URIPath))
+	}
+	if targetGroup.APIKey != nil {
+		middleware = append(middleware, APIKeyAuth(*targetGroup.APIKey, lb.metrics))
+	}
+	// Requests are sent to other groups only once they passed the group's access control,
+	// which the other groups don't repeat
+	if targetGroup.Geo != nil {
+		middleware = append(middleware, lb.geoFilter(*targetGroup.Geo))
+	}
+	if targetGroup.Canary != nil {
+		middleware = append(middleware, lb.canary(*targetGroup.Canary, routeName(targetGroup)))
+	}
+	if targetGroup.Experiment != nil {
+		middleware = append(middleware, lb.experiment(*targetGroup.Experiment))
+	}
+	if targetGroup.Fault != nil {
+		middleware = append(middleware, Fault(*targetGroup.Fault))
+	}
+	if targetGroup.SecurityHeaders != nil {
+		middleware = append(middleware, SecurityHeaders(*targetGroup.SecurityHeaders))
+	}
+	if targetGroup.MaxRequestBodyBytes > 0 {
+		middleware = append(middleware, maxRequestBody(targetGroup.MaxRequestBodyBytes))
+	}
+	if targetGroup.Compression != nil {
+		middleware = append(middleware, Compress(*targetGroup.Compression))
+	}
+	if targetGroup.Cache != nil {
+		// The cache sits inside compression so entries are stored uncompressed
+		cache := NewCache(*targetGroup.Cache, lb.metrics, routeName(targetGroup))
+		lb.caches = append(lb.caches, cache)
+		middleware = append(middleware, cache.Middleware())
+	}
+	return middleware
+}
+
+// routedGroups returns the other target groups that requests for this group may be sent to
+func (tg *TargetGroup) routedGroups() []*TargetGroup {
+	var groups []*TargetGroup
+	if tg.Geo != nil {
+		for _, route := range tg.Geo.Routes {
+			if route.TargetGroup != nil {
+				groups = append(groups, route.TargetGroup)
+			}
+		}
+	}
+	if tg.Canary != nil && tg.Canary.TargetGroup != nil {
+		groups = append(groups, tg.Canary.TargetGroup)
+	}
+	if tg.Experiment != nil {
+		for _, variant := range tg.Experiment.Variants {
+			if variant.TargetGroup != nil {
+				groups = append(groups, variant.TargetGroup)
+			}
+		}
+	}
+	return groups
+}
+
+// routeName returns the name used for a target group in metrics and logs
+func routeName(targetGroup *TargetGroup) string {
+	name := targetGroup.URIPath
+	if name == "" {
+		name = "default"
+	}
+	if targetGroup.Tenant != "" {
+		name = tenantPrefix(targetGroup.Tenant) + name
+	}
+	return name
+}
+
+// headerHookWriter calls a function with the response headers right before they are sent,
+// letting middleware adjust headers set by the backend
+type headerHookWriter struct {
+	http.ResponseWriter
+	onHeader    func(status int, header http.Header)
+	wroteHeader bool
+}
+
+func (hw *headerHookWriter) WriteHeader(status int) {
+	if !hw.wroteHeader && status >= http.StatusOK {
+		hw.wroteHeader = true
+		hw.onHeader(status, hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerHookWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerHookWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerHookWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"lbwtg/loadbalancer"
+	"lbwtg/loadbalancer/testutil"
+)
+
+func TestRoutedGroupsPassAccessControl(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		group  func(routed *loadbalancer.TargetGroup) *loadbalancer.TargetGroup
+		target string
+		want   int
+	}{
+		{
+			name: "basic auth before a forced canary",
+			group: func(routed *loadbalancer.TargetGroup) *loadbalancer.TargetGroup {
+				return &loadbalancer.TargetGroup{
+					BasicAuth: &loadbalancer.BasicAuthConfig{Users: loadbalancer.Htpasswd{"alice": hash}},
+					Canary:    &loadbalancer.CanaryConfig{TargetGroup: routed, Header: "X-Canary"},
+				}
+			},
+			target: "/",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name: "waf before a canary taking every request",
+			group: func(routed *loadbalancer.TargetGroup) *loadbalancer.TargetGroup {
+				return &loadbalancer.TargetGroup{
+					WAF:    &loadbalancer.WAFConfig{Rules: loadbalancer.DefaultWAFRules()},
+					Canary: &loadbalancer.CanaryConfig{TargetGroup: routed, Weight: 1},
+				}
+			},
+			target: "/?q=1%27%20or%20%271%27=%271",
+			want:   http.StatusForbidden,
+		},
+		{
+			name: "basic auth before an experiment",
+			group: func(routed *loadbalancer.TargetGroup) *loadbalancer.TargetGroup {
+				return &loadbalancer.TargetGroup{
+					BasicAuth: &loadbalancer.BasicAuthConfig{Users: loadbalancer.Htpasswd{"alice": hash}},
+					Experiment: &loadbalancer.ExperimentConfig{
+						Name:     "checkout",
+						Variants: []loadbalancer.ExperimentVariant{{Name: "b", Weight: 1, TargetGroup: routed}},
+					},
+				}
+			},
+			target: "/",
+			want:   http.StatusUnauthorized,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary := testutil.NewBackend(t, "primary")
+			routed := testutil.NewBackend(t, "routed")
+			group := test.group(&loadbalancer.TargetGroup{Servers: testutil.Servers(routed)})
+			group.URIPath = "/"
+			group.Servers = testutil.Servers(primary)
+			lb := loadbalancer.NewLoadBalancer(loadbalancer.WithTargetGroup(group))
+			defer lb.Close()
+
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			r.Header.Set("X-Canary", "true")
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("status %d, want %d", w.Code, test.want)
+			}
+			if routed.Requests() != 0 {
+				t.Errorf("the routed group got %d requests", routed.Requests())
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPResponseBytes limits the size of OCSP responses read from responders
+const maxOCSPResponseBytes = 1 << 20
+
+// StapleOCSP fetches OCSP responses for the store's certificates from their issuers'
+// responders and staples them to TLS handshakes, saving clients from asking the responders
+// themselves. Every interval until ctx is done it fetches responses for new certificates
+// and refreshes those past half their validity. Certificates without a responder or an
+// issuer in their chain aren't stapled, and a failed refresh keeps the previous response
+// while it is valid.
+func (s *CertificateStore) StapleOCSP(ctx context.Context, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, file := range s.list() {
+			if err := file.staple(ctx, client); err != nil {
+				logger().Warn("ocsp stapling failed", "cert_file", file.CertFile, "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// staple fetches a new OCSP response for the current certificate if it has none or its
+// response is due for a refresh
+func (f *CertificateFile) staple(ctx context.Context, client *http.Client) error {
+	certificate := f.Certificate()
+	if certificate == nil || certificate.Leaf == nil || len(certificate.Leaf.OCSPServer) == 0 || len(certificate.Certificate) < 2 {
+		return nil
+	}
+	now := time.Now()
+	f.mu.Lock()
+	stapled := f.stapled == certificate && now.Before(f.ocspRefresh)
+	f.mu.Unlock()
+	if stapled {
+		return nil
+	}
+
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return fmt.Errorf("parsing issuer: %w", err)
+	}
+	raw, response, err := fetchOCSP(ctx, client, certificate.Leaf, issuer)
+	if err != nil {
+		f.dropExpiredStaple(certificate, now)
+		return err
+	}
+	if response.Status != ocsp.Good {
+		logger().Error("certificate is not valid according to its ocsp responder", "cert_file", f.CertFile, "status", ocspStatus(response.Status))
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Certificate() != certificate {
+		// Reloaded meanwhile, the new certificate is stapled on the next round
+		return nil
+	}
+	stapledCertificate := *certificate
+	stapledCertificate.OCSPStaple = raw
+	f.certificate.Store(&stapledCertificate)
+	f.stapled = &stapledCertificate
+	f.ocspRefresh = now.Add(time.Hour)
+	f.ocspExpires = response.NextUpdate
+	if !response.NextUpdate.IsZero() {
+		f.ocspRefresh = response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	}
+	logger().Debug("ocsp response stapled", "cert_file", f.CertFile, "next_update", response.NextUpdate)
+	return nil
+}
+
+// dropExpiredStaple stops stapling a response that expired without being refreshed, which
+// clients would reject
+func (f *CertificateFile) dropExpiredStaple(certificate *tls.Certificate, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stapled != certificate || f.ocspExpires.IsZero() || now.Before(f.ocspExpires) {
+		return
+	}
+	unstapled := *certificate
+	unstapled.OCSPStaple = nil
+	f.certificate.Store(&unstapled)
+	f.stapled = nil
+}
+
+// fetchOCSP asks the certificate's first OCSP responder for its status
+func fetchOCSP(ctx context.Context, client *http.Client, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("ocsp responder %s: %s", leaf.OCSPServer[0], resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return nil, nil, errors.New("ocsp response expired")
+	}
+	return raw, response, nil
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
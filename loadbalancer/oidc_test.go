@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReturnPath(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/", "/"},
+		{"/app/x?y=1", "/app/x?y=1"},
+		{"//evil.example/x", "/"},
+		{"/\\evil.example/x", "/"},
+		{"https://evil.example/x", "/"},
+		{"evil.example", "/"},
+		{"", "/"},
+	}
+	for _, test := range tests {
+		if got := returnPath(test.uri); got != test.want {
+			t.Errorf("returnPath(%q) = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestOIDCLoginsAreBounded(t *testing.T) {
+	a := &oidcAuth{config: OIDCConfig{ClientID: "lb"}, route: "/", logins: make(map[string]*oidcLogin), sessions: make(map[string]*oidcSession)}
+	provider := &oidcProvider{AuthorizationEndpoint: "https://idp.example/auth"}
+	for i := 0; i < maxOIDCLogins+100; i++ {
+		a.startLogin(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "//evil.example/x", nil), provider)
+	}
+	if len(a.logins) > maxOIDCLogins {
+		t.Errorf("%d logins in progress, want at most %d", len(a.logins), maxOIDCLogins)
+	}
+	for _, login := range a.logins {
+		if login.returnTo != "/" {
+			t.Fatalf("login returns to %q", login.returnTo)
+		}
+	}
+}
+
+// signJWT returns a JWT of the claims signed with key, an *rsa.PrivateKey for RS256 or an
+// *ecdsa.PrivateKey for ES256
+func signJWT(t *testing.T, alg, kid string, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key set serves a key rotated in after the others were fetched
+	rotatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32))) }
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{
+			{"kty": "EC", "kid": "rotated", "crv": "P-256", "x": encode(rotatedKey.X), "y": encode(rotatedKey.Y)},
+		}})
+	}))
+	defer jwks.Close()
+
+	provider := &oidcProvider{Issuer: "https://idp.example", JWKSURI: jwks.URL}
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{"iss": provider.Issuer, "sub": "alice", "aud": "lb", "exp": time.Now().Add(time.Hour).Unix(), "email": "alice@example.com"}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+	unsigned := signJWT(t, "none", "rsa", claims(nil), rsaKey)
+	unsigned = unsigned[:strings.LastIndex(unsigned, ".")+1]
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", claims(nil), rsaKey), true},
+		{"ES256", signJWT(t, "ES256", "ec", claims(nil), ecKey), true},
+		{"AudienceList", signJWT(t, "RS256", "rsa", claims(map[string]any{"aud": []string{"other", "lb"}}), rsaKey), true},
+		{"RotatedKey", signJWT(t, "ES256", "rotated", claims(nil), rotatedKey), true},
+		{"OtherIssuer", signJWT(t, "RS256", "rsa", claims(map[string]any{"iss": "https://evil.example"}), rsaKey), false},
+		{"OtherAudience", signJWT(t, "RS256", "rsa", claims(map[string]any{"aud": []string{"other"}}), rsaKey), false},
+		{"Expired", signJWT(t, "RS256", "rsa", claims(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()}), rsaKey), false},
+		{"SignedByAnotherKey", signJWT(t, "RS256", "rsa", claims(nil), otherKey), false},
+		{"AlgorithmOfAnotherKey", signJWT(t, "RS256", "ec", claims(nil), rsaKey), false},
+		{"UnknownKey", signJWT(t, "RS256", "unknown", claims(nil), rsaKey), false},
+		{"AlgorithmNone", unsigned, false},
+		{"Malformed", "a.b", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &oidcAuth{
+				config: OIDCConfig{ClientID: "lb"},
+				client: jwks.Client(),
+				keys:   map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey},
+			}
+			claims, err := a.verifyIDToken(context.Background(), provider, test.token)
+			if test.valid && err != nil {
+				t.Errorf("the token was rejected: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("the token was accepted: %+v", claims)
+			}
+			if test.valid && err == nil && (claims.Subject != "alice" || claims.Email != "alice@example.com") {
+				t.Errorf("the claims are %+v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+)
+
+// Option configures a LoadBalancer
+type Option func(*LoadBalancer)
+
+// WithTargetGroup adds a target group to the load balancer
+func WithTargetGroup(targetGroup *TargetGroup) Option {
+	return func(lb *LoadBalancer) {
+		lb.targetGroups = append(lb.targetGroups, targetGroup)
+	}
+}
+
+// WithServer adds a backend server to the default target group, which serves requests that don't match any other target group
+func WithServer(serverURL *url.URL) Option {
+	return func(lb *LoadBalancer) {
+		lb.defaultGroup.Servers = append(lb.defaultGroup.Servers, &Server{URL: serverURL})
+	}
+}
+
+// WithHealthCheck sets the health check path used for servers that don't specify their own
+func WithHealthCheck(path string) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthCheckPath = path
+	}
+}
+
+// WithBalancer sets the constructor used to create a Balancer for each target group
+func WithBalancer(newBalancer func() Balancer) Option {
+	return func(lb *LoadBalancer) {
+		lb.newBalancer = newBalancer
+	}
+}
+
+// WithTransport sets the transport used to forward requests to backend servers of target groups without their own
+func WithTransport(transport http.RoundTripper) Option {
+	return func(lb *LoadBalancer) {
+		lb.transport = transport
+	}
+}
+
+// WithTransportConfig creates a transport from the configuration and shares it, along with its
+// connection pool, across all target groups that don't have their own transport
+func WithTransportConfig(config TransportConfig) Option {
+	return func(lb *LoadBalancer) {
+		lb.transport = NewTransport(config)
+	}
+}
+
+// WithErrorHandler sets the handler called when a request can't be forwarded to the chosen backend server,
+// e.g. because dialing it failed. The default handler logs the error and responds with 502 Bad Gateway.
+func WithErrorHandler(errorHandler func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(lb *LoadBalancer) {
+		lb.errorHandler = errorHandler
+	}
+}
+
+// WithMetrics sets the registry the load balancer records its metrics in
+func WithMetrics(metrics *Metrics) Option {
+	return func(lb *LoadBalancer) {
+		lb.metrics = metrics
+	}
+}
+
+// WithBufferPool sets the buffer pool used by the reverse proxies when copying response bodies.
+// By default a BufferPool reporting to the load balancer's metrics is used.
+func WithBufferPool(bufferPool httputil.BufferPool) Option {
+	return func(lb *LoadBalancer) {
+		lb.bufferPool = bufferPool
+	}
+}
+
+// WithTrustedProxies sets the addresses of proxies in front of the load balancer whose
+// X-Forwarded-For headers are trusted when determining the client address
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(lb *LoadBalancer) {
+		lb.trustedProxies = append(lb.trustedProxies, prefixes...)
+	}
+}
+
+// WithGeoIP sets the database used to locate clients for target groups with a GeoConfig
+func WithGeoIP(geoIP *GeoIP) Option {
+	return func(lb *LoadBalancer) {
+		lb.geoIP = geoIP
+	}
+}
+
+// WithAdminAuth protects the admin API with an authentication middleware, such as
+// BearerTokenAuth or BasicAuth. Profiling endpoints are only served when it is set.
+func WithAdminAuth(auth Middleware) Option {
+	return func(lb *LoadBalancer) {
+		lb.adminAuth = auth
+	}
+}
@@ -0,0 +1,299 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PassthroughConfig configures a TLS passthrough listener, which routes TLS connections to
+// backends by the server name of their ClientHello without terminating them, for backends
+// that must do TLS themselves, e.g. to authenticate clients end to end
+type PassthroughConfig struct {
+	Addr string
+
+	// Routes are matched against the ClientHello's server name like VirtualHost.Hosts
+	Routes []PassthroughRoute
+
+	// DefaultBackends get connections matching no route or without a server name; such
+	// connections are closed if there are none
+	DefaultBackends []string
+
+	// HandshakeTimeout limits how long clients may take to send their ClientHello; 10s by
+	// default
+	HandshakeTimeout time.Duration
+
+	// DialTimeout limits connecting to a backend; 10s by default
+	DialTimeout time.Duration
+
+	// ClientLimits limits the connections of each client address when set
+	ClientLimits *ClientLimits
+
+	// Metrics, when set, counts the connections routed to each backend
+	Metrics *Metrics
+}
+
+// PassthroughRoute sends the connections for some server names to backends
+type PassthroughRoute struct {
+	Hosts []string
+
+	// Backends are host:port addresses, tried in turn from the next one for every
+	// connection until one accepts it
+	Backends []string
+}
+
+// passthroughBackends is a route's backends with the index to try first
+type passthroughBackends struct {
+	addrs []string
+	next  atomic.Uint32
+}
+
+// ServePassthrough accepts connections on the address and splices each to a backend of the
+// route for its server name
+func ServePassthrough(config PassthroughConfig) error {
+	return ServePassthroughContext(context.Background(), config)
+}
+
+// ServePassthroughContext is ServePassthrough until ctx is done. Then it stops accepting
+// connections and returns nil once the spliced connections are closed, or closes those
+// still open after shutdownTimeout.
+func ServePassthroughContext(ctx context.Context, config PassthroughConfig) error {
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = 10 * time.Second
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 10 * time.Second
+	}
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	if config.ClientLimits != nil {
+		listener = limitClients(listener, *config.ClientLimits, config.Metrics, config.Addr)
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	routes := make([]*passthroughBackends, len(config.Routes))
+	for i, route := range config.Routes {
+		routes[i] = &passthroughBackends{addrs: route.Backends}
+	}
+	defaults := &passthroughBackends{addrs: config.DefaultBackends}
+	conns := &passthroughConns{conns: make(map[net.Conn]struct{})}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				config.drain(conns)
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		conns.add(conn)
+		go func() {
+			defer conns.done(conn)
+			config.serve(conn, routes, defaults, conns)
+		}()
+	}
+}
+
+// drain waits for the connections to be over, closing those still open after
+// shutdownTimeout
+func (config *PassthroughConfig) drain(conns *passthroughConns) {
+	drained := make(chan struct{})
+	go func() {
+		conns.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(shutdownTimeout):
+		logger().Warn("passthrough: connections were still open at shutdown", "addr", config.Addr)
+		conns.closeAll()
+		<-drained
+	}
+}
+
+// passthroughConns tracks the client and backend connections of a passthrough listener,
+// so they can be drained when it shuts down
+type passthroughConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// add tracks a client connection until done is called for it
+func (c *passthroughConns) add(conn net.Conn) {
+	c.wg.Add(1)
+	c.track(conn)
+}
+
+// done stops tracking a client connection
+func (c *passthroughConns) done(conn net.Conn) {
+	c.untrack(conn)
+	c.wg.Done()
+}
+
+// track adds a connection to those closed by closeAll
+func (c *passthroughConns) track(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[conn] = struct{}{}
+}
+
+// untrack removes a connection from those closed by closeAll
+func (c *passthroughConns) untrack(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+}
+
+// closeAll closes the tracked connections
+func (c *passthroughConns) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// serve reads the connection's ClientHello and splices it to a backend
+func (config *PassthroughConfig) serve(conn net.Conn, routes []*passthroughBackends, defaults *passthroughBackends, conns *passthroughConns) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(config.HandshakeTimeout))
+	serverName, hello, err := readClientHello(conn)
+	if err != nil {
+		logger().Debug("reading client hello failed", "client", conn.RemoteAddr(), "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	backends := defaults
+	if i := matchPassthroughRoute(config.Routes, serverName); i >= 0 {
+		backends = routes[i]
+	}
+	backend, addr := config.dial(backends)
+	if backend == nil {
+		logger().Warn("no passthrough backend", "server_name", serverName, "client", conn.RemoteAddr())
+		config.count(serverName, "", "unavailable")
+		return
+	}
+	defer backend.Close()
+	conns.track(backend)
+	defer conns.untrack(backend)
+	config.count(serverName, addr, "routed")
+	if _, err := backend.Write(hello); err != nil {
+		return
+	}
+	splice(conn, backend)
+}
+
+// dial connects to the first of the backends that accepts, starting from the next one
+func (config *PassthroughConfig) dial(backends *passthroughBackends) (net.Conn, string) {
+	if len(backends.addrs) == 0 {
+		return nil, ""
+	}
+	start := int(backends.next.Add(1))
+	for i := range backends.addrs {
+		addr := backends.addrs[(start+i)%len(backends.addrs)]
+		conn, err := net.DialTimeout("tcp", addr, config.DialTimeout)
+		if err == nil {
+			return conn, addr
+		}
+		logger().Warn("passthrough backend unreachable", "backend", addr, "error", err)
+	}
+	return nil, ""
+}
+
+func (config *PassthroughConfig) count(serverName, backend, result string) {
+	if config.Metrics == nil {
+		return
+	}
+	config.Metrics.Counter("loadbalancer_passthrough_connections_total", "Number of TLS passthrough connections by backend and result.",
+		"listener", config.Addr, "backend", backend, "result", result).Inc()
+}
+
+// matchPassthroughRoute returns the index of the route for the server name, preferring
+// exact names over wildcards and longer wildcards over shorter ones, or -1
+func matchPassthroughRoute(routes []PassthroughRoute, serverName string) int {
+	if serverName == "" {
+		return -1
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	match, matchLen := -1, 0
+	for i, route := range routes {
+		for _, name := range route.Hosts {
+			name = strings.ToLower(name)
+			if name == serverName {
+				return i
+			}
+			if suffix, ok := strings.CutPrefix(name, "*"); ok && strings.HasSuffix(serverName, suffix) && len(suffix) > matchLen {
+				match, matchLen = i, len(suffix)
+			}
+		}
+	}
+	return match
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// readClientHello parses the ClientHello at the start of a TLS connection, returning its
+// server name and the bytes read so they can be replayed to the backend
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(sniffConn{Conn: conn, r: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	return hello.ServerName, read.Bytes(), nil
+}
+
+// sniffConn lets a TLS server read a ClientHello without writing to the client
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (sniffConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// splice copies between the connections in both directions until both are done
+func splice(client, backend net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(backend, client)
+	go copyHalf(client, backend)
+	wg.Wait()
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPassthroughDrainsConnectionsWhenDone(t *testing.T) {
+	certFile, keyFile, _ := writeCertificate(t)
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServePassthroughContext(ctx, PassthroughConfig{Addr: addr, DefaultBackends: []string{backend.Addr().String()}})
+	}()
+
+	var conn *tls.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func() {
+		t.Helper()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+			t.Fatalf("got %q (%v), want the echo", reply, err)
+		}
+	}
+	echo()
+
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("serving returned with a connection open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The open connection keeps working, but no new ones are accepted
+	echo()
+	if other, err := net.Dial("tcp", addr); err == nil {
+		other.Close()
+		t.Error("a connection was accepted after shutting down")
+	}
+
+	conn.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serving failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serving didn't return once the connection was closed")
+	}
+}
@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// observeTTFB records the time until a server's response headers arrived
+func (lb *LoadBalancer) observeTTFB(targetGroup *TargetGroup, server *Server, d time.Duration) {
+	lb.metrics.Histogram("loadbalancer_upstream_ttfb_seconds", "Time until backend response headers were received.",
+		DefaultLatencyBuckets, "route", routeName(targetGroup), "backend", server.name()).Observe(d.Seconds())
+}
+
+// observeDuration records the time until a server's response was fully sent to the client
+func (lb *LoadBalancer) observeDuration(targetGroup *TargetGroup, server *Server, d time.Duration) {
+	lb.metrics.Histogram("loadbalancer_upstream_duration_seconds", "Total time spent proxying requests to backends.",
+		DefaultLatencyBuckets, "route", routeName(targetGroup), "backend", server.name()).Observe(d.Seconds())
+}
+
+// backendInFlight returns the gauge of requests being proxied to a server
+func (lb *LoadBalancer) backendInFlight(targetGroup *TargetGroup, server *Server) *Gauge {
+	return lb.metrics.Gauge("loadbalancer_upstream_in_flight_requests", "Number of requests being proxied to each backend.",
+		"route", routeName(targetGroup), "backend", server.name())
+}
+
+// statusClass returns the class of a status code, like 2xx
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// countResponse counts a response sent to a client for a route, including responses the
+// load balancer generated itself
+func (lb *LoadBalancer) countResponse(targetGroup *TargetGroup, status int) {
+	lb.metrics.Counter("loadbalancer_requests_total", "Number of requests per route by response status class.",
+		"route", routeName(targetGroup), "class", statusClass(status)).Inc()
+}
+
+// countBackendResponse counts a response received from a server
+func (lb *LoadBalancer) countBackendResponse(targetGroup *TargetGroup, server *Server, status int) {
+	lb.metrics.Counter("loadbalancer_upstream_responses_total", "Number of backend responses by status class.",
+		"route", routeName(targetGroup), "backend", server.name(), "class", statusClass(status)).Inc()
+}
+
+// countProxyError counts a failure to get a response from a server
+func (lb *LoadBalancer) countProxyError(targetGroup *TargetGroup, server *Server, err error) {
+	lb.metrics.Counter("loadbalancer_upstream_errors_total", "Number of failed requests to backends by kind of error.",
+		"route", routeName(targetGroup), "backend", server.name(), "kind", proxyErrorKind(err)).Inc()
+}
+
+// proxyErrorKind classifies errors from forwarding a request as dial, timeout, tls,
+// canceled, body_too_large or other
+func proxyErrorKind(err error) string {
+	var opErr *net.OpError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case isMaxBytesError(err):
+		return "body_too_large"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case errors.As(err, &recordErr), errors.As(err, &certErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// countingHandler counts the responses a handler sends for a route
+func (lb *LoadBalancer) countingHandler(targetGroup *TargetGroup, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	status := 0
+	hooked := &headerHookWriter{ResponseWriter: w, onHeader: func(code int, _ http.Header) { status = code }}
+	next.ServeHTTP(hooked, r)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	lb.countResponse(targetGroup, status)
+}
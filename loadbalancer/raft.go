@@ -0,0 +1,588 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RaftConfig makes a ConfigReloader one node of a cluster replicating configuration
+// changes with the Raft consensus algorithm: reloads and rollbacks on any node are applied
+// by all of them, in the same order, as long as a majority of the nodes is up
+type RaftConfig struct {
+	// ID names the node; it must be unique in the cluster
+	ID string
+
+	// Addr is the address the node serves the Raft RPCs on, e.g. ":7946"
+	Addr string
+
+	// Peers are the URLs of the other nodes' Addr by their ID, e.g. "lb-2": "http://lb-2:7946"
+	Peers map[string]string
+
+	// Dir keeps the node's Raft state so it survives restarts; it is lost with the process
+	// if empty, which is only safe while the other nodes keep running
+	Dir string
+
+	// Key authenticates the nodes to each other. It is required unless Addr is a loopback
+	// address, since whoever can reach Addr without it can replace the configuration of
+	// every node.
+	Key string
+
+	// ElectionTimeout is how long followers wait for the leader before electing another,
+	// picked at random between it and twice it; 1s by default
+	ElectionTimeout time.Duration
+
+	// HeartbeatInterval is how often the leader replicates to the followers; 100ms by
+	// default
+	HeartbeatInterval time.Duration
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (role raftRole) String() string {
+	return [...]string{"follower", "candidate", "leader"}[role]
+}
+
+// raftEntry is an entry of the replicated log. Entries without data are the no-ops new
+// leaders append to commit the entries of earlier terms.
+type raftEntry struct {
+	Term  int64           `json:"term"`
+	Index int64           `json:"index"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// raftState is the state a node keeps on disk. Log starts with the last entry compacted
+// into it, which is committed: as every entry holds a whole configuration, the applied
+// entries before the latest one aren't needed.
+type raftState struct {
+	Term     int64       `json:"term"`
+	VotedFor string      `json:"voted_for"`
+	Log      []raftEntry `json:"log"`
+}
+
+type raftVoteRequest struct {
+	Term      int64  `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type raftVoteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term      int64       `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex int64       `json:"prev_index"`
+	PrevTerm  int64       `json:"prev_term"`
+	Entries   []raftEntry `json:"entries"`
+	Commit    int64       `json:"commit"`
+
+	// Snapshot replaces the follower's log with Entries, for followers behind the
+	// leader's compacted log
+	Snapshot bool `json:"snapshot"`
+}
+
+type raftAppendResponse struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"`
+
+	// Match is the follower's last matching entry on success, or a hint where to retry from
+	Match int64 `json:"match"`
+}
+
+// raftCompactEntries is how many applied entries are kept before the log is compacted
+const raftCompactEntries = 64
+
+// raftNode is a node of the Raft cluster, applying the committed entries' data in order
+type raftNode struct {
+	config RaftConfig
+	apply  func(data []byte)
+	client *http.Client
+
+	mu sync.Mutex
+	raftState
+	role          raftRole
+	leader        string
+	commitIndex   int64
+	lastApplied   int64
+	deadline      time.Time
+	lastHeartbeat time.Time
+	nextIndex     map[string]int64
+	matchIndex    map[string]int64
+	votes         int
+	applyC        chan struct{}
+}
+
+func newRaftNode(config RaftConfig, apply func(data []byte)) (*raftNode, error) {
+	if config.ID == "" {
+		return nil, errors.New("raft: the node needs an ID")
+	}
+	if config.Key == "" && !isLoopbackAddr(config.Addr) {
+		return nil, fmt.Errorf("raft: a key is required to serve on %q, which isn't a loopback address", config.Addr)
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 100 * time.Millisecond
+	}
+	n := &raftNode{
+		config:    config,
+		apply:     apply,
+		client:    &http.Client{Timeout: config.ElectionTimeout},
+		raftState: raftState{Log: []raftEntry{{}}},
+		applyC:    make(chan struct{}, 1),
+	}
+	if config.Dir != "" {
+		data, err := os.ReadFile(n.stateFile())
+		if err == nil {
+			err = json.Unmarshal(data, &n.raftState)
+			if err == nil && len(n.Log) == 0 {
+				err = errors.New("empty log")
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("raft: %w", err)
+		}
+	}
+	// The first entry is committed, so it can be applied before hearing from a leader
+	n.commitIndex = n.Log[0].Index
+	n.lastApplied = n.Log[0].Index - 1
+	n.resetDeadline()
+	return n, nil
+}
+
+func (n *raftNode) stateFile() string {
+	return filepath.Join(n.config.Dir, "raft-"+n.config.ID+".json")
+}
+
+// persist writes the state to disk before the node acts on it; n.mu must be held
+func (n *raftNode) persist() {
+	if n.config.Dir == "" {
+		return
+	}
+	data, err := json.Marshal(n.raftState)
+	if err == nil {
+		// Write to a temporary file first so a crash never leaves a truncated state behind
+		if err = os.WriteFile(n.stateFile()+".tmp", data, 0o600); err == nil {
+			err = os.Rename(n.stateFile()+".tmp", n.stateFile())
+		}
+	}
+	if err != nil {
+		logger().Error("raft: saving state failed", "error", err)
+	}
+}
+
+func (n *raftNode) lastIndex() int64 { return n.Log[len(n.Log)-1].Index }
+
+func (n *raftNode) lastTerm() int64 { return n.Log[len(n.Log)-1].Term }
+
+// entry returns the entry at index, which must be in the log
+func (n *raftNode) entry(index int64) raftEntry { return n.Log[index-n.Log[0].Index] }
+
+func (n *raftNode) resetDeadline() {
+	n.deadline = time.Now().Add(n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout))))
+}
+
+// majority is how many nodes, the node itself included, make a quorum; Peers lists only the
+// others
+func (n *raftNode) majority() int { return (len(n.config.Peers)+1)/2 + 1 }
+
+// run elects a leader, replicates and applies the log until ctx is done
+func (n *raftNode) run(ctx context.Context) {
+	go n.applyCommitted(ctx)
+	n.signalApply()
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == raftLeader && time.Since(n.lastHeartbeat) >= n.config.HeartbeatInterval:
+			n.broadcast()
+		case n.role != raftLeader && time.Now().After(n.deadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection asks the peers to make the node the leader of a new term
+func (n *raftNode) startElection() {
+	n.Term++
+	n.role = raftCandidate
+	n.VotedFor = n.config.ID
+	n.leader = ""
+	n.votes = 1
+	n.persist()
+	n.resetDeadline()
+	logger().Info("raft: starting election", "term", n.Term)
+	if n.votes >= n.majority() {
+		n.becomeLeader()
+		return
+	}
+	request := raftVoteRequest{Term: n.Term, Candidate: n.config.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	for _, url := range n.config.Peers {
+		url := url
+		go func() {
+			var response raftVoteResponse
+			if err := n.call(url+"/raft/vote", request, &response); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if response.Term > n.Term {
+				n.stepDown(response.Term)
+				return
+			}
+			if n.role == raftCandidate && n.Term == request.Term && response.Granted {
+				if n.votes++; n.votes >= n.majority() {
+					n.becomeLeader()
+				}
+			}
+		}()
+	}
+}
+
+func (n *raftNode) becomeLeader() {
+	n.role = raftLeader
+	n.leader = n.config.ID
+	n.nextIndex = make(map[string]int64)
+	n.matchIndex = make(map[string]int64)
+	for id := range n.config.Peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+	}
+	n.Log = append(n.Log, raftEntry{Term: n.Term, Index: n.lastIndex() + 1})
+	n.persist()
+	logger().Info("raft: elected leader", "term", n.Term)
+	n.broadcast()
+	n.advanceCommit()
+}
+
+// stepDown makes the node a follower, of a newer term if term is higher
+func (n *raftNode) stepDown(term int64) {
+	if term > n.Term {
+		n.Term = term
+		n.VotedFor = ""
+		n.persist()
+	}
+	n.role = raftFollower
+}
+
+// broadcast replicates the log to every peer
+func (n *raftNode) broadcast() {
+	n.lastHeartbeat = time.Now()
+	for id, url := range n.config.Peers {
+		go n.replicate(id, url)
+	}
+}
+
+// replicate sends the peer the entries it is missing
+func (n *raftNode) replicate(id, url string) {
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return
+	}
+	request := raftAppendRequest{Term: n.Term, Leader: n.config.ID, Commit: n.commitIndex}
+	next := n.nextIndex[id]
+	if next <= n.Log[0].Index {
+		request.Snapshot = true
+		request.Entries = append([]raftEntry(nil), n.Log...)
+	} else {
+		prev := n.entry(next - 1)
+		request.PrevIndex, request.PrevTerm = prev.Index, prev.Term
+		request.Entries = append([]raftEntry(nil), n.Log[next-n.Log[0].Index:]...)
+	}
+	n.mu.Unlock()
+
+	var response raftAppendResponse
+	if err := n.call(url+"/raft/append", request, &response); err != nil {
+		logger().Debug("raft: replicating failed", "peer", id, "error", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if response.Term > n.Term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.role != raftLeader || n.Term != request.Term {
+		return
+	}
+	if response.Success {
+		n.matchIndex[id] = max(n.matchIndex[id], response.Match)
+		n.nextIndex[id] = n.matchIndex[id] + 1
+		n.advanceCommit()
+	} else {
+		n.nextIndex[id] = max(1, min(next-1, response.Match+1))
+	}
+}
+
+// advanceCommit commits the entries of the current term a majority has
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.entry(index).Term == n.Term; index-- {
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *raftNode) signalApply() {
+	select {
+	case n.applyC <- struct{}{}:
+	default:
+	}
+}
+
+// applyCommitted applies the latest committed data whenever entries are committed, and
+// compacts the log
+func (n *raftNode) applyCommitted(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.applyC:
+		}
+		n.mu.Lock()
+		var data []byte
+		latest := int64(-1)
+		for index := max(n.lastApplied+1, n.Log[0].Index); index <= n.commitIndex; index++ {
+			if entry := n.entry(index); entry.Data != nil {
+				data, latest = entry.Data, index
+			}
+		}
+		n.lastApplied = max(n.lastApplied, n.commitIndex)
+		if latest >= 0 && latest-n.Log[0].Index > raftCompactEntries {
+			n.Log = append([]raftEntry(nil), n.Log[latest-n.Log[0].Index:]...)
+			n.persist()
+		}
+		n.mu.Unlock()
+		if data != nil {
+			n.apply(data)
+		}
+	}
+}
+
+// handleVote answers a candidate's vote request
+func (n *raftNode) handleVote(request raftVoteRequest) raftVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if request.Term > n.Term {
+		n.stepDown(request.Term)
+	}
+	upToDate := request.LastTerm > n.lastTerm() || request.LastTerm == n.lastTerm() && request.LastIndex >= n.lastIndex()
+	granted := request.Term == n.Term && (n.VotedFor == "" || n.VotedFor == request.Candidate) && upToDate
+	if granted {
+		n.VotedFor = request.Candidate
+		n.persist()
+		n.resetDeadline()
+	}
+	return raftVoteResponse{Term: n.Term, Granted: granted}
+}
+
+// handleAppend adds the leader's entries to the log
+func (n *raftNode) handleAppend(request raftAppendRequest) raftAppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if request.Term < n.Term {
+		return raftAppendResponse{Term: n.Term}
+	}
+	if request.Term > n.Term || n.role != raftFollower {
+		n.stepDown(request.Term)
+	}
+	n.leader = request.Leader
+	n.resetDeadline()
+
+	if request.Snapshot {
+		if len(request.Entries) == 0 {
+			return raftAppendResponse{Term: n.Term}
+		}
+		n.Log = request.Entries
+		n.persist()
+		n.commitIndex = max(n.commitIndex, n.Log[0].Index, min(request.Commit, n.lastIndex()))
+		n.signalApply()
+		return raftAppendResponse{Term: n.Term, Success: true, Match: n.lastIndex()}
+	}
+
+	if request.PrevIndex > n.lastIndex() {
+		return raftAppendResponse{Term: n.Term, Match: n.lastIndex()}
+	}
+	// Entries up to the first one are committed, so they match the leader's
+	if request.PrevIndex >= n.Log[0].Index && n.entry(request.PrevIndex).Term != request.PrevTerm {
+		return raftAppendResponse{Term: n.Term, Match: request.PrevIndex - 1}
+	}
+	changed := false
+	for _, entry := range request.Entries {
+		switch {
+		case entry.Index <= n.Log[0].Index:
+			continue
+		case entry.Index <= n.lastIndex():
+			if n.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			n.Log = n.Log[:entry.Index-n.Log[0].Index]
+		}
+		n.Log = append(n.Log, entry)
+		changed = true
+	}
+	if changed {
+		n.persist()
+	}
+	match := request.PrevIndex + int64(len(request.Entries))
+	if request.Commit > n.commitIndex {
+		n.commitIndex = min(request.Commit, match)
+		n.signalApply()
+	}
+	return raftAppendResponse{Term: n.Term, Success: true, Match: match}
+}
+
+// propose replicates data through the leader, waiting until it is committed
+func (n *raftNode) propose(ctx context.Context, data []byte) error {
+	n.mu.Lock()
+	if n.role != raftLeader {
+		url, ok := n.config.Peers[n.leader]
+		n.mu.Unlock()
+		if !ok {
+			return errors.New("raft: no leader")
+		}
+		return n.call(url+"/raft/propose", json.RawMessage(data), nil)
+	}
+	term := n.Term
+	entry := raftEntry{Term: term, Index: n.lastIndex() + 1, Data: data}
+	n.Log = append(n.Log, entry)
+	n.persist()
+	n.broadcast()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		committed, lost := n.commitIndex >= entry.Index, n.Term != term
+		n.mu.Unlock()
+		switch {
+		case lost:
+			return errors.New("raft: lost leadership before the change was committed")
+		case committed:
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("raft: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// call posts an RPC to a peer
+func (n *raftNode) call(url string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.config.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+n.config.Key)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// ServeHTTP serves the RPCs of the other nodes, and the node's status on GET /raft/status
+func (n *raftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if n.config.Key != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+n.config.Key)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/raft/status" {
+		n.mu.Lock()
+		status := map[string]any{"id": n.config.ID, "role": n.role.String(), "term": n.Term, "leader": n.leader, "commit": n.commitIndex, "last_index": n.lastIndex()}
+		n.mu.Unlock()
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64<<20))
+	switch r.URL.Path {
+	case "/raft/vote":
+		var request raftVoteRequest
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, n.handleVote(request))
+	case "/raft/append":
+		var request raftAppendRequest
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, n.handleAppend(request))
+	case "/raft/propose":
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := n.propose(r.Context(), data); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"committed": true})
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,313 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRaftMajority(t *testing.T) {
+	tests := []struct {
+		nodes int
+		want  int
+	}{
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{5, 3},
+	}
+	for _, test := range tests {
+		n := &raftNode{config: RaftConfig{Peers: make(map[string]string)}}
+		for i := 1; i < test.nodes; i++ {
+			n.config.Peers["peer"+strconv.Itoa(i)] = "http://peer" + strconv.Itoa(i)
+		}
+		if got := n.majority(); got != test.want {
+			t.Errorf("majority of %d nodes = %d, want %d", test.nodes, got, test.want)
+		}
+	}
+}
+
+// votingPeer is a fake node answering vote requests with granted
+func votingPeer(t *testing.T, granted bool, requests *atomic.Int64) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/raft/vote" {
+			http.NotFound(w, r)
+			return
+		}
+		var request raftVoteRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(raftVoteResponse{Term: request.Term, Granted: granted})
+		requests.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestRaftElectionNeedsMajority(t *testing.T) {
+	tests := []struct {
+		name    string
+		granted []bool
+		leader  bool
+	}{
+		{"2 nodes, no votes", []bool{false}, false},
+		{"2 nodes, 1 vote", []bool{true}, true},
+		{"3 nodes, no votes", []bool{false, false}, false},
+		{"3 nodes, 1 vote", []bool{true, false}, true},
+		{"4 nodes, 1 vote", []bool{true, false, false}, false},
+		{"4 nodes, 2 votes", []bool{true, true, false}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int64
+			config := RaftConfig{ID: "candidate", Addr: "127.0.0.1:0", Peers: make(map[string]string)}
+			for i, granted := range test.granted {
+				config.Peers["peer"+strconv.Itoa(i)] = votingPeer(t, granted, &requests)
+			}
+			n, err := newRaftNode(config, func([]byte) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.mu.Lock()
+			n.startElection()
+			n.mu.Unlock()
+
+			deadline := time.Now().Add(2 * time.Second)
+			for requests.Load() < int64(len(test.granted)) && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			// Give the last response time to be counted
+			time.Sleep(50 * time.Millisecond)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if leader := n.role == raftLeader; leader != test.leader {
+				t.Errorf("leader = %v with %d votes of %d nodes, want %v", leader, n.votes, len(test.granted)+1, test.leader)
+			}
+		})
+	}
+}
+
+func TestRaftRequiresKeyOffLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		key  string
+		ok   bool
+	}{
+		{":7947", "", false},
+		{"0.0.0.0:7947", "", false},
+		{"10.0.0.1:7947", "", false},
+		{"[::]:7947", "", false},
+		{"127.0.0.1:7947", "", true},
+		{"[::1]:7947", "", true},
+		{"localhost:7947", "", true},
+		{":7947", "secret", true},
+	}
+	for _, test := range tests {
+		_, err := newRaftNode(RaftConfig{ID: "lb-1", Addr: test.addr, Key: test.key}, func([]byte) {})
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("addr %q, key %q: err = %v", test.addr, test.key, err)
+		}
+	}
+}
+
+// raftEntries returns entries of the given terms, starting with the one at index 0
+func raftEntries(terms ...int64) []raftEntry {
+	entries := make([]raftEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = raftEntry{Term: term, Index: int64(i)}
+		if i > 0 {
+			entries[i].Data = json.RawMessage(strconv.Itoa(i))
+		}
+	}
+	return entries
+}
+
+func TestRaftHandleAppend(t *testing.T) {
+	tests := []struct {
+		name    string
+		request raftAppendRequest
+		want    raftAppendResponse
+		log     []raftEntry
+		commit  int64
+	}{
+		{
+			name:    "StaleTerm",
+			request: raftAppendRequest{Term: 1, PrevIndex: 2, PrevTerm: 2},
+			want:    raftAppendResponse{Term: 2},
+			log:     raftEntries(0, 1, 2),
+		},
+		{
+			name:    "Heartbeat",
+			request: raftAppendRequest{Term: 2, PrevIndex: 2, PrevTerm: 2, Commit: 2},
+			want:    raftAppendResponse{Term: 2, Success: true, Match: 2},
+			log:     raftEntries(0, 1, 2),
+			commit:  2,
+		},
+		{
+			name:    "Append",
+			request: raftAppendRequest{Term: 2, PrevIndex: 2, PrevTerm: 2, Entries: raftEntries(0, 1, 2, 2)[3:], Commit: 3},
+			want:    raftAppendResponse{Term: 2, Success: true, Match: 3},
+			log:     raftEntries(0, 1, 2, 2),
+			commit:  3,
+		},
+		{
+			name:    "CommitIsLimitedToTheEntriesReceived",
+			request: raftAppendRequest{Term: 2, PrevIndex: 1, PrevTerm: 1, Commit: 5},
+			want:    raftAppendResponse{Term: 2, Success: true, Match: 1},
+			log:     raftEntries(0, 1, 2),
+			commit:  1,
+		},
+		{
+			name:    "DuplicateEntries",
+			request: raftAppendRequest{Term: 2, PrevIndex: 0, PrevTerm: 0, Entries: raftEntries(0, 1, 2)[1:]},
+			want:    raftAppendResponse{Term: 2, Success: true, Match: 2},
+			log:     raftEntries(0, 1, 2),
+		},
+		{
+			name:    "ConflictingEntriesAreReplaced",
+			request: raftAppendRequest{Term: 3, PrevIndex: 1, PrevTerm: 1, Entries: raftEntries(0, 1, 3)[2:]},
+			want:    raftAppendResponse{Term: 3, Success: true, Match: 2},
+			log:     raftEntries(0, 1, 3),
+		},
+		{
+			name:    "MissingEntries",
+			request: raftAppendRequest{Term: 2, PrevIndex: 5, PrevTerm: 2},
+			want:    raftAppendResponse{Term: 2, Match: 2},
+			log:     raftEntries(0, 1, 2),
+		},
+		{
+			name:    "PreviousTermMismatch",
+			request: raftAppendRequest{Term: 2, PrevIndex: 2, PrevTerm: 1},
+			want:    raftAppendResponse{Term: 2, Match: 1},
+			log:     raftEntries(0, 1, 2),
+		},
+		{
+			name:    "Snapshot",
+			request: raftAppendRequest{Term: 2, Snapshot: true, Entries: []raftEntry{{Term: 2, Index: 10, Data: json.RawMessage("10")}}, Commit: 10},
+			want:    raftAppendResponse{Term: 2, Success: true, Match: 10},
+			log:     []raftEntry{{Term: 2, Index: 10, Data: json.RawMessage("10")}},
+			commit:  10,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := newRaftNode(RaftConfig{ID: "follower", Addr: "127.0.0.1:0"}, func([]byte) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Term, n.Log = 2, raftEntries(0, 1, 2)
+
+			if got := n.handleAppend(test.request); got != test.want {
+				t.Errorf("response %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(n.Log, test.log) {
+				t.Errorf("log %+v, want %+v", n.Log, test.log)
+			}
+			if n.commitIndex != test.commit {
+				t.Errorf("commit index %d, want %d", n.commitIndex, test.commit)
+			}
+		})
+	}
+}
+
+func TestRaftHandleVote(t *testing.T) {
+	tests := []struct {
+		name     string
+		votedFor string
+		request  raftVoteRequest
+		granted  bool
+	}{
+		{"UpToDate", "", raftVoteRequest{Term: 2, Candidate: "b", LastIndex: 2, LastTerm: 2}, true},
+		{"LaterTerm", "", raftVoteRequest{Term: 3, Candidate: "b", LastIndex: 1, LastTerm: 3}, true},
+		{"AgainForTheSameCandidate", "b", raftVoteRequest{Term: 2, Candidate: "b", LastIndex: 2, LastTerm: 2}, true},
+		{"AlreadyVoted", "c", raftVoteRequest{Term: 2, Candidate: "b", LastIndex: 2, LastTerm: 2}, false},
+		{"NewTermForgetsTheVote", "c", raftVoteRequest{Term: 3, Candidate: "b", LastIndex: 2, LastTerm: 2}, true},
+		{"StaleTerm", "", raftVoteRequest{Term: 1, Candidate: "b", LastIndex: 5, LastTerm: 5}, false},
+		{"ShorterLog", "", raftVoteRequest{Term: 2, Candidate: "b", LastIndex: 1, LastTerm: 2}, false},
+		{"OlderLastTerm", "", raftVoteRequest{Term: 3, Candidate: "b", LastIndex: 9, LastTerm: 1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := newRaftNode(RaftConfig{ID: "a", Addr: "127.0.0.1:0"}, func([]byte) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Term, n.VotedFor, n.Log = 2, test.votedFor, raftEntries(0, 1, 2)
+
+			response := n.handleVote(test.request)
+			if response.Granted != test.granted {
+				t.Errorf("granted = %v, want %v", response.Granted, test.granted)
+			}
+			if response.Term != max(2, test.request.Term) {
+				t.Errorf("term %d, want %d", response.Term, max(2, test.request.Term))
+			}
+			if test.granted && n.VotedFor != test.request.Candidate {
+				t.Errorf("voted for %q", n.VotedFor)
+			}
+		})
+	}
+}
+
+func TestRaftStateIsReplayed(t *testing.T) {
+	config := RaftConfig{ID: "a", Addr: "127.0.0.1:0", Dir: t.TempDir()}
+	n, err := newRaftNode(config, func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.handleVote(raftVoteRequest{Term: 2, Candidate: "b"})
+	n.handleAppend(raftAppendRequest{Term: 2, Leader: "b", Entries: raftEntries(0, 1, 2)[1:], Commit: 1})
+
+	restarted, err := newRaftNode(config, func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Term != 2 || restarted.VotedFor != "b" {
+		t.Errorf("term %d and vote %q after restarting, want 2 and b", restarted.Term, restarted.VotedFor)
+	}
+	if !reflect.DeepEqual(restarted.Log, raftEntries(0, 1, 2)) {
+		t.Errorf("log %+v after restarting", restarted.Log)
+	}
+	// Only the first entry is known to be committed until the leader says otherwise
+	if restarted.commitIndex != 0 {
+		t.Errorf("commit index %d after restarting, want 0", restarted.commitIndex)
+	}
+}
+
+func TestRaftAppliesTheLatestDataAndCompacts(t *testing.T) {
+	applied := make(chan string, 1)
+	n, err := newRaftNode(RaftConfig{ID: "a", Addr: "127.0.0.1:0"}, func(data []byte) { applied <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms := make([]int64, raftCompactEntries+10)
+	n.mu.Lock()
+	n.Log = raftEntries(terms...)
+	n.commitIndex = int64(len(terms) - 2)
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.applyCommitted(ctx)
+	n.signalApply()
+	select {
+	case data := <-applied:
+		if want := strconv.Itoa(len(terms) - 2); data != want {
+			t.Errorf("applied %s, want the data of the last committed entry %s", data, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing was applied")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// The log keeps the applied entry and the uncommitted one after it
+	if len(n.Log) != 2 || n.Log[0].Index != n.commitIndex {
+		t.Errorf("the log holds %d entries from %d after compacting", len(n.Log), n.Log[0].Index)
+	}
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter that allows bursts of up to burst events and refills at rate events per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available. Otherwise it returns how long until the next token.
+func (b *tokenBucket) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserve takes n tokens even if that leaves the bucket in debt, and returns how long
+// until the debt is paid off
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket will have refilled completely by now
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// RateLimitConfig limits how fast each client address may send requests
+type RateLimitConfig struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// RateLimit returns middleware that rejects clients exceeding the rate with 429 Too Many Requests
+func RateLimit(config RateLimitConfig) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastPrune := time.Now()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := ClientIP(r).String()
+
+			mu.Lock()
+			now := time.Now()
+			if now.Sub(lastPrune) > time.Minute {
+				// Forget clients whose buckets have refilled completely
+				for key, bucket := range buckets {
+					if bucket.full(now) {
+						delete(buckets, key)
+					}
+				}
+				lastPrune = now
+			}
+			bucket, ok := buckets[client]
+			if !ok {
+				bucket = newTokenBucket(config.RequestsPerSecond, config.Burst)
+				buckets[client] = bucket
+			}
+			mu.Unlock()
+
+			if ok, wait := bucket.allow(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
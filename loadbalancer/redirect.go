@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// acmeChallengePrefix is the path ACME HTTP-01 challenges are served under
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// RedirectToHTTPS returns a handler for a plain HTTP listener that permanently redirects
+// requests to the same URL over HTTPS. httpsPort is the port HTTPS is served on; it is
+// left out of the redirect when it is empty or "443". ACME HTTP-01 challenge requests are
+// passed to acme instead, if it isn't nil, so certificates can be issued and renewed.
+func RedirectToHTTPS(httpsPort string, acme http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acme != nil && strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+			acme.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// ACMEChallengeDir returns a handler serving ACME HTTP-01 challenge tokens from a webroot
+// directory, as written by clients like certbot in webroot mode
+func ACMEChallengeDir(webroot string) http.Handler {
+	return http.FileServer(http.Dir(webroot))
+}
+
+// RedirectConfig makes a target group answer requests with a redirect instead of
+// proxying them. Target may reference variables as ${name}: scheme, host, hostname, port,
+// path, rest (the path after the group's stripped prefix), query (the query string with its
+// leading "?", if any) and request_uri. For example, "https://www.example.com${request_uri}"
+// moves clients from the apex domain to www, and "/v2${rest}${query}" from old paths.
+type RedirectConfig struct {
+	Target string
+
+	// Status is 301, 302, 303, 307 or 308; 301 Moved Permanently if zero
+	Status int
+}
+
+// redirectHandler returns a handler answering with the group's redirect
+func redirectHandler(targetGroup *TargetGroup) http.Handler {
+	config := *targetGroup.Redirect
+	if config.Status == 0 {
+		config.Status = http.StatusMovedPermanently
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		hostname, port, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			hostname, port = r.Host, ""
+		}
+		query := ""
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.RawQuery
+		}
+		vars := map[string]string{
+			"scheme":      scheme,
+			"host":        r.Host,
+			"hostname":    hostname,
+			"port":        port,
+			"path":        r.URL.Path,
+			"rest":        targetGroup.upstreamPath(r.URL.Path),
+			"query":       query,
+			"request_uri": r.URL.RequestURI(),
+		}
+		target := os.Expand(config.Target, func(name string) string { return vars[name] })
+		http.Redirect(w, r, target, config.Status)
+	})
+}
+
+// validRedirectStatus reports whether status is a redirect status RedirectConfig supports
+func validRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisClient is a minimal RESP client supporting the few commands the load balancer needs
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	conns    chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// errRedisNil is returned for nil replies, e.g. missing keys
+var errRedisNil = errors.New("redis: nil")
+
+func newRedisClient(addr, password string, db int) *redisClient {
+	return &redisClient{addr: addr, password: password, db: db, conns: make(chan *redisConn, 8)}
+}
+
+// do sends a command and returns its reply: a string, int64, []any or nil
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.conn.SetDeadline(deadline)
+	} else {
+		conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	reply, err := conn.command(args...)
+	if err != nil && !errors.Is(err, errRedisNil) && !isRedisError(err) {
+		// The connection may be in an unknown state
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if c.password != "" {
+		if _, err := conn.command("AUTH", c.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func isRedisError(err error) bool {
+	var redisErr redisError
+	return errors.As(err, &redisErr)
+}
+
+func (conn *redisConn) command(args ...string) (any, error) {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+func (conn *redisConn) readReply() (any, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: malformed reply")
+	}
+	prefix, payload := line[0], line[1:len(line)-2]
+
+	switch prefix {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, errRedisNil
+		}
+		values := make([]any, count)
+		var replyErr error
+		for i := range values {
+			values[i], err = conn.readReply()
+			switch {
+			case err == nil || errors.Is(err, errRedisNil):
+			case isRedisError(err):
+				// The rest of the array is read so the connection can be used again
+				if replyErr == nil {
+					replyErr = err
+				}
+			default:
+				return nil, err
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", prefix)
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  any
+		err   string
+	}{
+		{"Status", "+OK\r\n", "OK", ""},
+		{"Integer", ":42\r\n", int64(42), ""},
+		{"Bulk", "$5\r\nhello\r\n", "hello", ""},
+		{"Nil", "$-1\r\n", nil, "redis: nil"},
+		{"Error", "-ERR wrong\r\n", nil, "redis: ERR wrong"},
+		{"Array", "*3\r\n$1\r\na\r\n$-1\r\n:2\r\n", []any{"a", nil, int64(2)}, ""},
+		{"ErrorsInArray", "*3\r\n-ERR first\r\n:1\r\n-ERR second\r\n", nil, "redis: ERR first"},
+		{"ErrorInNestedArray", "*2\r\n*2\r\n-ERR nested\r\n:1\r\n:2\r\n", nil, "redis: ERR nested"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The reply is followed by the next one on the same connection
+			conn := &redisConn{reader: bufio.NewReader(strings.NewReader(test.reply + "+NEXT\r\n"))}
+			got, err := conn.readReply()
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("got the error %v, want %s", err, test.err)
+				}
+			} else if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v (%v), want %#v", got, err, test.want)
+			}
+			if next, err := conn.readReply(); next != "NEXT" {
+				t.Errorf("the next reply is %#v (%v), the rest of the reply wasn't read", next, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// MiddlewareFactory creates middleware from its configuration file entry, the JSON object
+// including its "type"
+type MiddlewareFactory func(params json.RawMessage) (Middleware, error)
+
+// DiscoveryFactory creates a Discovery from its configuration file entry, the JSON object
+// including its "type"
+type DiscoveryFactory func(params json.RawMessage) (Discovery, error)
+
+// DialFunc opens connections to servers, like net.Dialer's DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// registry holds the components configuration files can refer to by name. Downstream builds
+// add their own from init functions.
+var registry = struct {
+	sync.RWMutex
+	balancers  map[string]func() Balancer
+	middleware map[string]MiddlewareFactory
+	discovery  map[string]DiscoveryFactory
+	dialers    map[string]DialFunc
+}{
+	balancers: map[string]func() Balancer{
+		"round_robin":       NewRoundRobin,
+		"rendezvous":        NewRendezvous,
+		"maglev":            newDefaultMaglev,
+		"consistent_hash":   newDefaultConsistentHash,
+		"ewma":              NewEWMA,
+		"least_connections": NewLeastConnections,
+	},
+	middleware: map[string]MiddlewareFactory{},
+	discovery: map[string]DiscoveryFactory{
+		"dns": newDNSDiscoveryFromConfig,
+	},
+	dialers: map[string]DialFunc{},
+}
+
+// RegisterBalancer makes a balancer available to configuration files under name. It panics
+// if the name is already registered.
+func RegisterBalancer(name string, newBalancer func() Balancer) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.balancers[name]; ok {
+		panic("loadbalancer: balancer " + name + " registered twice")
+	}
+	registry.balancers[name] = newBalancer
+}
+
+// RegisterMiddleware makes a middleware type available to configuration files under name.
+// It panics if the name is already registered or is a built-in middleware type.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.middleware[name]; ok || builtinMiddleware[name] {
+		panic("loadbalancer: middleware " + name + " registered twice")
+	}
+	registry.middleware[name] = factory
+}
+
+// RegisterDiscovery makes a service discovery type available to configuration files under
+// name. It panics if the name is already registered.
+func RegisterDiscovery(name string, factory DiscoveryFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.discovery[name]; ok {
+		panic("loadbalancer: discovery " + name + " registered twice")
+	}
+	registry.discovery[name] = factory
+}
+
+// RegisterDialer makes a dialer available to transports under name, see
+// TransportConfig.Dialer, e.g. for special network setups or fake servers in tests. It
+// panics if the name is already registered.
+func RegisterDialer(name string, dial DialFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.dialers[name]; ok {
+		panic("loadbalancer: dialer " + name + " registered twice")
+	}
+	registry.dialers[name] = dial
+}
+
+func lookupBalancer(name string) (func() Balancer, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if newBalancer, ok := registry.balancers[name]; ok {
+		return newBalancer, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q, registered: %v", name, registeredNames(registry.balancers))
+}
+
+func lookupMiddleware(name string) (MiddlewareFactory, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	factory, ok := registry.middleware[name]
+	return factory, ok
+}
+
+func lookupDiscovery(name string) (DiscoveryFactory, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if factory, ok := registry.discovery[name]; ok {
+		return factory, nil
+	}
+	return nil, fmt.Errorf("unknown discovery %q, registered: %v", name, registeredNames(registry.discovery))
+}
+
+func lookupDialer(name string) (DialFunc, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if dial, ok := registry.dialers[name]; ok {
+		return dial, nil
+	}
+	return nil, fmt.Errorf("unknown dialer %q, registered: %v", name, registeredNames(registry.dialers))
+}
+
+func registeredNames[T any](components map[string]T) []string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
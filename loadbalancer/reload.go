@@ -0,0 +1,494 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigReloader serves requests with a load balancer built from a configuration file and
+// replaces it with a new one when the file is reloaded. Requests in flight finish on the
+// load balancer they started on. Metrics are kept across reloads.
+type ConfigReloader struct {
+	config  ReloaderConfig
+	opts    []Option
+	metrics *Metrics
+
+	// mu serializes reloads and guards history and gateway
+	mu      sync.Mutex
+	current atomic.Pointer[loadedConfig]
+	history []ConfigVersion
+
+	// gateway are the routes last read from the Gateway API
+	gateway *gatewayRoutes
+
+	raft *raftNode
+}
+
+// ReloaderConfig configures a ConfigReloader
+type ReloaderConfig struct {
+	// Path is the configuration file; it may be empty if Gateway is set
+	Path string
+
+	// Gateway adds the routes of Kubernetes Gateway API resources to the configuration
+	Gateway *GatewayConfig
+
+	// Raft replicates reloads and rollbacks to the other nodes of a cluster when set, see
+	// ServeRaft. Each node starts with its own configuration file until the cluster's
+	// latest configuration is applied.
+	Raft *RaftConfig
+
+	// Audit records reloads and rollbacks when set
+	Audit *AuditLog
+
+	// History is the number of applied configurations kept for rollbacks, 10 by default
+	History int
+
+	// HistoryDir keeps the applied configurations on disk as well, so they survive restarts
+	HistoryDir string
+}
+
+// ConfigVersion is a configuration that was applied
+type ConfigVersion struct {
+	Generation int64     `json:"generation"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Config     *Config   `json:"config"`
+}
+
+// loadedConfig is a configuration and the load balancer built from it
+type loadedConfig struct {
+	config     *Config
+	generation int64
+	lb         *LoadBalancer
+	admin      http.Handler
+}
+
+// NewConfigReloader loads the configuration file and creates its load balancer with opts,
+// like NewFromConfig
+func NewConfigReloader(config ReloaderConfig, opts ...Option) (*ConfigReloader, error) {
+	if config.History <= 0 {
+		config.History = 10
+	}
+	c := &ConfigReloader{config: config, metrics: NewMetrics()}
+	c.opts = append([]Option{WithMetrics(c.metrics), WithAuditLog(config.Audit)}, opts...)
+	if err := c.loadHistory(); err != nil {
+		return nil, err
+	}
+	if config.Gateway != nil {
+		routes, err := config.Gateway.routes(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		c.gateway = routes
+	}
+	loaded, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.apply(loaded, "startup", "config.load"); err != nil {
+		return nil, err
+	}
+	if config.Raft != nil {
+		if c.raft, err = newRaftNode(*config.Raft, c.applyReplicated); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// LoadBalancer returns the current load balancer
+func (c *ConfigReloader) LoadBalancer() *LoadBalancer {
+	return c.current.Load().lb
+}
+
+// Config returns the current configuration
+func (c *ConfigReloader) Config() *Config {
+	return c.current.Load().config
+}
+
+// Metrics returns the metrics registry shared by all the load balancers
+func (c *ConfigReloader) Metrics() *Metrics {
+	return c.metrics
+}
+
+// ServeHTTP serves the request with the current load balancer
+func (c *ConfigReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.LoadBalancer().ServeHTTP(w, r)
+}
+
+// Reload loads the configuration file again and switches to a load balancer built from it.
+// If the file is invalid, the current load balancer is kept. actor identifies who asked for
+// the reload in the audit log.
+func (c *ConfigReloader) Reload(actor string) error {
+	c.mu.Lock()
+	config, err := c.load()
+	c.mu.Unlock()
+	if err == nil {
+		err = c.change(config, actor, "config.reload")
+	}
+	if err != nil {
+		c.config.Audit.Record(AuditEvent{Actor: actor, Action: "config.reload", Error: err.Error()})
+	}
+	return err
+}
+
+// load reads the configuration file and adds the Gateway API routes
+func (c *ConfigReloader) load() (*Config, error) {
+	config := &Config{}
+	if c.config.Path != "" {
+		var err error
+		if config, err = LoadConfig(c.config.Path); err != nil {
+			return nil, err
+		}
+	}
+	if c.gateway != nil {
+		c.gateway.merge(config)
+	}
+	return config, nil
+}
+
+// WatchGateway reads the Gateway API resources every interval of the ReloaderConfig's
+// Gateway and reloads when their routes change, until ctx is done. Failed reads keep the
+// current routes.
+func (c *ConfigReloader) WatchGateway(ctx context.Context) {
+	interval := c.config.Gateway.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		routes, err := c.config.Gateway.routes(ctx)
+		if err != nil {
+			logger().Warn("gateway: reading routes failed", "error", err)
+			continue
+		}
+		c.mu.Lock()
+		changed := !equalJSON(routes, c.gateway)
+		if changed {
+			c.gateway = routes
+		}
+		c.mu.Unlock()
+		if changed {
+			if err := c.Reload("gateway"); err != nil {
+				logger().Error("gateway: applying routes failed", "error", err)
+			}
+		}
+	}
+}
+
+// equalJSON reports whether the values encode to the same JSON
+func equalJSON(a, b any) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
+
+// raftChange is a configuration change replicated through Raft
+type raftChange struct {
+	Actor  string  `json:"actor"`
+	Action string  `json:"action"`
+	Config *Config `json:"config"`
+}
+
+// change applies a configuration, on every node of the cluster if there is one
+func (c *ConfigReloader) change(config *Config, actor, action string) error {
+	if c.raft == nil {
+		return c.switchTo(config, actor, action)
+	}
+	data, err := json.Marshal(raftChange{Actor: actor, Action: action, Config: config})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.raft.propose(ctx, data)
+}
+
+// applyReplicated applies a configuration change committed by the cluster
+func (c *ConfigReloader) applyReplicated(data []byte) {
+	var change struct {
+		raftChange
+		Config json.RawMessage `json:"config"`
+	}
+	err := json.Unmarshal(data, &change)
+	if err == nil {
+		if change.raftChange.Config, err = ParseConfig(change.Config); err == nil {
+			err = c.switchTo(change.raftChange.Config, change.Actor, change.Action)
+		}
+	}
+	if err != nil {
+		// The node keeps its configuration, e.g. when a file it refers to is missing here
+		logger().Error("raft: applying configuration failed", "action", change.Action, "error", err)
+		c.config.Audit.Record(AuditEvent{Actor: change.Actor, Action: change.Action, Error: err.Error()})
+	}
+}
+
+// ServeRaft serves the RPCs of the cluster's other nodes on the RaftConfig's Addr and takes
+// part in the cluster until ctx is done. The node's state is served on GET /raft/status.
+func (c *ConfigReloader) ServeRaft(ctx context.Context) error {
+	if c.raft == nil {
+		return fmt.Errorf("raft: not configured")
+	}
+	server := &http.Server{Addr: c.raft.config.Addr, Handler: c.raft, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go c.raft.run(ctx)
+	if err := server.ListenAndServe(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// switchTo applies a configuration and records the change
+func (c *ConfigReloader) switchTo(config *Config, actor, action string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.current.Load()
+	if err := c.apply(config, actor, action); err != nil {
+		return err
+	}
+	c.config.Audit.Record(AuditEvent{Actor: actor, Action: action, Changes: diffConfigs(previous.config, config)})
+	logger().Info("configuration applied", "action", action, "generation", c.current.Load().generation)
+	// Give requests still using the previous load balancer time to finish
+	time.AfterFunc(drainTimeout, func() { previous.lb.Close() })
+	return nil
+}
+
+// drainTimeout is how long a replaced load balancer is kept open
+const drainTimeout = time.Minute
+
+// apply builds a load balancer from the configuration, makes it the current one and adds
+// the configuration to the history
+func (c *ConfigReloader) apply(config *Config, actor, action string) error {
+	lb, err := NewFromConfig(config, c.opts...)
+	if err != nil {
+		return err
+	}
+	var generation int64 = 1
+	if len(c.history) > 0 {
+		generation = c.history[len(c.history)-1].Generation + 1
+	}
+	lb.vars.Get("config_generation").(*expvar.Int).Set(generation)
+	if current := c.current.Load(); current != nil {
+		// Weights set through the admin API outlive reloads
+		current.lb.mu.Lock()
+		for name, weight := range current.lb.weights {
+			lb.weights[name] = weight
+		}
+		current.lb.mu.Unlock()
+	}
+	c.current.Store(&loadedConfig{config: config, generation: generation, lb: lb, admin: lb.AdminHandler()})
+
+	version := ConfigVersion{Generation: generation, Time: time.Now(), Actor: actor, Action: action, Config: config}
+	c.history = append(c.history, version)
+	if len(c.history) > c.config.History {
+		c.history = c.history[len(c.history)-c.config.History:]
+	}
+	if err := c.saveVersion(version); err != nil {
+		logger().Error("saving configuration history failed", "generation", generation, "error", err)
+	}
+	return nil
+}
+
+// Versions returns the configurations kept for rollbacks, oldest first
+func (c *ConfigReloader) Versions() []ConfigVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ConfigVersion(nil), c.history...)
+}
+
+// Rollback applies the configuration of an earlier generation again, as a new generation.
+// Files the configuration refers to, like htpasswd files, are read again.
+func (c *ConfigReloader) Rollback(generation int64, actor string) error {
+	c.mu.Lock()
+	var config *Config
+	for _, version := range c.history {
+		if version.Generation == generation {
+			config = version.Config
+		}
+	}
+	c.mu.Unlock()
+
+	err := fmt.Errorf("generation %d isn't in the configuration history", generation)
+	if config != nil {
+		err = c.change(config, actor, fmt.Sprintf("config.rollback:%d", generation))
+	}
+	if err != nil {
+		c.config.Audit.Record(AuditEvent{Actor: actor, Action: "config.rollback", Error: err.Error()})
+	}
+	return err
+}
+
+// versionFile returns the path of a generation in the history directory
+func (c *ConfigReloader) versionFile(generation int64) string {
+	return filepath.Join(c.config.HistoryDir, fmt.Sprintf("config-%06d.json", generation))
+}
+
+// saveVersion writes a version to the history directory and removes those beyond History
+func (c *ConfigReloader) saveVersion(version ConfigVersion) error {
+	if c.config.HistoryDir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated version behind
+	path := c.versionFile(version.Generation)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := os.Remove(c.versionFile(version.Generation - int64(c.config.History))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadHistory reads the versions saved in the history directory
+func (c *ConfigReloader) loadHistory() error {
+	if c.config.HistoryDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.config.HistoryDir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(c.config.HistoryDir, "config-*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var version struct {
+			ConfigVersion
+			Config json.RawMessage `json:"config"`
+		}
+		if err := json.Unmarshal(data, &version); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if version.ConfigVersion.Config, err = ParseConfig(version.Config); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		c.history = append(c.history, version.ConfigVersion)
+	}
+	if len(c.history) > c.config.History {
+		c.history = c.history[len(c.history)-c.config.History:]
+	}
+	return nil
+}
+
+// AdminHandler returns the current load balancer's admin API together with endpoints to
+// reload the configuration file (POST /config/reload), list the configuration history
+// (GET /config/versions) and roll back (POST /config/rollback). Like the admin API, it is
+// read-only without WithAdminAuth.
+func (c *ConfigReloader) AdminHandler() http.Handler {
+	reload := http.HandlerFunc(c.handleReload)
+	versions := http.HandlerFunc(c.handleVersions)
+	rollback := http.HandlerFunc(c.handleRollback)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := c.current.Load()
+		if _, ok := current.lb.requestTenant(r); ok {
+			// Tenants can't change the configuration
+			current.admin.ServeHTTP(w, r)
+			return
+		}
+		var handler http.Handler
+		switch r.URL.Path {
+		case "/config/reload":
+			handler = reload
+		case "/config/versions":
+			handler = versions
+		case "/config/rollback":
+			handler = rollback
+		default:
+			current.admin.ServeHTTP(w, r)
+			return
+		}
+		if auth := current.lb.adminAuth; auth != nil {
+			handler = auth(handler)
+		} else {
+			handler = readOnly(handler)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleVersions lists the configurations that can be rolled back to, without their contents
+func (c *ConfigReloader) handleVersions(w http.ResponseWriter, r *http.Request) {
+	current := c.current.Load().generation
+	type version struct {
+		ConfigVersion
+		Config  *Config `json:"config,omitempty"`
+		Current bool    `json:"current"`
+	}
+	var versions []version
+	for _, v := range c.Versions() {
+		versions = append(versions, version{ConfigVersion: v, Current: v.Generation == current})
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// handleRollback rolls back to the generation given by the generation query parameter, or
+// to the one before the current generation:
+//
+//	POST /config/rollback?generation=3
+func (c *ConfigReloader) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	generation := c.current.Load().generation - 1
+	if s := r.URL.Query().Get("generation"); s != "" {
+		var err error
+		if generation, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "Invalid generation", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := c.Rollback(generation, adminActor(r)); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"generation": c.current.Load().generation})
+}
+
+func (c *ConfigReloader) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := c.Reload(adminActor(r)); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"generation": c.current.Load().generation})
+}
@@ -0,0 +1,117 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// RetryConfig retries requests on other servers of their group when they fail without a
+// response, e.g. because the connection was refused or reset. Requests with the GET, HEAD
+// or OPTIONS methods are always retried; others only with an Idempotency-Key header, so a
+// request the server may have acted on isn't repeated, unless NonIdempotent is set.
+type RetryConfig struct {
+	// Attempts is how many times a request is retried at most, each on a different server
+	Attempts int
+
+	// NonIdempotent retries requests of any method, for routes whose backends can safely
+	// receive them more than once
+	NonIdempotent bool
+}
+
+// maxRetryBodyBytes bounds the request bodies kept in memory to be sent again on retries.
+// Requests with larger bodies aren't retried.
+const maxRetryBodyBytes = 1 << 20
+
+// retryable reports whether the request may be sent again after failing
+func (config *RetryConfig) retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return config.NonIdempotent || r.Header.Get("Idempotency-Key") != ""
+}
+
+// retryingTransport sends requests through next, retrying them on other servers of the
+// group when that fails
+type retryingTransport struct {
+	lb          *LoadBalancer
+	targetGroup *TargetGroup
+	servers     []*Server
+	first       *Server
+	request     *http.Request
+	next        http.RoundTripper
+}
+
+// retryingTransport returns a transport retrying the group's retryable requests, or next
+// for requests that aren't
+func (lb *LoadBalancer) retryingTransport(targetGroup *TargetGroup, servers []*Server, first *Server, r *http.Request, next http.RoundTripper) http.RoundTripper {
+	if targetGroup.Retry.Attempts <= 0 || !targetGroup.Retry.retryable(r) {
+		return next
+	}
+	return &retryingTransport{lb: lb, targetGroup: targetGroup, servers: servers, first: first, request: r, next: next}
+}
+
+func (t *retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := bufferBody(req)
+	failed := map[*Server]bool{t.first: true}
+	// retried is the server of the latest retry, released once its request is over; the
+	// first server is released by forward
+	var retried *Server
+	release := func() {
+		if retried != nil {
+			t.lb.serverDone(t.targetGroup, retried)
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && retried != nil {
+			resp.Body = &doneOnClose{ReadCloser: resp.Body, done: release}
+			return resp, nil
+		}
+		if err == nil || !ok || attempt == t.targetGroup.Retry.Attempts || req.Context().Err() != nil || isMaxBytesError(err) {
+			release()
+			return resp, err
+		}
+
+		server := t.lb.getNextServer(t.targetGroup, t.request, t.servers, failed)
+		if server == nil || failed[server] {
+			if server != nil {
+				t.lb.serverDone(t.targetGroup, server)
+			}
+			release()
+			return nil, err
+		}
+		release()
+		retried = server
+		failed[server] = true
+		logger().Debug("retrying request", "error", err, "server", server.name(), "attempt", attempt+1, "request_id", RequestID(t.request))
+		t.lb.metrics.Counter("loadbalancer_retries_total", "Number of requests retried on another server.", "route", routeName(t.targetGroup)).Inc()
+
+		req = req.Clone(context.WithValue(req.Context(), upstreamKey{}, server))
+		req.URL.Scheme, req.URL.Host = server.URL.Scheme, server.URL.Host
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+}
+
+// bufferBody reads the request's body into memory so it can be sent again, and reports
+// whether it could. Bodies over maxRetryBodyBytes, or failing to be read, are put back
+// together to be sent once.
+func bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBodyBytes+1))
+	if err != nil || len(body) > maxRetryBodyBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// matches reports whether the target group serves the request
+func (tg *TargetGroup) matches(r *http.Request) bool {
+	if len(tg.Listeners) > 0 && !slices.Contains(tg.Listeners, ListenerName(r)) {
+		return false
+	}
+	if tg.Match != nil && !tg.Match.Match(r) {
+		return false
+	}
+	path := r.URL.Path
+	if path == tg.URIPath || (tg.Match != nil || len(tg.Listeners) > 0) && tg.URIPath == "" {
+		return true
+	}
+	return tg.StripPrefix && strings.HasPrefix(path, strings.TrimSuffix(tg.URIPath, "/")+"/")
+}
+
+// upstreamPath returns the path forwarded to the group's servers for a request path
+func (tg *TargetGroup) upstreamPath(path string) string {
+	if !tg.StripPrefix {
+		return path
+	}
+	path = strings.TrimPrefix(path, strings.TrimSuffix(tg.URIPath, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// rewriteCookies adjusts the Set-Cookie headers of a backend response for the path and host
+// the client sees: paths get the stripped prefix back and domains naming the backend are
+// dropped, making the cookies host-only.
+func rewriteCookies(header http.Header, targetGroup *TargetGroup, server *Server) {
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	prefix := ""
+	if targetGroup.StripPrefix {
+		prefix = strings.TrimSuffix(targetGroup.URIPath, "/")
+	}
+	backendHost := server.URL.Hostname()
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts := strings.Split(cookie, ";")
+		kept := parts[:1]
+		for _, attr := range parts[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+			switch strings.ToLower(name) {
+			case "path":
+				if prefix != "" && strings.HasPrefix(value, "/") {
+					attr = " Path=" + prefix + value
+				}
+			case "domain":
+				if strings.EqualFold(strings.TrimPrefix(value, "."), backendHost) || net.ParseIP(value) != nil {
+					continue
+				}
+			}
+			kept = append(kept, attr)
+		}
+		rewritten = append(rewritten, strings.Join(kept, ";"))
+	}
+	header["Set-Cookie"] = rewritten
+}
+
+// rewriteLocation maps Location headers pointing at a backend back to the scheme, host and
+// path prefix the client used, so redirects don't leak internal addresses
+func rewriteLocation(resp *http.Response, targetGroup *TargetGroup, servers []*Server) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	target, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+
+	if target.IsAbs() {
+		internal := false
+		for _, server := range servers {
+			if strings.EqualFold(target.Host, server.URL.Host) {
+				internal = true
+				break
+			}
+		}
+		if !internal {
+			return
+		}
+		target.Scheme = requestScheme(resp.Request)
+		target.Host = resp.Request.Host
+	} else if target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		// Protocol-relative and relative references are left alone
+		return
+	}
+
+	if targetGroup.StripPrefix {
+		target.Path = strings.TrimSuffix(targetGroup.URIPath, "/") + target.Path
+		target.RawPath = ""
+	}
+	resp.Header.Set("Location", target.String())
+}
+
+// requestScheme returns the scheme the client used to reach the load balancer
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
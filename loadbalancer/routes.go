@@ -0,0 +1,50 @@
+package loadbalancer
+
+import (
+	"maps"
+	"net/http/httputil"
+)
+
+// routeTable is the routing state requests are served with: the target groups and virtual
+// hosts in matching order, and the servers of every group with a proxy to each. A
+// published table is never changed; changes like discovered servers publish a copy, so
+// requests read the table without locking and never see part of a change. Reloads swap
+// whole load balancers the same way, see ConfigReloader.
+type routeTable struct {
+	targetGroups []*TargetGroup
+	vhosts       []*VirtualHost
+	defaultGroup *TargetGroup
+	servers      map[*TargetGroup][]*Server
+	proxies      map[*TargetGroup]map[*Server]*httputil.ReverseProxy
+}
+
+// publishRoutes publishes the routing state of a new load balancer
+func (lb *LoadBalancer) publishRoutes() {
+	routes := &routeTable{
+		targetGroups: lb.targetGroups,
+		vhosts:       lb.vhosts,
+		defaultGroup: lb.defaultGroup,
+		servers:      make(map[*TargetGroup][]*Server, len(lb.balancers)),
+		proxies:      make(map[*TargetGroup]map[*Server]*httputil.ReverseProxy, len(lb.balancers)),
+	}
+	for targetGroup := range lb.balancers {
+		routes.servers[targetGroup] = targetGroup.Servers
+		routes.proxies[targetGroup] = lb.groupProxies(targetGroup, targetGroup.Servers, nil)
+	}
+	lb.routes.Store(routes)
+}
+
+// publishServers publishes a table with new servers for a group. The caller must hold
+// lb.mu, which serializes the changes.
+func (lb *LoadBalancer) publishServers(targetGroup *TargetGroup, servers []*Server) {
+	current := lb.routes.Load()
+	if current == nil {
+		return
+	}
+	routes := *current
+	routes.servers = maps.Clone(current.servers)
+	routes.servers[targetGroup] = servers
+	routes.proxies = maps.Clone(current.proxies)
+	routes.proxies[targetGroup] = lb.groupProxies(targetGroup, servers, current.proxies[targetGroup])
+	lb.routes.Store(&routes)
+}
@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSetServersPublishesWithoutChangingTheGroup(t *testing.T) {
+	configured := benchmarkServers(2)
+	targetGroup := &TargetGroup{URIPath: "/", Servers: configured}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup))
+	defer lb.Close()
+
+	discovered := benchmarkServers(3)
+	lb.SetServers(targetGroup, discovered)
+	if !sameServers(targetGroup.Servers, configured) {
+		t.Errorf("the group's servers were changed")
+	}
+	if !sameServers(lb.servers(targetGroup), discovered) {
+		t.Errorf("the route table doesn't have the discovered servers")
+	}
+}
+
+func TestServerSelectionUsesTheRequestsRouteTable(t *testing.T) {
+	targetGroup := &TargetGroup{URIPath: "/", Servers: benchmarkServers(3), SubsetSize: 2}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup), WithBalancer(NewLeastConnections))
+	defer lb.Close()
+	lists := [][]*Server{benchmarkServers(4), benchmarkServers(5)}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			lb.SetServers(targetGroup, lists[i%2])
+		}
+	}()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 1000; i++ {
+		servers := lb.servers(targetGroup)
+		failed := map[*Server]bool{}
+		for j := 0; j < 2; j++ {
+			server := lb.getNextServer(targetGroup, r, servers, failed)
+			if !slices.Contains(servers, server) {
+				t.Fatalf("server %v isn't one of the request's servers", server)
+			}
+			failed[server] = true
+			lb.serverDone(targetGroup, server)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// RegisterRuntimeMetrics adds Go runtime and process metrics to a registry: goroutines,
+// heap usage, garbage collection and, where the platform exposes them, file descriptors
+func RegisterRuntimeMetrics(metrics *Metrics) {
+	stats := &memStatsCache{}
+	metrics.GaugeFunc("go_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	metrics.GaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		return float64(stats.read().HeapAlloc)
+	})
+	metrics.GaugeFunc("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", func() float64 {
+		return float64(stats.read().HeapInuse)
+	})
+	metrics.GaugeFunc("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", func() float64 {
+		return float64(stats.read().Sys)
+	})
+	metrics.CounterFunc("go_gc_cycles_total", "Number of completed GC cycles.", func() float64 {
+		return float64(stats.read().NumGC)
+	})
+	metrics.CounterFunc("go_gc_pause_seconds_total", "Total time the program was stopped for garbage collection.", func() float64 {
+		return time.Duration(stats.read().PauseTotalNs).Seconds()
+	})
+	metrics.GaugeFunc("go_gc_last_pause_seconds", "Duration of the most recent GC pause.", func() float64 {
+		m := stats.read()
+		if m.NumGC == 0 {
+			return 0
+		}
+		return time.Duration(m.PauseNs[(m.NumGC+255)%256]).Seconds()
+	})
+	registerFDMetrics(metrics)
+}
+
+// memStatsCache shares one runtime.ReadMemStats, which stops the world, between the
+// metrics of a scrape
+type memStatsCache struct {
+	mu     sync.Mutex
+	stats  runtime.MemStats
+	readAt time.Time
+}
+
+func (c *memStatsCache) read() *runtime.MemStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.readAt) > time.Second {
+		runtime.ReadMemStats(&c.stats)
+		c.readAt = time.Now()
+	}
+	stats := c.stats
+	return &stats
+}
@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secret is a configuration value that may refer to a secret kept elsewhere instead of
+// holding it in plaintext:
+//
+//	env:NAME               the environment variable NAME
+//	file:/run/secrets/x    the contents of the file, without surrounding whitespace
+//	vault:secret/app#key   the field key of a Vault secret, read from VAULT_ADDR with
+//	                       VAULT_TOKEN; KV version 1 and 2 engines are supported
+//
+// Other values are used as they are. References are resolved whenever a load balancer is
+// built from the configuration, so reloads pick up changed secrets, and configurations
+// are written, e.g. to their history, with the references rather than the secrets.
+type Secret string
+
+// Resolve returns the secret's value
+func (s Secret) Resolve() (string, error) {
+	ref := string(s)
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret %s: environment variable is not set", ref)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", ref, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(ref, "vault:"):
+		value, err := readVaultSecret(strings.TrimPrefix(ref, "vault:"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", ref, err)
+		}
+		return value, nil
+	}
+	return ref, nil
+}
+
+// resolveSecrets resolves each of the secrets
+func resolveSecrets(secrets []Secret) ([]string, error) {
+	values := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		value, err := secret.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// readVaultSecret reads a field, given after # in ref, of the secret at the path of ref.
+// The field may be left out for secrets with only one.
+func readVaultSecret(ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s", resp.Status)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			// KV version 2 nests the secret's fields
+			data = inner
+		}
+	}
+	if field == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("the secret has %d fields, name one after #", len(data))
+		}
+		for name := range data {
+			field = name
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string field %q", field)
+	}
+	return value, nil
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SecurityHeadersConfig configures security-related response headers. Headers are only
+// added when the backend didn't set them; empty or zero fields add nothing.
+type SecurityHeadersConfig struct {
+	// HSTSMaxAge enables Strict-Transport-Security
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// ContentTypeNosniff sets X-Content-Type-Options: nosniff
+	ContentTypeNosniff bool
+
+	// FrameOptions is the X-Frame-Options value, e.g. "DENY" or "SAMEORIGIN"
+	FrameOptions string
+
+	// ReferrerPolicy is the Referrer-Policy value, e.g. "strict-origin-when-cross-origin"
+	ReferrerPolicy string
+
+	// ContentSecurityPolicy is the Content-Security-Policy value
+	ContentSecurityPolicy string
+}
+
+// SecurityHeaders returns middleware that adds the configured security headers to responses
+func SecurityHeaders(config SecurityHeadersConfig) Middleware {
+	headers := make(map[string]string)
+	if config.HSTSMaxAge > 0 {
+		hsts := fmt.Sprintf("max-age=%d", int(config.HSTSMaxAge.Seconds()))
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if config.HSTSPreload {
+			hsts += "; preload"
+		}
+		headers["Strict-Transport-Security"] = hsts
+	}
+	if config.ContentTypeNosniff {
+		headers["X-Content-Type-Options"] = "nosniff"
+	}
+	if config.FrameOptions != "" {
+		headers["X-Frame-Options"] = config.FrameOptions
+	}
+	if config.ReferrerPolicy != "" {
+		headers["Referrer-Policy"] = config.ReferrerPolicy
+	}
+	if config.ContentSecurityPolicy != "" {
+		headers["Content-Security-Policy"] = config.ContentSecurityPolicy
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&headerHookWriter{ResponseWriter: w, onHeader: func(status int, header http.Header) {
+				for name, value := range headers {
+					if header.Get(name) == "" {
+						header.Set(name, value)
+					}
+				}
+			}}, r)
+		})
+	}
+}
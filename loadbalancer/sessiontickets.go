@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SessionTicketConfig rotates the keys encrypting TLS session tickets, so a leaked key only
+// exposes the sessions of a limited time while clients can still resume their sessions.
+// Zero values use the defaults.
+type SessionTicketConfig struct {
+	// RotationInterval is how often a new key is generated, or KeyFile is read again; 1h
+	// by default
+	RotationInterval time.Duration
+
+	// Keys is how many of the latest keys are accepted for resuming sessions, so sessions
+	// can be resumed for about Keys rotations; 24 by default
+	Keys int
+
+	// KeyFile shares the keys between instances, so clients can resume their sessions with
+	// any of them. It holds one base64 encoded 32 byte key per line, the first encrypting
+	// new tickets, and is rotated by whatever distributes it rather than by the load
+	// balancer.
+	KeyFile string
+}
+
+// sessionTicketKeys serves TLS configurations with the current session ticket keys
+type sessionTicketKeys struct {
+	config  SessionTicketConfig
+	base    *tls.Config
+	keys    [][32]byte
+	current atomic.Pointer[tls.Config]
+}
+
+func newSessionTicketKeys(config SessionTicketConfig, base *tls.Config) (*sessionTicketKeys, error) {
+	if config.RotationInterval <= 0 {
+		config.RotationInterval = time.Hour
+	}
+	if config.Keys <= 0 {
+		config.Keys = 24
+	}
+	k := &sessionTicketKeys{config: config, base: base}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// getConfigForClient is the tls.Config.GetConfigForClient function making handshakes use
+// the current keys
+func (k *sessionTicketKeys) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return k.current.Load(), nil
+}
+
+// run rotates the keys every interval until ctx is done
+func (k *sessionTicketKeys) run(ctx context.Context) {
+	ticker := time.NewTicker(k.config.RotationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := k.rotate(); err != nil {
+			logger().Error("rotating session ticket keys failed", "error", err)
+		}
+	}
+}
+
+// rotate generates a new key, or reads the key file, and keeps the latest keys
+func (k *sessionTicketKeys) rotate() error {
+	if k.config.KeyFile != "" {
+		keys, err := readSessionTicketKeys(k.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		k.keys = keys[:min(len(keys), k.config.Keys)]
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		k.keys = append([][32]byte{key}, k.keys[:min(len(k.keys), k.config.Keys-1)]...)
+	}
+	config := k.base.Clone()
+	config.SetSessionTicketKeys(k.keys)
+	k.current.Store(config)
+	return nil
+}
+
+// readSessionTicketKeys reads a key file, see SessionTicketConfig.KeyFile
+func readSessionTicketKeys(path string) ([][32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][32]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%s:%d: want a base64 encoded 32 byte key", path, i+1)
+		}
+		keys = append(keys, [32]byte(decoded))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no session ticket keys", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// StateFile keeps what load balancers learn about their servers at runtime in a file, so a
+// restarted load balancer doesn't send full traffic to servers known to be down or
+// drained: their latest health check results, and the weights set through the admin API or
+// by weight tuning. Servers that were down when the state was saved are skipped for a TTL
+// after the restart before they are checked again.
+type StateFile struct {
+	path string
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	lb       *LoadBalancer
+	health   *healthTable
+	restored *serverState
+}
+
+// serverState is the content of a state file
+type serverState struct {
+	Health  map[string]serverHealth `json:"health"`
+	Weights map[string]int          `json:"weights"`
+	Tuned   map[string]int          `json:"tuned"`
+}
+
+// NewStateFile reads the state saved in path, if any. Servers found down are skipped
+// until ttl has passed since their last check, 10s if zero.
+func NewStateFile(path string, ttl time.Duration) (*StateFile, error) {
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	s := &StateFile{path: path, ttl: ttl, health: newHealthTable(ttl)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state serverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	now := time.Now()
+	for server, health := range state.Health {
+		if !health.Healthy {
+			// The TTL starts again so the server isn't retried as soon as it's restarted
+			s.health.servers[server] = serverHealth{Time: now}
+		}
+	}
+	s.restored = &state
+	return s, nil
+}
+
+// WithStateFile keeps the load balancer's state in the file, restoring it if the load
+// balancer is the first to use the file. ConfigReloader keeps using the file for the load
+// balancers of new configurations.
+func WithStateFile(state *StateFile) Option {
+	return func(lb *LoadBalancer) {
+		lb.state = state
+	}
+}
+
+// attach makes the load balancer the one whose state is saved
+func (s *StateFile) attach(lb *LoadBalancer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lb.health == nil {
+		lb.health = s.health
+	} else if lb.health != s.health {
+		// Results shared through gossip are saved instead
+		lb.health.merge(s.health.recent())
+		s.health = lb.health
+	}
+	if s.restored != nil {
+		lb.mu.Lock()
+		for name, weight := range s.restored.Weights {
+			lb.weights[name] = weight
+		}
+		for name, weight := range s.restored.Tuned {
+			lb.tuned[name] = weight
+		}
+		lb.mu.Unlock()
+		s.restored = nil
+	}
+	s.lb = lb
+}
+
+// Run saves the state every interval until ctx is done, and once more then
+func (s *StateFile) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Save(); err != nil {
+				logger().Error("saving server state failed", "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if err := s.Save(); err != nil {
+			logger().Error("saving server state failed", "error", err)
+		}
+	}
+}
+
+// Save writes the state of the current load balancer to the file
+func (s *StateFile) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lb == nil {
+		return nil
+	}
+	state := serverState{Health: s.health.recent()}
+	s.lb.mu.Lock()
+	state.Weights = make(map[string]int, len(s.lb.weights))
+	for name, weight := range s.lb.weights {
+		state.Weights[name] = weight
+	}
+	state.Tuned = make(map[string]int, len(s.lb.tuned))
+	for name, weight := range s.lb.tuned {
+		state.Tuned[name] = weight
+	}
+	s.lb.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated state behind
+	if err := os.WriteFile(s.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
@@ -0,0 +1,103 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticConfig makes a target group serve files from a local directory instead of
+// proxying to servers, e.g. for single-page apps or maintenance pages. Requests are mapped
+// to files by their path after the group's prefix is stripped.
+type StaticConfig struct {
+	// Root is the directory files are served from
+	Root string
+
+	// Index lists the files served for directory requests, index.html if empty
+	Index []string
+
+	// Fallback is served, relative to Root, for requests matching no file, like a
+	// single-page app's index.html; if empty those get 404 Not Found
+	Fallback string
+
+	// MaxAge is how long clients may cache files without revalidating them. Index and
+	// fallback documents are always revalidated, so new deployments show up at once.
+	MaxAge time.Duration
+}
+
+// staticHandler returns a handler serving the files of the group's StaticConfig
+func staticHandler(targetGroup *TargetGroup) http.Handler {
+	config := *targetGroup.Static
+	if len(config.Index) == 0 {
+		config.Index = []string{"index.html"}
+	}
+	root := http.Dir(config.Root)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + targetGroup.upstreamPath(r.URL.Path))
+		if hidden(name) {
+			http.NotFound(w, r)
+			return
+		}
+		if serveFile(w, r, root, name, config, false) {
+			return
+		}
+		for _, index := range config.Index {
+			if serveFile(w, r, root, path.Join(name, index), config, true) {
+				return
+			}
+		}
+		if config.Fallback != "" && serveFile(w, r, root, path.Join("/", config.Fallback), config, true) {
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// serveFile serves the named file if it exists and isn't a directory. document marks index
+// and fallback documents, which clients must revalidate.
+func serveFile(w http.ResponseWriter, r *http.Request, root http.FileSystem, name string, config StaticConfig, document bool) bool {
+	file, err := root.Open(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger().Error("static file error", "file", name, "error", err, "request_id", RequestID(r))
+		}
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	switch {
+	case document:
+		w.Header().Set("Cache-Control", "no-cache")
+	case config.MaxAge > 0:
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(config.MaxAge.Seconds())))
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return true
+}
+
+// hidden reports whether a path names a dotfile or is inside a dot directory, like .git,
+// which aren't served
+func hidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
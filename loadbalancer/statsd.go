@@ -0,0 +1,158 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDConfig configures exporting metrics as StatsD packets
+type StatsDConfig struct {
+	// Addr is the host:port of the StatsD agent, reached over UDP
+	Addr string
+
+	// Prefix is prepended to every metric name, e.g. "lb."
+	Prefix string
+
+	// Tags are added to every metric as name:value pairs. Tags and metric labels are only
+	// sent with DogStatsD; plain StatsD gets label values appended to metric names instead.
+	Tags      []string
+	DogStatsD bool
+
+	// Interval between flushes, 10s by default
+	Interval time.Duration
+}
+
+// maxStatsDPacket keeps packets below common network MTUs
+const maxStatsDPacket = 1432
+
+// StatsDExporter periodically sends the metrics of a registry to a StatsD agent. Counters
+// are sent as the increase since the last flush, gauges as their value and histograms as
+// the increase of their count and sum.
+type StatsDExporter struct {
+	metrics *Metrics
+	config  StatsDConfig
+	conn    net.Conn
+	last    map[string]float64
+}
+
+// NewStatsDExporter creates an exporter for metrics
+func NewStatsDExporter(metrics *Metrics, config StatsDConfig) (*StatsDExporter, error) {
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	conn, err := net.Dial("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDExporter{metrics: metrics, config: config, conn: conn, last: make(map[string]float64)}, nil
+}
+
+// Run flushes metrics every interval until ctx is done, then closes the connection
+func (e *StatsDExporter) Run(ctx context.Context) {
+	defer e.conn.Close()
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.Flush()
+			return
+		case <-ticker.C:
+			e.Flush()
+		}
+	}
+}
+
+// Flush sends the current metrics
+func (e *StatsDExporter) Flush() {
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := e.conn.Write(packet.Bytes()); err != nil {
+			logger().Warn("statsd: sending metrics failed", "error", err)
+		}
+		packet.Reset()
+	}
+	write := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacket {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	for _, sample := range e.metrics.snapshot() {
+		name, tags := e.name(sample)
+		switch sample.kind {
+		case "counter":
+			if delta := e.delta(name+tags, sample.value); delta > 0 {
+				write(e.line(name, delta, "c", tags))
+			}
+		case "gauge":
+			write(e.line(name, sample.value, "g", tags))
+		case "histogram":
+			if delta := e.delta(name+".count"+tags, sample.value); delta > 0 {
+				write(e.line(name+".count", delta, "c", tags))
+				write(e.line(name+".sum", e.delta(name+".sum"+tags, sample.sum), "c", tags))
+			}
+		}
+	}
+	send()
+}
+
+// delta returns the increase of a cumulative value since the last flush
+func (e *StatsDExporter) delta(key string, value float64) float64 {
+	delta := value - e.last[key]
+	e.last[key] = value
+	if delta < 0 {
+		// The series was reset
+		return value
+	}
+	return delta
+}
+
+// name returns the StatsD name of a sample and, for DogStatsD, its tags
+func (e *StatsDExporter) name(sample metricSample) (string, string) {
+	name := e.config.Prefix + sample.name
+	if !e.config.DogStatsD {
+		for i := 1; i < len(sample.labels); i += 2 {
+			name += "." + statsDSegment.Replace(sanitizeStatsD(sample.labels[i]))
+		}
+		return name, ""
+	}
+	tags := append([]string(nil), e.config.Tags...)
+	for i := 0; i+1 < len(sample.labels); i += 2 {
+		tags = append(tags, sample.labels[i]+":"+sanitizeStatsD(sample.labels[i+1]))
+	}
+	if len(tags) == 0 {
+		return name, ""
+	}
+	return name, "|#" + strings.Join(tags, ",")
+}
+
+func (e *StatsDExporter) line(name string, value float64, kind, tags string) string {
+	return fmt.Sprintf("%s:%s|%s%s", name, strconv.FormatFloat(value, 'f', -1, 64), kind, tags)
+}
+
+// statsDSegment keeps label values from adding levels to plain StatsD names
+var statsDSegment = strings.NewReplacer(".", "_", "/", "_")
+
+// sanitizeStatsD replaces characters with a meaning in the StatsD protocol
+func sanitizeStatsD(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
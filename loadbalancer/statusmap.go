@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StatusMapping changes a status code of backend responses before they reach clients,
+// e.g. turning a legacy service's 404s into 410 Gone, and optionally their body
+type StatusMapping struct {
+	From int
+	To   int
+
+	// Body replaces the response's body when set, as ContentType or text/plain
+	Body        string
+	ContentType string
+}
+
+// mapStatus applies the first mapping for the response's status
+func mapStatus(resp *http.Response, mappings []StatusMapping) {
+	for _, mapping := range mappings {
+		if mapping.From != resp.StatusCode {
+			continue
+		}
+		resp.StatusCode = mapping.To
+		resp.Status = strconv.Itoa(mapping.To) + " " + http.StatusText(mapping.To)
+		if mapping.Body != "" {
+			contentType := mapping.ContentType
+			if contentType == "" {
+				contentType = "text/plain; charset=utf-8"
+			}
+			resp.Body.Close()
+			resp.Body = io.NopCloser(strings.NewReader(mapping.Body))
+			resp.ContentLength = int64(len(mapping.Body))
+			resp.TransferEncoding = nil
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("ETag")
+			resp.Header.Set("Content-Type", contentType)
+			resp.Header.Set("Content-Length", strconv.Itoa(len(mapping.Body)))
+		}
+		return
+	}
+}
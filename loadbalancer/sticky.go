@@ -0,0 +1,310 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StickyConfig keeps the requests with the same key on the server first chosen for the
+// key, for backends keeping session state, as long as the server is healthy
+type StickyConfig struct {
+	// Key is the request key, e.g. from ParseHashKey("cookie:session"). Requests without
+	// one are balanced as usual.
+	Key func(r *http.Request) string
+
+	// TTL is how long a key stays with its server after its last request; 1h by default
+	TTL time.Duration
+
+	// Name separates the keys of the groups sharing a StickyTable; the group's URIPath
+	// unless set
+	Name string
+}
+
+// StickyTable maps the keys of sticky target groups to servers. A table shared by the
+// instances of the load balancer, like RedisStickyTable, keeps sessions on their server
+// whichever instance their requests reach.
+type StickyTable interface {
+	// Lookup returns the URL of the server the key is on, or "" if it isn't on any, and
+	// extends the key's TTL
+	Lookup(ctx context.Context, key string, ttl time.Duration) (string, error)
+
+	// Store puts the key on a server for ttl
+	Store(ctx context.Context, key, server string, ttl time.Duration) error
+}
+
+// WithStickyTable sets the table of sticky target groups, by default one in memory of the
+// load balancer
+func WithStickyTable(table StickyTable) Option {
+	return func(lb *LoadBalancer) {
+		lb.sticky = table
+	}
+}
+
+// stickyServer returns the server the request's key is on, if it is one of the servers
+func (lb *LoadBalancer) stickyServer(r *http.Request, targetGroup *TargetGroup, key string, servers []*Server) *Server {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	url, err := lb.sticky.Lookup(ctx, targetGroup.Sticky.tableKey(targetGroup, key), targetGroup.Sticky.ttl())
+	if err != nil {
+		logger().Warn("sticky table lookup failed", "error", err)
+		return nil
+	}
+	for _, server := range servers {
+		if url != "" && server.URL.String() == url {
+			return server
+		}
+	}
+	return nil
+}
+
+// stick puts the request's key on the server without holding up the request
+func (lb *LoadBalancer) stick(targetGroup *TargetGroup, key string, server *Server) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lb.sticky.Store(ctx, targetGroup.Sticky.tableKey(targetGroup, key), server.URL.String(), targetGroup.Sticky.ttl()); err != nil {
+			logger().Warn("sticky table update failed", "error", err)
+		}
+	}()
+}
+
+// tableKey returns the table key of a request key of the group
+func (config *StickyConfig) tableKey(targetGroup *TargetGroup, key string) string {
+	if config.Name != "" {
+		return config.Name + " " + key
+	}
+	return targetGroup.URIPath + " " + key
+}
+
+func (config *StickyConfig) ttl() time.Duration {
+	if config.TTL <= 0 {
+		return time.Hour
+	}
+	return config.TTL
+}
+
+// memoryStickyTable is a StickyTable of a single instance
+type memoryStickyTable struct {
+	mu      sync.Mutex
+	entries map[string]stickyEntry
+	swept   time.Time
+}
+
+type stickyEntry struct {
+	server  string
+	expires time.Time
+}
+
+// NewMemoryStickyTable returns a StickyTable kept in memory, for a single instance
+func NewMemoryStickyTable() StickyTable {
+	return &memoryStickyTable{entries: make(map[string]stickyEntry), swept: time.Now()}
+}
+
+// Lookup implements StickyTable
+func (t *memoryStickyTable) Lookup(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", nil
+	}
+	entry.expires = time.Now().Add(ttl)
+	t.entries[key] = entry
+	return entry.server, nil
+}
+
+// Store implements StickyTable
+func (t *memoryStickyTable) Store(ctx context.Context, key, server string, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.swept) > time.Minute {
+		for key, entry := range t.entries {
+			if now.After(entry.expires) {
+				delete(t.entries, key)
+			}
+		}
+		t.swept = now
+	}
+	t.entries[key] = stickyEntry{server: server, expires: now.Add(ttl)}
+	return nil
+}
+
+// FileStickyTable is a StickyTable of a single instance kept in a file as well as in
+// memory, so sessions stay on their servers when the load balancer restarts. Changes are
+// appended to the file, which is rewritten with the live entries once most of it is stale.
+type FileStickyTable struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]fileStickyEntry
+	lines   int
+}
+
+// fileStickyEntry is an entry of a FileStickyTable, and a line of its file
+type fileStickyEntry struct {
+	Key     string    `json:"key"`
+	Server  string    `json:"server"`
+	Expires time.Time `json:"expires"`
+
+	// saved is when the entry was last written to the file
+	saved time.Time
+}
+
+// NewFileStickyTable opens the table kept in path, creating the file if it doesn't exist
+func NewFileStickyTable(path string) (*FileStickyTable, error) {
+	t := &FileStickyTable{path: path, entries: make(map[string]fileStickyEntry)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	now := time.Now()
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry fileStickyEntry
+		if len(line) == 0 || json.Unmarshal(line, &entry) != nil {
+			// A line cut short by a crash
+			continue
+		}
+		if entry.Expires.After(now) {
+			entry.saved = now
+			t.entries[entry.Key] = entry
+		} else {
+			delete(t.entries, entry.Key)
+		}
+	}
+	if err := t.compact(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Lookup implements StickyTable. The extended TTL is written to the file when the one it
+// has is half over.
+func (t *FileStickyTable) Lookup(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	now := time.Now()
+	if !ok || now.After(entry.Expires) {
+		return "", nil
+	}
+	entry.Expires = now.Add(ttl)
+	if now.Sub(entry.saved) > ttl/2 {
+		if err := t.append(&entry); err != nil {
+			return "", err
+		}
+	}
+	t.entries[key] = entry
+	return entry.Server, nil
+}
+
+// Store implements StickyTable
+func (t *FileStickyTable) Store(ctx context.Context, key, server string, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry := fileStickyEntry{Key: key, Server: server, Expires: time.Now().Add(ttl)}
+	if err := t.append(&entry); err != nil {
+		return err
+	}
+	t.entries[key] = entry
+	if t.lines > 2*len(t.entries)+1000 {
+		return t.compact()
+	}
+	return nil
+}
+
+// Close closes the table's file
+func (t *FileStickyTable) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// append writes an entry to the file; t.mu must be held
+func (t *FileStickyTable) append(entry *fileStickyEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	entry.saved = time.Now()
+	t.lines++
+	return nil
+}
+
+// compact rewrites the file with the live entries; t.mu must be held unless t is new
+func (t *FileStickyTable) compact() error {
+	var buf bytes.Buffer
+	now := time.Now()
+	for key, entry := range t.entries {
+		if now.After(entry.Expires) {
+			delete(t.entries, key)
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	// Write to a temporary file first so a crash never loses the table
+	if err := os.WriteFile(t.path+".tmp", buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(t.path+".tmp", t.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.lines = file, len(t.entries)
+	return nil
+}
+
+// RedisStickyTable is a StickyTable kept in Redis under prefix+key, shared by all the
+// instances using the same server. It needs Redis 6.2 or later.
+type RedisStickyTable struct {
+	client *redisClient
+	prefix string
+}
+
+// NewRedisStickyTable creates a table in the Redis server at addr
+func NewRedisStickyTable(addr, password string, db int, prefix string) *RedisStickyTable {
+	if prefix == "" {
+		prefix = "sticky:"
+	}
+	return &RedisStickyTable{client: newRedisClient(addr, password, db), prefix: prefix}
+}
+
+// Lookup implements StickyTable
+func (t *RedisStickyTable) Lookup(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	reply, err := t.client.do(ctx, "GETEX", t.prefix+key, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if errors.Is(err, errRedisNil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	server, _ := reply.(string)
+	return server, nil
+}
+
+// Store implements StickyTable
+func (t *RedisStickyTable) Store(ctx context.Context, key, server string, ttl time.Duration) error {
+	_, err := t.client.do(ctx, "SET", t.prefix+key, server, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stickyLine is a line of a FileStickyTable's file
+func stickyLine(key, server string, expires time.Time) string {
+	return fmt.Sprintf(`{"key":%q,"server":%q,"expires":%q}`, key, server, expires.Format(time.RFC3339Nano)) + "\n"
+}
+
+func TestFileStickyTableReplay(t *testing.T) {
+	live, expired := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	tests := []struct {
+		name  string
+		lines []string
+		want  map[string]string
+	}{
+		{"Empty", nil, map[string]string{}},
+		{"Entries", []string{stickyLine("a", "s1", live), stickyLine("b", "s2", live)}, map[string]string{"a": "s1", "b": "s2"}},
+		{"LaterLinesWin", []string{stickyLine("a", "s1", live), stickyLine("a", "s2", live)}, map[string]string{"a": "s2"}},
+		{"ExpiredEntriesAreDropped", []string{stickyLine("a", "s1", live), stickyLine("b", "s2", expired)}, map[string]string{"a": "s1"}},
+		{"ExpiringRemovesEarlierLines", []string{stickyLine("a", "s1", live), stickyLine("a", "s1", expired)}, map[string]string{}},
+		{"LineCutShort", []string{stickyLine("a", "s1", live), `{"key":"b","ser`}, map[string]string{"a": "s1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sticky.json")
+			if err := os.WriteFile(path, []byte(strings.Join(test.lines, "")), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			table, err := NewFileStickyTable(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer table.Close()
+
+			for key, want := range test.want {
+				if got, err := table.Lookup(context.Background(), key, time.Hour); err != nil || got != want {
+					t.Errorf("%s is stuck to %q (%v), want %q", key, got, err, want)
+				}
+			}
+			if len(table.entries) != len(test.want) {
+				t.Errorf("the table has %d entries, want %d", len(table.entries), len(test.want))
+			}
+			// Opening the table compacts its file to the live entries
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := bytes.Count(data, []byte("\n")); lines != len(test.want) {
+				t.Errorf("the file has %d lines, want %d", lines, len(test.want))
+			}
+		})
+	}
+}
+
+func TestFileStickyTableCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sticky.json")
+	table, err := NewFileStickyTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := table.Store(context.Background(), "key-"+fmt.Sprint(i%10), "server-"+fmt.Sprint(i), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.lines > 2*len(table.entries)+1000 {
+		t.Errorf("the file has %d lines for %d entries", table.lines, len(table.entries))
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last server stored for each key survives compaction and a restart
+	reopened, err := NewFileStickyTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for i := 1990; i < 2000; i++ {
+		key, want := "key-"+fmt.Sprint(i%10), "server-"+fmt.Sprint(i)
+		if got, _ := reopened.Lookup(context.Background(), key, time.Hour); got != want {
+			t.Errorf("%s is stuck to %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// WithInstanceID sets the number of this load balancer among its replicas, counting from 0,
+// which picks its subset of the servers of target groups with a SubsetSize. It panics if id
+// is negative.
+func WithInstanceID(id int) Option {
+	if id < 0 {
+		panic("loadbalancer: negative instance ID " + strconv.Itoa(id))
+	}
+	return func(lb *LoadBalancer) {
+		lb.instanceID = id
+	}
+}
+
+// serverSubset is the subset of a group's servers used by this instance
+type serverSubset struct {
+	// servers are the group's servers the subset was picked from
+	servers []*Server
+	subset  []*Server
+}
+
+// subset returns the servers of the group this instance balances over. The caller must
+// hold lb.mu.
+func (lb *LoadBalancer) subset(targetGroup *TargetGroup, servers []*Server) []*Server {
+	if targetGroup.SubsetSize <= 0 || len(servers) <= targetGroup.SubsetSize {
+		return servers
+	}
+	cached := lb.subsets[targetGroup]
+	if cached == nil || !sameServers(cached.servers, servers) {
+		cached = &serverSubset{servers: servers, subset: deterministicSubset(servers, targetGroup.SubsetSize, lb.instanceID)}
+		lb.subsets[targetGroup] = cached
+	}
+	return cached.subset
+}
+
+// deterministicSubset picks size servers for an instance, as described in Google's SRE
+// book: the servers are shuffled the same way by every instance in a round of consecutive IDs
+// and split into subsets, one per instance, so each round spreads its instances evenly
+// over all servers. Servers are sorted by name first so instances agree on their order.
+func deterministicSubset(servers []*Server, size, instance int) []*Server {
+	sorted := append([]*Server(nil), servers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name() < sorted[j].name() })
+
+	subsetCount := len(sorted) / size
+	round := instance / subsetCount
+	rand.New(rand.NewSource(int64(round))).Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+	start := (instance % subsetCount) * size
+	return sorted[start : start+size]
+}
+
+// sameServers reports whether two server lists are the same
+func sameServers(a, b []*Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import "testing"
+
+func TestWithInstanceIDRejectsNegativeIDs(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("WithInstanceID(-1) didn't panic")
+		}
+	}()
+	WithInstanceID(-1)
+}
+
+func TestDeterministicSubset(t *testing.T) {
+	tests := []struct {
+		servers, size, round int
+	}{
+		{servers: 6, size: 2, round: 0},
+		{servers: 6, size: 2, round: 1},
+		{servers: 10, size: 3, round: 0},
+		{servers: 10, size: 3, round: 7},
+		{servers: 30, size: 5, round: 1000},
+	}
+	for _, test := range tests {
+		servers := benchmarkServers(test.servers)
+		reversed := make([]*Server, len(servers))
+		for i, server := range servers {
+			reversed[len(servers)-1-i] = server
+		}
+		subsetCount := test.servers / test.size
+
+		// The instances of a round use each server at most once, and all but the remainder
+		used := make(map[*Server]int)
+		for i := 0; i < subsetCount; i++ {
+			instance := test.round*subsetCount + i
+			subset := deterministicSubset(servers, test.size, instance)
+			if len(subset) != test.size {
+				t.Fatalf("%+v: instance %d got %d servers", test, instance, len(subset))
+			}
+			// Instances agree on the subsets whatever order they list the servers in
+			if again := deterministicSubset(reversed, test.size, instance); !sameServers(subset, again) {
+				t.Errorf("%+v: instance %d got %v from the reversed servers, %v before", test, instance, again, subset)
+			}
+			for _, server := range subset {
+				used[server]++
+			}
+		}
+		if len(used) != subsetCount*test.size {
+			t.Errorf("%+v: the round used %d servers, want %d", test, len(used), subsetCount*test.size)
+		}
+		for server, n := range used {
+			if n != 1 {
+				t.Errorf("%+v: %s is used by %d instances of the round", test, server.URL.Host, n)
+			}
+		}
+	}
+}
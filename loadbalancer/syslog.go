@@ -0,0 +1,221 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyslogConfig configures sending log lines to a syslog server
+type SyslogConfig struct {
+	// Network is udp, tcp or unix, and Addr is the server's host:port or socket path
+	Network string
+	Addr    string
+
+	// Facility is a facility name like daemon or local0, local0 by default
+	Facility string
+
+	// Severity is a severity name like info or err, info by default
+	Severity string
+
+	// AppName identifies the sender, lbwtg by default
+	AppName string
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// SyslogWriter is an io.WriteCloser sending each write as an RFC 5424 syslog message.
+// Messages are framed by octet counting over TCP and sent as datagrams otherwise.
+type SyslogWriter struct {
+	config   SyslogConfig
+	priority int
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// DialSyslog connects to the syslog server
+func DialSyslog(config SyslogConfig) (*SyslogWriter, error) {
+	if config.Facility == "" {
+		config.Facility = "local0"
+	}
+	if config.Severity == "" {
+		config.Severity = "info"
+	}
+	if config.AppName == "" {
+		config.AppName = "lbwtg"
+	}
+	facility, ok := syslogFacilities[config.Facility]
+	if !ok {
+		return nil, fmt.Errorf("syslog: unknown facility %q", config.Facility)
+	}
+	severity, ok := syslogSeverities[config.Severity]
+	if !ok {
+		return nil, fmt.Errorf("syslog: unknown severity %q", config.Severity)
+	}
+	switch config.Network {
+	case "udp", "tcp", "unix":
+	default:
+		return nil, fmt.Errorf("syslog: network must be udp, tcp or unix, not %q", config.Network)
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &SyslogWriter{config: config, priority: facility*8 + severity, hostname: hostname}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// connect dials the server. Unix sockets are datagram sockets on most systems, but some
+// daemons listen on stream sockets instead.
+func (w *SyslogWriter) connect() error {
+	var conn net.Conn
+	var err error
+	if w.config.Network == "unix" {
+		if conn, err = net.Dial("unixgram", w.config.Addr); err != nil {
+			conn, err = net.Dial("unix", w.config.Addr)
+		}
+	} else {
+		conn, err = net.Dial(w.config.Network, w.config.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends p, without its trailing newline, as one message. A broken connection is
+// redialed once.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	return w.write(w.priority, p)
+}
+
+func (w *SyslogWriter) write(priority int, p []byte) (int, error) {
+	msg := w.format(priority, bytes.TrimRight(p, "\n"))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		if _, err := w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return 0, err
+	}
+	if _, err := w.conn.Write(msg); err != nil {
+		return 0, fmt.Errorf("syslog: %w", err)
+	}
+	return len(p), nil
+}
+
+// format builds an RFC 5424 message: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (w *SyslogWriter) format(priority int, p []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - - ", priority, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.config.AppName, os.Getpid())
+	b.Write(p)
+	if w.config.Network != "tcp" {
+		return b.Bytes()
+	}
+	return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+}
+
+// Close closes the connection
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// severityWriter sends messages over a SyslogWriter's connection with another severity
+type severityWriter struct {
+	w        *SyslogWriter
+	priority int
+}
+
+func (sw severityWriter) Write(p []byte) (int, error) {
+	return sw.w.write(sw.priority, p)
+}
+
+// NewSyslogHandler returns a slog handler writing records to w in the text format, with
+// the syslog severity matching their level instead of w's own
+func NewSyslogHandler(w *SyslogWriter) slog.Handler {
+	// Syslog timestamps the messages itself
+	options := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}
+	facility := w.priority / 8 * 8
+	handler := func(severity string) slog.Handler {
+		return slog.NewTextHandler(severityWriter{w, facility + syslogSeverities[severity]}, options)
+	}
+	return syslogHandler{handler("debug"), handler("info"), handler("warning"), handler("err")}
+}
+
+// syslogHandler passes records to the handler for their level: debug, info, warn or error
+type syslogHandler [4]slog.Handler
+
+func (h syslogHandler) handler(level slog.Level) slog.Handler {
+	switch {
+	case level >= slog.LevelError:
+		return h[3]
+	case level >= slog.LevelWarn:
+		return h[2]
+	case level >= slog.LevelInfo:
+		return h[1]
+	}
+	return h[0]
+}
+
+func (h syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler(level).Enabled(ctx, level)
+}
+
+func (h syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler(record.Level).Handle(ctx, record)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for i := range h {
+		h[i] = h[i].WithAttrs(attrs)
+	}
+	return h
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	for i := range h {
+		h[i] = h[i].WithGroup(name)
+	}
+	return h
+}
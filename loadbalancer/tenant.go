@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Tenant is a team sharing the load balancer with others. Target groups belong to a tenant
+// through TargetGroup.Tenant, which prefixes their route names in metrics and logs with the
+// tenant's name, e.g. "shop:/cart".
+type Tenant struct {
+	Name string
+
+	// AdminTokens are bearer tokens for the tenant's admin API, which only serves the
+	// tenant's metrics (GET /metrics) and purges the tenant's caches (POST /cache/purge)
+	AdminTokens []string
+}
+
+// WithTenant adds a tenant whose admin tokens are accepted by the admin API
+func WithTenant(tenant Tenant) Option {
+	return func(lb *LoadBalancer) {
+		lb.tenants = append(lb.tenants, tenant)
+	}
+}
+
+// tenantPrefix is the prefix of the route names of a tenant's target groups
+func tenantPrefix(tenant string) string {
+	return tenant + ":"
+}
+
+// requestTenant returns the tenant whose admin token the request carries
+func (lb *LoadBalancer) requestTenant(r *http.Request) (Tenant, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return Tenant{}, false
+	}
+	for _, tenant := range lb.tenants {
+		for _, expected := range tenant.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				return tenant, true
+			}
+		}
+	}
+	return Tenant{}, false
+}
+
+// tenantAdminHandler returns the admin API for a tenant's admin tokens
+func (lb *LoadBalancer) tenantAdminHandler(tenant Tenant) http.Handler {
+	prefix := tenantPrefix(tenant.Name)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", lb.metrics.filtered(func(labels []string) bool {
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i] == "route" && strings.HasPrefix(labels[i+1], prefix) {
+				return true
+			}
+		}
+		return false
+	}))
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		var caches []*Cache
+		for _, cache := range lb.caches {
+			if strings.HasPrefix(cache.route, prefix) {
+				caches = append(caches, cache)
+			}
+		}
+		lb.purgeCaches(w, r, caches)
+	})
+	return mux
+}
@@ -0,0 +1,208 @@
+// Package testutil provides fake backends for testing load balancers end to end: httptest
+// servers with configurable latency, response status and health, including health that
+// flaps on its own.
+package testutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lbwtg/loadbalancer"
+)
+
+// BackendHeader is the response header naming the backend that served a request
+const BackendHeader = "X-Backend"
+
+// Backend is a fake backend server. Requests to its health path get 200 OK while it's
+// healthy and 503 Service Unavailable otherwise; all other requests get its status after
+// its latency.
+type Backend struct {
+	name       string
+	healthPath string
+	server     *httptest.Server
+
+	mu      sync.Mutex
+	latency time.Duration
+	status  int
+	healthy bool
+	flap    time.Duration
+
+	requests     atomic.Int64
+	healthChecks atomic.Int64
+}
+
+// BackendOption configures a Backend
+type BackendOption func(*Backend)
+
+// WithLatency delays every response but health checks by d
+func WithLatency(d time.Duration) BackendOption {
+	return func(b *Backend) {
+		b.latency = d
+	}
+}
+
+// WithStatus sets the status of the responses, 200 OK by default
+func WithStatus(status int) BackendOption {
+	return func(b *Backend) {
+		b.status = status
+	}
+}
+
+// WithHealthPath sets the path health checks are answered on, /health by default. An
+// empty path makes the balancer consider the backend always healthy.
+func WithHealthPath(path string) BackendOption {
+	return func(b *Backend) {
+		b.healthPath = path
+	}
+}
+
+// WithUnhealthy starts the backend unhealthy
+func WithUnhealthy() BackendOption {
+	return func(b *Backend) {
+		b.healthy = false
+	}
+}
+
+// WithFlapping switches the backend between healthy and unhealthy every period
+func WithFlapping(period time.Duration) BackendOption {
+	return func(b *Backend) {
+		b.flap = period
+	}
+}
+
+// NewBackend starts a backend that is closed when the test ends
+func NewBackend(tb testing.TB, name string, opts ...BackendOption) *Backend {
+	tb.Helper()
+	b := &Backend{name: name, healthPath: "/health", status: http.StatusOK, healthy: true}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	tb.Cleanup(b.server.Close)
+	if b.flap > 0 {
+		done := make(chan struct{})
+		tb.Cleanup(func() { close(done) })
+		go func() {
+			ticker := time.NewTicker(b.flap)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					b.SetHealthy(!b.Healthy())
+				}
+			}
+		}()
+	}
+	return b
+}
+
+func (b *Backend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(BackendHeader, b.name)
+	if b.healthPath != "" && r.URL.Path == b.healthPath {
+		b.healthChecks.Add(1)
+		if !b.Healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return
+	}
+	b.requests.Add(1)
+	b.mu.Lock()
+	latency, status := b.latency, b.status
+	b.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(b.name))
+}
+
+// Name returns the backend's name, which its responses carry in BackendHeader
+func (b *Backend) Name() string {
+	return b.name
+}
+
+// URL returns the backend's URL
+func (b *Backend) URL() *url.URL {
+	u, _ := url.Parse(b.server.URL)
+	return u
+}
+
+// Server returns a load balancer server for the backend, named after it
+func (b *Backend) Server() *loadbalancer.Server {
+	return &loadbalancer.Server{URL: b.URL(), HealthCheckPath: b.healthPath, Name: b.name}
+}
+
+// Servers returns the load balancer servers of the backends
+func Servers(backends ...*Backend) []*loadbalancer.Server {
+	servers := make([]*loadbalancer.Server, len(backends))
+	for i, backend := range backends {
+		servers[i] = backend.Server()
+	}
+	return servers
+}
+
+// SetHealthy changes whether health checks succeed
+func (b *Backend) SetHealthy(healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthy = healthy
+}
+
+// Healthy reports whether health checks succeed
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+// SetLatency changes the delay of the responses
+func (b *Backend) SetLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latency = d
+}
+
+// SetStatus changes the status of the responses
+func (b *Backend) SetStatus(status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status = status
+}
+
+// Requests returns the number of requests served, not counting health checks
+func (b *Backend) Requests() int {
+	return int(b.requests.Load())
+}
+
+// HealthChecks returns the number of health checks answered
+func (b *Backend) HealthChecks() int {
+	return int(b.healthChecks.Load())
+}
+
+// Get sends a GET request for target, a path or URL, to handler and returns the response
+func Get(handler http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+// Distribution sends n GET requests for target to handler and counts the responses by the
+// backend that served them; responses from none are counted under ""
+func Distribution(handler http.Handler, target string, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[Get(handler, target).Header().Get(BackendHeader)]++
+	}
+	return counts
+}
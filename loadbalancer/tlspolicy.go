@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// TLSPolicy restricts the TLS connections a listener accepts, e.g. to meet a compliance
+// baseline. Zero fields keep Go's defaults.
+type TLSPolicy struct {
+	// MinVersion is the lowest accepted protocol version, like tls.VersionTLS12
+	MinVersion uint16
+
+	// CipherSuites lists the cipher suites allowed for TLS 1.2 and earlier, in order of
+	// preference. TLS 1.3 suites aren't configurable.
+	CipherSuites []uint16
+
+	// CurvePreferences lists the key exchange curves allowed, in order of preference
+	CurvePreferences []tls.CurveID
+
+	// NextProtos are the application protocols offered with ALPN. Leaving out h2 disables
+	// HTTP/2; http/1.1 is always offered.
+	NextProtos []string
+}
+
+// apply sets the policy on the server's TLS configuration
+func (policy *TLSPolicy) apply(server *http.Server) {
+	server.TLSConfig.MinVersion = policy.MinVersion
+	server.TLSConfig.CipherSuites = policy.CipherSuites
+	server.TLSConfig.CurvePreferences = policy.CurvePreferences
+	if len(policy.NextProtos) > 0 {
+		server.TLSConfig.NextProtos = policy.NextProtos
+		if !slices.Contains(policy.NextProtos, "h2") {
+			// A non-nil map keeps the server from setting up HTTP/2
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS protocol version: 1.0, 1.1, 1.2 or 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return version, nil
+}
+
+// ParseCipherSuite parses the standard name of a cipher suite, like
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Suites Go considers insecure are refused.
+func ParseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return 0, fmt.Errorf("cipher suite %s is only used by TLS 1.3, whose suites aren't configurable", name)
+		}
+		return suite.ID, nil
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// ParseCurve parses the name of a key exchange curve: X25519, P-256, P-384 or P-521
+func ParseCurve(name string) (tls.CurveID, error) {
+	curve, ok := tlsCurves[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown curve %q, want X25519, P-256, P-384 or P-521", name)
+	}
+	return curve, nil
+}
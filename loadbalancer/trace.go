@@ -0,0 +1,231 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TracingConfig configures the trace context headers sent to backends. The load balancer
+// joins the client's trace if it sent one, or starts a new trace, and tells backends it is
+// their parent.
+type TracingConfig struct {
+	// Sampled sets the sampled flag of traces started by the load balancer
+	Sampled bool
+
+	// B3 also sends Zipkin B3 headers to every backend: B3Single, B3Multi or both. Without
+	// it, B3 headers are only sent in the format the client used.
+	B3 []B3Format
+}
+
+// B3Format is a way of sending Zipkin B3 headers
+type B3Format string
+
+// B3 header formats
+const (
+	// B3Single is the b3 header: traceid-spanid-sampled-parentid
+	B3Single B3Format = "single"
+
+	// B3Multi is the X-B3-TraceId, X-B3-SpanId, X-B3-ParentSpanId and X-B3-Sampled headers
+	B3Multi B3Format = "multi"
+)
+
+// WithTracing propagates W3C Trace Context (traceparent and tracestate) headers to backends.
+// Traces are also joined from Zipkin B3 headers, which are propagated in turn.
+func WithTracing(config TracingConfig) Option {
+	return func(lb *LoadBalancer) {
+		lb.tracing = &config
+	}
+}
+
+// TraceContext identifies a request within a distributed trace
+type TraceContext struct {
+	TraceID [16]byte
+
+	// SpanID identifies the load balancer's handling of the request and ParentID the
+	// client's span, which is zero for traces started by the load balancer
+	SpanID   [8]byte
+	ParentID [8]byte
+
+	Sampled bool
+
+	// State is the vendor-specific tracestate header, passed on unchanged
+	State string
+}
+
+type traceKey struct{}
+
+// Trace returns the trace context of a request, if tracing is enabled
+func Trace(r *http.Request) (TraceContext, bool) {
+	trace, ok := r.Context().Value(traceKey{}).(TraceContext)
+	return trace, ok
+}
+
+// TraceIDString returns the trace ID in hex
+func (t TraceContext) TraceIDString() string {
+	return hex.EncodeToString(t.TraceID[:])
+}
+
+// traceparent formats the traceparent header sent to backends
+func (t TraceContext) traceparent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return "00-" + t.TraceIDString() + "-" + hex.EncodeToString(t.SpanID[:]) + "-" + flags
+}
+
+// withTrace joins the request's trace or starts one, stores it in the request context and
+// replaces the trace headers with those for backends
+func (config *TracingConfig) withTrace(r *http.Request) *http.Request {
+	b3Trace, b3Formats, b3OK := parseB3(r.Header)
+	trace, ok := parseTraceparent(r.Header.Get("Traceparent"))
+	switch {
+	case ok:
+		trace.State = strings.Join(r.Header.Values("Tracestate"), ",")
+	case b3OK:
+		trace = b3Trace
+	default:
+		rand.Read(trace.TraceID[:])
+		trace.Sampled = config.Sampled
+		if len(b3Formats) > 0 {
+			// The client only sent a sampling decision
+			trace.Sampled = b3Trace.Sampled
+		}
+	}
+	rand.Read(trace.SpanID[:])
+
+	r.Header.Set("Traceparent", trace.traceparent())
+	if trace.State != "" {
+		r.Header.Set("Tracestate", trace.State)
+	} else {
+		// tracestate is meaningless without a valid traceparent
+		r.Header.Del("Tracestate")
+	}
+	setB3(r.Header, trace, append(b3Formats, config.B3...))
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, trace))
+}
+
+// parseTraceparent parses a traceparent header: version-traceid-parentid-flags in lowercase
+// hex. Versions after 00 may append fields, which are ignored.
+func parseTraceparent(s string) (TraceContext, bool) {
+	var trace TraceContext
+	if len(s) < 55 || (len(s) > 55 && (s[:2] == "00" || s[55] != '-')) {
+		return trace, false
+	}
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' || s[:2] == "ff" || !isLowerHex(s[:55]) {
+		return trace, false
+	}
+	var flags [1]byte
+	hex.Decode(trace.TraceID[:], []byte(s[3:35]))
+	hex.Decode(trace.ParentID[:], []byte(s[36:52]))
+	hex.Decode(flags[:], []byte(s[53:55]))
+	if trace.TraceID == [16]byte{} || trace.ParentID == [8]byte{} {
+		return trace, false
+	}
+	trace.Sampled = flags[0]&1 == 1
+	return trace, true
+}
+
+// isLowerHex reports whether s contains only lowercase hex digits and dashes
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// b3Headers are the B3 multi headers
+var b3Headers = []string{"X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled", "X-B3-Flags"}
+
+// parseB3 reads a trace from the b3 header or, failing that, the X-B3 headers. It returns
+// the formats the client used, which are present even if they only carry a sampling decision.
+func parseB3(header http.Header) (TraceContext, []B3Format, bool) {
+	var trace TraceContext
+	if single := header.Get("B3"); single != "" {
+		fields := strings.Split(single, "-")
+		if len(fields) == 1 {
+			trace.Sampled = fields[0] == "1" || fields[0] == "d"
+			return trace, []B3Format{B3Single}, false
+		}
+		if len(fields) > 4 || !parseB3IDs(&trace, fields[0], fields[1]) {
+			return trace, nil, false
+		}
+		if len(fields) > 2 {
+			trace.Sampled = fields[2] == "1" || fields[2] == "d"
+		}
+		return trace, []B3Format{B3Single}, true
+	}
+
+	sampled, flags := header.Get("X-B3-Sampled"), header.Get("X-B3-Flags")
+	trace.Sampled = sampled == "1" || sampled == "true" || flags == "1"
+	traceID, spanID := header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId")
+	if traceID == "" && spanID == "" {
+		if sampled != "" || flags != "" {
+			return trace, []B3Format{B3Multi}, false
+		}
+		return trace, nil, false
+	}
+	if !parseB3IDs(&trace, traceID, spanID) {
+		return trace, nil, false
+	}
+	return trace, []B3Format{B3Multi}, true
+}
+
+// parseB3IDs decodes a 64 or 128-bit trace ID and the client's span ID
+func parseB3IDs(trace *TraceContext, traceID, spanID string) bool {
+	if len(traceID) != 16 && len(traceID) != 32 || len(spanID) != 16 || !isLowerHex(traceID+spanID) ||
+		strings.Contains(traceID+spanID, "-") {
+		return false
+	}
+	// 64-bit trace IDs are the low half of a 128-bit ID
+	if _, err := hex.Decode(trace.TraceID[16-len(traceID)/2:], []byte(traceID)); err != nil {
+		return false
+	}
+	if _, err := hex.Decode(trace.ParentID[:], []byte(spanID)); err != nil {
+		return false
+	}
+	return trace.TraceID != [16]byte{} && trace.ParentID != [8]byte{}
+}
+
+// setB3 replaces the B3 headers with the trace in each of the formats
+func setB3(header http.Header, trace TraceContext, formats []B3Format) {
+	if len(formats) == 0 {
+		return
+	}
+	header.Del("B3")
+	for _, name := range b3Headers {
+		header.Del(name)
+	}
+
+	traceID, spanID := trace.TraceIDString(), hex.EncodeToString(trace.SpanID[:])
+	sampled := "0"
+	if trace.Sampled {
+		sampled = "1"
+	}
+	var parentID string
+	if trace.ParentID != [8]byte{} {
+		parentID = hex.EncodeToString(trace.ParentID[:])
+	}
+	for _, format := range formats {
+		switch format {
+		case B3Single:
+			single := traceID + "-" + spanID + "-" + sampled
+			if parentID != "" {
+				single += "-" + parentID
+			}
+			header.Set("B3", single)
+		case B3Multi:
+			header.Set("X-B3-TraceId", traceID)
+			header.Set("X-B3-SpanId", spanID)
+			header.Set("X-B3-Sampled", sampled)
+			if parentID != "" {
+				header.Set("X-B3-ParentSpanId", parentID)
+			}
+		}
+	}
+}
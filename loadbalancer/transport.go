@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig configures the http.Transport used to reach the servers of a target group.
+// Zero values fall back to the defaults of http.DefaultTransport.
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSClientConfig       *tls.Config
+
+	// RootCAs verifies the servers' certificates instead of the system roots, for servers
+	// with certificates from a private CA
+	RootCAs *x509.CertPool
+
+	// ServerName is the name the servers' certificates are verified for, and sent with SNI,
+	// instead of the host of their URLs
+	ServerName string
+
+	// InsecureSkipVerify accepts any server certificate, so connections to the servers can
+	// be intercepted. A warning is logged for every transport created with it.
+	InsecureSkipVerify bool
+
+	// Connection pool settings
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+	DisableKeepAlives   bool
+
+	// DNSCache resolves the servers' host names when set
+	DNSCache *DNSCache
+
+	// Proxy is the URL of an HTTP or SOCKS5 proxy to reach the servers through, see
+	// ParseProxyURL, or "direct" for none. By default the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables apply. Connections through a proxy don't use DNSCache.
+	Proxy string
+
+	// NoProxy lists, separated by commas like NO_PROXY, the hosts, domains and CIDR
+	// prefixes reached without Proxy
+	NoProxy string
+
+	// Dialer names a dialer registered with RegisterDialer that opens the connections to
+	// the servers instead of a net.Dialer. KeepAlive doesn't apply to its connections.
+	Dialer string
+}
+
+// NewTransport creates an http.Transport from the given configuration
+func NewTransport(config TransportConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.DialTimeout > 0 || config.KeepAlive != 0 || config.DNSCache != nil || config.Dialer != "" {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if config.DialTimeout > 0 {
+			dialer.Timeout = config.DialTimeout
+		}
+		if config.KeepAlive != 0 {
+			// A negative KeepAlive disables TCP keep-alive probes
+			dialer.KeepAlive = config.KeepAlive
+		}
+		dial := dialer.DialContext
+		if config.Dialer != "" {
+			dial = namedDialer(config.Dialer, dialer.Timeout)
+		}
+		if config.DNSCache != nil {
+			dial = config.DNSCache.DialContext(dial)
+		}
+		transport.DialContext = dial
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = config.MaxConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	transport.Proxy = proxyFunc(config)
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	if config.TLSClientConfig != nil {
+		transport.TLSClientConfig = config.TLSClientConfig
+	}
+	if config.RootCAs != nil || config.ServerName != "" || config.InsecureSkipVerify {
+		tlsConfig := &tls.Config{}
+		if config.TLSClientConfig != nil {
+			tlsConfig = config.TLSClientConfig.Clone()
+		}
+		if config.RootCAs != nil {
+			tlsConfig.RootCAs = config.RootCAs
+		}
+		if config.ServerName != "" {
+			tlsConfig.ServerName = config.ServerName
+		}
+		if config.InsecureSkipVerify {
+			logger().Warn("backend TLS certificates are not verified", "server_name", config.ServerName)
+			tlsConfig.InsecureSkipVerify = true
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport
+}
+
+// namedDialer returns the registered dialer, limited to the timeout, or a dial function
+// failing with the lookup error
+func namedDialer(name string, timeout time.Duration) DialFunc {
+	dial, err := lookupDialer(name)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// targetGroupTransport returns the transport for a target group, falling back to the load balancer's transport
+func (lb *LoadBalancer) targetGroupTransport(targetGroup *TargetGroup) http.RoundTripper {
+	if targetGroup.Transport != nil {
+		return targetGroup.Transport
+	}
+	if targetGroup.TransportConfig != nil {
+		// Target groups with the same configuration share a transport and its connection pool
+		config := *targetGroup.TransportConfig
+		for other, transport := range lb.transports {
+			if other.Transport == nil && other.TransportConfig != nil && *other.TransportConfig == config {
+				return transport
+			}
+		}
+		return NewTransport(config)
+	}
+	return lb.transport
+}
@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// WeightTuningConfig configures automatic weight tuning: every interval, servers get
+// weights from MinWeight for ones failing or much slower than the rest of their group, up
+// to MaxWeight for healthy ones. Weights move halfway to their target each interval so a
+// single bad interval doesn't drain a server. The tuned weights multiply the configured
+// ones, or those set with SetWeight, so weight 0 still drains a server.
+type WeightTuningConfig struct {
+	// Interval is how often weights are adjusted, 10s if zero
+	Interval time.Duration
+
+	// MinWeight and MaxWeight bound the tuned weights, 1 and 10 if zero
+	MinWeight int
+	MaxWeight int
+}
+
+// WithWeightTuning adjusts server weights automatically from their error rates and
+// latencies, so degraded servers get less traffic before they fail health checks
+func WithWeightTuning(config WeightTuningConfig) Option {
+	return func(lb *LoadBalancer) {
+		if config.Interval <= 0 {
+			config.Interval = 10 * time.Second
+		}
+		if config.MinWeight <= 0 {
+			config.MinWeight = 1
+		}
+		if config.MaxWeight <= 0 {
+			config.MaxWeight = 10
+		}
+		lb.tuner = &weightTuner{config: config, stats: make(map[string]*serverStats)}
+	}
+}
+
+// weightTuner collects how servers responded during an interval
+type weightTuner struct {
+	config WeightTuningConfig
+
+	mu    sync.Mutex
+	stats map[string]*serverStats
+}
+
+type serverStats struct {
+	requests int
+	errors   int
+	seconds  float64
+}
+
+// record counts a response of a server, or a failure to get one. A nil tuner records nothing.
+func (t *weightTuner) record(server *Server, latency time.Duration, failed bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.stats[server.name()]
+	if !ok {
+		stats = &serverStats{}
+		t.stats[server.name()] = stats
+	}
+	stats.requests++
+	stats.seconds += latency.Seconds()
+	if failed {
+		stats.errors++
+	}
+}
+
+// runWeightTuning tunes the weights every interval until the load balancer is closed
+func (lb *LoadBalancer) runWeightTuning() {
+	ticker := time.NewTicker(lb.tuner.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lb.ctx.Done():
+			return
+		case <-ticker.C:
+			lb.tuneWeights()
+		}
+	}
+}
+
+// tuneWeights sets the tuned weight of every server that served requests during the
+// interval. A server's target is MaxWeight scaled down by its error rate and by how much
+// slower it was than its group's average.
+func (lb *LoadBalancer) tuneWeights() {
+	t := lb.tuner
+	t.mu.Lock()
+	stats := t.stats
+	t.stats = make(map[string]*serverStats)
+	t.mu.Unlock()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, servers := range lb.routes.Load().servers {
+		var requests int
+		var seconds float64
+		for _, server := range servers {
+			if s, ok := stats[server.name()]; ok {
+				requests += s.requests
+				seconds += s.seconds
+			}
+		}
+		if requests == 0 {
+			continue
+		}
+		average := seconds / float64(requests)
+		for _, server := range servers {
+			s, ok := stats[server.name()]
+			if !ok {
+				continue
+			}
+			score := 1 - float64(s.errors)/float64(s.requests)
+			if latency := s.seconds / float64(s.requests); latency > average {
+				score *= average / latency
+			}
+			target := float64(t.config.MinWeight) + score*float64(t.config.MaxWeight-t.config.MinWeight)
+			current, ok := lb.tuned[server.name()]
+			if !ok {
+				current = t.config.MaxWeight
+			}
+			weight := int(math.Round((float64(current) + target) / 2))
+			weight = min(max(weight, t.config.MinWeight), t.config.MaxWeight)
+			if weight != current {
+				logger().Debug("server weight tuned", "server", server.name(), "from", current, "to", weight)
+			}
+			lb.tuned[server.name()] = weight
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package loadbalancer
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// UpstreamAuth is a credential added to the requests forwarded to a target group's servers,
+// for backends behind their own authentication. It replaces any value the client sent for
+// the header.
+type UpstreamAuth struct {
+	// Header is Authorization unless set
+	Header string
+	Value  string
+}
+
+// BearerUpstreamAuth returns UpstreamAuth sending a bearer token
+func BearerUpstreamAuth(token string) *UpstreamAuth {
+	return &UpstreamAuth{Value: "Bearer " + token}
+}
+
+// BasicUpstreamAuth returns UpstreamAuth sending HTTP basic credentials
+func BasicUpstreamAuth(username, password string) *UpstreamAuth {
+	return &UpstreamAuth{Value: "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+}
+
+// apply sets the credential on a request to a server
+func (auth *UpstreamAuth) apply(header http.Header) {
+	name := auth.Header
+	if name == "" {
+		name = "Authorization"
+	}
+	header.Set(name, auth.Value)
+}
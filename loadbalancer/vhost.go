@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// VirtualHost is a set of routes for requests to some host names, like an nginx server
+// block. Requests for hosts without a virtual host are routed by the load balancer's own
+// target groups.
+type VirtualHost struct {
+	// Hosts are matched case-insensitively against the request host without its port.
+	// A name like *.apps.example.com matches every subdomain of apps.example.com; exact
+	// names take precedence over wildcards, and longer wildcards over shorter ones.
+	Hosts []string
+
+	TargetGroups []*TargetGroup
+
+	// DefaultGroup serves requests matching none of the target groups. Without one they
+	// get 404 Not Found.
+	DefaultGroup *TargetGroup
+}
+
+// WithVirtualHost adds a virtual host to the load balancer
+func WithVirtualHost(vhost *VirtualHost) Option {
+	return func(lb *LoadBalancer) {
+		lb.vhosts = append(lb.vhosts, vhost)
+	}
+}
+
+// matchVirtualHost returns the virtual host for the request's host, if there is one
+func (routes *routeTable) matchVirtualHost(r *http.Request) *VirtualHost {
+	if len(routes.vhosts) == 0 {
+		return nil
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var match *VirtualHost
+	matchLen := 0
+	for _, vhost := range routes.vhosts {
+		for _, name := range vhost.Hosts {
+			name = strings.ToLower(name)
+			if name == host {
+				return vhost
+			}
+			if suffix, ok := strings.CutPrefix(name, "*"); ok && strings.HasSuffix(host, suffix) && len(suffix) > matchLen {
+				match, matchLen = vhost, len(suffix)
+			}
+		}
+	}
+	return match
+}
+
+// groups returns the virtual host's target groups, including the default group
+func (vhost *VirtualHost) groups() []*TargetGroup {
+	if vhost.DefaultGroup == nil {
+		return vhost.TargetGroups
+	}
+	return append(append([]*TargetGroup(nil), vhost.TargetGroups...), vhost.DefaultGroup)
+}
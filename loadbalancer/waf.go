@@ -0,0 +1,173 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// WAFMode selects what happens when a WAF rule matches
+type WAFMode string
+
+const (
+	// WAFLogOnly logs matching requests but lets them through
+	WAFLogOnly WAFMode = "log"
+
+	// WAFEnforce rejects matching requests with 403 Forbidden
+	WAFEnforce WAFMode = "enforce"
+)
+
+// WAFRule rejects requests whose inspected parts match a pattern
+type WAFRule struct {
+	ID string
+
+	// Targets lists the parts of the request the pattern is matched against: "path",
+	// "query", "headers", "header:<Name>" or "body"
+	Targets []string
+
+	Pattern *regexp.Regexp
+}
+
+// WAFConfig configures the request-filtering rule engine for a target group
+type WAFConfig struct {
+	// Mode defaults to WAFEnforce
+	Mode WAFMode
+
+	Rules []WAFRule
+
+	// AllowedMethods, if non-empty, rejects requests with any other method
+	AllowedMethods []string
+
+	// MaxBodyBytes limits how much of the request body is inspected. Defaults to 64 KiB.
+	MaxBodyBytes int64
+}
+
+// DefaultWAFRules returns basic SQL injection, XSS and path traversal signatures
+func DefaultWAFRules() []WAFRule {
+	targets := []string{"path", "query", "body"}
+	return []WAFRule{
+		{ID: "sqli-union", Targets: targets, Pattern: regexp.MustCompile(`(?i)\bunion\b[\s(]+(all\s+)?select\b`)},
+		{ID: "sqli-tautology", Targets: targets, Pattern: regexp.MustCompile(`(?i)['"]\s*(or|and)\s+['"]?\w+['"]?\s*=\s*['"]?\w+`)},
+		{ID: "sqli-comment", Targets: targets, Pattern: regexp.MustCompile(`(?i)('|\b(select|insert|update|delete|drop)\b[^;]*)(--|#|/\*)`)},
+		{ID: "sqli-stacked", Targets: targets, Pattern: regexp.MustCompile(`(?i);\s*(drop|delete|insert|update|shutdown|exec)\b`)},
+		{ID: "xss-script", Targets: targets, Pattern: regexp.MustCompile(`(?i)<\s*script\b`)},
+		{ID: "xss-handler", Targets: targets, Pattern: regexp.MustCompile(`(?i)<[^>]+\bon[a-z]+\s*=`)},
+		{ID: "xss-javascript-uri", Targets: targets, Pattern: regexp.MustCompile(`(?i)javascript\s*:`)},
+		{ID: "path-traversal", Targets: []string{"path", "query"}, Pattern: regexp.MustCompile(`(^|[\\/])\.\.([\\/]|$)`)},
+	}
+}
+
+// waf returns middleware that applies a target group's WAF rules
+func (lb *LoadBalancer) waf(config WAFConfig, route string) Middleware {
+	if config.Mode == "" {
+		config.Mode = WAFEnforce
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 64 << 10
+	}
+	inspectsBody := false
+	for _, rule := range config.Rules {
+		for _, target := range rule.Targets {
+			inspectsBody = inspectsBody || target == "body"
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ruleID := ""
+			if len(config.AllowedMethods) > 0 && !containsFold(config.AllowedMethods, r.Method) {
+				ruleID = "method-not-allowed"
+			} else {
+				var body []byte
+				if inspectsBody && r.Body != nil && r.Body != http.NoBody {
+					var err error
+					body, err = io.ReadAll(io.LimitReader(r.Body, config.MaxBodyBytes))
+					if err != nil {
+						http.Error(w, "Bad request", http.StatusBadRequest)
+						return
+					}
+					// Put the inspected part back in front of the rest of the body
+					r.Body = struct {
+						io.Reader
+						io.Closer
+					}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				}
+				ruleID = matchWAFRules(config.Rules, r, body)
+			}
+			if ruleID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			action := "blocked"
+			if config.Mode == WAFLogOnly {
+				action = "logged"
+			}
+			lb.metrics.Counter("loadbalancer_waf_matches_total", "Number of requests matching WAF rules.", "route", route, "rule", ruleID, "action", action).Inc()
+			logger().Warn("waf: rule matched", "rule", ruleID, "method", r.Method, "uri", r.URL.RequestURI(), "client_ip", ClientIP(r), "action", action)
+			if config.Mode == WAFLogOnly {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+// matchWAFRules returns the ID of the first rule matching the request, or "" if none match
+func matchWAFRules(rules []WAFRule, r *http.Request, body []byte) string {
+	for _, rule := range rules {
+		if rule.Pattern == nil {
+			continue
+		}
+		for _, target := range rule.Targets {
+			if wafTargetMatches(rule.Pattern, target, r, body) {
+				return rule.ID
+			}
+		}
+	}
+	return ""
+}
+
+func wafTargetMatches(pattern *regexp.Regexp, target string, r *http.Request, body []byte) bool {
+	switch {
+	case target == "path":
+		return pattern.MatchString(r.URL.Path)
+	case target == "query":
+		query, err := url.QueryUnescape(r.URL.RawQuery)
+		if err != nil {
+			query = r.URL.RawQuery
+		}
+		return pattern.MatchString(query)
+	case target == "body":
+		return pattern.Match(body)
+	case target == "headers":
+		for _, values := range r.Header {
+			for _, value := range values {
+				if pattern.MatchString(value) {
+					return true
+				}
+			}
+		}
+	case strings.HasPrefix(target, "header:"):
+		for _, value := range r.Header.Values(strings.TrimPrefix(target, "header:")) {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsFold reports whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASMPlugin is a request and response filter compiled to WebAssembly from any language.
+// A plugin module may export:
+//
+//	on_request() i32   called before the request is forwarded
+//	on_response() i32  called before the response headers are sent to the client
+//
+// Both return 0 to continue, or an HTTP status code to answer the client with instead; from
+// on_response, that discards the backend's response, keeping the headers the plugin set. The
+// host provides these functions in the "lb" module, where kind 0 is the request's headers and
+// kind 1 the response's, and strings are passed as pointer and length pairs in the plugin's
+// memory:
+//
+//	get_header(kind, name, name_len, buf, buf_len i32) i32
+//	set_header(kind, name, name_len, value, value_len i32)
+//	add_header(kind, name, name_len, value, value_len i32)
+//	remove_header(kind, name, name_len i32)
+//	get_property(name, name_len, buf, buf_len i32) i32
+//	send_body(body, body_len i32)
+//	log(message, message_len i32)
+//
+// get_header and get_property return the length of the value, writing it to buf if it fits,
+// or -1 if it is missing. The properties are method, path, host, scheme, client_ip,
+// request_id, status (in on_response) and config, the plugin's configuration string.
+// send_body sets the body of a response sent instead of the backend's. Plugins built for WASI
+// are supported; instances are pooled and each handles one request at a time. A call that
+// runs longer than wasmCallTimeout, or outlives its request, is stopped.
+type WASMPlugin struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   string
+	pool     chan api.Module
+}
+
+// wasmPoolSize is the number of idle plugin instances kept for reuse
+const wasmPoolSize = 16
+
+// wasmCallTimeout bounds each call into a plugin, so a plugin stuck in a loop can't hold a
+// request forever
+const wasmCallTimeout = time.Second
+
+// wasmCall is the state of one plugin invocation, reached from host functions via the context
+type wasmCall struct {
+	r              *http.Request
+	config         string
+	requestHeader  http.Header
+	responseHeader http.Header
+	status         int
+	body           []byte
+}
+
+type wasmCallKey struct{}
+
+// LoadWASMPlugin compiles the WASM plugin at path. config is passed to the plugin as the
+// config property.
+func LoadWASMPlugin(path, config string) (*WASMPlugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	if _, err := wasmHostModule(runtime).Instantiate(ctx); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm plugin %s: %w", path, err)
+	}
+
+	plugin := &WASMPlugin{
+		runtime:  runtime,
+		compiled: compiled,
+		config:   config,
+		pool:     make(chan api.Module, wasmPoolSize),
+	}
+	// Instantiate once up front so broken plugins fail at load time
+	blank := &wasmCall{r: &http.Request{URL: &url.URL{}, Header: http.Header{}}, config: config}
+	blank.requestHeader = blank.r.Header
+	loadCtx, cancel := context.WithTimeout(ctx, wasmCallTimeout)
+	defer cancel()
+	module, err := plugin.instance(context.WithValue(loadCtx, wasmCallKey{}, blank))
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm plugin %s: %w", path, err)
+	}
+	plugin.release(module)
+	return plugin, nil
+}
+
+// Close releases the plugin's runtime and instances
+func (p *WASMPlugin) Close() error {
+	return p.runtime.Close(context.Background())
+}
+
+func (p *WASMPlugin) instance(ctx context.Context) (api.Module, error) {
+	select {
+	case module := <-p.pool:
+		return module, nil
+	default:
+	}
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize").
+		WithStdout(os.Stdout).WithStderr(os.Stderr)
+	return p.runtime.InstantiateModule(ctx, p.compiled, config)
+}
+
+func (p *WASMPlugin) release(module api.Module) {
+	select {
+	case p.pool <- module:
+	default:
+		module.Close(context.Background())
+	}
+}
+
+// call runs an exported filter function, returning the status code it asked to reply with
+func (p *WASMPlugin) call(name string, call *wasmCall) (int, error) {
+	call.config = p.config
+	ctx, cancel := context.WithTimeout(call.r.Context(), wasmCallTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, wasmCallKey{}, call)
+	module, err := p.instance(ctx)
+	if err != nil {
+		return 0, err
+	}
+	function := module.ExportedFunction(name)
+	if function == nil {
+		p.release(module)
+		return 0, nil
+	}
+	results, err := function.Call(ctx)
+	if err != nil {
+		// A trapped or stopped instance may be left in any state, so don't reuse it
+		module.Close(context.Background())
+		return 0, err
+	}
+	p.release(module)
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return int(int32(results[0])), nil
+}
+
+// Middleware returns middleware running the plugin's filters
+func (p *WASMPlugin) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := &wasmCall{r: r, requestHeader: r.Header}
+			status, err := p.call("on_request", call)
+			if err != nil {
+				logger().Error("wasm plugin: on_request failed", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if status != 0 {
+				writeWASMReply(w, status, call.body)
+				return
+			}
+
+			next.ServeHTTP(&wasmResponseWriter{ResponseWriter: w, plugin: p, r: r}, r)
+		})
+	}
+}
+
+// wasmResponseWriter runs on_response right before the response headers are sent and, if
+// the plugin answers instead, sends its reply and discards the backend's response
+type wasmResponseWriter struct {
+	http.ResponseWriter
+	plugin      *WASMPlugin
+	r           *http.Request
+	wroteHeader bool
+	replaced    bool
+}
+
+func (ww *wasmResponseWriter) WriteHeader(status int) {
+	if ww.replaced {
+		return
+	}
+	if !ww.wroteHeader && status >= http.StatusOK {
+		ww.wroteHeader = true
+		header := ww.Header()
+		call := &wasmCall{r: ww.r, requestHeader: ww.r.Header, responseHeader: header, status: status}
+		reply, err := ww.plugin.call("on_response", call)
+		if err != nil {
+			logger().Error("wasm plugin: on_response failed", "error", err)
+		}
+		if reply != 0 {
+			ww.replaced = true
+			// The backend's body is discarded, so are the headers describing it
+			header.Del("Content-Length")
+			header.Del("Content-Encoding")
+			header.Del("Content-Type")
+			writeWASMReply(ww.ResponseWriter, reply, call.body)
+			return
+		}
+	}
+	ww.ResponseWriter.WriteHeader(status)
+}
+
+func (ww *wasmResponseWriter) Write(p []byte) (int, error) {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	if ww.replaced {
+		return len(p), nil
+	}
+	return ww.ResponseWriter.Write(p)
+}
+
+func (ww *wasmResponseWriter) Flush() {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	if !ww.replaced {
+		http.NewResponseController(ww.ResponseWriter).Flush()
+	}
+}
+
+func (ww *wasmResponseWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+func writeWASMReply(w http.ResponseWriter, status int, body []byte) {
+	if status < 100 || status > 999 {
+		status = http.StatusInternalServerError
+	}
+	if body == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func currentWASMCall(ctx context.Context) *wasmCall {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	return call
+}
+
+func (c *wasmCall) header(kind uint32) http.Header {
+	if kind == 1 {
+		return c.responseHeader
+	}
+	return c.requestHeader
+}
+
+func (c *wasmCall) property(name string) (string, bool) {
+	switch name {
+	case "method":
+		return c.r.Method, true
+	case "path":
+		return c.r.URL.Path, true
+	case "host":
+		return c.r.Host, true
+	case "scheme":
+		return requestScheme(c.r), true
+	case "client_ip":
+		return ClientIP(c.r).String(), true
+	case "request_id":
+		return RequestID(c.r), true
+	case "status":
+		if c.status != 0 {
+			return strconv.Itoa(c.status), true
+		}
+	case "config":
+		return c.config, true
+	}
+	return "", false
+}
+
+// readString reads a string argument from a plugin's memory
+func readString(m api.Module, ptr, length uint32) string {
+	b, ok := m.Memory().Read(ptr, length)
+	if !ok {
+		return ""
+	}
+	return string(b)
+}
+
+// writeValue copies a value to a plugin's buffer if it fits and returns its length
+func writeValue(m api.Module, value string, ok bool, buf, bufLen uint32) int32 {
+	if !ok {
+		return -1
+	}
+	if uint32(len(value)) <= bufLen {
+		m.Memory().Write(buf, []byte(value))
+	}
+	return int32(len(value))
+}
+
+// wasmHostModule defines the functions plugins import from the "lb" module
+func wasmHostModule(runtime wazero.Runtime) wazero.HostModuleBuilder {
+	builder := runtime.NewHostModuleBuilder("lb")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, name, nameLen, buf, bufLen uint32) int32 {
+		call := currentWASMCall(ctx)
+		header := call.header(kind)
+		if header == nil {
+			return -1
+		}
+		values := header.Values(readString(m, name, nameLen))
+		if len(values) == 0 {
+			return -1
+		}
+		return writeValue(m, values[0], true, buf, bufLen)
+	}).Export("get_header")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, name, nameLen, value, valueLen uint32) {
+		if header := currentWASMCall(ctx).header(kind); header != nil {
+			header.Set(readString(m, name, nameLen), readString(m, value, valueLen))
+		}
+	}).Export("set_header")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, name, nameLen, value, valueLen uint32) {
+		if header := currentWASMCall(ctx).header(kind); header != nil {
+			header.Add(readString(m, name, nameLen), readString(m, value, valueLen))
+		}
+	}).Export("add_header")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind, name, nameLen uint32) {
+		if header := currentWASMCall(ctx).header(kind); header != nil {
+			header.Del(readString(m, name, nameLen))
+		}
+	}).Export("remove_header")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, name, nameLen, buf, bufLen uint32) int32 {
+		value, ok := currentWASMCall(ctx).property(readString(m, name, nameLen))
+		return writeValue(m, value, ok, buf, bufLen)
+	}).Export("get_property")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, body, bodyLen uint32) {
+		if b, ok := m.Memory().Read(body, bodyLen); ok {
+			currentWASMCall(ctx).body = append([]byte{}, b...)
+		}
+	}).Export("send_body")
+	builder.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, message, messageLen uint32) {
+		logger().Info("wasm plugin: " + readString(m, message, messageLen))
+	}).Export("log")
+	return builder
+}
@@ -0,0 +1,85 @@
+package loadbalancer_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lbwtg/loadbalancer"
+	"lbwtg/loadbalancer/testutil"
+)
+
+// Function bodies for the test plugins, each of type () -> i32
+var (
+	wasmReturn0   = []byte{0x00, 0x41, 0x00, 0x0b}                         // i32.const 0
+	wasmReturn418 = []byte{0x00, 0x41, 0xa2, 0x03, 0x0b}                   // i32.const 418
+	wasmLoop      = []byte{0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00, 0x0b} // loop br 0 end unreachable
+)
+
+// wasmSection encodes a module section whose contents are shorter than 128 bytes
+func wasmSection(id byte, contents ...byte) []byte {
+	return append([]byte{id, byte(len(contents))}, contents...)
+}
+
+// writeWASMPlugin writes a plugin exporting on_request and on_response with the given bodies
+func writeWASMPlugin(t *testing.T, onRequest, onResponse []byte) string {
+	t.Helper()
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, wasmSection(1, 0x01, 0x60, 0x00, 0x01, 0x7f)...)
+	module = append(module, wasmSection(3, 0x02, 0x00, 0x00)...)
+	exports := []byte{0x02}
+	for i, name := range []string{"on_request", "on_response"} {
+		exports = append(exports, byte(len(name)))
+		exports = append(exports, name...)
+		exports = append(exports, 0x00, byte(i))
+	}
+	module = append(module, wasmSection(7, exports...)...)
+	code := []byte{0x02, byte(len(onRequest))}
+	code = append(code, onRequest...)
+	code = append(code, byte(len(onResponse)))
+	code = append(code, onResponse...)
+	module = append(module, wasmSection(10, code...)...)
+
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(path, module, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWASMPluginReplies(t *testing.T) {
+	tests := []struct {
+		name                  string
+		onRequest, onResponse []byte
+		status                int
+		backendBody           bool
+	}{
+		{"Continue", wasmReturn0, wasmReturn0, http.StatusOK, true},
+		{"ReplyToRequest", wasmReturn418, wasmReturn0, http.StatusTeapot, false},
+		{"ReplyToResponse", wasmReturn0, wasmReturn418, http.StatusTeapot, false},
+		{"StuckPluginIsStopped", wasmLoop, wasmReturn0, http.StatusInternalServerError, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			plugin, err := loadbalancer.LoadWASMPlugin(writeWASMPlugin(t, test.onRequest, test.onResponse), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer plugin.Close()
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "7")
+				w.Write([]byte("backend"))
+			})
+
+			w := testutil.Get(plugin.Middleware()(backend), "/")
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+			if got := w.Body.String() == "backend"; got != test.backendBody {
+				t.Errorf("body %q", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// maxWeight bounds server weights, which round-robin style balancers expand into that
+// many entries per server
+const maxWeight = 1000
+
+// weight returns the server's weight: the one set through the admin API, or its configured
+// Weight, multiplied by its tuned weight with weight tuning. The caller must hold lb.mu.
+func (lb *LoadBalancer) weight(server *Server) int {
+	weight, ok := lb.weights[server.name()]
+	if !ok {
+		weight = max(server.Weight, 1)
+	}
+	if lb.tuner != nil {
+		tuned, ok := lb.tuned[server.name()]
+		if !ok {
+			tuned = lb.tuner.config.MaxWeight
+		}
+		weight *= tuned
+	}
+	return weight
+}
+
+// uniform reports whether all the servers have weight 1. The caller must hold lb.mu.
+func (lb *LoadBalancer) uniform(servers []*Server) bool {
+	for _, server := range servers {
+		if lb.weight(server) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// weighted repeats each server by its weight, divided by the weights' greatest common
+// divisor, for balancers that treat every entry alike. The caller must hold lb.mu.
+func (lb *LoadBalancer) weighted(servers []*Server) []*Server {
+	if lb.uniform(servers) {
+		return servers
+	}
+	divisor, total := 0, 0
+	for _, server := range servers {
+		divisor = gcd(divisor, lb.weight(server))
+		total += lb.weight(server)
+	}
+	if divisor == 0 {
+		return nil
+	}
+	weighted := make([]*Server, 0, total/divisor)
+	for _, server := range servers {
+		for i := 0; i < lb.weight(server)/divisor; i++ {
+			weighted = append(weighted, server)
+		}
+	}
+	return weighted
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// candidateCache is a group's candidates for requests no server has failed for yet, kept
+// while the group's servers and their weights stay the same so they aren't expanded anew
+// for every request
+type candidateCache struct {
+	servers   []*Server
+	weights   []int
+	available []*Server
+	weighted  []*Server
+}
+
+// cachedCandidates returns the group's candidates out of servers, computing them again if
+// the servers or their weights changed. The caller must hold lb.mu.
+func (lb *LoadBalancer) cachedCandidates(targetGroup *TargetGroup, servers []*Server) *candidateCache {
+	cached := lb.candidateCaches[targetGroup]
+	if cached != nil && sameServers(cached.servers, servers) {
+		same := true
+		for i, server := range servers {
+			if lb.weight(server) != cached.weights[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return cached
+		}
+	}
+	weights := make([]int, len(servers))
+	for i, server := range servers {
+		weights[i] = lb.weight(server)
+	}
+	available := lb.available(servers, nil)
+	cached = &candidateCache{servers: servers, weights: weights, available: available, weighted: lb.weighted(available)}
+	lb.candidateCaches[targetGroup] = cached
+	return cached
+}
+
+// SetWeight overrides the weight of the servers with the given name in every target group.
+// Weight 0 drains the servers. ConfigReloader carries the weights set this way over to the
+// load balancers of new configurations. It returns false if there is no such server.
+func (lb *LoadBalancer) SetWeight(name string, weight int) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	found := false
+	for _, servers := range lb.routes.Load().servers {
+		for _, server := range servers {
+			found = found || server.name() == name
+		}
+	}
+	if found {
+		lb.weights[name] = weight
+	}
+	return found
+}
+
+// serverWeight is a server and its weight in the admin API
+type serverWeight struct {
+	Server string `json:"server"`
+	Route  string `json:"route"`
+	Zone   string `json:"zone,omitempty"`
+	Weight int    `json:"weight"`
+}
+
+// handleServerWeights lists the servers with their weights and, for PUT requests, changes
+// the weight of one:
+//
+//	GET /servers/weights
+//	PUT /servers/weights?server=backend-1&weight=0
+func (lb *LoadBalancer) handleServerWeights(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		name := r.URL.Query().Get("server")
+		weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+		if err != nil || weight < 0 || weight > maxWeight {
+			http.Error(w, fmt.Sprintf("weight must be from 0 to %d", maxWeight), http.StatusBadRequest)
+			return
+		}
+		lb.mu.Lock()
+		previous, ok := lb.weights[name]
+		lb.mu.Unlock()
+		if !lb.SetWeight(name, weight) {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+		from := "default"
+		if ok {
+			from = strconv.Itoa(previous)
+		}
+		logger().Info("server weight changed", "server", name, "weight", weight)
+		lb.audit.recordRequest(r, "server.weight", fmt.Sprintf("%s: %s -> %d", name, from, weight))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lb.mu.Lock()
+	var weights []serverWeight
+	for targetGroup, servers := range lb.routes.Load().servers {
+		for _, server := range servers {
+			weights = append(weights, serverWeight{Server: server.name(), Route: routeName(targetGroup), Zone: server.Zone, Weight: lb.weight(server)})
+		}
+	}
+	lb.mu.Unlock()
+	sort.Slice(weights, func(i, j int) bool {
+		if weights[i].Route != weights[j].Route {
+			return weights[i].Route < weights[j].Route
+		}
+		return weights[i].Server < weights[j].Server
+	})
+	writeJSON(w, http.StatusOK, weights)
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import "testing"
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    []int
+	}{
+		{weights: []int{1, 1, 1}, want: []int{1, 1, 1}},
+		{weights: []int{3, 1}, want: []int{3, 1}},
+		{weights: []int{200, 100}, want: []int{2, 1}},
+		{weights: []int{1000, 1000, 1000}, want: []int{1, 1, 1}},
+		{weights: []int{6, 4, 10}, want: []int{3, 2, 5}},
+	}
+	for _, test := range tests {
+		servers := benchmarkServers(len(test.weights))
+		for i, server := range servers {
+			server.Weight = test.weights[i]
+		}
+		lb := NewLoadBalancer(WithTargetGroup(&TargetGroup{URIPath: "/", Servers: servers}))
+		lb.mu.Lock()
+		weighted := lb.weighted(servers)
+		lb.mu.Unlock()
+		lb.Close()
+
+		counts := make(map[*Server]int)
+		for _, server := range weighted {
+			counts[server]++
+		}
+		for i, server := range servers {
+			if counts[server] != test.want[i] {
+				t.Errorf("weights %v: server %d is repeated %d times, want %d", test.weights, i, counts[server], test.want[i])
+			}
+		}
+	}
+}
+
+func TestWeightedCandidatesAreCached(t *testing.T) {
+	servers := benchmarkServers(3)
+	for i, server := range servers {
+		server.Weight = maxWeight - i
+	}
+	targetGroup := &TargetGroup{URIPath: "/", Servers: servers}
+	lb := NewLoadBalancer(WithTargetGroup(targetGroup))
+	defer lb.Close()
+	candidates := func() []*Server {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return lb.candidates(targetGroup, lb.servers(targetGroup), nil, true)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { candidates() }); allocs != 0 {
+		t.Errorf("picking candidates allocates %v times per request", allocs)
+	}
+	before := len(candidates())
+	lb.SetWeight(servers[0].name(), 0)
+	after := candidates()
+	if len(after) >= before {
+		t.Errorf("%d candidates after draining a server, %d before", len(after), before)
+	}
+	for _, server := range after {
+		if server == servers[0] {
+			t.Fatal("the drained server is still a candidate")
+		}
+	}
+}
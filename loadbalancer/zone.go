@@ -0,0 +1,52 @@
+package loadbalancer
+
+// WithZone sets the zone, like an availability zone, the load balancer runs in. Requests
+// go to servers in the same zone while any of them is healthy and spill over to servers
+// in other zones when none is.
+func WithZone(zone string) Option {
+	return func(lb *LoadBalancer) {
+		lb.zone = zone
+	}
+}
+
+// candidates returns the servers a request may be sent to next: those of the group's subset
+// of servers that haven't failed for it and aren't drained, limited to the load balancer's
+// zone if any of them are in it. With repeat, servers are repeated by their weight. The
+// caller must hold lb.mu.
+func (lb *LoadBalancer) candidates(targetGroup *TargetGroup, servers []*Server, failed map[*Server]bool, repeat bool) []*Server {
+	servers = lb.subset(targetGroup, servers)
+	if len(failed) == 0 && lb.zone == "" && lb.uniform(servers) {
+		return servers
+	}
+	if len(failed) == 0 {
+		cached := lb.cachedCandidates(targetGroup, servers)
+		if repeat {
+			return cached.weighted
+		}
+		return cached.available
+	}
+	available := lb.available(servers, failed)
+	if repeat {
+		return lb.weighted(available)
+	}
+	return available
+}
+
+// available returns the servers that haven't failed and aren't drained, limited to the load
+// balancer's zone if any of them are in it. The caller must hold lb.mu.
+func (lb *LoadBalancer) available(servers []*Server, failed map[*Server]bool) []*Server {
+	var available, local []*Server
+	for _, server := range servers {
+		if failed[server] || lb.weight(server) == 0 {
+			continue
+		}
+		available = append(available, server)
+		if lb.zone != "" && server.Zone == lb.zone {
+			local = append(local, server)
+		}
+	}
+	if len(local) > 0 {
+		return local
+	}
+	return available
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"lbwtg/loadbalancer"
+)
+
+// reopenOnSignal reopens the log files whenever the process receives SIGUSR1, so they can
+// be rotated by logrotate without copytruncate
+func reopenOnSignal(audit *loadbalancer.AuditLog) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if err := loadbalancer.ReopenLogFiles(); err != nil {
+				fmt.Println("Reopening log files failed:", err)
+			}
+			if audit != nil {
+				if err := audit.Reopen(); err != nil {
+					fmt.Println("Reopening audit log failed:", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+import "lbwtg/loadbalancer"
+
+// reopenOnSignal does nothing on Windows, which has no SIGUSR1
+func reopenOnSignal(audit *loadbalancer.AuditLog) {}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// startService does nothing outside Windows
+func startService(name string, stop func()) (stopped func()) {
+	return func() {}
+}
+
+// controlService fails outside Windows, where services are managed by the init system
+func controlService(name, command string) error {
+	return errors.New("-service is only supported on Windows")
+}
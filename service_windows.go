@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"lbwtg/loadbalancer"
+)
+
+// stopCheckInterval is how often the service tells the service control manager it's still
+// stopping
+const stopCheckInterval = 2 * time.Second
+
+// lbService reports the load balancer running to the service control manager until it is
+// asked to stop, then shuts it down like SIGTERM does and reports it stopping until it has
+type lbService struct {
+	stop    func()
+	stopped chan struct{}
+}
+
+// Execute implements svc.Handler
+func (s *lbService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-s.stopped:
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s.stop()
+				ticker := time.NewTicker(stopCheckInterval)
+				defer ticker.Stop()
+				waitHint := uint32(2 * stopCheckInterval / time.Millisecond)
+				for checkPoint := uint32(1); ; {
+					status <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: waitHint}
+					select {
+					case <-s.stopped:
+						return false, 0
+					case <-ticker.C:
+						checkPoint++
+					case <-requests:
+						// Interrogations get the status again; the service is already stopping
+					}
+				}
+			}
+		}
+	}
+}
+
+// startService hands the process to the service control manager when it was started as a
+// Windows service. Stopping the service calls stop, and the service is reported stopping
+// until the returned function is called once the load balancer has shut down.
+func startService(name string, stop func()) (stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+	// Services start in the system directory, so relative paths are relative to the executable
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	service := &lbService{stop: stop, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(name, service); err != nil {
+			loadbalancer.Logger().Error("running the service failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+	return func() {
+		close(service.stopped)
+		<-done
+	}
+}
+
+// controlService installs, uninstalls, starts, stops or shows the status of the Windows
+// service. It's installed to run the executable with the flags given besides -service.
+func controlService(name, command string) error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer manager.Disconnect()
+
+	if command == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		var args []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "service" {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		service, err := manager.CreateService(name, exe, mgr.Config{
+			DisplayName: "lbwtg load balancer",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return err
+		}
+		defer service.Close()
+		fmt.Println("Installed service", name)
+		return nil
+	}
+
+	service, err := manager.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s: %w", name, err)
+	}
+	defer service.Close()
+	switch command {
+	case "uninstall":
+		if err := service.Delete(); err != nil {
+			return err
+		}
+		fmt.Println("Uninstalled service", name)
+	case "start":
+		if err := service.Start(); err != nil {
+			return err
+		}
+		fmt.Println("Started service", name)
+	case "stop":
+		status, err := service.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s didn't stop within 30s", name)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = service.Query(); err != nil {
+				return err
+			}
+		}
+		fmt.Println("Stopped service", name)
+	case "status":
+		status, err := service.Query()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Service %s is %s\n", name, serviceStates[status.State])
+	default:
+		return fmt.Errorf("unknown service command %q", command)
+	}
+	return nil
+}
+
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "starting",
+	svc.StopPending:     "stopping",
+	svc.Running:         "running",
+	svc.ContinuePending: "continuing",
+	svc.PausePending:    "pausing",
+	svc.Paused:          "paused",
+}